@@ -25,6 +25,7 @@ NATSClient::NATSClient() {
   memset(_pass, 0, sizeof(_pass));
   memset(_token, 0, sizeof(_token));
   memset(_clientId, 0, sizeof(_clientId));
+  memset(_inboxPrefix, 0, sizeof(_inboxPrefix));
   memset(_deviceId, 0, sizeof(_deviceId));
   memset(_deviceType, 0, sizeof(_deviceType));
   memset(_deviceName, 0, sizeof(_deviceName));
@@ -42,6 +43,8 @@ NATSClient::NATSClient() {
   
   // Generate default client ID
   sprintf(_clientId, "arduino_%lu", millis());
+  
+  strncpy(_inboxPrefix, NATS_INBOX_PREFIX, sizeof(_inboxPrefix) - 1);
 }
 
 NATSClient::~NATSClient() {
@@ -409,6 +412,11 @@ void NATSClient::setVerbose(bool verbose) {
   _verbose = verbose;
 }
 
+void NATSClient::setInboxPrefix(const char* prefix) {
+  memset(_inboxPrefix, 0, sizeof(_inboxPrefix));
+  strncpy(_inboxPrefix, prefix, sizeof(_inboxPrefix) - 1);
+}
+
 bool NATSClient::isReconnecting() {
   return _reconnecting;
 }
@@ -571,7 +579,7 @@ bool NATSClient::_processErr(const char* error) {
 }
 
 void NATSClient::_generateInbox(char* inbox) {
-  sprintf(inbox, "%s%08lX%04X", NATS_INBOX_PREFIX, millis(), random(0xFFFF));
+  snprintf(inbox, NATS_MAX_SUBJECT_LENGTH, "%s%08lX%04X", _inboxPrefix, millis(), random(0xFFFF));
 }
 
 int NATSClient::_findSubscription(const char* subject) {
@@ -27,7 +27,13 @@
 #define NATS_DEFAULT_PORT 4222
 #define NATS_MAX_SUBJECT_LENGTH 256
 #define NATS_MAX_PAYLOAD_SIZE 1024
+// Reply subjects of requests start with this. Devices provisioned by homix
+// may only use their own prefix, which their homix_credentials.h defines:
+// include it first and pass NATS_INBOX_PREFIX to setInboxPrefix(), or set it
+// in the build flags.
+#ifndef NATS_INBOX_PREFIX
 #define NATS_INBOX_PREFIX "_INBOX."
+#endif
 #define NATS_CONNECTION_TIMEOUT 5000
 #define NATS_PING_INTERVAL 120000  // 2 minutes
 #define NATS_MAX_RECONNECT_ATTEMPTS 5
@@ -80,6 +86,7 @@ public:
   void setReconnect(bool enable);
   void setPingInterval(unsigned long interval);
   void setVerbose(bool verbose);
+  void setInboxPrefix(const char* prefix);
   
   // Status
   bool isReconnecting();
@@ -101,6 +108,7 @@ private:
   char _pass[64];
   char _token[256];
   char _clientId[64];
+  char _inboxPrefix[64];
   
   // Device info for discovery
   char _deviceId[64];
@@ -223,6 +223,22 @@ void test_request() {
     TEST_ASSERT_TRUE(sent.indexOf("PUB time.service") >= 0);
 }
 
+// Test request/reply on a device's own inbox prefix
+void test_request_inbox_prefix() {
+    mockClient->setResponse("INFO {\"server_id\":\"test\",\"version\":\"2.0.0\"}\r\n+OK\r\n+OK\r\n");
+    nats->setInboxPrefix("_INBOX_test-device-01.");
+    nats->connect("test.server", 4222);
+    
+    mockClient->clearBuffers();
+    
+    bool result = nats->request("time.service", "", [](const char* subject, const char* data, const char* reply) {}, 1000);
+    
+    TEST_ASSERT_TRUE(result);
+    String sent = mockClient->getWriteBuffer();
+    TEST_ASSERT_TRUE(sent.indexOf("SUB _INBOX_test-device-01.") >= 0);
+    TEST_ASSERT_TRUE(sent.indexOf("PUB time.service _INBOX_test-device-01.") >= 0);
+}
+
 // Test device info
 void test_device_info() {
     nats->setDeviceInfo("test-device-01", "sensor", "Test Sensor");
@@ -334,6 +350,7 @@ void setup() {
     RUN_TEST(test_publish_binary);
     RUN_TEST(test_subscribe);
     RUN_TEST(test_request);
+    RUN_TEST(test_request_inbox_prefix);
     RUN_TEST(test_device_info);
     RUN_TEST(test_auto_discovery);
     RUN_TEST(test_ping_handling);
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/homix-dev/homix/edge/internal/bridge"
+	"github.com/homix-dev/homix/edge/internal/buffer"
+	"github.com/homix-dev/homix/edge/internal/gateway"
+	"github.com/homix-dev/homix/edge/internal/health"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/spf13/viper"
+)
+
+// edgeServices holds the running edge components that need an ordered
+// shutdown
+type edgeServices struct {
+	server         *server.Server
+	local          *nats.Conn
+	cloud          *nats.Conn
+	cloudConnected func() bool
+
+	gateway     *gateway.Gateway
+	stopGateway context.CancelFunc
+
+	bridge *bridge.Bridge
+
+	buffer     *buffer.Buffer // nil when buffering is disabled
+	stopBuffer context.CancelFunc
+
+	health *health.Server
+}
+
+// shutdown stops the edge in order: adapters, bridge, outbound buffer, local
+// connection, offline notice, cloud connection, health endpoint and finally
+// the embedded server. The bridge stops before the flush, so nothing is
+// buffered after it. Every step is bounded by a timeout, so a stuck step
+// never blocks the ones after it.
+func (s *edgeServices) shutdown() {
+	stepTimeout := viper.GetDuration("shutdown.step_timeout")
+
+	s.step("stopping protocol adapters", stepTimeout, func(ctx context.Context) error {
+		s.stopGateway()
+		return wait(ctx, s.gateway.Wait)
+	})
+
+	s.step("stopping cloud bridge", stepTimeout, s.bridge.Stop)
+
+	if s.buffer != nil {
+		s.step("flushing outbound buffer", viper.GetDuration("shutdown.flush_timeout"), func(ctx context.Context) error {
+			defer s.stopBuffer()
+			return s.buffer.Flush(ctx)
+		})
+	}
+
+	s.step("draining local connection", stepTimeout, func(ctx context.Context) error {
+		return drain(ctx, s.local)
+	})
+
+	s.step("announcing edge offline", stepTimeout, func(ctx context.Context) error {
+		if !s.cloudConnected() {
+			return errors.New("cloud not connected")
+		}
+		return publishOffline(ctx, s.cloud)
+	})
+
+	s.step("draining cloud connection", stepTimeout, func(ctx context.Context) error {
+		return drain(ctx, s.cloud)
+	})
+
+	s.step("stopping health endpoint", stepTimeout, s.health.Shutdown)
+
+	// Shutdown stops JetStream, which flushes its stores to disk
+	s.step("shutting down local NATS server", stepTimeout, func(ctx context.Context) error {
+		return wait(ctx, func() {
+			s.server.Shutdown()
+			s.server.WaitForShutdown()
+		})
+	})
+}
+
+// step runs one shutdown step with a timeout and logs its outcome
+func (s *edgeServices) step(name string, timeout time.Duration, fn func(ctx context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	log.Printf("Shutdown: %s...", name)
+	started := time.Now()
+	if err := fn(ctx); err != nil {
+		log.Printf("Shutdown: %s failed after %s: %v", name, time.Since(started).Round(time.Millisecond), err)
+		return
+	}
+	log.Printf("Shutdown: %s done in %s", name, time.Since(started).Round(time.Millisecond))
+}
+
+// drain drains a connection and waits for it to close. The connection is
+// closed outright if draining does not finish in time.
+func drain(ctx context.Context, nc *nats.Conn) error {
+	if nc.IsClosed() {
+		return nil
+	}
+
+	if err := nc.Drain(); err != nil {
+		nc.Close()
+		return err
+	}
+
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+
+	for !nc.IsClosed() {
+		select {
+		case <-ctx.Done():
+			nc.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// wait runs fn and waits for it to return or ctx to end
+func wait(ctx context.Context, fn func()) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -2,14 +2,25 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
+	"github.com/homix-dev/homix/edge/internal/automation"
+	"github.com/homix-dev/homix/edge/internal/bridge"
+	"github.com/homix-dev/homix/edge/internal/buffer"
+	"github.com/homix-dev/homix/edge/internal/devices"
+	"github.com/homix-dev/homix/edge/internal/gateway"
+	"github.com/homix-dev/homix/edge/internal/gateway/mqtt"
+	"github.com/homix-dev/homix/edge/internal/gateway/zigbee2mqtt"
+	"github.com/homix-dev/homix/edge/internal/health"
+	"github.com/homix-dev/homix/edge/internal/identity"
+	"github.com/homix-dev/homix/edge/internal/leafnode"
 	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
 	"github.com/spf13/viper"
@@ -23,6 +34,19 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	// Settings the cloud assigned at an earlier registration
+	if err := loadAssigned(viper.GetString("data.dir")); err != nil {
+		log.Fatalf("Failed to load assigned config: %v", err)
+	}
+
+	// Load the persistent edge identity, generating it on first start
+	id, err := identity.Load(viper.GetString("data.dir"), viper.GetString("home.id"))
+	if err != nil {
+		log.Fatalf("Failed to load edge identity: %v", err)
+	}
+	viper.Set("home.id", id.HomeID)
+	log.Printf("Home ID: %s", id.HomeID)
+
 	// Create context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -32,28 +56,41 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to start local NATS server: %v", err)
 	}
-	defer localServer.Shutdown()
 
 	// Connect to Synadia Cloud as a leaf node
-	cloudConn, err := connectToCloud()
+	cloudConn, err := connectToCloud(localServer)
 	if err != nil {
 		log.Fatalf("Failed to connect to Synadia Cloud: %v", err)
 	}
-	defer cloudConn.Close()
+
+	// Register with the cloud, retrying in the background if it is unavailable
+	if err := registerWithCloud(cloudConn, id); err != nil {
+		log.Printf("Edge registration failed: %v", err)
+		go registerInBackground(ctx, cloudConn, id)
+	}
 
 	// Start the edge services
-	if err := startEdgeServices(ctx, cloudConn); err != nil {
+	svc, err := startEdgeServices(ctx, localServer, cloudConn)
+	if err != nil {
 		log.Fatalf("Failed to start edge services: %v", err)
 	}
 
 	// Wait for shutdown signal
-	sigCh := make(chan os.Signal, 1)
+	sigCh := make(chan os.Signal, 2)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 	<-sigCh
 
+	// A second signal skips the remaining shutdown steps
+	go func() {
+		<-sigCh
+		log.Println("Forced shutdown")
+		os.Exit(1)
+	}()
+
 	log.Println("Shutting down gracefully...")
 	cancel()
-	time.Sleep(2 * time.Second)
+	svc.shutdown()
+	log.Println("Edge server stopped")
 }
 
 func loadConfig() error {
@@ -71,7 +108,26 @@ func loadConfig() error {
 	viper.SetDefault("cloud.url", "tls://connect.ngs.global")
 	viper.SetDefault("cloud.reconnect_wait", "2s")
 	viper.SetDefault("home.name", "My Home")
+	viper.SetDefault("data.dir", "/data")
+	viper.SetDefault("edge.register_timeout", "5s")
+	viper.SetDefault("edge.heartbeat_interval", "30s")
+	viper.SetDefault("cloud.mode", "client")
+	viper.SetDefault("local.host", "0.0.0.0")
 	viper.SetDefault("local.port", 4222)
+	viper.SetDefault("local.http_port", 8222)
+	viper.SetDefault("local.auth.mode", "none")
+	viper.SetDefault("local.leafnode.host", "0.0.0.0")
+	viper.SetDefault("local.leafnode.port", 7422)
+	viper.SetDefault("bridge.command_timeout", "5s")
+	viper.SetDefault("automation.bucket", "automations")
+	viper.SetDefault("buffer.enabled", true)
+	viper.SetDefault("buffer.max_size", "64MB")
+	viper.SetDefault("buffer.max_age", "24h")
+	viper.SetDefault("buffer.collapse_state", true)
+	viper.SetDefault("metrics.enabled", true)
+	viper.SetDefault("metrics.port", 2112)
+	viper.SetDefault("shutdown.step_timeout", "5s")
+	viper.SetDefault("shutdown.flush_timeout", "10s")
 	viper.SetDefault("logging.level", "info")
 
 	if err := viper.ReadInConfig(); err != nil {
@@ -81,27 +137,19 @@ func loadConfig() error {
 		log.Println("No config file found, using environment variables")
 	}
 
-	// Generate home ID if not set
-	if viper.GetString("home.id") == "" {
-		viper.Set("home.id", generateHomeID())
-	}
-
 	return nil
 }
 
 func startLocalNATSServer() (*server.Server, error) {
-	opts := &server.Options{
-		Port:     viper.GetInt("local.port"),
-		HTTPPort: 8222, // For monitoring
+	cfg, err := localServerConfig()
+	if err != nil {
+		return nil, err
 	}
 
-	// Configure as a leaf node hub
-	opts.LeafNode.Port = 7422
-	opts.LeafNode.Host = "0.0.0.0"
-
-	// Enable JetStream for local state
-	opts.JetStream = true
-	opts.StoreDir = "/data/jetstream"
+	opts, err := cfg.Options()
+	if err != nil {
+		return nil, fmt.Errorf("invalid local server configuration:\n%w", err)
+	}
 
 	// Create and start the server
 	ns, err := server.NewServer(opts)
@@ -116,11 +164,89 @@ func startLocalNATSServer() (*server.Server, error) {
 		return nil, fmt.Errorf("NATS server failed to start")
 	}
 
-	log.Printf("Local NATS server started on port %d", opts.Port)
+	log.Printf("Local NATS server started on port %d (auth: %s, tls: %t, leaf remotes: %d)",
+		opts.Port, cfg.Auth.Mode, cfg.TLS.Enabled(), len(cfg.LeafNode.Remotes))
 	return ns, nil
 }
 
-func connectToCloud() (*nats.Conn, error) {
+// localServerConfig reads the embedded server configuration
+func localServerConfig() (leafnode.Config, error) {
+	cfg := leafnode.Config{
+		Host:     viper.GetString("local.host"),
+		Port:     viper.GetInt("local.port"),
+		HTTPPort: viper.GetInt("local.http_port"),
+		StoreDir: viper.GetString("local.store_dir"),
+		TLS:      tlsConfig("local.tls"),
+		Auth: leafnode.AuthConfig{
+			Mode:          viper.GetString("local.auth.mode"),
+			OperatorJWT:   viper.GetString("local.auth.operator_jwt"),
+			SystemAccount: viper.GetString("local.auth.system_account"),
+			Accounts:      viper.GetStringSlice("local.auth.accounts"),
+			ResolverDir:   viper.GetString("local.auth.resolver_dir"),
+			Credentials:   viper.GetString("local.auth.credentials"),
+		},
+		LeafNode: leafnode.LeafNodeConfig{
+			Host: viper.GetString("local.leafnode.host"),
+			Port: viper.GetInt("local.leafnode.port"),
+			TLS:  tlsConfig("local.leafnode.tls"),
+		},
+		JetStream: leafnode.JetStreamConfig{
+			MaxMemory: viper.GetString("local.jetstream.max_memory"),
+			MaxStore:  viper.GetString("local.jetstream.max_store"),
+		},
+	}
+
+	if cfg.StoreDir == "" {
+		cfg.StoreDir = filepath.Join(viper.GetString("data.dir"), "jetstream")
+	}
+
+	if err := viper.UnmarshalKey("local.leafnode.remotes", &cfg.LeafNode.Remotes); err != nil {
+		return cfg, fmt.Errorf("invalid local.leafnode.remotes: %w", err)
+	}
+
+	if viper.GetString("cloud.mode") == "leafnode" && len(cfg.LeafNode.Remotes) == 0 {
+		return cfg, fmt.Errorf("cloud.mode leafnode requires at least one entry in local.leafnode.remotes")
+	}
+
+	return cfg, nil
+}
+
+func tlsConfig(key string) leafnode.TLSConfig {
+	return leafnode.TLSConfig{
+		CertFile: viper.GetString(key + ".cert_file"),
+		KeyFile:  viper.GetString(key + ".key_file"),
+		CAFile:   viper.GetString(key + ".ca_file"),
+		Verify:   viper.GetBool(key + ".verify"),
+	}
+}
+
+// connectLocal opens an in-process connection to the embedded server
+func connectLocal(ns *server.Server, name string) (*nats.Conn, error) {
+	opts := []nats.Option{
+		nats.Name(name),
+		nats.InProcessServer(ns),
+	}
+
+	if creds := viper.GetString("local.auth.credentials"); creds != "" {
+		opts = append(opts, nats.UserCredentials(creds))
+	}
+
+	return nats.Connect("", opts...)
+}
+
+func connectToCloud(ns *server.Server) (*nats.Conn, error) {
+	// With leaf node remotes the embedded server carries cloud traffic, so
+	// cloud subjects are reached through the local server
+	if viper.GetString("cloud.mode") == "leafnode" {
+		nc, err := connectLocal(ns, fmt.Sprintf("edge-%s", viper.GetString("home.id")))
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to local NATS: %w", err)
+		}
+
+		log.Println("Using leaf node connection to Synadia Cloud")
+		return nc, nil
+	}
+
 	cloudURL := viper.GetString("cloud.url")
 	credsFile := viper.GetString("cloud.credentials")
 
@@ -132,9 +258,6 @@ func connectToCloud() (*nats.Conn, error) {
 		nats.UserCredentials(credsFile),
 		nats.MaxReconnects(-1),
 		nats.ReconnectWait(viper.GetDuration("cloud.reconnect_wait")),
-		nats.ReconnectHandler(func(nc *nats.Conn) {
-			log.Println("Reconnected to Synadia Cloud")
-		}),
 		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
 			log.Printf("Disconnected from cloud: %v", err)
 		}),
@@ -143,92 +266,216 @@ func connectToCloud() (*nats.Conn, error) {
 		}),
 	}
 
+	// With the outbound buffer enabled, publishes must fail while
+	// disconnected instead of queueing in the client's reconnect buffer
+	if viper.GetBool("buffer.enabled") {
+		opts = append(opts, nats.ReconnectBufSize(-1))
+	}
+
 	nc, err := nats.Connect(cloudURL, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to cloud: %w", err)
 	}
 
 	log.Printf("Connected to Synadia Cloud at %s", cloudURL)
-
-	// Announce this home to the cloud
-	homeInfo := map[string]interface{}{
-		"id":        viper.GetString("home.id"),
-		"name":      viper.GetString("home.name"),
-		"version":   "2.0.0",
-		"edge_type": "docker",
-		"connected": time.Now().UTC(),
-	}
-
-	data, err := json.Marshal(homeInfo)
-	if err != nil {
-		log.Printf("Failed to marshal home info: %v", err)
-	} else if err := nc.Publish("home.edge.announce", data); err != nil {
-		log.Printf("Failed to announce home: %v", err)
-	}
-
 	return nc, nil
 }
 
-func startEdgeServices(ctx context.Context, cloud *nats.Conn) error {
+// startEdgeServices starts the edge components. They run until ctx is
+// cancelled and the returned services are shut down.
+func startEdgeServices(ctx context.Context, ns *server.Server, cloud *nats.Conn) (*edgeServices, error) {
 	// Connect to local NATS
-	local, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", viper.GetInt("local.port")))
+	local, err := connectLocal(ns, "edge-services")
 	if err != nil {
-		return fmt.Errorf("failed to connect to local NATS: %w", err)
+		return nil, fmt.Errorf("failed to connect to local NATS: %w", err)
+	}
+	svc := &edgeServices{server: ns, local: local, cloud: cloud}
+
+	// Track local devices so commands can be routed to them
+	registry := devices.NewRegistry()
+	if err := registry.Subscribe(local); err != nil {
+		return nil, fmt.Errorf("failed to start device registry: %w", err)
 	}
-	defer local.Close()
 
-	// Start device gateway (handles device discovery and protocol translation)
+	// Start device gateway (runs protocol adapters in-process)
 	log.Println("Starting device gateway...")
-	// TODO: Implement device gateway
+	gwCfg := gateway.Config{
+		RestartDelay:    viper.GetDuration("gateway.restart_delay"),
+		MaxRestartDelay: viper.GetDuration("gateway.max_restart_delay"),
+		CommandTimeout:  viper.GetDuration("gateway.command_timeout"),
+	}
+	if err := viper.UnmarshalKey("gateway.adapters", &gwCfg.Adapters); err != nil {
+		return nil, fmt.Errorf("invalid gateway.adapters: %w", err)
+	}
+	svc.gateway = gateway.New(local, gwCfg)
+	svc.gateway.Register("mqtt", mqtt.New)
+	svc.gateway.Register("zigbee2mqtt", zigbee2mqtt.New)
+
+	// Adapters are stopped first on shutdown, so they get their own context
+	gwCtx, stopGateway := context.WithCancel(context.Background())
+	svc.stopGateway = stopGateway
+	if err := svc.gateway.Start(gwCtx); err != nil {
+		return nil, fmt.Errorf("failed to start device gateway: %w", err)
+	}
 
 	// Start automation engine (executes automations locally)
 	log.Println("Starting automation engine...")
-	// TODO: Implement automation engine
-
-	// Bridge important subjects between local and cloud
-	if err := setupBridging(local, cloud); err != nil {
-		return fmt.Errorf("failed to setup bridging: %w", err)
+	engine := automation.New(local, registry, automation.Config{
+		Bucket: viper.GetString("automation.bucket"),
+		Debug:  viper.GetBool("automation.debug"),
+	})
+	if err := engine.Start(ctx); err != nil {
+		return nil, fmt.Errorf("failed to start automation engine: %w", err)
 	}
 
-	// Monitor for context cancellation
-	<-ctx.Done()
-	return nil
-}
+	// In leaf node mode the cloud link is the embedded server's leaf connection
+	leafMode := viper.GetString("cloud.mode") == "leafnode"
+	cloudConnected := cloud.IsConnected
+	if leafMode {
+		cloudConnected = func() bool { return ns.NumLeafNodes() > 0 }
+	}
+	svc.cloudConnected = cloudConnected
+
+	// Buffer cloud-bound messages while the cloud is unreachable
+	var buf *buffer.Buffer
+	var outbox bridge.Outbox
+	if viper.GetBool("buffer.enabled") {
+		bufCfg := buffer.Config{
+			MaxBytes:      int64(viper.GetSizeInBytes("buffer.max_size")),
+			MaxAge:        viper.GetDuration("buffer.max_age"),
+			CollapseState: viper.GetBool("buffer.collapse_state"),
+		}
+		if leafMode {
+			bufCfg.Connected = cloudConnected
+		}
+		buf = buffer.New(local, cloud, bufCfg)
 
-func setupBridging(local, cloud *nats.Conn) error {
-	homeID := viper.GetString("home.id")
+		// The buffer keeps forwarding until it is flushed on shutdown
+		bufCtx, stopBuffer := context.WithCancel(context.Background())
+		svc.stopBuffer = stopBuffer
+		if err := buf.Start(bufCtx); err != nil {
+			return nil, fmt.Errorf("failed to start outbound buffer: %w", err)
+		}
+		svc.buffer = buf
+		outbox = buf
+	}
 
-	// Bridge device announcements to cloud
-	local.Subscribe("home.devices.*.announce", func(msg *nats.Msg) {
-		// Add home ID to subject
-		cloudSubject := fmt.Sprintf("cloud.homes.%s.devices.announce", homeID)
-		cloud.Publish(cloudSubject, msg.Data)
+	// Bridge subjects between local and cloud according to the bridge rules
+	rules, err := bridgeRules()
+	if err != nil {
+		return nil, err
+	}
+	b := bridge.New(local, cloud, registry, engine, outbox, bridge.Config{
+		HomeID:         viper.GetString("home.id"),
+		CommandTimeout: viper.GetDuration("bridge.command_timeout"),
+		Rules:          rules,
 	})
+	if err := b.Start(); err != nil {
+		return nil, fmt.Errorf("failed to setup bridging: %w", err)
+	}
+	svc.bridge = b
+
+	// Reload bridge rules when edge.yaml changes
+	if viper.ConfigFileUsed() != "" {
+		viper.OnConfigChange(func(e fsnotify.Event) {
+			rules, err := bridgeRules()
+			if err == nil {
+				err = b.SetRules(rules)
+			}
+			if err != nil {
+				log.Printf("Failed to reload bridge rules, keeping the current rules: %v", err)
+			}
+		})
+		viper.WatchConfig()
+	}
 
-	// Bridge device states to cloud
-	local.Subscribe("home.devices.*.state", func(msg *nats.Msg) {
-		cloudSubject := fmt.Sprintf("cloud.homes.%s.devices.state", homeID)
-		cloud.Publish(cloudSubject, msg.Data)
-	})
+	bufferDepth := func() uint64 {
+		if buf == nil {
+			return 0
+		}
+		return buf.Depth()
+	}
 
-	// Bridge commands from cloud to local devices
-	cloud.Subscribe(fmt.Sprintf("cloud.homes.%s.devices.*.command", homeID), func(msg *nats.Msg) {
-		// Extract device ID and forward locally
-		// TODO: Parse subject properly
-		local.Publish("home.devices.light.command", msg.Data)
+	// Report edge health to the cloud
+	go runHeartbeat(ctx, cloud, cloudConnected, registry.Count, bufferDepth)
+
+	// Serve health and readiness locally, so container health checks work
+	// with metrics disabled
+	hs := health.New(health.Config{
+		Host:    viper.GetString("metrics.host"),
+		Port:    viper.GetInt("metrics.port"),
+		Metrics: viper.GetBool("metrics.enabled"),
+	}, health.Sources{
+		Server:         ns,
+		CloudConnected: cloudConnected,
+		Bridge:         b.Stats,
+		BufferDepth:    bufferDepth,
+		Automation:     engine.Status,
+		DeviceCount:    registry.Count,
 	})
+	if err := hs.Start(ctx); err != nil {
+		return nil, fmt.Errorf("failed to start health endpoint: %w", err)
+	}
+	svc.health = hs
+
+	// Record outages and, once the cloud is back, replay buffered messages
+	// and resync device state
+	onDisconnect := hs.CloudDisconnected
+	onReconnect := func() {
+		log.Println("Reconnected to Synadia Cloud")
+		if buf != nil {
+			buf.Resume()
+		}
+		b.PublishSnapshot()
+	}
+	if leafMode {
+		go watchLeafConnection(ctx, cloudConnected, onDisconnect, onReconnect)
+	} else {
+		cloud.SetDisconnectErrHandler(func(nc *nats.Conn, err error) {
+			log.Printf("Disconnected from cloud: %v", err)
+			onDisconnect()
+		})
+		cloud.SetReconnectHandler(func(nc *nats.Conn) { onReconnect() })
+	}
 
-	// Subscribe to automation updates from cloud
-	cloud.Subscribe(fmt.Sprintf("cloud.homes.%s.automations.update", homeID), func(msg *nats.Msg) {
-		log.Println("Received automation update from cloud")
-		// TODO: Update local automation engine
-	})
+	return svc, nil
+}
 
-	log.Println("Cloud-local bridging established")
-	return nil
+// watchLeafConnection calls onDisconnect and onReconnect when the leaf node
+// connection to the cloud drops and is restored. The server raises no events
+// for leaf node disconnects, so the connection is checked instead.
+func watchLeafConnection(ctx context.Context, connected func() bool, onDisconnect, onReconnect func()) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	wasConnected := connected()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			isConnected := connected()
+			if isConnected && !wasConnected {
+				onReconnect()
+			} else if !isConnected && wasConnected {
+				log.Println("Leaf node connection to cloud lost")
+				onDisconnect()
+			}
+			wasConnected = isConnected
+		}
+	}
 }
 
-func generateHomeID() string {
-	// Simple ID generation - in production use UUID
-	return fmt.Sprintf("home-%d", time.Now().Unix())
-}
\ No newline at end of file
+// bridgeRules reads the bridge rules from the configuration. Without a
+// bridge.rules section the default rules apply.
+func bridgeRules() ([]bridge.Rule, error) {
+	if !viper.IsSet("bridge.rules") {
+		return bridge.DefaultRules(), nil
+	}
+
+	var rules []bridge.Rule
+	if err := viper.UnmarshalKey("bridge.rules", &rules); err != nil {
+		return nil, fmt.Errorf("invalid bridge.rules: %w", err)
+	}
+	return rules, nil
+}
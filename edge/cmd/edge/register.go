@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/homix-dev/homix/edge/internal/identity"
+	"github.com/nats-io/nats.go"
+	"github.com/spf13/viper"
+)
+
+// version is the edge server version reported to the cloud
+const version = "2.0.0"
+
+// startedAt is used to report the edge uptime
+var startedAt = time.Now()
+
+// assignedKeys are the settings the cloud may assign at registration. They
+// configure connections made at startup, so they are stored in the data
+// directory and take effect when the edge next starts.
+var assignedKeys = []string{
+	"home.name",
+	"cloud.url",
+	"cloud.credentials",
+	"local.leafnode.remotes",
+}
+
+// assignedFile holds the settings last assigned by the cloud
+const assignedFile = "assigned.json"
+
+// registration is the request sent to the cloud on home.edge.announce. The
+// signature over the home ID and timestamp proves possession of the edge key.
+type registration struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Version   string    `json:"version"`
+	EdgeType  string    `json:"edge_type"`
+	PublicKey string    `json:"public_key"`
+	Connected time.Time `json:"connected"`
+	Signature string    `json:"signature"`
+}
+
+// registrationResponse is the cloud's acknowledgement of a registration
+type registrationResponse struct {
+	Accepted bool                   `json:"accepted"`
+	Error    string                 `json:"error,omitempty"`
+	Config   map[string]interface{} `json:"config,omitempty"`
+}
+
+// heartbeat is published periodically on home.edge.heartbeat
+type heartbeat struct {
+	ID            string    `json:"id"`
+	Version       string    `json:"version"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+	DeviceCount   int       `json:"device_count"`
+	BufferDepth   uint64    `json:"buffer_depth"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// offline is published on home.edge.offline when the edge shuts down
+type offline struct {
+	ID            string    `json:"id"`
+	Version       string    `json:"version"`
+	Reason        string    `json:"reason"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// registerWithCloud performs the registration handshake and stores the
+// config assigned by the cloud for the next start
+func registerWithCloud(nc *nats.Conn, id *identity.Identity) error {
+	req := registration{
+		ID:        id.HomeID,
+		Name:      viper.GetString("home.name"),
+		Version:   version,
+		EdgeType:  "docker",
+		PublicKey: id.PublicKey,
+		Connected: time.Now().UTC(),
+	}
+
+	sig, err := id.Sign([]byte(req.ID + "|" + req.Connected.Format(time.RFC3339Nano)))
+	if err != nil {
+		return fmt.Errorf("failed to sign registration: %w", err)
+	}
+	req.Signature = sig
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal registration: %w", err)
+	}
+
+	msg, err := nc.Request("home.edge.announce", data, viper.GetDuration("edge.register_timeout"))
+	if err != nil {
+		return fmt.Errorf("registration request failed: %w", err)
+	}
+
+	var resp registrationResponse
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		return fmt.Errorf("invalid registration response: %w", err)
+	}
+	if !resp.Accepted {
+		return fmt.Errorf("registration rejected: %s", resp.Error)
+	}
+
+	if len(resp.Config) > 0 {
+		changed, err := storeAssigned(viper.GetString("data.dir"), resp.Config)
+		if err != nil {
+			return fmt.Errorf("failed to store assigned config: %w", err)
+		}
+		if len(changed) > 0 {
+			log.Printf("Cloud assigned new %s, restart the edge to apply", strings.Join(changed, ", "))
+		}
+	}
+
+	log.Printf("Registered with Synadia Cloud as %s", id.HomeID)
+	return nil
+}
+
+// storeAssigned keeps the settings in config that the cloud may assign, and
+// returns those that differ from the running config. Other settings are
+// ignored.
+func storeAssigned(dataDir string, config map[string]interface{}) ([]string, error) {
+	assigned := viper.New()
+	if err := assigned.MergeConfigMap(config); err != nil {
+		return nil, err
+	}
+	for _, key := range assigned.AllKeys() {
+		if !isAssignable(key) {
+			log.Printf("Ignoring %s assigned by the cloud", key)
+		}
+	}
+
+	stored, err := readAssigned(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	for _, key := range assignedKeys {
+		if !assigned.IsSet(key) {
+			continue
+		}
+		value := assigned.Get(key)
+		if !reflect.DeepEqual(viper.Get(key), value) {
+			changed = append(changed, key)
+		}
+		stored[key] = value
+	}
+	if len(changed) == 0 {
+		return nil, nil
+	}
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dataDir, assignedFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+// loadAssigned applies the settings the cloud assigned at an earlier
+// registration. They override the config file and environment.
+func loadAssigned(dataDir string) error {
+	stored, err := readAssigned(dataDir)
+	if err != nil {
+		return err
+	}
+	for key, value := range stored {
+		if !isAssignable(key) {
+			continue
+		}
+		viper.Set(key, value)
+		log.Printf("Using %s assigned by the cloud", key)
+	}
+	return nil
+}
+
+func readAssigned(dataDir string) (map[string]interface{}, error) {
+	stored := make(map[string]interface{})
+	data, err := os.ReadFile(filepath.Join(dataDir, assignedFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return stored, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", assignedFile, err)
+	}
+	return stored, nil
+}
+
+// isAssignable reports whether the cloud may assign a config key
+func isAssignable(key string) bool {
+	for _, allowed := range assignedKeys {
+		if key == allowed || strings.HasPrefix(key, allowed+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// registerInBackground retries the registration handshake until the cloud
+// accepts it
+func registerInBackground(ctx context.Context, nc *nats.Conn, id *identity.Identity) {
+	wait := viper.GetDuration("cloud.reconnect_wait")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		if err := registerWithCloud(nc, id); err != nil {
+			log.Printf("Edge registration failed: %v", err)
+			if wait < time.Minute {
+				wait *= 2
+			}
+			continue
+		}
+		return
+	}
+}
+
+// runHeartbeat publishes edge health to the cloud until ctx is cancelled
+func runHeartbeat(ctx context.Context, cloud *nats.Conn, connected func() bool, deviceCount func() int, bufferDepth func() uint64) {
+	ticker := time.NewTicker(viper.GetDuration("edge.heartbeat_interval"))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !connected() {
+				continue
+			}
+
+			data, err := json.Marshal(heartbeat{
+				ID:            viper.GetString("home.id"),
+				Version:       version,
+				UptimeSeconds: int64(time.Since(startedAt).Seconds()),
+				DeviceCount:   deviceCount(),
+				BufferDepth:   bufferDepth(),
+				Timestamp:     time.Now().UTC(),
+			})
+			if err != nil {
+				log.Printf("Failed to marshal heartbeat: %v", err)
+				continue
+			}
+
+			if err := cloud.Publish("home.edge.heartbeat", data); err != nil {
+				log.Printf("Failed to publish heartbeat: %v", err)
+			}
+		}
+	}
+}
+
+// publishOffline tells the cloud the edge is going offline on purpose
+func publishOffline(ctx context.Context, cloud *nats.Conn) error {
+	data, err := json.Marshal(offline{
+		ID:            viper.GetString("home.id"),
+		Version:       version,
+		Reason:        "shutdown",
+		UptimeSeconds: int64(time.Since(startedAt).Seconds()),
+		Timestamp:     time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal offline notice: %w", err)
+	}
+
+	if err := cloud.Publish("home.edge.offline", data); err != nil {
+		return err
+	}
+	return cloud.FlushWithContext(ctx)
+}
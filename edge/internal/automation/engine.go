@@ -0,0 +1,535 @@
+package automation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/homix-dev/homix/edge/internal/devices"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Config contains the automation engine configuration
+type Config struct {
+	Bucket string // KV bucket on the local server holding automations
+	Debug  bool   // Log every evaluation
+}
+
+// Engine executes automations against local device state. It only talks to
+// the local NATS server, so automations keep running while the cloud is
+// unreachable.
+type Engine struct {
+	nc       *nats.Conn
+	kv       jetstream.KeyValue
+	registry *devices.Registry
+	config   Config
+
+	automations  map[string]*Automation
+	disabled     map[string]struct{} // Stored but not loaded
+	deviceStates map[string]*DeviceState
+	mu           sync.RWMutex
+
+	evaluator *Evaluator
+
+	running atomic.Bool
+	runs    atomic.Uint64
+	lastRun atomic.Int64 // Unix nanoseconds
+}
+
+// Status summarises the state of the automation engine
+type Status struct {
+	Running     bool       `json:"running"`
+	Automations int        `json:"automations"`
+	Enabled     int        `json:"enabled"`
+	Runs        uint64     `json:"runs"`
+	LastRun     *time.Time `json:"last_run,omitempty"`
+}
+
+// New creates a new automation engine
+func New(nc *nats.Conn, registry *devices.Registry, cfg Config) *Engine {
+	if cfg.Bucket == "" {
+		cfg.Bucket = "automations"
+	}
+
+	e := &Engine{
+		nc:           nc,
+		registry:     registry,
+		config:       cfg,
+		automations:  make(map[string]*Automation),
+		disabled:     make(map[string]struct{}),
+		deviceStates: make(map[string]*DeviceState),
+	}
+	e.evaluator = NewEvaluator(e)
+
+	return e
+}
+
+// Start loads automations from KV and begins evaluating them. It returns once
+// the initial set of automations is loaded; evaluation continues until ctx is
+// cancelled.
+func (e *Engine) Start(ctx context.Context) error {
+	js, err := jetstream.New(e.nc)
+	if err != nil {
+		return fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:      e.config.Bucket,
+		Description: "Edge automations",
+		History:     5,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open automations KV store: %w", err)
+	}
+	e.kv = kv
+
+	// The watcher delivers every stored automation first, then live changes
+	watcher, err := kv.WatchAll(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to watch automations: %w", err)
+	}
+
+	loaded := make(chan struct{})
+	go e.watchAutomations(ctx, watcher, loaded)
+
+	select {
+	case <-loaded:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if err := e.startSubscriptions(); err != nil {
+		return fmt.Errorf("failed to start subscriptions: %w", err)
+	}
+
+	go e.runClock(ctx)
+	e.running.Store(true)
+	go func() {
+		<-ctx.Done()
+		e.running.Store(false)
+	}()
+
+	e.mu.RLock()
+	log.Printf("Automation engine started with %d active automations", len(e.automations))
+	e.mu.RUnlock()
+	return nil
+}
+
+// ApplyUpdate stores an automation change pushed from the cloud. The KV
+// watcher picks the change up, so the running set follows the bucket.
+func (e *Engine) ApplyUpdate(ctx context.Context, data []byte) error {
+	if e.kv == nil {
+		return errors.New("automation engine not started")
+	}
+
+	var update Update
+	if err := json.Unmarshal(data, &update); err != nil {
+		return fmt.Errorf("invalid automation update: %w", err)
+	}
+
+	automationID := update.AutomationID
+	if automationID == "" && update.Automation != nil {
+		automationID = update.Automation.ID
+	}
+	if automationID == "" {
+		return errors.New("automation_id is required")
+	}
+
+	switch update.Type {
+	case "created", "updated":
+		if update.Automation == nil {
+			return fmt.Errorf("automation is required for %s updates", update.Type)
+		}
+		update.Automation.ID = automationID
+		return e.putAutomation(ctx, update.Automation)
+
+	case "enabled", "disabled":
+		entry, err := e.kv.Get(ctx, automationID)
+		if err != nil {
+			return fmt.Errorf("failed to get automation %s: %w", automationID, err)
+		}
+
+		var automation Automation
+		if err := json.Unmarshal(entry.Value(), &automation); err != nil {
+			return fmt.Errorf("failed to unmarshal automation %s: %w", automationID, err)
+		}
+		automation.Enabled = update.Type == "enabled"
+		return e.putAutomation(ctx, &automation)
+
+	case "deleted":
+		if err := e.kv.Delete(ctx, automationID); err != nil {
+			return fmt.Errorf("failed to delete automation %s: %w", automationID, err)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown automation update type: %s", update.Type)
+	}
+}
+
+func (e *Engine) putAutomation(ctx context.Context, automation *Automation) error {
+	automation.UpdatedAt = time.Now().UTC()
+
+	data, err := json.Marshal(automation)
+	if err != nil {
+		return fmt.Errorf("failed to marshal automation: %w", err)
+	}
+
+	if _, err := e.kv.Put(ctx, automation.ID, data); err != nil {
+		return fmt.Errorf("failed to store automation %s: %w", automation.ID, err)
+	}
+	return nil
+}
+
+func (e *Engine) watchAutomations(ctx context.Context, watcher jetstream.KeyWatcher, loaded chan struct{}) {
+	defer watcher.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case entry, ok := <-watcher.Updates():
+			if !ok {
+				return
+			}
+
+			// A nil entry marks the end of the initial values
+			if entry == nil {
+				close(loaded)
+				continue
+			}
+
+			e.applyEntry(entry)
+		}
+	}
+}
+
+func (e *Engine) applyEntry(entry jetstream.KeyValueEntry) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	key := entry.Key()
+	if entry.Operation() != jetstream.KeyValuePut {
+		delete(e.disabled, key)
+		if _, exists := e.automations[key]; exists {
+			delete(e.automations, key)
+			log.Printf("Removed automation: %s", key)
+		}
+		return
+	}
+
+	var automation Automation
+	if err := json.Unmarshal(entry.Value(), &automation); err != nil {
+		log.Printf("Failed to unmarshal automation %s: %v", key, err)
+		return
+	}
+
+	if !automation.Enabled {
+		e.disabled[key] = struct{}{}
+		if _, exists := e.automations[key]; exists {
+			delete(e.automations, key)
+			log.Printf("Removed disabled automation: %s", key)
+		}
+		return
+	}
+
+	delete(e.disabled, key)
+	_, exists := e.automations[key]
+	e.automations[key] = &automation
+	if !exists {
+		log.Printf("Loaded automation: %s (%s)", automation.Name, automation.ID)
+	}
+}
+
+func (e *Engine) startSubscriptions() error {
+	// Device states, in both the short and the typed subject layouts
+	for _, subject := range []string{"home.devices.*.state", "home.devices.*.*.state"} {
+		if _, err := e.nc.Subscribe(subject, e.handleDeviceState); err != nil {
+			return err
+		}
+	}
+
+	// System events for event triggers
+	if _, err := e.nc.Subscribe("home.events.>", e.handleEvent); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (e *Engine) handleDeviceState(msg *nats.Msg) {
+	var state map[string]interface{}
+	if err := json.Unmarshal(msg.Data, &state); err != nil {
+		log.Printf("Failed to parse device state: %v", err)
+		return
+	}
+
+	deviceID, _ := state["device_id"].(string)
+	if deviceID == "" {
+		// home.devices.<id>.state or home.devices.<type>.<id>.state
+		tokens := strings.Split(msg.Subject, ".")
+		deviceID = tokens[len(tokens)-2]
+	}
+
+	// Devices that nest their attributes under "state" are flattened, so
+	// triggers can address attributes directly
+	if nested, ok := state["state"].(map[string]interface{}); ok {
+		for k, v := range nested {
+			state[k] = v
+		}
+	}
+
+	e.mu.Lock()
+	deviceState, exists := e.deviceStates[deviceID]
+	if !exists {
+		deviceState = &DeviceState{
+			DeviceID: deviceID,
+			State:    make(map[string]interface{}),
+		}
+		e.deviceStates[deviceID] = deviceState
+	}
+	for k, v := range state {
+		deviceState.State[k] = v
+	}
+	deviceState.LastUpdate = time.Now()
+	deviceState.Online = true
+	e.mu.Unlock()
+
+	e.evaluateTriggers("device_state", func(trigger Trigger) bool {
+		return trigger.Type == "device_state" && trigger.DeviceID == deviceID
+	}, map[string]interface{}{
+		"trigger_type": "device_state",
+		"device_id":    deviceID,
+		"state":        state,
+	})
+}
+
+func (e *Engine) handleEvent(msg *nats.Msg) {
+	var event map[string]interface{}
+	if err := json.Unmarshal(msg.Data, &event); err != nil {
+		return
+	}
+
+	eventType, _ := event["event_type"].(string)
+	if eventType == "" {
+		return
+	}
+
+	e.evaluateTriggers("event", func(trigger Trigger) bool {
+		return trigger.Type == "event" && trigger.Event == eventType
+	}, map[string]interface{}{
+		"trigger_type": "event",
+		"event":        eventType,
+		"data":         event["data"],
+	})
+}
+
+// runClock evaluates time triggers at the start of every minute
+func (e *Engine) runClock(ctx context.Context) {
+	now := time.Now()
+	timer := time.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case tick := <-timer.C:
+			timer.Reset(tick.Truncate(time.Minute).Add(time.Minute).Sub(time.Now()))
+
+			e.evaluateTriggers("time", func(trigger Trigger) bool {
+				return trigger.Type == "time" || trigger.Type == "time_pattern"
+			}, map[string]interface{}{
+				"trigger_type": "time",
+				"time":         tick,
+			})
+		}
+	}
+}
+
+// evaluateTriggers evaluates every automation with a trigger that matches
+func (e *Engine) evaluateTriggers(kind string, match func(Trigger) bool, context map[string]interface{}) {
+	e.mu.RLock()
+	automations := make([]Automation, 0)
+	for _, automation := range e.automations {
+		for _, trigger := range automation.Triggers {
+			if match(trigger) {
+				automations = append(automations, *automation)
+				break
+			}
+		}
+	}
+	e.mu.RUnlock()
+
+	if e.config.Debug && len(automations) > 0 {
+		log.Printf("Evaluating %d automations for %s trigger", len(automations), kind)
+	}
+
+	for _, automation := range automations {
+		go e.evaluator.EvaluateAutomation(automation, context)
+	}
+}
+
+// attribute returns the last known value of a device attribute
+func (e *Engine) attribute(deviceID, attribute string) (interface{}, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	deviceState, exists := e.deviceStates[deviceID]
+	if !exists || deviceState.State == nil {
+		return nil, false
+	}
+
+	value, exists := deviceState.State[attribute]
+	return value, exists
+}
+
+// Status returns the current engine status
+func (e *Engine) Status() Status {
+	e.mu.RLock()
+	status := Status{
+		Running:     e.running.Load(),
+		Automations: len(e.automations) + len(e.disabled),
+		Enabled:     len(e.automations),
+		Runs:        e.runs.Load(),
+	}
+	e.mu.RUnlock()
+
+	if last := e.lastRun.Load(); last != 0 {
+		t := time.Unix(0, last).UTC()
+		status.LastRun = &t
+	}
+	return status
+}
+
+// recordRun updates the run info of an automation in KV
+func (e *Engine) recordRun(automationID string) {
+	e.runs.Add(1)
+	e.lastRun.Store(time.Now().UnixNano())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	entry, err := e.kv.Get(ctx, automationID)
+	if err != nil {
+		log.Printf("Failed to get automation %s: %v", automationID, err)
+		return
+	}
+
+	var automation Automation
+	if err := json.Unmarshal(entry.Value(), &automation); err != nil {
+		log.Printf("Failed to unmarshal automation %s: %v", automationID, err)
+		return
+	}
+	automation.LastRun = time.Now().UTC()
+	automation.RunCount++
+
+	data, err := json.Marshal(automation)
+	if err != nil {
+		log.Printf("Failed to marshal automation: %v", err)
+		return
+	}
+
+	// Only update if nothing changed in the meantime, a concurrent update
+	// from the cloud wins over run info
+	if _, err := e.kv.Update(ctx, automationID, data, entry.Revision()); err != nil {
+		log.Printf("Failed to update automation run info: %v", err)
+	}
+}
+
+// ExecuteAction executes an automation action
+func (e *Engine) ExecuteAction(action Action) error {
+	switch action.Type {
+	case "device_command":
+		return e.executeDeviceCommand(action)
+	case "scene_activate":
+		return e.executeSceneActivation(action)
+	case "notification":
+		return e.executeNotification(action)
+	default:
+		return fmt.Errorf("unknown action type: %s", action.Type)
+	}
+}
+
+func (e *Engine) executeDeviceCommand(action Action) error {
+	if action.DeviceID == "" {
+		return fmt.Errorf("device_id is required for device_command action")
+	}
+
+	deviceType := "unknown"
+	if device, ok := e.registry.Get(action.DeviceID); ok && device.Type != "" {
+		deviceType = device.Type
+	}
+
+	payload := map[string]interface{}{
+		"device_id": action.DeviceID,
+		"command":   action.Command,
+		"timestamp": time.Now().Unix(),
+	}
+	for k, v := range action.Data {
+		payload[k] = v
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal command: %w", err)
+	}
+
+	if err := e.nc.Publish(devices.CommandSubject(deviceType, action.DeviceID), data); err != nil {
+		return fmt.Errorf("failed to publish command: %w", err)
+	}
+
+	log.Printf("Executed device command: %s -> %s", action.DeviceID, action.Command)
+	return nil
+}
+
+func (e *Engine) executeSceneActivation(action Action) error {
+	if action.Scene == "" {
+		return fmt.Errorf("scene is required for scene_activate action")
+	}
+
+	payload := map[string]interface{}{
+		"scene_id":  action.Scene,
+		"timestamp": time.Now().Unix(),
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal scene activation: %w", err)
+	}
+
+	if err := e.nc.Publish(fmt.Sprintf("home.scenes.%s.activate", action.Scene), data); err != nil {
+		return fmt.Errorf("failed to publish scene activation: %w", err)
+	}
+
+	log.Printf("Activated scene: %s", action.Scene)
+	return nil
+}
+
+func (e *Engine) executeNotification(action Action) error {
+	payload := map[string]interface{}{
+		"message":   action.Data["message"],
+		"title":     action.Data["title"],
+		"priority":  action.Data["priority"],
+		"timestamp": time.Now().Unix(),
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+
+	if err := e.nc.Publish("home.notifications.send", data); err != nil {
+		return fmt.Errorf("failed to publish notification: %w", err)
+	}
+
+	log.Printf("Sent notification: %v", action.Data["title"])
+	return nil
+}
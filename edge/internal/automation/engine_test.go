@@ -0,0 +1,163 @@
+package automation
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/homix-dev/homix/edge/internal/devices"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func TestEngineRunsAutomationFromUpdate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	registry := devices.NewRegistry()
+	registry.HandleAnnounce("home.devices.light.hall-light.announce", []byte(`{}`))
+	engine, nc := startEngine(t, ctx, registry)
+
+	commands, err := nc.SubscribeSync("home.devices.light.hall-light.command")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	update, _ := json.Marshal(Update{
+		Type: "created",
+		Automation: &Automation{
+			ID:      "motion-light",
+			Name:    "Motion light",
+			Enabled: true,
+			Triggers: []Trigger{
+				{Type: "device_state", DeviceID: "hall-motion", Attribute: "motion", Value: true},
+			},
+			Actions: []Action{
+				{Type: "device_command", DeviceID: "hall-light", Command: "turn_on"},
+			},
+		},
+	})
+	if err := engine.ApplyUpdate(ctx, update); err != nil {
+		t.Fatalf("failed to apply update: %v", err)
+	}
+
+	// Wait for the watcher to load the automation
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		engine.mu.RLock()
+		_, loaded := engine.automations["motion-light"]
+		engine.mu.RUnlock()
+		if loaded {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("automation was not loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	nc.Publish("home.devices.hall-motion.state", []byte(`{"device_id":"hall-motion","state":{"motion":true}}`))
+
+	msg, err := commands.NextMsg(2 * time.Second)
+	if err != nil {
+		t.Fatalf("expected device command: %v", err)
+	}
+
+	var cmd map[string]interface{}
+	if err := json.Unmarshal(msg.Data, &cmd); err != nil {
+		t.Fatal(err)
+	}
+	if cmd["command"] != "turn_on" {
+		t.Fatalf("unexpected command: %s", msg.Data)
+	}
+
+	// Deleting the automation stops it from running
+	if err := engine.ApplyUpdate(ctx, []byte(`{"type":"deleted","automation_id":"motion-light"}`)); err != nil {
+		t.Fatalf("failed to delete automation: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	nc.Publish("home.devices.hall-motion.state", []byte(`{"device_id":"hall-motion","state":{"motion":true}}`))
+	if _, err := commands.NextMsg(300 * time.Millisecond); err == nil {
+		t.Fatal("deleted automation still ran")
+	}
+}
+
+func TestEngineStatusCountsDisabled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	engine, _ := startEngine(t, ctx, devices.NewRegistry())
+
+	for _, update := range []string{
+		`{"type":"created","automation":{"id":"porch","name":"Porch","enabled":true}}`,
+		`{"type":"created","automation":{"id":"garden","name":"Garden","enabled":true}}`,
+		`{"type":"disabled","automation_id":"garden"}`,
+		`{"type":"created","automation":{"id":"attic","name":"Attic","enabled":false}}`,
+	} {
+		if err := engine.ApplyUpdate(ctx, []byte(update)); err != nil {
+			t.Fatalf("failed to apply %s: %v", update, err)
+		}
+	}
+	waitForStatus(t, engine, Status{Running: true, Automations: 3, Enabled: 1})
+
+	if err := engine.ApplyUpdate(ctx, []byte(`{"type":"deleted","automation_id":"attic"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.ApplyUpdate(ctx, []byte(`{"type":"enabled","automation_id":"garden"}`)); err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, engine, Status{Running: true, Automations: 2, Enabled: 2})
+}
+
+// startEngine starts an engine on its own server and returns it with a
+// connection to that server
+func startEngine(t *testing.T, ctx context.Context, registry *devices.Registry) (*Engine, *nats.Conn) {
+	t.Helper()
+
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	ns.Start()
+	t.Cleanup(ns.Shutdown)
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("server not ready")
+	}
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(nc.Close)
+
+	engine := New(nc, registry, Config{})
+	if err := engine.Start(ctx); err != nil {
+		t.Fatalf("failed to start engine: %v", err)
+	}
+	return engine, nc
+}
+
+func waitForStatus(t *testing.T, engine *Engine, want Status) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got := engine.Status()
+		got.LastRun = nil
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("status = %+v, want %+v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,328 @@
+package automation
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Evaluator evaluates automation triggers and conditions
+type Evaluator struct {
+	engine *Engine
+}
+
+// NewEvaluator creates a new evaluator
+func NewEvaluator(engine *Engine) *Evaluator {
+	return &Evaluator{
+		engine: engine,
+	}
+}
+
+// EvaluateAutomation evaluates an automation
+func (e *Evaluator) EvaluateAutomation(automation Automation, context map[string]interface{}) {
+	debug := e.engine.config.Debug
+	if debug {
+		log.Printf("Evaluating automation: %s (%s) with context: %+v",
+			automation.Name, automation.ID, context)
+	}
+
+	// Check if any trigger matches
+	triggerMatched := false
+	for _, trigger := range automation.Triggers {
+		if e.evaluateTrigger(trigger, context) {
+			triggerMatched = true
+			break
+		}
+	}
+
+	if !triggerMatched {
+		if debug {
+			log.Printf("No triggers matched for automation: %s", automation.Name)
+		}
+		return
+	}
+
+	// Check all conditions
+	for _, condition := range automation.Conditions {
+		if !e.evaluateCondition(condition) {
+			if debug {
+				log.Printf("Condition not met for automation: %s", automation.Name)
+			}
+			return
+		}
+	}
+
+	// All triggers and conditions passed, execute actions
+	log.Printf("Executing automation: %s (%s)", automation.Name, automation.ID)
+
+	for i, action := range automation.Actions {
+		// Handle delay
+		if action.Delay > 0 {
+			time.Sleep(time.Duration(action.Delay) * time.Second)
+		}
+
+		if err := e.engine.ExecuteAction(action); err != nil {
+			log.Printf("Failed to execute action %d for automation %s: %v",
+				i, automation.Name, err)
+		}
+	}
+
+	e.engine.recordRun(automation.ID)
+}
+
+func (e *Evaluator) evaluateTrigger(trigger Trigger, context map[string]interface{}) bool {
+	triggerType, _ := context["trigger_type"].(string)
+
+	switch trigger.Type {
+	case "device_state":
+		if triggerType != "device_state" {
+			return false
+		}
+
+		deviceID, _ := context["device_id"].(string)
+		if trigger.DeviceID != deviceID {
+			return false
+		}
+
+		state, _ := context["state"].(map[string]interface{})
+		return e.evaluateDeviceStateTrigger(trigger, state)
+
+	case "time":
+		if triggerType != "time" {
+			return false
+		}
+		return e.evaluateTimeTrigger(trigger, context)
+
+	case "event":
+		if triggerType != "event" {
+			return false
+		}
+		return e.evaluateEventTrigger(trigger, context)
+
+	default:
+		log.Printf("Unknown trigger type: %s", trigger.Type)
+		return false
+	}
+}
+
+func (e *Evaluator) evaluateDeviceStateTrigger(trigger Trigger, state map[string]interface{}) bool {
+	if trigger.Attribute == "" {
+		return false
+	}
+
+	// Get the attribute value from state
+	value, exists := state[trigger.Attribute]
+	if !exists {
+		return false
+	}
+
+	// Check for exact value match
+	if trigger.Value != nil {
+		return compareValues(value, trigger.Value)
+	}
+
+	// Check for numeric comparisons
+	numValue, err := toFloat64(value)
+	if err == nil {
+		if trigger.Above > 0 && numValue <= trigger.Above {
+			return false
+		}
+		if trigger.Below > 0 && numValue >= trigger.Below {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (e *Evaluator) evaluateTimeTrigger(trigger Trigger, context map[string]interface{}) bool {
+	currentTime, _ := context["time"].(time.Time)
+	if currentTime.IsZero() {
+		currentTime = time.Now()
+	}
+
+	if trigger.Time == "" {
+		return false
+	}
+
+	// Time is in HH:MM format and matches within the minute
+	minutes, ok := parseTime(trigger.Time)
+	if !ok {
+		return false
+	}
+	return currentTime.Hour()*60+currentTime.Minute() == minutes
+}
+
+func (e *Evaluator) evaluateEventTrigger(trigger Trigger, context map[string]interface{}) bool {
+	event, _ := context["event"].(string)
+	return trigger.Event == event
+}
+
+func (e *Evaluator) evaluateCondition(condition Condition) bool {
+	switch condition.Type {
+	case "device_state":
+		return e.evaluateDeviceStateCondition(condition)
+	case "time":
+		return e.evaluateTimeCondition(condition)
+	case "numeric_state":
+		return e.evaluateNumericStateCondition(condition)
+	default:
+		log.Printf("Unknown condition type: %s", condition.Type)
+		return true // Unknown conditions pass by default
+	}
+}
+
+func (e *Evaluator) evaluateDeviceStateCondition(condition Condition) bool {
+	if condition.DeviceID == "" || condition.Attribute == "" {
+		return false
+	}
+
+	value, exists := e.engine.attribute(condition.DeviceID, condition.Attribute)
+	if !exists {
+		return false
+	}
+
+	if condition.Value != nil {
+		return compareValues(value, condition.Value)
+	}
+
+	return true
+}
+
+func (e *Evaluator) evaluateTimeCondition(condition Condition) bool {
+	now := time.Now()
+	currentMinutes := now.Hour()*60 + now.Minute()
+
+	if condition.After != "" {
+		if afterMinutes, ok := parseTime(condition.After); ok && currentMinutes < afterMinutes {
+			return false
+		}
+	}
+
+	if condition.Before != "" {
+		if beforeMinutes, ok := parseTime(condition.Before); ok && currentMinutes >= beforeMinutes {
+			return false
+		}
+	}
+
+	if len(condition.Weekday) > 0 {
+		currentWeekday := now.Weekday().String()
+		found := false
+		for _, weekday := range condition.Weekday {
+			if strings.EqualFold(weekday, currentWeekday) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (e *Evaluator) evaluateNumericStateCondition(condition Condition) bool {
+	if condition.DeviceID == "" || condition.Attribute == "" {
+		return false
+	}
+
+	value, exists := e.engine.attribute(condition.DeviceID, condition.Attribute)
+	if !exists {
+		return false
+	}
+
+	numValue, err := toFloat64(value)
+	if err != nil {
+		return false
+	}
+
+	if condition.Above > 0 && numValue <= condition.Above {
+		return false
+	}
+	if condition.Below > 0 && numValue >= condition.Below {
+		return false
+	}
+
+	return true
+}
+
+func compareValues(a, b interface{}) bool {
+	if a == nil && b == nil {
+		return true
+	}
+	if a == nil || b == nil {
+		return false
+	}
+
+	// Try string comparison
+	if fmt.Sprintf("%v", a) == fmt.Sprintf("%v", b) {
+		return true
+	}
+
+	// Try numeric comparison
+	aNum, err1 := toFloat64(a)
+	bNum, err2 := toFloat64(b)
+	if err1 == nil && err2 == nil {
+		return aNum == bNum
+	}
+
+	// Try boolean comparison
+	aBool, err1 := toBool(a)
+	bBool, err2 := toBool(b)
+	if err1 == nil && err2 == nil {
+		return aBool == bBool
+	}
+
+	return false
+}
+
+func toFloat64(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	default:
+		return 0, fmt.Errorf("cannot convert %T to float64", value)
+	}
+}
+
+func toBool(value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		return strconv.ParseBool(v)
+	case int:
+		return v != 0, nil
+	case float64:
+		return v != 0, nil
+	default:
+		return false, fmt.Errorf("cannot convert %T to bool", value)
+	}
+}
+
+// parseTime converts HH:MM to minutes since midnight
+func parseTime(timeStr string) (int, bool) {
+	parts := strings.Split(timeStr, ":")
+	if len(parts) != 2 {
+		return 0, false
+	}
+
+	hour, err1 := strconv.Atoi(parts[0])
+	minute, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil {
+		return 0, false
+	}
+
+	return hour*60 + minute, true
+}
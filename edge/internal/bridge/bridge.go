@@ -0,0 +1,250 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/homix-dev/homix/edge/internal/devices"
+	"github.com/nats-io/nats.go"
+)
+
+// Config contains the cloud bridge configuration
+type Config struct {
+	HomeID         string
+	CommandTimeout time.Duration
+	Rules          []Rule // Subject bridging rules, DefaultRules when nil
+}
+
+// AutomationUpdater applies automation changes pushed from the cloud
+type AutomationUpdater interface {
+	ApplyUpdate(ctx context.Context, data []byte) error
+}
+
+// Outbox buffers messages for the cloud while it is unreachable
+type Outbox interface {
+	Publish(cloudSubject string, data []byte, collapseKey string) error
+
+	// Delivered counts the messages the cloud has received
+	Delivered() uint64
+}
+
+// Bridge relays messages between the local NATS server and the cloud
+type Bridge struct {
+	local       *nats.Conn
+	cloud       *nats.Conn
+	registry    *devices.Registry
+	automations AutomationUpdater
+	outbox      Outbox
+	config      Config
+	counters    counters
+
+	rules    atomic.Pointer[ruleSet]
+	ruleSubs map[string]*nats.Subscription // By direction and source
+	rulesMu  sync.Mutex                    // Serializes reloads and Stop
+
+	subs    []*nats.Subscription // Commands, snapshots and automation updates
+	stopped bool
+}
+
+// New creates a new cloud bridge. Without an outbox, messages are published
+// to the cloud directly and dropped while it is unreachable.
+func New(local, cloud *nats.Conn, registry *devices.Registry, automations AutomationUpdater, outbox Outbox, cfg Config) *Bridge {
+	if cfg.CommandTimeout <= 0 {
+		cfg.CommandTimeout = 5 * time.Second
+	}
+
+	return &Bridge{
+		local:       local,
+		cloud:       cloud,
+		registry:    registry,
+		automations: automations,
+		outbox:      outbox,
+		config:      cfg,
+		ruleSubs:    make(map[string]*nats.Subscription),
+	}
+}
+
+// Start sets up the subscriptions that bridge local and cloud subjects
+func (b *Bridge) Start() error {
+	homeID := b.config.HomeID
+
+	// Bridge subjects according to the configured rules
+	rules := b.config.Rules
+	if rules == nil {
+		rules = DefaultRules()
+	}
+	if err := b.SetRules(rules); err != nil {
+		return err
+	}
+
+	// Bridge commands from cloud to local devices
+	sub, err := b.cloud.Subscribe(fmt.Sprintf("cloud.homes.%s.devices.*.command", homeID), b.handleCommand)
+	if err != nil {
+		return fmt.Errorf("failed to bridge commands: %w", err)
+	}
+	b.subs = append(b.subs, sub)
+
+	// Serve device snapshots on demand
+	sub, err = b.cloud.Subscribe(fmt.Sprintf("cloud.homes.%s.devices.snapshot.request", homeID), b.handleSnapshotRequest)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to snapshot requests: %w", err)
+	}
+	b.subs = append(b.subs, sub)
+
+	// Subscribe to automation updates from cloud
+	sub, err = b.cloud.Subscribe(fmt.Sprintf("cloud.homes.%s.automations.update", homeID), b.handleAutomationUpdate)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to automation updates: %w", err)
+	}
+	b.subs = append(b.subs, sub)
+
+	log.Println("Cloud-local bridging established")
+	return nil
+}
+
+// Stop drains the bridge subscriptions, so messages already received are
+// still handed to the outbox, and waits for them to finish or ctx to end.
+// Rules can't be set afterwards.
+func (b *Bridge) Stop(ctx context.Context) error {
+	b.rulesMu.Lock()
+	b.stopped = true
+	subs := append([]*nats.Subscription(nil), b.subs...)
+	for _, sub := range b.ruleSubs {
+		subs = append(subs, sub)
+	}
+	b.rulesMu.Unlock()
+
+	for _, sub := range subs {
+		if err := sub.Drain(); err != nil && !errors.Is(err, nats.ErrConnectionClosed) {
+			return fmt.Errorf("failed to drain %s: %w", sub.Subject, err)
+		}
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for _, sub := range subs {
+		for sub.IsValid() {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+		}
+	}
+	return nil
+}
+
+// publishCloud sends a local message to the cloud, through the outbox when
+// one is configured
+func (b *Bridge) publishCloud(cloudSubject string, data []byte, collapseKey string) {
+	var err error
+	if b.outbox != nil {
+		err = b.outbox.Publish(cloudSubject, data, collapseKey)
+	} else {
+		err = b.cloud.Publish(cloudSubject, data)
+	}
+	if err != nil {
+		b.counters.toCloudErrors.Add(1)
+		log.Printf("Failed to forward %s to cloud: %v", cloudSubject, err)
+		return
+	}
+	// The outbox counts messages once the cloud has them
+	if b.outbox == nil {
+		b.counters.toCloud.Add(1)
+	}
+}
+
+// handleCommand routes a cloud command to the local device it addresses.
+// Commands sent as requests are forwarded as requests, so the cloud caller
+// receives the device's reply.
+func (b *Bridge) handleCommand(msg *nats.Msg) {
+	b.counters.fromCloud.Add(1)
+
+	// cloud.homes.<home>.devices.<device>.command
+	tokens := strings.Split(msg.Subject, ".")
+	if len(tokens) != 6 {
+		b.respondError(msg, fmt.Errorf("invalid command subject: %s", msg.Subject))
+		return
+	}
+	deviceID := tokens[4]
+
+	device, ok := b.registry.Get(deviceID)
+	if !ok || device.Type == "" {
+		b.respondError(msg, fmt.Errorf("unknown device: %s", deviceID))
+		return
+	}
+
+	localMsg := &nats.Msg{
+		Subject: devices.CommandSubject(device.Type, device.ID),
+		Header:  msg.Header,
+		Data:    msg.Data,
+	}
+
+	if msg.Reply == "" {
+		if err := b.local.PublishMsg(localMsg); err != nil {
+			b.counters.fromCloudErrors.Add(1)
+			log.Printf("Failed to forward command to %s: %v", deviceID, err)
+		}
+		return
+	}
+
+	// Requests wait for the device, so don't block the subscription
+	go func() {
+		resp, err := b.local.RequestMsg(localMsg, b.config.CommandTimeout)
+		if err != nil {
+			if errors.Is(err, nats.ErrTimeout) || errors.Is(err, nats.ErrNoResponders) {
+				err = fmt.Errorf("device %s did not respond within %s", deviceID, b.config.CommandTimeout)
+			}
+			b.respondError(msg, err)
+			return
+		}
+
+		if err := msg.RespondMsg(&nats.Msg{Header: resp.Header, Data: resp.Data}); err != nil {
+			log.Printf("Failed to relay command response from %s: %v", deviceID, err)
+		}
+	}()
+}
+
+// handleAutomationUpdate stores an automation change in the local engine
+func (b *Bridge) handleAutomationUpdate(msg *nats.Msg) {
+	b.counters.fromCloud.Add(1)
+	log.Println("Received automation update from cloud")
+
+	if b.automations == nil {
+		b.respondError(msg, errors.New("automation engine not running"))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := b.automations.ApplyUpdate(ctx, msg.Data); err != nil {
+		b.respondError(msg, err)
+		return
+	}
+
+	if msg.Reply != "" {
+		msg.Respond([]byte(`{"success": true}`))
+	}
+}
+
+// respondError logs a failed cloud request and reports it to the caller, if any
+func (b *Bridge) respondError(msg *nats.Msg, err error) {
+	b.counters.fromCloudErrors.Add(1)
+	log.Printf("Request on %s failed: %v", msg.Subject, err)
+	if msg.Reply == "" {
+		return
+	}
+
+	data, _ := json.Marshal(map[string]string{"error": err.Error()})
+	if err := msg.Respond(data); err != nil {
+		log.Printf("Failed to send error response: %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/homix-dev/homix/edge/internal/devices"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func runServer(t *testing.T) *server.Server {
+	t.Helper()
+
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("server not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+	return ns
+}
+
+func connect(t *testing.T, ns *server.Server) *nats.Conn {
+	t.Helper()
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+func TestCommandRouting(t *testing.T) {
+	local := connect(t, runServer(t))
+	cloud := connect(t, runServer(t))
+
+	registry := devices.NewRegistry()
+	registry.HandleAnnounce("home.devices.lamp-1.announce", []byte(`{"device_id":"lamp-1","type":"light"}`))
+
+	b := New(local, cloud, registry, nil, nil, Config{HomeID: "h1", CommandTimeout: 200 * time.Millisecond})
+	if err := b.Start(); err != nil {
+		t.Fatalf("failed to start bridge: %v", err)
+	}
+
+	if _, err := local.Subscribe("home.devices.light.lamp-1.command", func(msg *nats.Msg) {
+		msg.Respond([]byte(`{"success":true}`))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	local.Flush()
+
+	resp, err := cloud.Request("cloud.homes.h1.devices.lamp-1.command", []byte(`{"command":"turn_on"}`), time.Second)
+	if err != nil {
+		t.Fatalf("command request failed: %v", err)
+	}
+	if string(resp.Data) != `{"success":true}` {
+		t.Fatalf("unexpected response: %s", resp.Data)
+	}
+
+	// A known device that never answers results in a timeout error
+	registry.HandleAnnounce("home.devices.switch.sw-1.announce", []byte(`{}`))
+	resp, err = cloud.Request("cloud.homes.h1.devices.sw-1.command", []byte(`{}`), time.Second)
+	if err != nil {
+		t.Fatalf("command request failed: %v", err)
+	}
+
+	var result map[string]string
+	if err := json.Unmarshal(resp.Data, &result); err != nil || result["error"] == "" {
+		t.Fatalf("expected error response, got: %s", resp.Data)
+	}
+
+	// Unknown devices are rejected immediately
+	resp, err = cloud.Request("cloud.homes.h1.devices.nope.command", []byte(`{}`), time.Second)
+	if err != nil {
+		t.Fatalf("command request failed: %v", err)
+	}
+	if err := json.Unmarshal(resp.Data, &result); err != nil || result["error"] != "unknown device: nope" {
+		t.Fatalf("unexpected response: %s", resp.Data)
+	}
+}
+
+func TestSnapshotRequest(t *testing.T) {
+	local := connect(t, runServer(t))
+	cloud := connect(t, runServer(t))
+
+	registry := devices.NewRegistry()
+	registry.HandleAnnounce("home.devices.light.lamp-1.announce", []byte(`{"name":"Lamp"}`))
+	registry.HandleState("home.devices.light.lamp-1.state", []byte(`{"state":"on"}`))
+	registry.HandleState("home.devices.sensor-1.state", []byte(`{"device_id":"sensor-1","temperature":21.5}`))
+
+	b := New(local, cloud, registry, nil, nil, Config{HomeID: "h1"})
+	if err := b.Start(); err != nil {
+		t.Fatalf("failed to start bridge: %v", err)
+	}
+
+	resp, err := cloud.Request("cloud.homes.h1.devices.snapshot.request", nil, time.Second)
+	if err != nil {
+		t.Fatalf("snapshot request failed: %v", err)
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(resp.Data, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.HomeID != "h1" || snapshot.DeviceCount != 2 {
+		t.Fatalf("unexpected snapshot: %s", resp.Data)
+	}
+
+	lamp := snapshot.Devices[0]
+	if lamp.ID != "lamp-1" || lamp.Type != "light" || string(lamp.State) != `{"state":"on"}` {
+		t.Fatalf("unexpected device record: %+v", lamp)
+	}
+}
+
+// recordingOutbox collects what the bridge hands to the outbox
+type recordingOutbox struct {
+	mu       sync.Mutex
+	subjects []string
+}
+
+func (o *recordingOutbox) Publish(cloudSubject string, data []byte, collapseKey string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.subjects = append(o.subjects, cloudSubject)
+	return nil
+}
+
+func (o *recordingOutbox) Delivered() uint64 { return 0 }
+
+func (o *recordingOutbox) count() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.subjects)
+}
+
+func TestStopHandsReceivedMessagesToOutbox(t *testing.T) {
+	local := connect(t, runServer(t))
+	cloud := connect(t, runServer(t))
+
+	outbox := &recordingOutbox{}
+	b := New(local, cloud, devices.NewRegistry(), nil, outbox, Config{HomeID: "h1"})
+	if err := b.Start(); err != nil {
+		t.Fatalf("failed to start bridge: %v", err)
+	}
+	local.Flush()
+
+	const total = 1000
+	for i := 0; i < total; i++ {
+		local.Publish("home.devices.lamp-1.state", []byte(`{"on":true}`))
+	}
+	local.Flush()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := b.Stop(ctx); err != nil {
+		t.Fatalf("failed to stop bridge: %v", err)
+	}
+	if n := outbox.count(); n != total {
+		t.Fatalf("outbox has %d of %d messages after stop", n, total)
+	}
+
+	// Nothing is bridged after stopping, and rules can't come back
+	local.Publish("home.devices.lamp-1.state", []byte(`{"on":false}`))
+	local.Flush()
+	time.Sleep(100 * time.Millisecond)
+	if n := outbox.count(); n != total {
+		t.Fatalf("outbox has %d messages, want %d after stop", n, total)
+	}
+	if err := b.SetRules(DefaultRules()); err == nil {
+		t.Fatal("expected rules to be refused after stop")
+	}
+}
@@ -0,0 +1,518 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Rule directions
+const (
+	ToCloud = "to_cloud"
+	ToLocal = "to_local"
+)
+
+// Rule maps subjects between the local server and the cloud. The source
+// subject (local for to_cloud, cloud for to_local) may contain wildcards;
+// the target is a template where {home_id} is the home ID and {1}, {2}, ...
+// are the tokens matched by the source wildcards. A message is handled by the
+// first rule of its direction whose subject and filter match.
+type Rule struct {
+	Name      string                 `mapstructure:"name"`
+	Direction string                 `mapstructure:"direction"`
+	Local     string                 `mapstructure:"local"`
+	Cloud     string                 `mapstructure:"cloud"`
+	Filter    map[string]interface{} `mapstructure:"filter"`     // JSON fields that must match, a list matches any of its values
+	Drop      bool                   `mapstructure:"drop"`       // Block matching messages
+	RateLimit string                 `mapstructure:"rate_limit"` // Per subject limit such as 1/10s
+	Dedupe    time.Duration          `mapstructure:"dedupe"`     // Skip repeated payloads on a subject within this window
+	Collapse  bool                   `mapstructure:"collapse"`   // Buffer only the latest message per subject while offline
+}
+
+// DefaultRules bridges device announcements and states to the cloud
+func DefaultRules() []Rule {
+	return []Rule{
+		{Name: "announce", Direction: ToCloud, Local: "home.devices.*.announce", Cloud: "cloud.homes.{home_id}.devices.announce"},
+		{Name: "typed-announce", Direction: ToCloud, Local: "home.devices.*.*.announce", Cloud: "cloud.homes.{home_id}.devices.announce"},
+		{Name: "state", Direction: ToCloud, Local: "home.devices.*.state", Cloud: "cloud.homes.{home_id}.devices.state", Collapse: true},
+		{Name: "typed-state", Direction: ToCloud, Local: "home.devices.*.*.state", Cloud: "cloud.homes.{home_id}.devices.state", Collapse: true},
+	}
+}
+
+// rule is a validated rule with its runtime state
+type rule struct {
+	Rule
+	source string // Subject subscribed to
+	target string // Subject template
+
+	limit  int
+	window time.Duration
+
+	subjects map[string]*subjectState
+	mu       sync.Mutex
+}
+
+// maxSubjects is the number of subjects a rule tracks before it evicts the
+// state of those whose rate limit and dedupe windows have passed
+const maxSubjects = 1024
+
+// ruleSet is one generation of rules. Handlers look up the current set for
+// every message, so a reload takes effect between two messages.
+type ruleSet struct {
+	rules []*rule
+}
+
+// subjectState tracks rate limiting and dedupe for one subject
+type subjectState struct {
+	windowStart time.Time
+	count       int
+	lastHash    uint64
+	lastSent    time.Time
+}
+
+var placeholder = regexp.MustCompile(`\{([a-z_]+|[0-9]+)\}`)
+
+// compileRules validates rules and prepares them for the given home
+func compileRules(rules []Rule, homeID string) ([]*rule, error) {
+	var errs []error
+	compiled := make([]*rule, 0, len(rules))
+
+	for i, r := range rules {
+		name := r.Name
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+
+		c, err := compileRule(r, homeID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("bridge.rules[%s]: %w", name, err))
+			continue
+		}
+		compiled = append(compiled, c)
+	}
+
+	return compiled, errors.Join(errs...)
+}
+
+func compileRule(r Rule, homeID string) (*rule, error) {
+	c := &rule{Rule: r, subjects: make(map[string]*subjectState)}
+
+	switch r.Direction {
+	case ToCloud:
+		c.source, c.target = r.Local, r.Cloud
+	case ToLocal:
+		c.source, c.target = r.Cloud, r.Local
+	default:
+		return nil, fmt.Errorf("direction must be %q or %q", ToCloud, ToLocal)
+	}
+
+	if c.source == "" {
+		return nil, errors.New("local and cloud subjects are required")
+	}
+	c.source = strings.ReplaceAll(c.source, "{home_id}", homeID)
+	wildcards, err := checkPattern(c.source)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.target == "" && !r.Drop {
+		return nil, errors.New("local and cloud subjects are required")
+	}
+	if strings.ContainsAny(c.target, "*>") {
+		return nil, fmt.Errorf("target subject %q must not contain wildcards", c.target)
+	}
+	for _, m := range placeholder.FindAllStringSubmatch(c.target, -1) {
+		if m[1] == "home_id" {
+			continue
+		}
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			return nil, fmt.Errorf("unknown placeholder %s", m[0])
+		}
+		if n < 1 || n > wildcards {
+			return nil, fmt.Errorf("placeholder %s has no matching wildcard in %q", m[0], c.source)
+		}
+	}
+
+	if r.RateLimit != "" {
+		if c.limit, c.window, err = parseRate(r.RateLimit); err != nil {
+			return nil, err
+		}
+	}
+	if r.Dedupe < 0 {
+		return nil, errors.New("dedupe must not be negative")
+	}
+
+	return c, nil
+}
+
+// checkPattern validates a subscription subject and counts its wildcards
+func checkPattern(subject string) (int, error) {
+	tokens := strings.Split(subject, ".")
+	wildcards := 0
+	for i, token := range tokens {
+		switch {
+		case token == "":
+			return 0, fmt.Errorf("invalid subject %q", subject)
+		case token == ">" && i != len(tokens)-1:
+			return 0, fmt.Errorf("'>' must be the last token of %q", subject)
+		case token == "*" || token == ">":
+			wildcards++
+		case strings.ContainsAny(token, "*> \t{}"):
+			return 0, fmt.Errorf("invalid subject %q", subject)
+		}
+	}
+	return wildcards, nil
+}
+
+// parseRate parses limits such as 5/s, 1/10s or 60/1m
+func parseRate(rate string) (int, time.Duration, error) {
+	count, per, ok := strings.Cut(rate, "/")
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if !ok || err != nil || n < 1 {
+		return 0, 0, fmt.Errorf("invalid rate_limit %q, expected e.g. 1/10s", rate)
+	}
+
+	per = strings.TrimSpace(per)
+	if per != "" && (per[0] < '0' || per[0] > '9') {
+		per = "1" + per
+	}
+	window, err := time.ParseDuration(per)
+	if err != nil || window <= 0 {
+		return 0, 0, fmt.Errorf("invalid rate_limit %q, expected e.g. 1/10s", rate)
+	}
+	return n, window, nil
+}
+
+// match reports whether a message on subject is handled by this rule and
+// returns the tokens captured by the wildcards
+func (r *rule) match(subject string, payload func() map[string]interface{}) ([]string, bool) {
+	captures, ok := matchSubject(r.source, subject)
+	if !ok {
+		return nil, false
+	}
+	if len(r.Filter) > 0 && !matchFilter(r.Filter, payload()) {
+		return nil, false
+	}
+	return captures, true
+}
+
+// targetSubject fills in the target template
+func (r *rule) targetSubject(homeID string, captures []string) string {
+	return placeholder.ReplaceAllStringFunc(r.target, func(m string) string {
+		key := m[1 : len(m)-1]
+		if key == "home_id" {
+			return homeID
+		}
+		n, _ := strconv.Atoi(key)
+		return captures[n-1]
+	})
+}
+
+// allow applies the rate limit and dedupe settings for a subject
+func (r *rule) allow(subject string, data []byte) bool {
+	if r.limit == 0 && r.Dedupe == 0 {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	state, ok := r.subjects[subject]
+	if !ok {
+		if len(r.subjects) >= maxSubjects {
+			r.evictExpired(now)
+		}
+		state = &subjectState{}
+		r.subjects[subject] = state
+	}
+
+	var hash uint64
+	if r.Dedupe > 0 {
+		h := fnv.New64a()
+		h.Write(data)
+		hash = h.Sum64()
+		if hash == state.lastHash && now.Sub(state.lastSent) < r.Dedupe {
+			return false
+		}
+	}
+
+	if r.limit > 0 {
+		if now.Sub(state.windowStart) >= r.window {
+			state.windowStart = now
+			state.count = 0
+		}
+		if state.count >= r.limit {
+			return false
+		}
+		state.count++
+	}
+
+	state.lastHash = hash
+	state.lastSent = now
+	return true
+}
+
+// evictExpired drops the state of subjects no longer rate limited or
+// deduped. The caller holds r.mu.
+func (r *rule) evictExpired(now time.Time) {
+	for subject, state := range r.subjects {
+		if now.Sub(state.windowStart) >= r.window && now.Sub(state.lastSent) >= r.Dedupe {
+			delete(r.subjects, subject)
+		}
+	}
+}
+
+// inherit takes over the subject state of the rule it replaces on reload,
+// for the subjects it still matches
+func (r *rule) inherit(previous []*rule) {
+	for _, old := range previous {
+		if old.Name == "" || old.Name != r.Name || old.Direction != r.Direction {
+			continue
+		}
+
+		old.mu.Lock()
+		for subject, state := range old.subjects {
+			if _, ok := matchSubject(r.source, subject); ok {
+				copied := *state
+				r.subjects[subject] = &copied
+			}
+		}
+		old.mu.Unlock()
+		return
+	}
+}
+
+// matchSubject matches a subject against a pattern and returns the tokens
+// matched by each wildcard
+func matchSubject(pattern, subject string) ([]string, bool) {
+	patternTokens := strings.Split(pattern, ".")
+	tokens := strings.Split(subject, ".")
+
+	var captures []string
+	for i, p := range patternTokens {
+		if p == ">" {
+			if i >= len(tokens) {
+				return nil, false
+			}
+			return append(captures, strings.Join(tokens[i:], ".")), true
+		}
+		if i >= len(tokens) {
+			return nil, false
+		}
+		if p == "*" {
+			captures = append(captures, tokens[i])
+		} else if p != tokens[i] {
+			return nil, false
+		}
+	}
+	return captures, len(tokens) == len(patternTokens)
+}
+
+// matchFilter checks that every filter field has one of the expected values.
+// Fields use dotted paths into the JSON payload.
+func matchFilter(filter map[string]interface{}, payload map[string]interface{}) bool {
+	if payload == nil {
+		return false
+	}
+
+	for path, expected := range filter {
+		value, ok := lookup(payload, path)
+		if !ok {
+			return false
+		}
+
+		options, isList := expected.([]interface{})
+		if !isList {
+			options = []interface{}{expected}
+		}
+
+		matched := false
+		for _, option := range options {
+			if fmt.Sprint(option) == fmt.Sprint(value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func lookup(payload map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = payload
+	for _, key := range strings.Split(path, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// SetRules replaces the bridge rules. The new rules are validated first; on
+// error the current rules stay in place. Subscriptions are kept per source
+// subject, so subjects the reload keeps are forwarded exactly once, and
+// only subjects it adds or removes are subscribed or unsubscribed. Named
+// rules keep the rate limit and dedupe state of the subjects they still match.
+func (b *Bridge) SetRules(rules []Rule) error {
+	compiled, err := compileRules(rules, b.config.HomeID)
+	if err != nil {
+		return err
+	}
+
+	b.rulesMu.Lock()
+	defer b.rulesMu.Unlock()
+	if b.stopped {
+		return errors.New("bridge is stopped")
+	}
+
+	// Subscribe the sources that are new, before the new rules take over
+	wanted := make(map[string]bool)
+	var added []string
+	for _, r := range compiled {
+		key := sourceKey(r.Direction, r.source)
+		if wanted[key] {
+			continue
+		}
+		wanted[key] = true
+		if b.ruleSubs[key] != nil {
+			continue
+		}
+
+		conn := b.local
+		if r.Direction == ToLocal {
+			conn = b.cloud
+		}
+		sub, err := conn.Subscribe(r.source, b.ruleHandler(r.Direction, r.source))
+		if err != nil {
+			for _, key := range added {
+				b.ruleSubs[key].Unsubscribe()
+				delete(b.ruleSubs, key)
+			}
+			return fmt.Errorf("failed to subscribe to %s: %w", r.source, err)
+		}
+		b.ruleSubs[key] = sub
+		added = append(added, key)
+	}
+
+	if old := b.rules.Load(); old != nil {
+		for _, r := range compiled {
+			r.inherit(old.rules)
+		}
+	}
+	b.rules.Store(&ruleSet{rules: compiled})
+
+	// Sources no rule uses any more; what they still hold is left to the
+	// current rules, which don't handle it
+	for key, sub := range b.ruleSubs {
+		if !wanted[key] {
+			sub.Unsubscribe()
+			delete(b.ruleSubs, key)
+		}
+	}
+
+	log.Printf("Bridge rules applied: %d rules", len(compiled))
+	return nil
+}
+
+func sourceKey(direction, source string) string {
+	return direction + " " + source
+}
+
+// ruleHandler forwards messages received on a source subject. Sources that
+// overlap each receive the message; it is handled on the source of the first
+// matching rule of the current set.
+func (b *Bridge) ruleHandler(direction, source string) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		set := b.rules.Load()
+		if set == nil {
+			return
+		}
+
+		var payload map[string]interface{}
+		parsed := false
+		decode := func() map[string]interface{} {
+			if !parsed {
+				parsed = true
+				json.Unmarshal(msg.Data, &payload)
+			}
+			return payload
+		}
+
+		var first *rule
+		var captures []string
+		for _, candidate := range set.rules {
+			if candidate.Direction != direction {
+				continue
+			}
+			if c, ok := candidate.match(msg.Subject, decode); ok {
+				first, captures = candidate, c
+				break
+			}
+		}
+
+		if first == nil || first.source != source {
+			return
+		}
+		r := first
+
+		if r.Drop || !r.allow(msg.Subject, msg.Data) {
+			b.counters.filtered.Add(1)
+			return
+		}
+
+		target := r.targetSubject(b.config.HomeID, captures)
+		if r.Direction == ToCloud {
+			collapseKey := ""
+			if r.Collapse {
+				collapseKey = msg.Subject
+			}
+			b.publishCloud(target, msg.Data, collapseKey)
+			return
+		}
+
+		b.forwardLocal(msg, target)
+	}
+}
+
+// forwardLocal delivers a cloud message on a local subject. Requests are
+// forwarded as requests so the cloud caller receives the reply.
+func (b *Bridge) forwardLocal(msg *nats.Msg, subject string) {
+	b.counters.fromCloud.Add(1)
+	localMsg := &nats.Msg{Subject: subject, Header: msg.Header, Data: msg.Data}
+
+	if msg.Reply == "" {
+		if err := b.local.PublishMsg(localMsg); err != nil {
+			b.counters.fromCloudErrors.Add(1)
+			log.Printf("Failed to forward %s to local: %v", subject, err)
+		}
+		return
+	}
+
+	go func() {
+		resp, err := b.local.RequestMsg(localMsg, b.config.CommandTimeout)
+		if err != nil {
+			b.respondError(msg, fmt.Errorf("no response on %s: %w", subject, err))
+			return
+		}
+		if err := msg.RespondMsg(&nats.Msg{Header: resp.Header, Data: resp.Data}); err != nil {
+			log.Printf("Failed to relay response from %s: %v", subject, err)
+		}
+	}()
+}
@@ -0,0 +1,230 @@
+package bridge
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/homix-dev/homix/edge/internal/devices"
+)
+
+func TestBridgeRules(t *testing.T) {
+	local := connect(t, runServer(t))
+	cloud := connect(t, runServer(t))
+
+	b := New(local, cloud, devices.NewRegistry(), nil, nil, Config{
+		HomeID: "h1",
+		Rules: []Rule{
+			{Direction: ToCloud, Local: "home.events.sensor.chatty", Drop: true},
+			{Direction: ToCloud, Local: "home.events.camera.*", Cloud: "cloud.homes.{home_id}.motion.{1}",
+				Filter: map[string]interface{}{"event_type": []interface{}{"motion"}}, RateLimit: "1/1m"},
+			{Direction: ToCloud, Local: "home.events.>", Cloud: "cloud.homes.{home_id}.events.{1}", Dedupe: time.Minute},
+		},
+	})
+	if err := b.Start(); err != nil {
+		t.Fatalf("failed to start bridge: %v", err)
+	}
+
+	received, err := cloud.SubscribeSync("cloud.homes.h1.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloud.Flush()
+
+	for _, m := range []struct{ subject, data string }{
+		{"home.events.sensor.chatty", `{"value": 1}`},                      // dropped
+		{"home.events.camera.front", `{"event_type": "motion", "seq": 1}`}, // motion rule
+		{"home.events.camera.front", `{"event_type": "motion", "seq": 2}`}, // rate limited
+		{"home.events.camera.back", `{"event_type": "motion"}`},            // limits are per subject
+		{"home.events.camera.front", `{"event_type": "tamper"}`},           // filtered, falls through to events
+		{"home.events.door.opened", `{"door": "front"}`},                   // events rule
+		{"home.events.door.opened", `{"door": "front"}`},                   // deduped
+	} {
+		local.Publish(m.subject, []byte(m.data))
+	}
+	local.Flush()
+
+	// Each source subject has its own subscription, so only the order per
+	// source is kept
+	want := map[string]string{
+		"cloud.homes.h1.motion.front":        `{"event_type": "motion", "seq": 1}`,
+		"cloud.homes.h1.motion.back":         `{"event_type": "motion"}`,
+		"cloud.homes.h1.events.camera.front": `{"event_type": "tamper"}`,
+		"cloud.homes.h1.events.door.opened":  `{"door": "front"}`,
+	}
+	for n := len(want); n > 0; n-- {
+		msg, err := received.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("expected %d messages: %v", len(want), err)
+		}
+		if data, ok := want[msg.Subject]; !ok || data != string(msg.Data) {
+			t.Fatalf("unexpected message %s %s", msg.Subject, msg.Data)
+		}
+		delete(want, msg.Subject)
+	}
+	if msg, err := received.NextMsg(200 * time.Millisecond); err == nil {
+		t.Fatalf("unexpected message %s %s", msg.Subject, msg.Data)
+	}
+	if stats := b.Stats(); stats.Filtered != 3 {
+		t.Fatalf("expected 3 filtered messages, got %+v", stats)
+	}
+
+	// Invalid rules are rejected and the current rules stay in place
+	if err := b.SetRules([]Rule{{Direction: ToCloud, Local: "home.>", Cloud: "cloud.{2}"}}); err == nil {
+		t.Fatal("expected invalid rules to be rejected")
+	}
+
+	// Reloading replaces the rules, including cloud to local ones
+	if err := b.SetRules([]Rule{
+		{Direction: ToLocal, Cloud: "cloud.homes.{home_id}.notify.*", Local: "home.notify.{1}"},
+	}); err != nil {
+		t.Fatalf("failed to reload rules: %v", err)
+	}
+
+	notified, err := local.SubscribeSync("home.notify.kitchen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.Flush()
+	events, err := cloud.SubscribeSync("cloud.homes.h1.events.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloud.Flush()
+
+	local.Publish("home.events.door.closed", []byte(`{}`))
+	cloud.Publish("cloud.homes.h1.notify.kitchen", []byte(`{"text": "hi"}`))
+	local.Flush()
+	cloud.Flush()
+
+	if _, err := notified.NextMsg(time.Second); err != nil {
+		t.Fatalf("notification not forwarded: %v", err)
+	}
+	if msg, err := events.NextMsg(200 * time.Millisecond); err == nil {
+		t.Fatalf("old rule still active: %s", msg.Subject)
+	}
+}
+
+func TestMatchSubject(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, subject string
+		captures         []string
+		ok               bool
+	}{
+		{"home.devices.*.state", "home.devices.lamp.state", []string{"lamp"}, true},
+		{"home.devices.*.state", "home.devices.light.lamp.state", nil, false},
+		{"home.events.>", "home.events.door.opened", []string{"door.opened"}, true},
+		{"home.events.>", "home.events", nil, false},
+		{"home.*.>", "home.health.edge.cpu", []string{"health", "edge.cpu"}, true},
+	} {
+		captures, ok := matchSubject(tc.pattern, tc.subject)
+		if ok != tc.ok || (ok && !slices.Equal(captures, tc.captures)) {
+			t.Errorf("matchSubject(%q, %q) = %v, %v", tc.pattern, tc.subject, captures, ok)
+		}
+	}
+}
+
+func TestReloadForwardsExactlyOnce(t *testing.T) {
+	local := connect(t, runServer(t))
+	cloud := connect(t, runServer(t))
+
+	// Reloads alternate between rule sets that change everything but the
+	// source subject
+	sets := [][]Rule{
+		{{Name: "events", Direction: ToCloud, Local: "home.events.>", Cloud: "cloud.homes.{home_id}.events.{1}"}},
+		{
+			{Name: "chatty", Direction: ToCloud, Local: "home.chatty.>", Drop: true},
+			{Name: "all-events", Direction: ToCloud, Local: "home.events.>", Cloud: "cloud.homes.{home_id}.events.{1}", Collapse: true},
+		},
+	}
+	b := New(local, cloud, devices.NewRegistry(), nil, nil, Config{HomeID: "h1", Rules: sets[0]})
+	if err := b.Start(); err != nil {
+		t.Fatalf("failed to start bridge: %v", err)
+	}
+
+	received, err := cloud.SubscribeSync("cloud.homes.h1.events.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received.SetPendingLimits(-1, -1)
+	cloud.Flush()
+
+	const total = 2000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < total; i++ {
+			local.Publish(fmt.Sprintf("home.events.seq.%d", i), []byte(`{}`))
+			if i%100 == 0 {
+				local.Flush()
+			}
+		}
+		local.Flush()
+	}()
+	reloads := 0
+	for running := true; running; reloads++ {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		if err := b.SetRules(sets[reloads%2]); err != nil {
+			t.Fatalf("failed to reload rules: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	seen := make(map[int]int)
+	for len(seen) < total {
+		msg, err := received.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("received %d of %d messages over %d reloads: %v", len(seen), total, reloads, err)
+		}
+		seq, _ := strconv.Atoi(msg.Subject[len("cloud.homes.h1.events.seq."):])
+		if seen[seq]++; seen[seq] > 1 {
+			t.Fatalf("message %d forwarded twice", seq)
+		}
+	}
+	if msg, err := received.NextMsg(200 * time.Millisecond); err == nil {
+		t.Fatalf("message forwarded twice: %s", msg.Subject)
+	}
+}
+
+func TestRuleSubjectState(t *testing.T) {
+	old, err := compileRule(Rule{Name: "camera", Direction: ToCloud, Local: "home.events.camera.*", Cloud: "cloud.{1}", RateLimit: "1/1m"}, "h1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.allow("home.events.camera.front", nil)
+	old.allow("home.events.camera.back", nil)
+
+	// A reloaded rule keeps the state of the subjects it still matches
+	narrowed, err := compileRule(Rule{Name: "camera", Direction: ToCloud, Local: "home.events.camera.front", Cloud: "cloud.front", RateLimit: "1/1m"}, "h1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	narrowed.inherit([]*rule{old})
+	if len(narrowed.subjects) != 1 || narrowed.subjects["home.events.camera.front"] == nil {
+		t.Fatalf("expected only the front camera state, got %v", narrowed.subjects)
+	}
+	if narrowed.allow("home.events.camera.front", nil) {
+		t.Fatal("rate limit reset by the reload")
+	}
+
+	// Expired subjects are evicted once a rule tracks too many
+	r, err := compileRule(Rule{Direction: ToCloud, Local: "home.events.>", Cloud: "cloud.{1}", Dedupe: time.Minute}, "h1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxSubjects; i++ {
+		subject := fmt.Sprintf("home.events.%d", i)
+		r.allow(subject, nil)
+		r.subjects[subject].lastSent = time.Now().Add(-time.Hour)
+	}
+	r.allow("home.events.new", nil)
+	if len(r.subjects) != 1 {
+		t.Fatalf("expected expired subjects to be evicted, %d tracked", len(r.subjects))
+	}
+}
@@ -0,0 +1,70 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/homix-dev/homix/edge/internal/devices"
+	"github.com/nats-io/nats.go"
+)
+
+// Snapshot is the full set of device records known to the edge, used by the
+// cloud to resync after a gap
+type Snapshot struct {
+	HomeID      string           `json:"home_id"`
+	Timestamp   time.Time        `json:"timestamp"`
+	DeviceCount int              `json:"device_count"`
+	Devices     []devices.Device `json:"devices"`
+}
+
+// snapshot builds a snapshot of every known device
+func (b *Bridge) snapshot() ([]byte, error) {
+	list := b.registry.List()
+
+	data, err := json.Marshal(Snapshot{
+		HomeID:      b.config.HomeID,
+		Timestamp:   time.Now().UTC(),
+		DeviceCount: len(list),
+		Devices:     list,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal device snapshot: %w", err)
+	}
+	return data, nil
+}
+
+// PublishSnapshot sends a snapshot of every known device to the cloud. When
+// an outbox is configured the snapshot is queued behind any buffered
+// messages, so it is never overtaken by older states.
+func (b *Bridge) PublishSnapshot() {
+	data, err := b.snapshot()
+	if err != nil {
+		log.Printf("Failed to build device snapshot: %v", err)
+		return
+	}
+
+	b.publishCloud(fmt.Sprintf("cloud.homes.%s.devices.snapshot", b.config.HomeID), data, "")
+	log.Printf("Published device snapshot (%d devices)", b.registry.Count())
+}
+
+// handleSnapshotRequest replies with a snapshot of every known device
+func (b *Bridge) handleSnapshotRequest(msg *nats.Msg) {
+	b.counters.fromCloud.Add(1)
+
+	data, err := b.snapshot()
+	if err != nil {
+		b.respondError(msg, err)
+		return
+	}
+
+	if msg.Reply == "" {
+		b.PublishSnapshot()
+		return
+	}
+
+	if err := msg.Respond(data); err != nil {
+		log.Printf("Failed to send device snapshot: %v", err)
+	}
+}
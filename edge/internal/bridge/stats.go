@@ -0,0 +1,35 @@
+package bridge
+
+import "sync/atomic"
+
+// Stats counts the messages the bridge relayed in each direction
+type Stats struct {
+	ToCloud         uint64 `json:"to_cloud"` // Delivered, not only buffered
+	ToCloudErrors   uint64 `json:"to_cloud_errors"`
+	FromCloud       uint64 `json:"from_cloud"`
+	FromCloudErrors uint64 `json:"from_cloud_errors"`
+	Filtered        uint64 `json:"filtered"` // Dropped by bridge rules
+}
+
+type counters struct {
+	toCloud         atomic.Uint64
+	toCloudErrors   atomic.Uint64
+	fromCloud       atomic.Uint64
+	fromCloudErrors atomic.Uint64
+	filtered        atomic.Uint64
+}
+
+// Stats returns the bridge message counters
+func (b *Bridge) Stats() Stats {
+	toCloud := b.counters.toCloud.Load()
+	if b.outbox != nil {
+		toCloud = b.outbox.Delivered()
+	}
+	return Stats{
+		ToCloud:         toCloud,
+		ToCloudErrors:   b.counters.toCloudErrors.Load(),
+		FromCloud:       b.counters.fromCloud.Load(),
+		FromCloudErrors: b.counters.fromCloudErrors.Load(),
+		Filtered:        b.counters.filtered.Load(),
+	}
+}
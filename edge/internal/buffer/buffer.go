@@ -0,0 +1,260 @@
+package buffer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	subjectPrefix = "edge.outbox"
+
+	// cloudSubjectHeader carries the cloud subject a buffered message is
+	// forwarded to
+	cloudSubjectHeader = "Edge-Cloud-Subject"
+)
+
+// Config contains the outbound buffer configuration
+type Config struct {
+	Stream        string        // JetStream stream holding buffered messages
+	MaxBytes      int64         // Oldest messages are dropped beyond this size
+	MaxAge        time.Duration // Messages older than this are dropped
+	CollapseState bool          // Keep only the latest message per collapse key
+
+	// Connected reports whether the cloud is reachable. Defaults to the cloud
+	// connection's state.
+	Connected func() bool
+}
+
+// Buffer is a JetStream-backed store-and-forward queue for messages bound
+// for the cloud. Messages are stored on the local server and forwarded in
+// order while the cloud connection is up.
+type Buffer struct {
+	local    *nats.Conn
+	cloud    *nats.Conn
+	js       jetstream.JetStream
+	stream   jetstream.Stream
+	consumer jetstream.Consumer
+	config   Config
+
+	resume    chan struct{}
+	delivered atomic.Uint64
+}
+
+// New creates a new outbound buffer
+func New(local, cloud *nats.Conn, cfg Config) *Buffer {
+	if cfg.Stream == "" {
+		cfg.Stream = "EDGE_OUTBOX"
+	}
+	if cfg.Connected == nil {
+		cfg.Connected = cloud.IsConnected
+	}
+
+	return &Buffer{
+		local:  local,
+		cloud:  cloud,
+		config: cfg,
+		resume: make(chan struct{}, 1),
+	}
+}
+
+// Start creates the buffer stream and begins forwarding to the cloud
+func (b *Buffer) Start(ctx context.Context) error {
+	js, err := jetstream.New(b.local)
+	if err != nil {
+		return fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+	b.js = js
+
+	stream, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:        b.config.Stream,
+		Description: "Messages waiting to be forwarded to the cloud",
+		Subjects:    []string{subjectPrefix + ".>"},
+		Retention:   jetstream.WorkQueuePolicy,
+		Discard:     jetstream.DiscardOld,
+		MaxBytes:    b.config.MaxBytes,
+		MaxAge:      b.config.MaxAge,
+		Storage:     jetstream.FileStorage,
+		AllowRollup: b.config.CollapseState,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create buffer stream: %w", err)
+	}
+	b.stream = stream
+
+	consumer, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Durable:       "cloud-forwarder",
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		DeliverPolicy: jetstream.DeliverAllPolicy,
+		AckWait:       30 * time.Second,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create buffer consumer: %w", err)
+	}
+	b.consumer = consumer
+
+	go b.forward(ctx)
+
+	if depth := b.Depth(); depth > 0 {
+		log.Printf("Outbound buffer has %d messages waiting for the cloud", depth)
+	}
+	return nil
+}
+
+// Publish queues a message for the cloud subject. Messages with the same
+// non-empty collapse key replace each other while waiting, when state
+// collapsing is enabled.
+func (b *Buffer) Publish(cloudSubject string, data []byte, collapseKey string) error {
+	msg := nats.NewMsg(subjectPrefix + ".msg")
+	msg.Header.Set(cloudSubjectHeader, cloudSubject)
+	msg.Data = data
+
+	if b.config.CollapseState && collapseKey != "" {
+		msg.Subject = fmt.Sprintf("%s.latest.%s", subjectPrefix, collapseKey)
+		msg.Header.Set(jetstream.MsgRollup, jetstream.MsgRollupSubject)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := b.js.PublishMsg(ctx, msg); err != nil {
+		return fmt.Errorf("failed to buffer message for %s: %w", cloudSubject, err)
+	}
+	return nil
+}
+
+// Resume wakes the forwarder after the cloud connection is restored
+func (b *Buffer) Resume() {
+	select {
+	case b.resume <- struct{}{}:
+	default:
+	}
+}
+
+// Flush waits until every buffered message has been forwarded. Messages still
+// waiting when ctx ends or the cloud is unreachable stay in the stream and are
+// forwarded after the next start.
+func (b *Buffer) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		depth := b.Depth()
+		if depth == 0 {
+			return nil
+		}
+		if !b.config.Connected() {
+			return fmt.Errorf("cloud unreachable, %d messages kept for the next start", depth)
+		}
+		b.Resume()
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d messages kept for the next start: %w", b.Depth(), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// Delivered returns the number of messages the cloud server has received
+func (b *Buffer) Delivered() uint64 {
+	return b.delivered.Load()
+}
+
+// Depth returns the number of messages waiting to be forwarded
+func (b *Buffer) Depth() uint64 {
+	if b.stream == nil {
+		return 0
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	info, err := b.stream.Info(ctx)
+	if err != nil {
+		return 0
+	}
+	return info.State.Msgs
+}
+
+// forward drains the stream into the cloud connection, pausing while the
+// cloud is unreachable
+func (b *Buffer) forward(ctx context.Context) {
+	for ctx.Err() == nil {
+		if !b.config.Connected() {
+			b.waitForResume(ctx)
+			continue
+		}
+
+		batch, err := b.consumer.Fetch(100, jetstream.FetchMaxWait(time.Second))
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, nats.ErrConnectionClosed) {
+				log.Printf("Failed to fetch buffered messages: %v", err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+
+		if err := b.send(batch); err != nil {
+			log.Printf("Cloud unavailable, buffering: %v", err)
+			b.waitForResume(ctx)
+		}
+	}
+}
+
+// send forwards a batch and acknowledges it once the cloud has it. On failure
+// the unsent messages are returned to the stream in order.
+func (b *Buffer) send(batch jetstream.MessageBatch) error {
+	msgs := make([]jetstream.Msg, 0)
+	for msg := range batch.Messages() {
+		msgs = append(msgs, msg)
+	}
+
+	sent := 0
+	var sendErr error
+	for _, msg := range msgs {
+		out := nats.NewMsg(msg.Headers().Get(cloudSubjectHeader))
+		for k, v := range msg.Headers() {
+			if k != cloudSubjectHeader && k != jetstream.MsgRollup {
+				out.Header[k] = v
+			}
+		}
+		out.Data = msg.Data()
+
+		if sendErr = b.cloud.PublishMsg(out); sendErr != nil {
+			break
+		}
+		sent++
+	}
+
+	// Only acknowledge what the cloud server has received
+	if sent > 0 {
+		if err := b.cloud.FlushTimeout(5 * time.Second); err != nil {
+			sent, sendErr = 0, err
+		}
+	}
+
+	b.delivered.Add(uint64(sent))
+	for i, msg := range msgs {
+		if i < sent {
+			msg.Ack()
+		} else {
+			msg.Nak()
+		}
+	}
+	return sendErr
+}
+
+func (b *Buffer) waitForResume(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-b.resume:
+	case <-time.After(5 * time.Second):
+	}
+}
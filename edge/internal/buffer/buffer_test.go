@@ -0,0 +1,118 @@
+package buffer
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func runServer(t *testing.T, opts *server.Options) *server.Server {
+	t.Helper()
+
+	opts.Host = "127.0.0.1"
+	opts.NoLog, opts.NoSigs = true, true
+
+	ns, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("server not ready")
+	}
+	return ns
+}
+
+func TestBufferReplaysInOrderAfterReconnect(t *testing.T) {
+	localServer := runServer(t, &server.Options{Port: -1, JetStream: true, StoreDir: t.TempDir()})
+	defer localServer.Shutdown()
+
+	cloudServer := runServer(t, &server.Options{Port: -1})
+	cloudPort := cloudServer.Addr().(*net.TCPAddr).Port
+
+	local, err := nats.Connect(localServer.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	cloud, err := nats.Connect(cloudServer.ClientURL(),
+		nats.ReconnectBufSize(-1),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(50*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cloud.Close()
+
+	received, err := cloud.SubscribeSync("cloud.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	buf := New(local, cloud, Config{CollapseState: true})
+	cloud.SetReconnectHandler(func(*nats.Conn) { buf.Resume() })
+	if err := buf.Start(ctx); err != nil {
+		t.Fatalf("failed to start buffer: %v", err)
+	}
+
+	// Take the cloud down and queue up traffic
+	cloudServer.Shutdown()
+	for cloud.IsConnected() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Let the pull request that was open during the disconnect expire, so
+	// every message below is buffered rather than already in flight
+	time.Sleep(1200 * time.Millisecond)
+
+	buf.Publish("cloud.announce", []byte("a1"), "")
+	buf.Publish("cloud.state", []byte("s1"), "lamp")
+	buf.Publish("cloud.state", []byte("s2"), "lamp")
+	buf.Publish("cloud.state", []byte("t1"), "sensor")
+	buf.Publish("cloud.announce", []byte("a2"), "")
+
+	if depth := buf.Depth(); depth != 4 {
+		t.Fatalf("expected 4 buffered messages, got %d", depth)
+	}
+	if delivered := buf.Delivered(); delivered != 0 {
+		t.Fatalf("expected nothing delivered while the cloud is down, got %d", delivered)
+	}
+
+	cloudServer = runServer(t, &server.Options{Port: cloudPort})
+	defer cloudServer.Shutdown()
+
+	want := []string{"a1", "s2", "t1", "a2"}
+	for _, expected := range want {
+		msg, err := received.NextMsg(5 * time.Second)
+		if err != nil {
+			t.Fatalf("expected %q: %v", expected, err)
+		}
+		if string(msg.Data) != expected {
+			t.Fatalf("expected %q, got %q", expected, msg.Data)
+		}
+		if msg.Header.Get(cloudSubjectHeader) != "" {
+			t.Fatal("internal header leaked to the cloud")
+		}
+	}
+	// Flush returns once the buffer is empty
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer flushCancel()
+	if err := buf.Flush(flushCtx); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if depth := buf.Depth(); depth != 0 {
+		t.Fatalf("expected an empty buffer after flush, got %d", depth)
+	}
+	if delivered := buf.Delivered(); delivered != 4 {
+		t.Fatalf("expected 4 delivered messages, got %d", delivered)
+	}
+}
@@ -0,0 +1,204 @@
+package devices
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Device is the edge's view of a local device, built from its announce and
+// state messages
+type Device struct {
+	ID       string          `json:"device_id"`
+	Type     string          `json:"type"`
+	Announce json.RawMessage `json:"announce,omitempty"`
+	State    json.RawMessage `json:"state,omitempty"`
+	LastSeen time.Time       `json:"last_seen"`
+}
+
+// Registry tracks the devices seen on the local NATS server
+type Registry struct {
+	devices map[string]*Device
+	mu      sync.RWMutex
+}
+
+// NewRegistry creates an empty device registry
+func NewRegistry() *Registry {
+	return &Registry{
+		devices: make(map[string]*Device),
+	}
+}
+
+// Subscribe starts tracking device announcements and states on the local
+// connection. Both the short (home.devices.<id>.announce) and the typed
+// (home.devices.<type>.<id>.announce) subject layouts are accepted.
+func (r *Registry) Subscribe(nc *nats.Conn) error {
+	handlers := map[string]func(subject string, data []byte){
+		"announce": r.HandleAnnounce,
+		"state":    r.HandleState,
+	}
+
+	for suffix, handle := range handlers {
+		for _, subject := range []string{"home.devices.*." + suffix, "home.devices.*.*." + suffix} {
+			if _, err := nc.Subscribe(subject, func(msg *nats.Msg) {
+				handle(msg.Subject, msg.Data)
+			}); err != nil {
+				return fmt.Errorf("failed to subscribe to %s: %w", subject, err)
+			}
+		}
+	}
+	return nil
+}
+
+// HandleAnnounce records a device announcement. An ID or type in the payload
+// overrides the subject's, unless it isn't a valid subject token.
+func (r *Registry) HandleAnnounce(subject string, data []byte) {
+	deviceID, deviceType := parseSubject(subject, "announce")
+
+	var info struct {
+		ID         string `json:"id"`
+		DeviceID   string `json:"device_id"`
+		Type       string `json:"type"`
+		DeviceType string `json:"device_type"`
+	}
+	if err := json.Unmarshal(data, &info); err == nil {
+		if info.DeviceID != "" {
+			deviceID = tokenOr(info.DeviceID, deviceID)
+		} else if info.ID != "" {
+			deviceID = tokenOr(info.ID, deviceID)
+		}
+		if info.DeviceType != "" {
+			deviceType = tokenOr(info.DeviceType, deviceType)
+		} else if info.Type != "" {
+			deviceType = tokenOr(info.Type, deviceType)
+		}
+	}
+
+	if deviceID == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	device := r.device(deviceID)
+	if deviceType != "" {
+		device.Type = deviceType
+	}
+	device.Announce = append(json.RawMessage(nil), data...)
+	device.LastSeen = time.Now()
+}
+
+// HandleState records the last state a device reported
+func (r *Registry) HandleState(subject string, data []byte) {
+	deviceID, deviceType := parseSubject(subject, "state")
+
+	var info struct {
+		DeviceID string `json:"device_id"`
+	}
+	if err := json.Unmarshal(data, &info); err == nil && info.DeviceID != "" {
+		deviceID = tokenOr(info.DeviceID, deviceID)
+	}
+
+	if deviceID == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	device := r.device(deviceID)
+	if device.Type == "" {
+		device.Type = deviceType
+	}
+	device.State = append(json.RawMessage(nil), data...)
+	device.LastSeen = time.Now()
+}
+
+// device returns the entry for a device, creating it if needed. The caller
+// must hold the write lock.
+func (r *Registry) device(deviceID string) *Device {
+	device, exists := r.devices[deviceID]
+	if !exists {
+		device = &Device{ID: deviceID}
+		r.devices[deviceID] = device
+	}
+	return device
+}
+
+// Get returns a copy of the device with the given ID
+func (r *Registry) Get(deviceID string) (Device, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	device, exists := r.devices[deviceID]
+	if !exists {
+		return Device{}, false
+	}
+	return *device, true
+}
+
+// List returns a copy of every known device, ordered by ID
+func (r *Registry) List() []Device {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	list := make([]Device, 0, len(r.devices))
+	for _, device := range r.devices {
+		list = append(list, *device)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Count returns the number of known devices
+func (r *Registry) Count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.devices)
+}
+
+// CommandSubject returns the local subject a device receives commands on
+func CommandSubject(deviceType, deviceID string) string {
+	return fmt.Sprintf("home.devices.%s.%s.command", deviceType, deviceID)
+}
+
+// validToken reports whether a device ID or type can be used as a single
+// subject token, without wildcards or separators
+func validToken(value string) bool {
+	return value != "" && !strings.ContainsAny(value, ".*> \t\r\n")
+}
+
+// tokenOr returns value if it is a valid subject token, otherwise fallback,
+// which comes from a subject and so always is
+func tokenOr(value, fallback string) string {
+	if validToken(value) {
+		return value
+	}
+	return fallback
+}
+
+// parseSubject extracts the device ID and, for typed subjects, the device
+// type from a home.devices subject ending in the given suffix.
+func parseSubject(subject, suffix string) (deviceID, deviceType string) {
+	tokens := strings.Split(subject, ".")
+	if len(tokens) < 4 || tokens[0] != "home" || tokens[1] != "devices" || tokens[len(tokens)-1] != suffix {
+		return "", ""
+	}
+
+	switch len(tokens) {
+	case 4:
+		return tokens[2], ""
+	case 5:
+		return tokens[3], tokens[2]
+	default:
+		return "", ""
+	}
+}
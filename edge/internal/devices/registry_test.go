@@ -0,0 +1,66 @@
+package devices
+
+import "testing"
+
+func TestAnnounceKeepsSubjectForInvalidTokens(t *testing.T) {
+	tests := []struct {
+		name     string
+		subject  string
+		payload  string
+		wantID   string
+		wantType string
+	}{
+		{"payload overrides", "home.devices.lamp-1.announce", `{"device_id":"lamp-2","type":"light"}`, "lamp-2", "light"},
+		{"wildcard ID", "home.devices.lamp-1.announce", `{"device_id":"x.>","type":"light"}`, "lamp-1", "light"},
+		{"ID with space", "home.devices.light.lamp-1.announce", `{"id":"lamp 1"}`, "lamp-1", "light"},
+		{"wildcard type", "home.devices.light.lamp-1.announce", `{"type":"*"}`, "lamp-1", "light"},
+		{"dotted type", "home.devices.light.lamp-1.announce", `{"device_type":"light.switch"}`, "lamp-1", "light"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegistry()
+			r.HandleAnnounce(tt.subject, []byte(tt.payload))
+
+			if r.Count() != 1 {
+				t.Fatalf("want 1 device, got %d", r.Count())
+			}
+			device, ok := r.Get(tt.wantID)
+			if !ok {
+				t.Fatalf("device %s not registered, have %v", tt.wantID, r.List())
+			}
+			if device.Type != tt.wantType {
+				t.Errorf("type = %q, want %q", device.Type, tt.wantType)
+			}
+			if got := CommandSubject(device.Type, device.ID); got != "home.devices."+tt.wantType+"."+tt.wantID+".command" {
+				t.Errorf("command subject = %q", got)
+			}
+		})
+	}
+}
+
+func TestStateKeepsSubjectForInvalidTokens(t *testing.T) {
+	r := NewRegistry()
+	r.HandleState("home.devices.sensor-1.state", []byte(`{"device_id":"sensor >","temperature":21}`))
+
+	if _, ok := r.Get("sensor-1"); !ok || r.Count() != 1 {
+		t.Fatalf("want only sensor-1, have %v", r.List())
+	}
+}
+
+func TestValidToken(t *testing.T) {
+	for value, want := range map[string]bool{
+		"lamp-1":   true,
+		"":         false,
+		"a.b":      false,
+		"*":        false,
+		">":        false,
+		"a b":      false,
+		"a\tb":     false,
+		"lamp_1\n": false,
+	} {
+		if got := validToken(value); got != want {
+			t.Errorf("validToken(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
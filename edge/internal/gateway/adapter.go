@@ -0,0 +1,60 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Adapter connects devices speaking one protocol to the local NATS server.
+// Adapters publish through their Host, so every protocol ends up on the
+// standard home.devices.<type>.<id>.* subjects.
+type Adapter interface {
+	// Start connects to the protocol and begins publishing devices. Errors
+	// after Start returns are reported with Host.Fail.
+	Start(ctx context.Context, host Host) error
+
+	// Stop disconnects from the protocol
+	Stop() error
+
+	// Discover asks the protocol to announce its devices again
+	Discover(ctx context.Context) error
+
+	// HandleCommand delivers a command addressed to one of the adapter's
+	// devices
+	HandleCommand(ctx context.Context, cmd Command) error
+}
+
+// Factory creates an adapter from its edge.yaml settings
+type Factory func(name string, settings map[string]interface{}) (Adapter, error)
+
+// Host is the gateway side of an adapter
+type Host interface {
+	// Announce publishes a device on home.devices.<type>.<id>.announce and
+	// routes its commands to the adapter
+	Announce(device Device) error
+
+	// PublishState publishes a device state on home.devices.<type>.<id>.state
+	PublishState(deviceType, deviceID string, state map[string]interface{}) error
+
+	// Fail reports that the adapter stopped working; the gateway restarts it
+	Fail(err error)
+}
+
+// Device describes a device an adapter announces
+type Device struct {
+	ID           string                 `json:"device_id"`
+	Type         string                 `json:"device_type"`
+	Name         string                 `json:"name,omitempty"`
+	Manufacturer string                 `json:"manufacturer,omitempty"`
+	Model        string                 `json:"model,omitempty"`
+	Features     []string               `json:"features,omitempty"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	Adapter      string                 `json:"adapter"`
+}
+
+// Command is a command for a device, received on its command subject
+type Command struct {
+	DeviceID   string          `json:"device_id"`
+	DeviceType string          `json:"device_type"`
+	Data       json.RawMessage `json:"data"`
+}
@@ -0,0 +1,336 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Config contains the device gateway configuration
+type Config struct {
+	Adapters        []AdapterConfig
+	RestartDelay    time.Duration // Delay before the first restart of a failed adapter
+	MaxRestartDelay time.Duration // Restart delays double up to this limit
+	CommandTimeout  time.Duration // How long an adapter may take to handle a command
+}
+
+// AdapterConfig enables an adapter in edge.yaml
+type AdapterConfig struct {
+	Name     string                 `mapstructure:"name"`
+	Type     string                 `mapstructure:"type"`
+	Enabled  bool                   `mapstructure:"enabled"`
+	Settings map[string]interface{} `mapstructure:"config"`
+}
+
+// AdapterStatus reports the state of a configured adapter
+type AdapterStatus struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Running   bool   `json:"running"`
+	Restarts  int    `json:"restarts"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Gateway runs protocol adapters in-process and supervises them
+type Gateway struct {
+	nc     *nats.Conn
+	config Config
+
+	factories map[string]Factory
+	adapters  map[string]*supervisor
+	owners    map[string]string // Device ID to adapter name
+	mu        sync.RWMutex
+
+	wg sync.WaitGroup
+}
+
+// New creates a new device gateway publishing on the local connection
+func New(nc *nats.Conn, cfg Config) *Gateway {
+	if cfg.RestartDelay <= 0 {
+		cfg.RestartDelay = time.Second
+	}
+	if cfg.MaxRestartDelay < cfg.RestartDelay {
+		cfg.MaxRestartDelay = time.Minute
+	}
+	if cfg.CommandTimeout <= 0 {
+		cfg.CommandTimeout = 10 * time.Second
+	}
+
+	return &Gateway{
+		nc:        nc,
+		config:    cfg,
+		factories: make(map[string]Factory),
+		adapters:  make(map[string]*supervisor),
+		owners:    make(map[string]string),
+	}
+}
+
+// Register makes an adapter type available to edge.yaml
+func (g *Gateway) Register(adapterType string, factory Factory) {
+	g.factories[adapterType] = factory
+}
+
+// Start creates the enabled adapters and runs them until ctx is cancelled.
+// Configuration errors are returned before any adapter starts.
+func (g *Gateway) Start(ctx context.Context) error {
+	initial := make(map[string]Adapter)
+
+	for i, cfg := range g.config.Adapters {
+		if !cfg.Enabled {
+			continue
+		}
+		if cfg.Name == "" {
+			cfg.Name = cfg.Type
+		}
+
+		factory, ok := g.factories[cfg.Type]
+		if !ok {
+			return fmt.Errorf("gateway.adapters[%d]: unknown adapter type %q", i, cfg.Type)
+		}
+		if _, exists := g.adapters[cfg.Name]; exists {
+			return fmt.Errorf("gateway.adapters[%d]: duplicate adapter name %q", i, cfg.Name)
+		}
+
+		adapter, err := factory(cfg.Name, cfg.Settings)
+		if err != nil {
+			return fmt.Errorf("gateway.adapters[%d] (%s): %w", i, cfg.Name, err)
+		}
+
+		g.adapters[cfg.Name] = &supervisor{
+			name:     cfg.Name,
+			kind:     cfg.Type,
+			factory:  factory,
+			settings: cfg.Settings,
+		}
+		initial[cfg.Name] = adapter
+	}
+
+	if _, err := g.nc.Subscribe("home.devices.*.*.command", g.handleCommand); err != nil {
+		return fmt.Errorf("failed to subscribe to device commands: %w", err)
+	}
+	if _, err := g.nc.Subscribe("home.gateway.discover", g.handleDiscover); err != nil {
+		return fmt.Errorf("failed to subscribe to discovery requests: %w", err)
+	}
+
+	for name, adapter := range initial {
+		g.wg.Add(1)
+		go g.supervise(ctx, g.adapters[name], adapter)
+	}
+
+	log.Printf("Device gateway started with %d adapters", len(initial))
+	return nil
+}
+
+// Wait blocks until every adapter has stopped
+func (g *Gateway) Wait() {
+	g.wg.Wait()
+}
+
+// Status returns the state of every enabled adapter, ordered by name
+func (g *Gateway) Status() []AdapterStatus {
+	list := make([]AdapterStatus, 0, len(g.adapters))
+	for _, s := range g.adapters {
+		list = append(list, s.status())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// supervise runs an adapter and restarts it with backoff whenever it fails
+func (g *Gateway) supervise(ctx context.Context, s *supervisor, adapter Adapter) {
+	defer g.wg.Done()
+
+	delay := g.config.RestartDelay
+	for {
+		started := time.Now()
+
+		err := errors.New("adapter could not be created")
+		if adapter != nil {
+			err = g.run(ctx, s, adapter)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("Adapter %s failed, restarting in %s: %v", s.name, delay, err)
+		s.failed(err)
+
+		// An adapter that ran for a while gets a fresh backoff
+		if time.Since(started) > g.config.MaxRestartDelay {
+			delay = g.config.RestartDelay
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > g.config.MaxRestartDelay {
+			delay = g.config.MaxRestartDelay
+		}
+
+		if adapter, err = s.factory(s.name, s.settings); err != nil {
+			log.Printf("Failed to create adapter %s: %v", s.name, err)
+			adapter = nil
+		}
+	}
+}
+
+// run starts an adapter and blocks until it fails or ctx is cancelled
+func (g *Gateway) run(ctx context.Context, s *supervisor, adapter Adapter) error {
+	host := &adapterHost{
+		gateway: g,
+		name:    s.name,
+		failed:  make(chan error, 1),
+	}
+
+	if err := adapter.Start(ctx, host); err != nil {
+		return fmt.Errorf("failed to start: %w", err)
+	}
+	s.started(adapter)
+	log.Printf("Adapter %s (%s) started", s.name, s.kind)
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-host.failed:
+	}
+
+	s.stopped()
+	if stopErr := adapter.Stop(); stopErr != nil {
+		log.Printf("Failed to stop adapter %s: %v", s.name, stopErr)
+	}
+	return err
+}
+
+// handleCommand routes commands for adapter devices to their adapter.
+// Commands for other devices are left to the devices themselves.
+func (g *Gateway) handleCommand(msg *nats.Msg) {
+	// home.devices.<type>.<id>.command
+	tokens := strings.Split(msg.Subject, ".")
+	cmd := Command{
+		DeviceType: tokens[2],
+		DeviceID:   tokens[3],
+		Data:       append(json.RawMessage(nil), msg.Data...),
+	}
+
+	g.mu.RLock()
+	owner, ok := g.owners[cmd.DeviceID]
+	g.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	adapter := g.adapters[owner].current()
+	if adapter == nil {
+		g.respond(msg, fmt.Errorf("adapter %s is not running", owner))
+		return
+	}
+
+	// Adapters may block on their protocol, so don't hold up the subscription
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), g.config.CommandTimeout)
+		defer cancel()
+
+		err := adapter.HandleCommand(ctx, cmd)
+		if err != nil {
+			log.Printf("Adapter %s failed to handle command for %s: %v", owner, cmd.DeviceID, err)
+		}
+		g.respond(msg, err)
+	}()
+}
+
+// handleDiscover asks every running adapter to announce its devices
+func (g *Gateway) handleDiscover(msg *nats.Msg) {
+	ctx, cancel := context.WithTimeout(context.Background(), g.config.CommandTimeout)
+	defer cancel()
+
+	var errs []error
+	for name, s := range g.adapters {
+		adapter := s.current()
+		if adapter == nil {
+			continue
+		}
+		if err := adapter.Discover(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	g.respond(msg, errors.Join(errs...))
+}
+
+func (g *Gateway) respond(msg *nats.Msg, err error) {
+	if msg.Reply == "" {
+		return
+	}
+
+	resp := map[string]string{"status": "ok"}
+	if err != nil {
+		resp = map[string]string{"error": err.Error()}
+	}
+	data, _ := json.Marshal(resp)
+	if err := msg.Respond(data); err != nil {
+		log.Printf("Failed to send gateway response: %v", err)
+	}
+}
+
+// supervisor tracks one configured adapter across restarts
+type supervisor struct {
+	name     string
+	kind     string
+	factory  Factory
+	settings map[string]interface{}
+
+	adapter   Adapter // nil while not running
+	restarts  int
+	lastError string
+	mu        sync.RWMutex
+}
+
+func (s *supervisor) started(adapter Adapter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.adapter = adapter
+}
+
+func (s *supervisor) stopped() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.adapter = nil
+}
+
+func (s *supervisor) failed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.restarts++
+	if err != nil {
+		s.lastError = err.Error()
+	}
+}
+
+func (s *supervisor) current() Adapter {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.adapter
+}
+
+func (s *supervisor) status() AdapterStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return AdapterStatus{
+		Name:      s.name,
+		Type:      s.kind,
+		Running:   s.adapter != nil,
+		Restarts:  s.restarts,
+		LastError: s.lastError,
+	}
+}
@@ -0,0 +1,140 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func runServer(t *testing.T) *nats.Conn {
+	t.Helper()
+
+	ns, err := server.NewServer(&server.Options{Port: -1, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("server did not start")
+	}
+	t.Cleanup(ns.Shutdown)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+// fakeAdapter announces one switch and records the commands it receives
+type fakeAdapter struct {
+	starts   *atomic.Int32
+	failOnce *atomic.Bool
+	commands chan Command
+}
+
+func (a *fakeAdapter) Start(ctx context.Context, host Host) error {
+	a.starts.Add(1)
+	if err := host.Announce(Device{ID: "lamp", Type: "switch", Name: "Lamp"}); err != nil {
+		return err
+	}
+	if err := host.PublishState("switch", "lamp", map[string]interface{}{"on": true}); err != nil {
+		return err
+	}
+	if a.failOnce.CompareAndSwap(true, false) {
+		host.Fail(errors.New("connection lost"))
+	}
+	return nil
+}
+
+func (a *fakeAdapter) Stop() error                        { return nil }
+func (a *fakeAdapter) Discover(ctx context.Context) error { return nil }
+
+func (a *fakeAdapter) HandleCommand(ctx context.Context, cmd Command) error {
+	a.commands <- cmd
+	return nil
+}
+
+func TestGatewayRunsAndRestartsAdapters(t *testing.T) {
+	nc := runServer(t)
+
+	states, err := nc.SubscribeSync("home.devices.switch.lamp.state")
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	starts := &atomic.Int32{}
+	failOnce := &atomic.Bool{}
+	failOnce.Store(true)
+	commands := make(chan Command, 1)
+
+	gw := New(nc, Config{
+		RestartDelay: 10 * time.Millisecond,
+		Adapters: []AdapterConfig{
+			{Name: "fake", Type: "fake", Enabled: true},
+			{Name: "off", Type: "missing", Enabled: false},
+		},
+	})
+	gw.Register("fake", func(name string, settings map[string]interface{}) (Adapter, error) {
+		return &fakeAdapter{starts: starts, failOnce: failOnce, commands: commands}, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := gw.Start(ctx); err != nil {
+		t.Fatalf("failed to start gateway: %v", err)
+	}
+
+	msg, err := states.NextMsg(2 * time.Second)
+	if err != nil {
+		t.Fatalf("no state published: %v", err)
+	}
+	var state map[string]interface{}
+	if err := json.Unmarshal(msg.Data, &state); err != nil || state["device_id"] != "lamp" || state["on"] != true {
+		t.Fatalf("unexpected state %s", msg.Data)
+	}
+
+	// The adapter fails on its first run and is restarted
+	deadline := time.Now().Add(2 * time.Second)
+	for starts.Load() < 2 || !gw.Status()[0].Running {
+		if time.Now().After(deadline) {
+			t.Fatalf("adapter was not restarted: %+v", gw.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := gw.Status()[0]; status.Restarts != 1 || status.LastError != "connection lost" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	resp, err := nc.Request("home.devices.switch.lamp.command", []byte(`{"on": false}`), 2*time.Second)
+	if err != nil {
+		t.Fatalf("command failed: %v", err)
+	}
+	if string(resp.Data) != `{"status":"ok"}` {
+		t.Fatalf("unexpected response %s", resp.Data)
+	}
+
+	cmd := <-commands
+	if cmd.DeviceID != "lamp" || cmd.DeviceType != "switch" || string(cmd.Data) != `{"on": false}` {
+		t.Fatalf("unexpected command %+v", cmd)
+	}
+
+	cancel()
+	gw.Wait()
+}
+
+func TestGatewayRejectsUnknownAdapterType(t *testing.T) {
+	nc := runServer(t)
+
+	gw := New(nc, Config{Adapters: []AdapterConfig{{Name: "zigbee", Type: "zigbee", Enabled: true}}})
+	if err := gw.Start(context.Background()); err == nil {
+		t.Fatal("expected an error for an unknown adapter type")
+	}
+}
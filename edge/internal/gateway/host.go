@@ -0,0 +1,88 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// adapterHost publishes on behalf of one adapter run
+type adapterHost struct {
+	gateway *Gateway
+	name    string
+	failed  chan error
+}
+
+func (h *adapterHost) Announce(device Device) error {
+	if err := checkToken("device type", device.Type); err != nil {
+		return err
+	}
+	if err := checkToken("device ID", device.ID); err != nil {
+		return err
+	}
+	device.Adapter = h.name
+
+	g := h.gateway
+	g.mu.Lock()
+	if owner, ok := g.owners[device.ID]; ok && owner != h.name {
+		g.mu.Unlock()
+		return fmt.Errorf("device %s is already announced by adapter %s", device.ID, owner)
+	}
+	g.owners[device.ID] = h.name
+	g.mu.Unlock()
+
+	data, err := json.Marshal(device)
+	if err != nil {
+		return fmt.Errorf("failed to marshal announcement: %w", err)
+	}
+	return g.nc.Publish(fmt.Sprintf("home.devices.%s.%s.announce", device.Type, device.ID), data)
+}
+
+func (h *adapterHost) PublishState(deviceType, deviceID string, state map[string]interface{}) error {
+	if err := checkToken("device type", deviceType); err != nil {
+		return err
+	}
+	if err := checkToken("device ID", deviceID); err != nil {
+		return err
+	}
+
+	msg := make(map[string]interface{}, len(state)+2)
+	for k, v := range state {
+		msg[k] = v
+	}
+	msg["device_id"] = deviceID
+	if _, ok := msg["timestamp"]; !ok {
+		msg["timestamp"] = time.Now().UTC()
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+	return h.gateway.nc.Publish(fmt.Sprintf("home.devices.%s.%s.state", deviceType, deviceID), data)
+}
+
+func (h *adapterHost) Fail(err error) {
+	if err == nil {
+		err = errors.New("adapter reported a failure")
+	}
+
+	// Only the first failure of a run matters
+	select {
+	case h.failed <- err:
+	default:
+	}
+}
+
+// checkToken makes sure a value can be used as a single subject token
+func checkToken(kind, value string) error {
+	if value == "" {
+		return fmt.Errorf("%s is required", kind)
+	}
+	if strings.ContainsAny(value, ".*> \t\r\n") {
+		return fmt.Errorf("%s %q is not a valid subject token", kind, value)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-viper/mapstructure/v2"
+	"github.com/homix-dev/homix/edge/internal/gateway"
+)
+
+// BrokerConfig contains the MQTT broker connection settings
+type BrokerConfig struct {
+	Broker   string `mapstructure:"broker"`
+	ClientID string `mapstructure:"client_id"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	QoS      byte   `mapstructure:"qos"`
+}
+
+// Config contains the generic MQTT adapter settings
+type Config struct {
+	BrokerConfig `mapstructure:",squash"`
+	Devices      []DeviceConfig `mapstructure:"devices"`
+}
+
+// DeviceConfig maps an MQTT device's topics to a homix device
+type DeviceConfig struct {
+	ID           string `mapstructure:"id"`
+	Type         string `mapstructure:"type"`
+	Name         string `mapstructure:"name"`
+	StateTopic   string `mapstructure:"state_topic"`
+	CommandTopic string `mapstructure:"command_topic"`
+}
+
+// Adapter bridges plain MQTT devices configured by topic
+type Adapter struct {
+	config Config
+	client paho.Client
+	host   gateway.Host
+
+	devices map[string]DeviceConfig // By device ID
+}
+
+// New creates a generic MQTT adapter from its edge.yaml settings
+func New(name string, settings map[string]interface{}) (gateway.Adapter, error) {
+	var cfg Config
+	if err := Decode(settings, &cfg); err != nil {
+		return nil, err
+	}
+	if cfg.ClientID == "" {
+		cfg.ClientID = "homix-edge-" + name
+	}
+	if err := cfg.BrokerConfig.Validate(); err != nil {
+		return nil, err
+	}
+
+	devices := make(map[string]DeviceConfig, len(cfg.Devices))
+	for i, device := range cfg.Devices {
+		if device.ID == "" || device.Type == "" {
+			return nil, fmt.Errorf("devices[%d]: id and type are required", i)
+		}
+		if device.StateTopic == "" && device.CommandTopic == "" {
+			return nil, fmt.Errorf("devices[%d]: state_topic or command_topic is required", i)
+		}
+		if _, exists := devices[device.ID]; exists {
+			return nil, fmt.Errorf("devices[%d]: duplicate device id %q", i, device.ID)
+		}
+		devices[device.ID] = device
+	}
+
+	return &Adapter{config: cfg, devices: devices}, nil
+}
+
+// Start connects to the broker, announces the configured devices and
+// subscribes to their state topics
+func (a *Adapter) Start(ctx context.Context, host gateway.Host) error {
+	a.host = host
+
+	client, err := Connect(a.config.BrokerConfig, host.Fail)
+	if err != nil {
+		return err
+	}
+	a.client = client
+
+	for _, device := range a.devices {
+		if device.StateTopic == "" {
+			continue
+		}
+
+		token := client.Subscribe(device.StateTopic, a.config.QoS, func(_ paho.Client, msg paho.Message) {
+			a.handleState(device, msg.Payload())
+		})
+		if token.Wait() && token.Error() != nil {
+			client.Disconnect(250)
+			return fmt.Errorf("failed to subscribe to %s: %w", device.StateTopic, token.Error())
+		}
+	}
+
+	return a.Discover(ctx)
+}
+
+// Stop disconnects from the broker
+func (a *Adapter) Stop() error {
+	if a.client != nil {
+		a.client.Disconnect(250)
+	}
+	return nil
+}
+
+// Discover announces the configured devices
+func (a *Adapter) Discover(ctx context.Context) error {
+	for _, device := range a.devices {
+		if err := a.host.Announce(gateway.Device{
+			ID:   device.ID,
+			Type: device.Type,
+			Name: device.Name,
+		}); err != nil {
+			return fmt.Errorf("failed to announce %s: %w", device.ID, err)
+		}
+	}
+	return nil
+}
+
+// HandleCommand publishes the command payload on the device's command topic
+func (a *Adapter) HandleCommand(ctx context.Context, cmd gateway.Command) error {
+	device, ok := a.devices[cmd.DeviceID]
+	if !ok {
+		return fmt.Errorf("unknown device: %s", cmd.DeviceID)
+	}
+	if device.CommandTopic == "" {
+		return fmt.Errorf("device %s does not accept commands", cmd.DeviceID)
+	}
+
+	return Publish(ctx, a.client, device.CommandTopic, a.config.QoS, []byte(cmd.Data))
+}
+
+// handleState publishes an MQTT state payload for a device. JSON objects are
+// published as-is, anything else as {"value": ...}.
+func (a *Adapter) handleState(device DeviceConfig, payload []byte) {
+	var state map[string]interface{}
+	if err := json.Unmarshal(payload, &state); err != nil || state == nil {
+		state = map[string]interface{}{"value": strings.TrimSpace(string(payload))}
+	}
+
+	if err := a.host.PublishState(device.Type, device.ID, state); err != nil {
+		log.Printf("Failed to publish state of %s: %v", device.ID, err)
+	}
+}
+
+// Validate checks the broker settings
+func (c BrokerConfig) Validate() error {
+	if c.Broker == "" {
+		return fmt.Errorf("broker is required")
+	}
+	if c.QoS > 2 {
+		return fmt.Errorf("qos must be 0, 1 or 2")
+	}
+	return nil
+}
+
+// Connect connects to an MQTT broker. Automatic reconnects are disabled so a
+// lost connection is reported to onLost and the gateway restarts the adapter.
+func Connect(cfg BrokerConfig, onLost func(error)) (paho.Client, error) {
+	opts := paho.NewClientOptions()
+	opts.AddBroker(cfg.Broker)
+	opts.SetClientID(cfg.ClientID)
+	opts.SetAutoReconnect(false)
+	opts.SetConnectTimeout(10 * time.Second)
+
+	if cfg.Username != "" {
+		opts.SetUsername(cfg.Username)
+		opts.SetPassword(cfg.Password)
+	}
+
+	opts.SetConnectionLostHandler(func(_ paho.Client, err error) {
+		onLost(fmt.Errorf("MQTT connection lost: %w", err))
+	})
+
+	client := paho.NewClient(opts)
+	token := client.Connect()
+	if token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("failed to connect to MQTT broker %s: %w", cfg.Broker, token.Error())
+	}
+	return client, nil
+}
+
+// Publish publishes a message and waits for it to be sent, or for ctx to end
+func Publish(ctx context.Context, client paho.Client, topic string, qos byte, payload []byte) error {
+	token := client.Publish(topic, qos, false, payload)
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return fmt.Errorf("publish to %s: %w", topic, ctx.Err())
+	}
+}
+
+// Decode decodes adapter settings from edge.yaml
+func Decode(settings map[string]interface{}, out interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           out,
+		WeaklyTypedInput: true,
+		ErrorUnused:      true,
+	})
+	if err != nil {
+		return err
+	}
+	if err := decoder.Decode(settings); err != nil {
+		return fmt.Errorf("invalid settings: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package zigbee2mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/homix-dev/homix/edge/internal/gateway"
+	"github.com/homix-dev/homix/edge/internal/gateway/mqtt"
+)
+
+// Config contains the Zigbee2MQTT adapter settings
+type Config struct {
+	mqtt.BrokerConfig `mapstructure:",squash"`
+	BaseTopic         string `mapstructure:"base_topic"`
+}
+
+// Device is a Zigbee device as listed by Zigbee2MQTT on bridge/devices
+type Device struct {
+	IEEE           string                 `json:"ieee_address"`
+	FriendlyName   string                 `json:"friendly_name"`
+	Type           string                 `json:"type"`
+	NetworkAddress uint16                 `json:"network_address"`
+	Supported      bool                   `json:"supported"`
+	Definition     map[string]interface{} `json:"definition"`
+	PowerSource    string                 `json:"power_source"`
+	ModelID        string                 `json:"model_id"`
+	Manufacturer   string                 `json:"manufacturer"`
+}
+
+// Adapter bridges Zigbee devices managed by Zigbee2MQTT
+type Adapter struct {
+	config Config
+	client paho.Client
+	host   gateway.Host
+
+	devices map[string]*Device // By friendly name
+	ids     map[string]string  // Device ID to friendly name
+	mu      sync.RWMutex
+}
+
+// New creates a Zigbee2MQTT adapter from its edge.yaml settings
+func New(name string, settings map[string]interface{}) (gateway.Adapter, error) {
+	var cfg Config
+	if err := mqtt.Decode(settings, &cfg); err != nil {
+		return nil, err
+	}
+	if cfg.ClientID == "" {
+		cfg.ClientID = "homix-edge-" + name
+	}
+	if cfg.BaseTopic == "" {
+		cfg.BaseTopic = "zigbee2mqtt"
+	}
+	if err := cfg.BrokerConfig.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &Adapter{
+		config:  cfg,
+		devices: make(map[string]*Device),
+		ids:     make(map[string]string),
+	}, nil
+}
+
+// Start connects to the broker and requests the Zigbee device list
+func (a *Adapter) Start(ctx context.Context, host gateway.Host) error {
+	a.host = host
+
+	client, err := mqtt.Connect(a.config.BrokerConfig, host.Fail)
+	if err != nil {
+		return err
+	}
+	a.client = client
+
+	topics := map[string]byte{
+		a.config.BaseTopic + "/+":              a.config.QoS, // Device states
+		a.config.BaseTopic + "/bridge/devices": a.config.QoS, // Device list
+	}
+	token := client.SubscribeMultiple(topics, a.handleMessage)
+	if token.Wait() && token.Error() != nil {
+		client.Disconnect(250)
+		return fmt.Errorf("failed to subscribe to %s: %w", a.config.BaseTopic, token.Error())
+	}
+
+	return a.Discover(ctx)
+}
+
+// Stop disconnects from the broker
+func (a *Adapter) Stop() error {
+	if a.client != nil {
+		a.client.Disconnect(250)
+	}
+	return nil
+}
+
+// Discover asks Zigbee2MQTT to publish its device list again
+func (a *Adapter) Discover(ctx context.Context) error {
+	return mqtt.Publish(ctx, a.client, a.config.BaseTopic+"/bridge/devices/get", a.config.QoS, []byte("{}"))
+}
+
+// HandleCommand sends a command to <base_topic>/<friendly_name>/set
+func (a *Adapter) HandleCommand(ctx context.Context, cmd gateway.Command) error {
+	a.mu.RLock()
+	friendlyName, ok := a.ids[cmd.DeviceID]
+	a.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown device: %s", cmd.DeviceID)
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(cmd.Data, &payload); err != nil {
+		return fmt.Errorf("invalid command: %w", err)
+	}
+
+	// Remove metadata fields
+	delete(payload, "device_id")
+	delete(payload, "timestamp")
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal command: %w", err)
+	}
+
+	return mqtt.Publish(ctx, a.client, fmt.Sprintf("%s/%s/set", a.config.BaseTopic, friendlyName), a.config.QoS, data)
+}
+
+func (a *Adapter) handleMessage(_ paho.Client, msg paho.Message) {
+	name := strings.TrimPrefix(msg.Topic(), a.config.BaseTopic+"/")
+
+	switch {
+	case name == "bridge/devices":
+		a.handleDeviceList(msg.Payload())
+	case name == "bridge" || strings.Contains(name, "/"):
+		// bridge/state, bridge/event and friends are Zigbee2MQTT internals
+	default:
+		a.handleDeviceState(name, msg.Payload())
+	}
+}
+
+func (a *Adapter) handleDeviceList(payload []byte) {
+	var list []Device
+	if err := json.Unmarshal(payload, &list); err != nil {
+		log.Printf("Failed to parse Zigbee2MQTT device list: %v", err)
+		return
+	}
+
+	for i := range list {
+		device := &list[i]
+		// The coordinator is listed too but is not a device to control
+		if device.FriendlyName == "" || device.Type == "Coordinator" {
+			continue
+		}
+
+		id := DeviceID(device.FriendlyName)
+		a.mu.Lock()
+		a.devices[device.FriendlyName] = device
+		a.ids[id] = device.FriendlyName
+		a.mu.Unlock()
+
+		if err := a.host.Announce(gateway.Device{
+			ID:           id,
+			Type:         DeviceType(device.Definition),
+			Name:         device.FriendlyName,
+			Manufacturer: device.Manufacturer,
+			Model:        device.ModelID,
+			Features:     Features(device.Definition),
+			Attributes: map[string]interface{}{
+				"ieee_address":    device.IEEE,
+				"power_source":    device.PowerSource,
+				"supported":       device.Supported,
+				"network_address": device.NetworkAddress,
+			},
+		}); err != nil {
+			log.Printf("Failed to announce Zigbee device %s: %v", device.FriendlyName, err)
+		}
+	}
+}
+
+func (a *Adapter) handleDeviceState(friendlyName string, payload []byte) {
+	a.mu.RLock()
+	device, ok := a.devices[friendlyName]
+	a.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	var state map[string]interface{}
+	if err := json.Unmarshal(payload, &state); err != nil {
+		log.Printf("Failed to parse state of Zigbee device %s: %v", friendlyName, err)
+		return
+	}
+	state["ieee_address"] = device.IEEE
+	state["timestamp"] = time.Now().Unix()
+
+	if err := a.host.PublishState(DeviceType(device.Definition), DeviceID(friendlyName), state); err != nil {
+		log.Printf("Failed to publish state of Zigbee device %s: %v", friendlyName, err)
+	}
+}
+
+var invalidIDChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// DeviceID turns a Zigbee2MQTT friendly name into a subject-safe device ID
+func DeviceID(friendlyName string) string {
+	return strings.Trim(invalidIDChars.ReplaceAllString(strings.ToLower(friendlyName), "_"), "_")
+}
+
+// DeviceType derives the homix device type from a Zigbee2MQTT definition
+func DeviceType(definition map[string]interface{}) string {
+	if definition == nil {
+		return "unknown"
+	}
+
+	exposes, _ := definition["exposes"].([]interface{})
+	for _, expose := range exposes {
+		exposeMap, ok := expose.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		switch exposeMap["type"] {
+		case "switch", "light", "lock", "climate", "cover":
+			return exposeMap["type"].(string)
+		}
+
+		if isBinary(exposeMap) {
+			return "binary_sensor"
+		}
+		features, _ := exposeMap["features"].([]interface{})
+		for _, f := range features {
+			if fm, ok := f.(map[string]interface{}); ok && isBinary(fm) {
+				return "binary_sensor"
+			}
+		}
+	}
+
+	// Default to sensor
+	return "sensor"
+}
+
+func isBinary(expose map[string]interface{}) bool {
+	switch expose["property"] {
+	case "occupancy", "contact", "water_leak":
+		return true
+	}
+	return false
+}
+
+// Features lists the properties exposed by a Zigbee2MQTT definition
+func Features(definition map[string]interface{}) []string {
+	var features []string
+
+	exposes, _ := definition["exposes"].([]interface{})
+	for _, expose := range exposes {
+		exposeMap, ok := expose.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if property, ok := exposeMap["property"].(string); ok {
+			features = append(features, property)
+		}
+
+		nested, _ := exposeMap["features"].([]interface{})
+		for _, f := range nested {
+			if fm, ok := f.(map[string]interface{}); ok {
+				if property, ok := fm["property"].(string); ok {
+					features = append(features, property)
+				}
+			}
+		}
+	}
+
+	return features
+}
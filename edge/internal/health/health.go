@@ -0,0 +1,205 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/homix-dev/homix/edge/internal/automation"
+	"github.com/homix-dev/homix/edge/internal/bridge"
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// Config contains the health endpoint configuration
+type Config struct {
+	Host    string
+	Port    int
+	Metrics bool // Serve /metrics
+}
+
+// Sources provides the edge components the health endpoint reports on. Any
+// of the functions may be nil when the component is not running.
+type Sources struct {
+	Server         *server.Server
+	CloudConnected func() bool
+	Bridge         func() bridge.Stats
+	BufferDepth    func() uint64
+	Automation     func() automation.Status
+	DeviceCount    func() int
+}
+
+// Status is the full edge status served on /status
+type Status struct {
+	Ready       bool              `json:"ready"`
+	Server      ServerStatus      `json:"server"`
+	Cloud       CloudStatus       `json:"cloud"`
+	Bridge      bridge.Stats      `json:"bridge"`
+	BufferDepth uint64            `json:"buffer_depth"`
+	Automation  automation.Status `json:"automation"`
+	DeviceCount int               `json:"device_count"`
+	Timestamp   time.Time         `json:"timestamp"`
+}
+
+// ServerStatus describes the embedded NATS server
+type ServerStatus struct {
+	Running   bool `json:"running"`
+	JetStream bool `json:"jetstream"`
+	Clients   int  `json:"clients"`
+	LeafNodes int  `json:"leaf_nodes"`
+}
+
+// CloudStatus describes the cloud connection
+type CloudStatus struct {
+	Connected             bool       `json:"connected"`
+	LastDisconnect        *time.Time `json:"last_disconnect,omitempty"`
+	SinceLastDisconnectMS int64      `json:"since_last_disconnect_ms,omitempty"`
+}
+
+// Server serves /healthz, /readyz, /status and, when enabled, /metrics over
+// HTTP
+type Server struct {
+	config  Config
+	sources Sources
+	http    *http.Server
+
+	lastDisconnect time.Time
+	mu             sync.RWMutex
+}
+
+// New creates a new health endpoint
+func New(cfg Config, sources Sources) *Server {
+	s := &Server{
+		config:  cfg,
+		sources: sources,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.HandleFunc("/status", s.handleStatus)
+	if cfg.Metrics {
+		mux.HandleFunc("/metrics", s.handleMetrics)
+	}
+
+	s.http = &http.Server{
+		Addr:              net.JoinHostPort(cfg.Host, fmt.Sprint(cfg.Port)),
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	return s
+}
+
+// Start listens on the configured port. An edge that starts without a cloud
+// connection is in an outage from the start.
+func (s *Server) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.http.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.http.Addr, err)
+	}
+
+	go func() {
+		if err := s.http.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Health endpoint stopped: %v", err)
+		}
+	}()
+	if s.sources.CloudConnected != nil && !s.sources.CloudConnected() {
+		s.CloudDisconnected()
+	}
+
+	log.Printf("Health endpoint listening on %s", listener.Addr())
+	return nil
+}
+
+// Shutdown stops the HTTP server
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.http.Shutdown(ctx)
+}
+
+// CloudDisconnected records that the cloud connection dropped. It is called
+// from the connection's disconnect events, so short outages are seen too.
+func (s *Server) CloudDisconnected() {
+	s.mu.Lock()
+	s.lastDisconnect = time.Now()
+	s.mu.Unlock()
+}
+
+// Status collects the current edge status
+func (s *Server) Status() Status {
+	status := Status{Timestamp: time.Now().UTC()}
+
+	if ns := s.sources.Server; ns != nil {
+		status.Server = ServerStatus{
+			Running:   ns.Running(),
+			JetStream: ns.JetStreamEnabled(),
+			Clients:   ns.NumClients(),
+			LeafNodes: ns.NumLeafNodes(),
+		}
+	}
+
+	if s.sources.CloudConnected != nil {
+		status.Cloud.Connected = s.sources.CloudConnected()
+	}
+	s.mu.RLock()
+	if !s.lastDisconnect.IsZero() {
+		last := s.lastDisconnect.UTC()
+		status.Cloud.LastDisconnect = &last
+		status.Cloud.SinceLastDisconnectMS = time.Since(last).Milliseconds()
+	}
+	s.mu.RUnlock()
+
+	if s.sources.Bridge != nil {
+		status.Bridge = s.sources.Bridge()
+	}
+	if s.sources.BufferDepth != nil {
+		status.BufferDepth = s.sources.BufferDepth()
+	}
+	if s.sources.Automation != nil {
+		status.Automation = s.sources.Automation()
+	}
+	if s.sources.DeviceCount != nil {
+		status.DeviceCount = s.sources.DeviceCount()
+	}
+
+	// The edge works offline, so readiness does not depend on the cloud
+	status.Ready = status.Server.Running && status.Server.JetStream &&
+		(s.sources.Automation == nil || status.Automation.Running)
+
+	return status
+}
+
+// handleHealthz reports whether the embedded server is alive
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if s.sources.Server != nil && !s.sources.Server.Running() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz reports whether the edge is ready to serve devices
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	status := s.Status()
+	code := http.StatusOK
+	if !status.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, status)
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Status())
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write health response: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/homix-dev/homix/edge/internal/automation"
+	"github.com/homix-dev/homix/edge/internal/bridge"
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+func runServer(t *testing.T) *server.Server {
+	t.Helper()
+
+	ns, err := server.NewServer(&server.Options{
+		Port:      -1,
+		NoLog:     true,
+		NoSigs:    true,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("server did not start")
+	}
+	t.Cleanup(ns.Shutdown)
+	return ns
+}
+
+func TestReadinessAndMetrics(t *testing.T) {
+	ns := runServer(t)
+
+	engineRunning := false
+	cloudConnected := true
+	s := New(Config{Metrics: true}, Sources{
+		Server:         ns,
+		CloudConnected: func() bool { return cloudConnected },
+		Bridge:         func() bridge.Stats { return bridge.Stats{ToCloud: 7, FromCloud: 3} },
+		BufferDepth:    func() uint64 { return 42 },
+		Automation:     func() automation.Status { return automation.Status{Running: engineRunning, Automations: 2} },
+		DeviceCount:    func() int { return 5 },
+	})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.http.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	if rec := get("/healthz"); rec.Code != http.StatusOK {
+		t.Fatalf("healthz returned %d", rec.Code)
+	}
+
+	// Not ready until the automation engine runs
+	if rec := get("/readyz"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz returned %d before the engine started", rec.Code)
+	}
+	engineRunning = true
+
+	// A cloud outage doesn't make the edge unready
+	cloudConnected = false
+	s.CloudDisconnected()
+
+	rec := get("/readyz")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("readyz returned %d", rec.Code)
+	}
+
+	var status Status
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("invalid status: %v", err)
+	}
+	if status.Cloud.Connected || status.Cloud.LastDisconnect == nil {
+		t.Fatalf("expected a recorded cloud disconnect, got %+v", status.Cloud)
+	}
+	if status.DeviceCount != 5 || status.BufferDepth != 42 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	metrics := get("/metrics").Body.String()
+	for _, want := range []string{
+		`edge_messages_total{direction="to_cloud"} 7`,
+		`edge_messages_total{direction="from_cloud"} 3`,
+		"edge_buffer_depth 42",
+		"edge_devices_total 5",
+		"edge_cloud_connected 0",
+		"edge_automations_total 2",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics missing %q:\n%s", want, metrics)
+		}
+	}
+}
+
+func TestStartWithoutCloudRecordsOutage(t *testing.T) {
+	s := New(Config{Host: "127.0.0.1"}, Sources{
+		CloudConnected: func() bool { return false },
+	})
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+
+	status := s.Status()
+	if status.Cloud.Connected || status.Cloud.LastDisconnect == nil {
+		t.Fatalf("expected an outage since start, got %+v", status.Cloud)
+	}
+}
+
+func TestMetricsDisabledKeepsHealth(t *testing.T) {
+	s := New(Config{}, Sources{Server: runServer(t)})
+
+	for path, want := range map[string]int{
+		"/healthz": http.StatusOK,
+		"/status":  http.StatusOK,
+		"/metrics": http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		s.http.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Errorf("%s returned %d, want %d", path, rec.Code, want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package health
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+)
+
+// handleMetrics serves the edge status in the Prometheus text format
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	status := s.Status()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	header := func(name, kind, help string) {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	metric := func(name, kind, help string, value interface{}) {
+		header(name, kind, help)
+		fmt.Fprintf(out, "%s %v\n", name, value)
+	}
+
+	metric("edge_ready", "gauge", "Whether the edge is ready to serve devices.", boolValue(status.Ready))
+	metric("edge_server_running", "gauge", "Whether the embedded NATS server is running.", boolValue(status.Server.Running))
+	metric("edge_server_clients", "gauge", "Clients connected to the embedded NATS server.", status.Server.Clients)
+	metric("edge_server_leaf_nodes", "gauge", "Leaf node connections of the embedded NATS server.", status.Server.LeafNodes)
+	metric("edge_cloud_connected", "gauge", "Whether the cloud is reachable.", boolValue(status.Cloud.Connected))
+	if status.Cloud.LastDisconnect != nil {
+		metric("edge_cloud_last_disconnect_timestamp_seconds", "gauge", "Time of the last cloud disconnect.",
+			status.Cloud.LastDisconnect.Unix())
+	}
+
+	header("edge_messages_total", "counter", "Messages relayed by the cloud bridge.")
+	fmt.Fprintf(out, "edge_messages_total{direction=\"to_cloud\"} %d\n", status.Bridge.ToCloud)
+	fmt.Fprintf(out, "edge_messages_total{direction=\"from_cloud\"} %d\n", status.Bridge.FromCloud)
+	header("edge_message_errors_total", "counter", "Messages the cloud bridge failed to relay.")
+	fmt.Fprintf(out, "edge_message_errors_total{direction=\"to_cloud\"} %d\n", status.Bridge.ToCloudErrors)
+	fmt.Fprintf(out, "edge_message_errors_total{direction=\"from_cloud\"} %d\n", status.Bridge.FromCloudErrors)
+
+	metric("edge_messages_filtered_total", "counter", "Messages dropped by bridge rules.", status.Bridge.Filtered)
+
+	metric("edge_buffer_depth", "gauge", "Messages waiting in the offline buffer.", status.BufferDepth)
+	metric("edge_automation_running", "gauge", "Whether the automation engine is running.", boolValue(status.Automation.Running))
+	metric("edge_automations_total", "gauge", "Automations stored in the automations bucket.", status.Automation.Automations)
+	metric("edge_automations_enabled", "gauge", "Enabled automations.", status.Automation.Enabled)
+	metric("edge_automation_runs_total", "counter", "Automation runs since start.", status.Automation.Runs)
+	metric("edge_devices_total", "gauge", "Devices known to the edge.", status.DeviceCount)
+}
+
+func boolValue(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
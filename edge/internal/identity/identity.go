@@ -0,0 +1,146 @@
+package identity
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nats-io/nkeys"
+)
+
+// fileName is the identity file inside the edge data directory
+const fileName = "identity.json"
+
+// Identity is the persistent identity of an edge server. It is generated on
+// first start and reused afterwards, so a restarted edge is recognised as the
+// same home.
+type Identity struct {
+	HomeID    string    `json:"home_id"`
+	PublicKey string    `json:"public_key"`
+	Seed      string    `json:"seed"`
+	CreatedAt time.Time `json:"created_at"`
+
+	keyPair nkeys.KeyPair
+}
+
+// Load reads the identity from dataDir, creating it on first start. A
+// non-empty homeID overrides the stored home ID and is persisted.
+func Load(dataDir, homeID string) (*Identity, error) {
+	path := filepath.Join(dataDir, fileName)
+
+	id, err := read(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read identity: %w", err)
+	}
+
+	changed := false
+	if id == nil {
+		if id, err = generate(); err != nil {
+			return nil, err
+		}
+		changed = true
+	}
+
+	if homeID != "" && homeID != id.HomeID {
+		id.HomeID = homeID
+		changed = true
+	}
+
+	if changed {
+		if err := write(path, id); err != nil {
+			return nil, fmt.Errorf("failed to store identity: %w", err)
+		}
+	}
+
+	return id, nil
+}
+
+// Sign signs data with the edge's nkey and returns the base64 signature
+func (id *Identity) Sign(data []byte) (string, error) {
+	sig, err := id.keyPair.Sign(data)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func generate() (*Identity, error) {
+	kp, err := nkeys.CreateServer()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create edge key: %w", err)
+	}
+
+	pub, err := kp.PublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get edge public key: %w", err)
+	}
+
+	seed, err := kp.Seed()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get edge seed: %w", err)
+	}
+
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, fmt.Errorf("failed to generate home ID: %w", err)
+	}
+
+	return &Identity{
+		HomeID:    "home-" + hex.EncodeToString(suffix),
+		PublicKey: pub,
+		Seed:      string(seed),
+		CreatedAt: time.Now().UTC(),
+		keyPair:   kp,
+	}, nil
+}
+
+func read(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var id Identity
+	if err := json.Unmarshal(data, &id); err != nil {
+		return nil, err
+	}
+
+	kp, err := nkeys.FromSeed([]byte(id.Seed))
+	if err != nil {
+		return nil, fmt.Errorf("invalid edge seed: %w", err)
+	}
+	pub, err := kp.PublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("invalid edge seed: %w", err)
+	}
+	if pub != id.PublicKey {
+		return nil, fmt.Errorf("edge seed does not match public key %s", id.PublicKey)
+	}
+	id.keyPair = kp
+
+	return &id, nil
+}
+
+func write(path string, id *Identity) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(id, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write atomically so a crash never leaves a truncated identity behind
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
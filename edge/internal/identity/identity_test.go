@@ -0,0 +1,129 @@
+package identity
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nkeys"
+)
+
+func TestLoadCreatesIdentity(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+
+	id, err := Load(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(id.HomeID, "home-") {
+		t.Errorf("home ID = %q, want a generated home- ID", id.HomeID)
+	}
+	if !nkeys.IsValidPublicServerKey(id.PublicKey) {
+		t.Errorf("public key %q is not a server key", id.PublicKey)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("identity file mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	sig, err := id.Sign([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kp, err := nkeys.FromPublicKey(id.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kp.Verify([]byte("hello"), raw); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+}
+
+func TestLoadReusesIdentity(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := Load(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Load(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.HomeID != first.HomeID || second.PublicKey != first.PublicKey {
+		t.Errorf("reloaded %s/%s, want %s/%s", second.HomeID, second.PublicKey, first.HomeID, first.PublicKey)
+	}
+
+	// A configured home ID replaces the stored one but keeps the key
+	third, err := Load(dir, "home-beach-house")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.HomeID != "home-beach-house" || third.PublicKey != first.PublicKey {
+		t.Errorf("got %s/%s, want home-beach-house/%s", third.HomeID, third.PublicKey, first.PublicKey)
+	}
+	fourth, err := Load(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fourth.HomeID != "home-beach-house" {
+		t.Errorf("home ID = %q after reload, want the configured one kept", fourth.HomeID)
+	}
+}
+
+func TestLoadRejectsCorruptedIdentity(t *testing.T) {
+	other, err := generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mismatched := *valid
+	mismatched.PublicKey = other.PublicKey
+	badSeed := *valid
+	badSeed.Seed = "SNOTASEED"
+
+	for _, tt := range []struct {
+		name string
+		data func(t *testing.T) []byte
+		want string
+	}{
+		{"truncated", func(t *testing.T) []byte { return []byte(`{"home_id": "home-1", "se`) }, "unexpected end"},
+		{"invalid seed", func(t *testing.T) []byte { return marshal(t, &badSeed) }, "invalid edge seed"},
+		{"mismatched key", func(t *testing.T) []byte { return marshal(t, &mismatched) }, "does not match public key"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, fileName), tt.data(t), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := Load(dir, "")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Load() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func marshal(t *testing.T, id *Identity) []byte {
+	t.Helper()
+	data, err := json.Marshal(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,250 @@
+package leafnode
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nkeys"
+)
+
+// Authorization modes for the embedded server
+const (
+	AuthNone     = "none"
+	AuthOperator = "operator"
+)
+
+// Config describes the embedded NATS server devices connect to
+type Config struct {
+	Host      string
+	Port      int
+	HTTPPort  int // 0 disables the monitoring endpoint
+	StoreDir  string
+	TLS       TLSConfig
+	Auth      AuthConfig
+	LeafNode  LeafNodeConfig
+	JetStream JetStreamConfig
+}
+
+// TLSConfig contains certificate settings for a listener
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	Verify   bool // Require client certificates
+}
+
+// Enabled reports whether TLS is configured
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+// AuthConfig controls how clients authenticate to the embedded server. In
+// operator mode accounts are resolved from JWTs, so the per-device user JWTs
+// issued by the device provisioner are accepted.
+type AuthConfig struct {
+	Mode          string
+	OperatorJWT   string   // Operator JWT file
+	SystemAccount string   // System account public key
+	Accounts      []string // Account JWT files preloaded into the resolver
+	ResolverDir   string   // Directory resolver storage; accepts $SYS.REQ.CLAIMS.UPDATE
+	Credentials   string   // Credentials the edge itself connects with
+}
+
+// LeafNodeConfig configures leaf node connections to and from the server
+type LeafNodeConfig struct {
+	Host    string
+	Port    int // 0 disables accepting leaf node connections
+	TLS     TLSConfig
+	Remotes []RemoteConfig
+}
+
+// RemoteConfig is an outbound leaf node connection, e.g. to Synadia Cloud
+type RemoteConfig struct {
+	URL         string `mapstructure:"url"`
+	Credentials string `mapstructure:"credentials"`
+	Account     string `mapstructure:"account"` // Local account to bind, operator mode only
+}
+
+// JetStreamConfig limits the resources used by JetStream. Sizes accept
+// suffixes such as 512MB or 10GB; empty means no limit.
+type JetStreamConfig struct {
+	MaxMemory string
+	MaxStore  string
+}
+
+// Validate checks the configuration and returns an error describing every
+// problem found
+func (c Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Port < 1 || c.Port > 65535 {
+		fail("local.port: %d is not a valid port", c.Port)
+	}
+	if c.HTTPPort < 0 || c.HTTPPort > 65535 {
+		fail("local.http_port: %d is not a valid port", c.HTTPPort)
+	}
+	if c.StoreDir == "" {
+		fail("local.store_dir: is required")
+	}
+
+	errs = append(errs, c.TLS.validate("local.tls")...)
+	errs = append(errs, c.LeafNode.TLS.validate("local.leafnode.tls")...)
+
+	if c.LeafNode.Port < 0 || c.LeafNode.Port > 65535 {
+		fail("local.leafnode.port: %d is not a valid port", c.LeafNode.Port)
+	}
+	if c.LeafNode.Port != 0 && c.LeafNode.Port == c.Port {
+		fail("local.leafnode.port: %d is already used by local.port", c.Port)
+	}
+
+	for i, remote := range c.LeafNode.Remotes {
+		field := fmt.Sprintf("local.leafnode.remotes[%d]", i)
+
+		u, err := url.Parse(remote.URL)
+		if remote.URL == "" {
+			fail("%s.url: is required", field)
+		} else if err != nil || u.Host == "" {
+			fail("%s.url: %q is not a valid URL", field, remote.URL)
+		}
+		if remote.Credentials != "" {
+			if err := checkFile(remote.Credentials); err != nil {
+				fail("%s.credentials: %v", field, err)
+			}
+		}
+		if remote.Account != "" {
+			if c.Auth.Mode != AuthOperator {
+				fail("%s.account: only supported with local.auth.mode %q", field, AuthOperator)
+			} else if !nkeys.IsValidPublicAccountKey(remote.Account) {
+				fail("%s.account: %q is not an account public key", field, remote.Account)
+			}
+		}
+	}
+
+	switch c.Auth.Mode {
+	case "", AuthNone:
+		if c.Auth.OperatorJWT != "" || len(c.Auth.Accounts) > 0 || c.Auth.ResolverDir != "" {
+			fail("local.auth: operator settings require mode %q", AuthOperator)
+		}
+	case AuthOperator:
+		errs = append(errs, c.Auth.validateOperator()...)
+	default:
+		fail("local.auth.mode: unknown mode %q (expected %q or %q)", c.Auth.Mode, AuthNone, AuthOperator)
+	}
+
+	if _, err := ParseSize(c.JetStream.MaxMemory); err != nil {
+		fail("local.jetstream.max_memory: %v", err)
+	}
+	if _, err := ParseSize(c.JetStream.MaxStore); err != nil {
+		fail("local.jetstream.max_store: %v", err)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (t TLSConfig) validate(field string) []error {
+	var errs []error
+	if !t.Enabled() {
+		if t.CAFile != "" || t.Verify {
+			errs = append(errs, fmt.Errorf("%s: cert_file and key_file are required when ca_file or verify is set", field))
+		}
+		return errs
+	}
+
+	if t.CertFile == "" || t.KeyFile == "" {
+		errs = append(errs, fmt.Errorf("%s: cert_file and key_file must both be set", field))
+	}
+	for _, file := range []struct{ name, path string }{
+		{"cert_file", t.CertFile}, {"key_file", t.KeyFile}, {"ca_file", t.CAFile},
+	} {
+		if file.path == "" {
+			continue
+		}
+		if err := checkFile(file.path); err != nil {
+			errs = append(errs, fmt.Errorf("%s.%s: %v", field, file.name, err))
+		}
+	}
+	if t.Verify && t.CAFile == "" {
+		errs = append(errs, fmt.Errorf("%s: ca_file is required to verify client certificates", field))
+	}
+	return errs
+}
+
+func (a AuthConfig) validateOperator() []error {
+	var errs []error
+
+	if a.OperatorJWT == "" {
+		errs = append(errs, errors.New("local.auth.operator_jwt: is required in operator mode"))
+	} else if err := checkFile(a.OperatorJWT); err != nil {
+		errs = append(errs, fmt.Errorf("local.auth.operator_jwt: %v", err))
+	}
+
+	if a.SystemAccount == "" {
+		errs = append(errs, errors.New("local.auth.system_account: is required in operator mode"))
+	} else if !nkeys.IsValidPublicAccountKey(a.SystemAccount) {
+		errs = append(errs, fmt.Errorf("local.auth.system_account: %q is not an account public key", a.SystemAccount))
+	}
+
+	if len(a.Accounts) == 0 && a.ResolverDir == "" {
+		errs = append(errs, errors.New("local.auth: accounts or resolver_dir is required in operator mode"))
+	}
+	for i, path := range a.Accounts {
+		if err := checkFile(path); err != nil {
+			errs = append(errs, fmt.Errorf("local.auth.accounts[%d]: %v", i, err))
+		}
+	}
+
+	if a.Credentials == "" {
+		errs = append(errs, errors.New("local.auth.credentials: is required in operator mode, the edge needs them to connect"))
+	} else if err := checkFile(a.Credentials); err != nil {
+		errs = append(errs, fmt.Errorf("local.auth.credentials: %v", err))
+	}
+
+	return errs
+}
+
+func checkFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return nil
+}
+
+// ParseSize parses sizes such as 512MB, 10GB or 1048576. An empty string is
+// zero.
+func ParseSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	if s == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		value  int64
+	}{
+		{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1},
+	} {
+		if strings.HasSuffix(s, unit.suffix) {
+			multiplier = unit.value
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a valid size", size)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,99 @@
+package leafnode
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	cfg := Config{
+		Port:     4222,
+		StoreDir: t.TempDir(),
+		TLS:      TLSConfig{CertFile: "/missing/server.pem", Verify: true},
+		Auth:     AuthConfig{Mode: "token"},
+		LeafNode: LeafNodeConfig{
+			Port:    4222,
+			Remotes: []RemoteConfig{{URL: ""}},
+		},
+		JetStream: JetStreamConfig{MaxStore: "lots"},
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected validation to fail")
+	}
+
+	for _, want := range []string{
+		"local.tls: cert_file and key_file must both be set",
+		"local.tls.cert_file:",
+		"local.tls: ca_file is required",
+		"local.leafnode.port: 4222 is already used by local.port",
+		"local.leafnode.remotes[0].url: is required",
+		`local.auth.mode: unknown mode "token"`,
+		"local.jetstream.max_store:",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("missing %q in:\n%v", want, err)
+		}
+	}
+}
+
+func TestOptionsStartServer(t *testing.T) {
+	cfg := Config{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		StoreDir:  t.TempDir(),
+		JetStream: JetStreamConfig{MaxMemory: "64MB", MaxStore: "128MB"},
+	}
+
+	// Validate rejects the random port used by the test, so check a fixed one
+	fixed := cfg
+	fixed.Port = 4222
+	if err := fixed.Validate(); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+
+	opts, err := fixed.Options()
+	if err != nil {
+		t.Fatalf("failed to build options: %v", err)
+	}
+	if opts.JetStreamMaxMemory != 64<<20 || opts.JetStreamMaxStore != 128<<20 {
+		t.Fatalf("unexpected JetStream limits: %d/%d", opts.JetStreamMaxMemory, opts.JetStreamMaxStore)
+	}
+
+	opts.Port = cfg.Port
+	opts.NoLog = true
+	opts.NoSigs = true
+	ns, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	ns.Start()
+	defer ns.Shutdown()
+
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("server did not start")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for input, want := range map[string]int64{
+		"":      0,
+		"1024":  1024,
+		"512MB": 512 << 20,
+		"10 gb": 10 << 30,
+		"1KB":   1 << 10,
+	} {
+		got, err := ParseSize(input)
+		if err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d", input, got, err, want)
+		}
+	}
+
+	if _, err := ParseSize("-1MB"); err == nil {
+		t.Error("expected negative size to fail")
+	}
+}
@@ -0,0 +1,132 @@
+package leafnode
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// Options validates the configuration and builds the embedded server options
+func (c Config) Options() (*server.Options, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	opts := &server.Options{
+		Host:      c.Host,
+		Port:      c.Port,
+		HTTPPort:  c.HTTPPort,
+		JetStream: true,
+		StoreDir:  c.StoreDir,
+		// The edge handles signals itself to shut down in order
+		NoSigs: true,
+	}
+
+	// Sizes were checked by Validate
+	opts.JetStreamMaxMemory, _ = ParseSize(c.JetStream.MaxMemory)
+	opts.JetStreamMaxStore, _ = ParseSize(c.JetStream.MaxStore)
+
+	if c.TLS.Enabled() {
+		tc, err := c.TLS.build()
+		if err != nil {
+			return nil, fmt.Errorf("local.tls: %w", err)
+		}
+		opts.TLSConfig = tc
+		opts.TLSTimeout = server.TLS_TIMEOUT.Seconds()
+		opts.TLSVerify = c.TLS.Verify
+	}
+
+	// Accept leaf node connections (e.g. from other edges)
+	opts.LeafNode.Host = c.LeafNode.Host
+	opts.LeafNode.Port = c.LeafNode.Port
+	if c.LeafNode.TLS.Enabled() {
+		tc, err := c.LeafNode.TLS.build()
+		if err != nil {
+			return nil, fmt.Errorf("local.leafnode.tls: %w", err)
+		}
+		opts.LeafNode.TLSConfig = tc
+		opts.LeafNode.TLSTimeout = server.DEFAULT_LEAF_TLS_TIMEOUT.Seconds()
+	}
+
+	for _, remote := range c.LeafNode.Remotes {
+		u, err := url.Parse(remote.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid leaf node remote %q: %w", remote.URL, err)
+		}
+
+		opts.LeafNode.Remotes = append(opts.LeafNode.Remotes, &server.RemoteLeafOpts{
+			URLs:         []*url.URL{u},
+			Credentials:  remote.Credentials,
+			LocalAccount: remote.Account,
+			TLS:          u.Scheme == "tls",
+		})
+	}
+
+	if c.Auth.Mode == AuthOperator {
+		if err := c.Auth.apply(opts); err != nil {
+			return nil, err
+		}
+	}
+
+	return opts, nil
+}
+
+func (t TLSConfig) build() (*tls.Config, error) {
+	return server.GenTLSConfig(&server.TLSConfigOpts{
+		CertFile: t.CertFile,
+		KeyFile:  t.KeyFile,
+		CaFile:   t.CAFile,
+		Verify:   t.Verify,
+	})
+}
+
+// apply configures operator mode: trusted operator, system account and an
+// account resolver preloaded with the configured account JWTs
+func (a AuthConfig) apply(opts *server.Options) error {
+	operator, err := server.ReadOperatorJWT(a.OperatorJWT)
+	if err != nil {
+		return fmt.Errorf("local.auth.operator_jwt: %w", err)
+	}
+	opts.TrustedOperators = []*jwt.OperatorClaims{operator}
+	opts.SystemAccount = a.SystemAccount
+
+	var resolver server.AccountResolver
+	if a.ResolverDir != "" {
+		// A directory resolver accepts pushed updates, e.g. revocations
+		resolver, err = server.NewDirAccResolver(a.ResolverDir, 0, 2*time.Minute, server.NoDelete)
+		if err != nil {
+			return fmt.Errorf("local.auth.resolver_dir: %w", err)
+		}
+	} else {
+		resolver = &server.MemAccResolver{}
+	}
+
+	for i, path := range a.Accounts {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("local.auth.accounts[%d]: %w", i, err)
+		}
+
+		token := strings.TrimSpace(string(data))
+		claims, err := jwt.DecodeAccountClaims(token)
+		if err != nil {
+			return fmt.Errorf("local.auth.accounts[%d]: invalid account JWT: %w", i, err)
+		}
+		if !operator.DidSign(claims) {
+			return fmt.Errorf("local.auth.accounts[%d]: account %s is not signed by the configured operator", i, claims.Subject)
+		}
+
+		if err := resolver.Store(claims.Subject, token); err != nil {
+			return fmt.Errorf("local.auth.accounts[%d]: failed to store account: %w", i, err)
+		}
+	}
+	opts.AccountResolver = resolver
+
+	return nil
+}
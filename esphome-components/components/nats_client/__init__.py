@@ -17,6 +17,7 @@ CONF_RECONNECT_INTERVAL = "reconnect_interval"
 CONF_STATUS_INTERVAL = "status_interval"
 CONF_DISCOVERY_PREFIX = "discovery_prefix"
 CONF_USE_SSL = "use_ssl"
+CONF_INBOX_PREFIX = "inbox_prefix"
 
 nats_ns = cg.esphome_ns.namespace("nats")
 NATSClient = nats_ns.class_("NATSClient", cg.Component)
@@ -37,6 +38,7 @@ CONFIG_SCHEMA = cv.Schema(
         cv.Optional(CONF_STATUS_INTERVAL, default="60s"): cv.positive_time_period_milliseconds,
         cv.Optional(CONF_DISCOVERY_PREFIX, default="home"): cv.string,
         cv.Optional(CONF_USE_SSL, default=False): cv.boolean,
+        cv.Optional(CONF_INBOX_PREFIX): cv.string,
     }
 ).extend(cv.COMPONENT_SCHEMA)
 
@@ -62,6 +64,8 @@ async def to_code(config):
     cg.add(var.set_status_interval(config[CONF_STATUS_INTERVAL]))
     cg.add(var.set_discovery_prefix(config[CONF_DISCOVERY_PREFIX]))
     cg.add(var.set_use_ssl(config[CONF_USE_SSL]))
+    if CONF_INBOX_PREFIX in config:
+        cg.add(var.set_inbox_prefix(config[CONF_INBOX_PREFIX]))
 
     # Make the NATS client globally available
     cg.add_define("USE_NATS")
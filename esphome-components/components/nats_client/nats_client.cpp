@@ -329,7 +329,9 @@ void NATSClient::process_info_(const std::string &info) {
 
 std::string NATSClient::generate_inbox_() {
   static uint32_t counter = 0;
-  return "_INBOX." + this->device_id_ + "." + std::to_string(millis()) + "." + std::to_string(counter++);
+  // Devices provisioned by homix may only receive replies on their own prefix
+  std::string prefix = this->inbox_prefix_.empty() ? "_INBOX." + this->device_id_ : this->inbox_prefix_;
+  return prefix + "." + std::to_string(millis()) + "." + std::to_string(counter++);
 }
 
 }  // namespace nats
@@ -33,6 +33,7 @@ class NATSClient : public Component {
   void set_status_interval(uint32_t interval) { this->status_interval_ = interval; }
   void set_discovery_prefix(const std::string &prefix) { this->discovery_prefix_ = prefix; }
   void set_use_ssl(bool use_ssl) { this->use_ssl_ = use_ssl; }
+  void set_inbox_prefix(const std::string &prefix) { this->inbox_prefix_ = prefix; }
 
   // Public methods
   bool is_connected() const { return this->connected_; }
@@ -82,6 +83,7 @@ class NATSClient : public Component {
   uint32_t status_interval_{60000};      // 60 seconds
   std::string discovery_prefix_{"home"};
   bool use_ssl_{false};
+  std::string inbox_prefix_;  // Defaults to _INBOX.<device_id>
 
   // NATS protocol state
   std::string server_id_;
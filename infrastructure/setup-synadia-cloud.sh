@@ -223,13 +223,14 @@ services:
   device-provisioner:
     image: ${PROVISIONER_IMAGE:-nats-device-provisioner:latest}
     build:
-      context: ./services/device-provisioner
-      dockerfile: Dockerfile
+      context: .
+      dockerfile: services/device-provisioner/Dockerfile
     container_name: nats-device-provisioner
     depends_on:
       - nats
     volumes:
       - ./infrastructure/creds/device-provisioner.creds:/app/nats.creds:ro
+      - ./device-templates:/app/device-templates:ro
     environment:
       - NATS_URL=nats://nats:4222
       - NATS_CREDS=/app/nats.creds
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/audit"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/bulk"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/spf13/cobra"
+)
+
+var (
+	bulkOutput   string
+	bulkFormat   string
+	bulkExisting string
+	bulkDryRun   bool
+)
+
+var bulkCmd = &cobra.Command{
+	Use:   "bulk <manifest.csv|manifest.yaml>",
+	Short: "Provision every device in a CSV or YAML manifest",
+	Long: `Provision the devices listed in a manifest and write one credentials
+bundle per device, plus a summary.json report, to a directory or tarball.
+
+CSV manifests have a header row with device_id, device_type, name,
+description, room and firmware columns; any other column is passed on as
+metadata. YAML manifests
+have a devices list with the same fields and a metadata map.
+
+Re-running a manifest is safe: devices that are already provisioned are
+skipped, or given new credentials with --existing renew.`,
+	Example: `  device-provisioner bulk sensors.csv --output ./bundles
+  device-provisioner bulk sensors.yaml --output bundles.tar.gz --format esphome
+  device-provisioner bulk sensors.csv --dry-run`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		entries, err := bulk.ReadManifest(args[0])
+		if err != nil {
+			return err
+		}
+		if !bulkDryRun && bulkOutput == "" {
+			return fmt.Errorf("--output is required unless --dry-run is set")
+		}
+
+		prov, cleanup, err := setup()
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		var out bulk.Output
+		if !bulkDryRun {
+			out, err = bulk.OpenOutput(bulkOutput)
+			if err != nil {
+				return err
+			}
+		}
+
+		ctx, cancel := signal.NotifyContext(audit.WithActor(context.Background(), cliActor()), os.Interrupt)
+		defer cancel()
+
+		report, err := bulk.Run(ctx, prov, entries, out, bulk.Options{
+			Format:   models.BundleFormat(bulkFormat),
+			Existing: bulk.Existing(bulkExisting),
+			DryRun:   bulkDryRun,
+		})
+		if out != nil {
+			if closeErr := out.Close(); err == nil && closeErr != nil {
+				err = fmt.Errorf("failed to write output: %w", closeErr)
+			}
+		}
+		if report != nil {
+			report.Print(cmd.OutOrStdout())
+		}
+		if err != nil {
+			return err
+		}
+		if report.Failed > 0 {
+			return fmt.Errorf("%d of %d devices failed", report.Failed, len(report.Results))
+		}
+		return nil
+	},
+}
+
+func init() {
+	bulkCmd.Flags().StringVarP(&bulkOutput, "output", "o", "", "Directory, or .tar/.tar.gz file, to write bundles and the report to")
+	bulkCmd.Flags().StringVar(&bulkFormat, "format", string(models.BundleCreds), "Bundle format: creds, esphome, arduino or json")
+	bulkCmd.Flags().StringVar(&bulkExisting, "existing", string(bulk.SkipExisting), "What to do with devices that are already provisioned: skip or renew")
+	bulkCmd.Flags().BoolVar(&bulkDryRun, "dry-run", false, "Show what would be done without provisioning anything")
+
+	rootCmd.AddCommand(bulkCmd)
+}
@@ -5,7 +5,11 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/homix-dev/homix/services/device-provisioner/internal/api"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/audit"
 	"github.com/homix-dev/homix/services/device-provisioner/internal/provisioner"
 	"github.com/nats-io/nats.go"
 	"github.com/sirupsen/logrus"
@@ -19,7 +23,18 @@ var (
 	natsCreds   string
 	signingKey  string
 	accountPub  string
+	systemCreds string
+	operatorKey string
 	kvBucket    string
+	auditStream string
+	templateDir string
+	credTTL     time.Duration
+	renewWindow time.Duration
+	sweepEvery  time.Duration
+	claimTTL    time.Duration
+	deviceURL   string
+	apiAddr     string
+	apiToken    string
 	debug       bool
 	log         = logrus.New()
 )
@@ -30,87 +45,58 @@ var rootCmd = &cobra.Command{
 	Long: `The Device Provisioning Service manages JWT credential generation
 for devices in the NATS-based home automation system.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		// Configure logging
-		if debug {
-			log.SetLevel(logrus.DebugLevel)
+		// The admin API is off unless given an address, and needs a token
+		if apiAddr == "" {
+			apiAddr = os.Getenv("API_ADDR")
 		}
-		log.SetFormatter(&logrus.TextFormatter{
-			FullTimestamp: true,
-		})
-
-		// Get signing key from env if not provided
-		if signingKey == "" {
-			signingKey = os.Getenv("SIGNING_KEY")
-		}
-		if signingKey == "" {
-			return fmt.Errorf("signing key is required (--signing-key or SIGNING_KEY env)")
-		}
-
-		// Get account public key from env if not provided
-		if accountPub == "" {
-			accountPub = os.Getenv("ACCOUNT_PUB")
-		}
-		if accountPub == "" {
-			return fmt.Errorf("account public key is required (--account-pub or ACCOUNT_PUB env)")
-		}
-
-		// Connect to NATS
-		opts := []nats.Option{
-			nats.Name("device-provisioner"),
-			nats.MaxReconnects(-1),
-			nats.ErrorHandler(func(nc *nats.Conn, sub *nats.Subscription, err error) {
-				log.Errorf("NATS error: %v", err)
-			}),
-			nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
-				log.Warnf("Disconnected from NATS: %v", err)
-			}),
-			nats.ReconnectHandler(func(nc *nats.Conn) {
-				log.Info("Reconnected to NATS")
-			}),
+		if apiToken == "" {
+			apiToken = os.Getenv("API_TOKEN")
 		}
-
-		// Add authentication
-		if natsCreds != "" {
-			opts = append(opts, nats.UserCredentials(natsCreds))
-		} else if natsUser != "" && natsPass != "" {
-			opts = append(opts, nats.UserInfo(natsUser, natsPass))
+		if apiAddr != "" && apiToken == "" {
+			return fmt.Errorf("API token is required with --api-addr (--api-token or API_TOKEN env)")
 		}
 
-		nc, err := nats.Connect(natsURL, opts...)
+		prov, cleanup, err := setup()
 		if err != nil {
-			return fmt.Errorf("failed to connect to NATS: %w", err)
-		}
-		defer nc.Close()
-
-		log.Info("Connected to NATS")
-
-		// Create provisioner
-		cfg := provisioner.Config{
-			NATS:       nc,
-			Logger:     log,
-			SigningKey: signingKey,
-			AccountPub: accountPub,
-			IssuerName: "device-provisioner",
-			KVBucket:   kvBucket,
+			return err
 		}
+		defer cleanup()
 
-		prov, err := provisioner.New(cfg)
-		if err != nil {
-			return fmt.Errorf("failed to create provisioner: %w", err)
+		if apiAddr != "" {
+			srv, err := api.New(api.Config{Addr: apiAddr, Token: apiToken}, prov, log)
+			if err != nil {
+				return fmt.Errorf("failed to create admin API: %w", err)
+			}
+			if err := srv.Start(); err != nil {
+				return err
+			}
+			defer func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				srv.Shutdown(ctx)
+			}()
 		}
 
 		// Create context for graceful shutdown
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
 
-		// Handle signals
+		// Handle signals, SIGHUP reloads the device templates
 		sigCh := make(chan os.Signal, 1)
-		signal.Notify(sigCh, os.Interrupt)
+		signal.Notify(sigCh, os.Interrupt, syscall.SIGHUP)
 
 		go func() {
-			<-sigCh
-			log.Info("Shutting down...")
-			cancel()
+			for sig := range sigCh {
+				if sig == syscall.SIGHUP {
+					if err := prov.ReloadTemplates(); err != nil {
+						log.WithError(err).Error("Failed to reload device templates")
+					}
+					continue
+				}
+				log.Info("Shutting down...")
+				cancel()
+				return
+			}
 		}()
 
 		// Run provisioner
@@ -119,6 +105,136 @@ for devices in the NATS-based home automation system.`,
 	},
 }
 
+// setup connects to NATS and creates the provisioner from the flags. cleanup
+// closes the connections.
+func setup() (*provisioner.Provisioner, func(), error) {
+	// Configure logging
+	if debug {
+		log.SetLevel(logrus.DebugLevel)
+	}
+	log.SetFormatter(&logrus.TextFormatter{
+		FullTimestamp: true,
+	})
+
+	// Get signing key from env if not provided
+	if signingKey == "" {
+		signingKey = os.Getenv("SIGNING_KEY")
+	}
+	if signingKey == "" {
+		return nil, nil, fmt.Errorf("signing key is required (--signing-key or SIGNING_KEY env)")
+	}
+
+	// Get account public key from env if not provided
+	if accountPub == "" {
+		accountPub = os.Getenv("ACCOUNT_PUB")
+	}
+	if accountPub == "" {
+		return nil, nil, fmt.Errorf("account public key is required (--account-pub or ACCOUNT_PUB env)")
+	}
+
+	// Revocation push needs a system account user and an operator signing key
+	if systemCreds == "" {
+		systemCreds = os.Getenv("SYSTEM_CREDS")
+	}
+	if operatorKey == "" {
+		operatorKey = os.Getenv("OPERATOR_SIGNING_KEY")
+	}
+	if (systemCreds == "") != (operatorKey == "") {
+		return nil, nil, fmt.Errorf("--system-creds and --operator-signing-key must be set together")
+	}
+
+	if templateDir == "" {
+		templateDir = os.Getenv("TEMPLATES_DIR")
+	}
+
+	// Devices reach NATS on the same URL unless told otherwise
+	if deviceURL == "" {
+		deviceURL = natsURL
+	}
+
+	// Connect to NATS
+	opts := []nats.Option{
+		nats.Name("device-provisioner"),
+		nats.MaxReconnects(-1),
+		nats.ErrorHandler(func(nc *nats.Conn, sub *nats.Subscription, err error) {
+			log.Errorf("NATS error: %v", err)
+		}),
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			log.Warnf("Disconnected from NATS: %v", err)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Info("Reconnected to NATS")
+		}),
+	}
+
+	// Add authentication
+	if natsCreds != "" {
+		opts = append(opts, nats.UserCredentials(natsCreds))
+	} else if natsUser != "" && natsPass != "" {
+		opts = append(opts, nats.UserInfo(natsUser, natsPass))
+	}
+
+	nc, err := nats.Connect(natsURL, opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+
+	log.Info("Connected to NATS")
+
+	var sys *nats.Conn
+	if systemCreds != "" {
+		sys, err = nats.Connect(natsURL,
+			nats.Name("device-provisioner-system"),
+			nats.MaxReconnects(-1),
+			nats.UserCredentials(systemCreds),
+		)
+		if err != nil {
+			nc.Close()
+			return nil, nil, fmt.Errorf("failed to connect to NATS system account: %w", err)
+		}
+		log.Info("Connected to NATS system account, revocations will be pushed to the resolver")
+	}
+
+	// Create provisioner
+	cfg := provisioner.Config{
+		NATS:       nc,
+		Logger:     log,
+		SigningKey: signingKey,
+		AccountPub: accountPub,
+		IssuerName: "device-provisioner",
+		KVBucket:   kvBucket,
+
+		AuditStream: auditStream,
+
+		TemplatesDir: templateDir,
+
+		CredentialTTL: credTTL,
+		RenewWindow:   renewWindow,
+		SweepInterval: sweepEvery,
+
+		ClaimTTL:  claimTTL,
+		ServerURL: deviceURL,
+
+		System:             sys,
+		OperatorSigningKey: operatorKey,
+	}
+
+	cleanup := func() {
+		if sys != nil {
+			sys.Close()
+		}
+		nc.Close()
+	}
+
+	prov, err := provisioner.New(cfg)
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("failed to create provisioner: %w", err)
+	}
+
+	return prov, cleanup, nil
+}
+
 func init() {
 	rootCmd.PersistentFlags().StringVar(&natsURL, "nats-url", "nats://localhost:4222", "NATS server URL")
 	rootCmd.PersistentFlags().StringVar(&natsUser, "nats-user", "", "NATS username")
@@ -126,7 +242,18 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&natsCreds, "creds", "", "NATS credentials file")
 	rootCmd.PersistentFlags().StringVar(&signingKey, "signing-key", "", "Account signing key seed")
 	rootCmd.PersistentFlags().StringVar(&accountPub, "account-pub", "", "Account public key")
+	rootCmd.PersistentFlags().StringVar(&systemCreds, "system-creds", "", "System account credentials file, for pushing revocations")
+	rootCmd.PersistentFlags().StringVar(&operatorKey, "operator-signing-key", "", "Operator signing key seed, for reissuing the account JWT")
 	rootCmd.PersistentFlags().StringVar(&kvBucket, "kv-bucket", "device-credentials", "KV bucket for device registry")
+	rootCmd.PersistentFlags().StringVar(&auditStream, "audit-stream", audit.DefaultStream, "JetStream stream for the audit log of credential operations")
+	rootCmd.PersistentFlags().StringVar(&templateDir, "templates-dir", "", "Directory of device templates defining device permissions, or TEMPLATES_DIR env (default device-templates)")
+	rootCmd.PersistentFlags().DurationVar(&credTTL, "credential-ttl", provisioner.DefaultCredentialTTL, "Lifetime of issued device credentials")
+	rootCmd.PersistentFlags().DurationVar(&renewWindow, "renew-window", provisioner.DefaultRenewWindow, "Ask devices to renew credentials this long before they expire")
+	rootCmd.PersistentFlags().DurationVar(&sweepEvery, "sweep-interval", provisioner.DefaultSweepInterval, "How often to look for expiring credentials")
+	rootCmd.PersistentFlags().DurationVar(&claimTTL, "claim-ttl", provisioner.DefaultClaimTTL, "How long a device claim PIN stays valid")
+	rootCmd.PersistentFlags().StringVar(&deviceURL, "device-url", "", "NATS URL put in claim QR codes (default --nats-url)")
+	rootCmd.PersistentFlags().StringVar(&apiAddr, "api-addr", "", "Address for the HTTP admin API, e.g. :8084, or API_ADDR env (default off)")
+	rootCmd.PersistentFlags().StringVar(&apiToken, "api-token", "", "Bearer token for the HTTP admin API, or API_TOKEN env")
 	rootCmd.PersistentFlags().BoolVar(&debug, "debug", false, "Enable debug logging")
 }
 
@@ -135,4 +262,4 @@ func main() {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-}
\ No newline at end of file
+}
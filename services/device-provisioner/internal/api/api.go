@@ -0,0 +1,358 @@
+// Package api serves the provisioner's HTTP admin API
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/audit"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/provisioner"
+	"github.com/sirupsen/logrus"
+)
+
+// Largest request body accepted
+const maxBodySize = 1 << 20
+
+// Config contains the HTTP API configuration
+type Config struct {
+	Addr  string // Listen address, e.g. :8084
+	Token string // Bearer token clients must present
+}
+
+// Server serves the admin API:
+//
+//	GET    /api/devices               list devices, ?type= &role= &status= &limit= &cursor=
+//	POST   /api/devices               provision a device
+//	POST   /api/roles                 issue service or user credentials for a role
+//	POST   /api/nonce                 a nonce for a device to sign its own key with
+//	GET    /api/devices/{id}          get a device
+//	DELETE /api/devices/{id}          revoke and remove a device
+//	POST   /api/devices/{id}/revoke   revoke a device's credentials
+//	POST   /api/devices/{id}/renew    issue a device new credentials
+//	GET    /api/devices/{id}/history  the device's registry revisions
+//	GET    /api/audit                 audit records, ?device_id= &operation= &since= &after= &limit=
+//
+// Failures are answered with a models.ErrorResponse. Every /api request
+// needs an Authorization: Bearer header with the token.
+// Callers may name who they act for in a Homix-Actor header, which goes into
+// the audit log. /healthz is open.
+type Server struct {
+	prov  *provisioner.Provisioner
+	log   *logrus.Logger
+	token []byte
+	http  *http.Server
+}
+
+// New creates the admin API server
+func New(cfg Config, prov *provisioner.Provisioner, log *logrus.Logger) (*Server, error) {
+	if cfg.Token == "" {
+		return nil, fmt.Errorf("an API token is required")
+	}
+
+	s := &Server{
+		prov:  prov,
+		log:   log,
+		token: []byte(cfg.Token),
+	}
+
+	s.http = &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	return s, nil
+}
+
+// Handler returns the API's routes
+func (s *Server) Handler() http.Handler {
+	api := http.NewServeMux()
+	api.HandleFunc("GET /api/devices", s.handleList)
+	api.HandleFunc("POST /api/devices", s.handleProvision)
+	api.HandleFunc("GET /api/devices/{id}", s.handleGet)
+	api.HandleFunc("DELETE /api/devices/{id}", s.handleDelete)
+	api.HandleFunc("POST /api/devices/{id}/revoke", s.handleRevoke)
+	api.HandleFunc("POST /api/devices/{id}/renew", s.handleRenew)
+	api.HandleFunc("GET /api/devices/{id}/history", s.handleHistory)
+	api.HandleFunc("POST /api/roles", s.handleRole)
+	api.HandleFunc("POST /api/nonce", s.handleNonce)
+	api.HandleFunc("GET /api/audit", s.handleAudit)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.Handle("/api/", s.authenticate(api))
+	return mux
+}
+
+// Start listens on the configured address
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.http.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.http.Addr, err)
+	}
+
+	go func() {
+		if err := s.http.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.log.WithError(err).Error("Admin API stopped")
+		}
+	}()
+
+	s.log.WithField("addr", listener.Addr().String()).Info("Admin API listening")
+	return nil
+}
+
+// Shutdown stops the HTTP server
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.http.Shutdown(ctx)
+}
+
+// authenticate rejects requests without the bearer token and names the
+// caller for the audit log
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), s.token) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="device-provisioner"`)
+			writeError(w, http.StatusUnauthorized, models.ErrorResponse{Error: "missing or invalid API token", Code: models.CodeUnauthorized})
+			return
+		}
+
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		ctx := audit.WithActor(r.Context(), audit.Actor{
+			Kind:       audit.ActorHTTP,
+			Name:       "api-token",
+			Address:    host,
+			OnBehalfOf: r.Header.Get(audit.HeaderActor),
+		})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	req := models.ListRequest{
+		DeviceType: models.DeviceType(query.Get("type")),
+		Role:       models.Role(query.Get("role")),
+		Status:     models.DeviceStatus(query.Get("status")),
+		Cursor:     query.Get("cursor"),
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			badRequest(w, "limit", "invalid limit %q", limit)
+			return
+		}
+		req.Limit = n
+	}
+
+	list, err := s.prov.QueryDevices(r.Context(), req)
+	if err != nil {
+		s.fail(w, "list devices", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) handleProvision(w http.ResponseWriter, r *http.Request) {
+	var req models.ProvisionRequest
+	if err := readJSON(r, &req); err != nil {
+		badRequest(w, "", "%v", err)
+		return
+	}
+
+	resp, err := s.prov.ProvisionDevice(r.Context(), req)
+	if err != nil {
+		s.fail(w, "provision device", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	device, err := s.prov.GetDevice(r.Context(), r.PathValue("id"))
+	if err != nil {
+		s.fail(w, "get device", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, device)
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	if err := s.prov.DeleteDevice(r.Context(), r.PathValue("id")); err != nil {
+		s.fail(w, "delete device", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := s.prov.RevokeDevice(r.Context(), id); err != nil {
+		s.fail(w, "revoke device", err)
+		return
+	}
+
+	device, err := s.prov.GetDevice(r.Context(), id)
+	if err != nil {
+		s.fail(w, "get device", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, device)
+}
+
+func (s *Server) handleRenew(w http.ResponseWriter, r *http.Request) {
+	var req models.ReissueRequest
+	if err := readJSON(r, &req); err != nil && !errors.Is(err, io.EOF) {
+		badRequest(w, "", "%v", err)
+		return
+	}
+
+	resp, err := s.prov.ReissueDevice(r.Context(), r.PathValue("id"), req.Format)
+	if err != nil {
+		s.fail(w, "renew device", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	history, err := s.prov.DeviceHistory(r.Context(), r.PathValue("id"))
+	if err != nil {
+		s.fail(w, "get device history", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, history)
+}
+
+func (s *Server) handleRole(w http.ResponseWriter, r *http.Request) {
+	var req models.RoleRequest
+	if err := readJSON(r, &req); err != nil {
+		badRequest(w, "", "%v", err)
+		return
+	}
+
+	resp, err := s.prov.ProvisionRole(r.Context(), req)
+	if err != nil {
+		s.fail(w, "issue role credentials", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+func (s *Server) handleNonce(w http.ResponseWriter, r *http.Request) {
+	nonce, err := s.prov.NewNonce()
+	if err != nil {
+		s.fail(w, "create nonce", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, nonce)
+}
+
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := audit.Query{
+		DeviceID:  query.Get("device_id"),
+		Operation: audit.Operation(query.Get("operation")),
+	}
+	if since := query.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			badRequest(w, "since", "invalid since %q, want an RFC 3339 time", since)
+			return
+		}
+		q.Since = t
+	}
+	if after := query.Get("after"); after != "" {
+		n, err := strconv.ParseUint(after, 10, 64)
+		if err != nil {
+			badRequest(w, "after", "invalid after %q", after)
+			return
+		}
+		q.After = n
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			badRequest(w, "limit", "invalid limit %q", limit)
+			return
+		}
+		q.Limit = n
+	}
+
+	page, err := s.prov.QueryAudit(r.Context(), q)
+	if err != nil {
+		s.fail(w, "query audit log", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// statuses maps error codes to HTTP statuses, anything else is a 500
+var statuses = map[models.ErrorCode]int{
+	models.CodeInvalidRequest: http.StatusBadRequest,
+	models.CodeDeviceNotFound: http.StatusNotFound,
+	models.CodeClaimNotFound:  http.StatusNotFound,
+	models.CodeDeviceExists:   http.StatusConflict,
+	models.CodeDeviceRevoked:  http.StatusConflict,
+	models.CodeConflict:       http.StatusConflict,
+	models.CodeAccessExpired:  http.StatusForbidden,
+	models.CodeRateLimited:    http.StatusTooManyRequests,
+}
+
+// fail answers with the error response and status matching a provisioner
+// error, logging failures that aren't the client's doing
+func (s *Server) fail(w http.ResponseWriter, action string, err error) {
+	resp := provisioner.ErrorResponse(err)
+	status, ok := statuses[resp.Code]
+	if !ok {
+		status = http.StatusInternalServerError
+		s.log.WithError(err).Errorf("Failed to %s", action)
+	}
+	writeError(w, status, resp)
+}
+
+// badRequest answers with an invalid_request error about a request field
+func badRequest(w http.ResponseWriter, field, format string, args ...interface{}) {
+	writeError(w, http.StatusBadRequest, models.ErrorResponse{
+		Error: fmt.Sprintf(format, args...),
+		Code:  models.CodeInvalidRequest,
+		Field: field,
+	})
+}
+
+// readJSON decodes a request body, rejecting unknown fields
+func readJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("request body is required: %w", err)
+		}
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, resp models.ErrorResponse) {
+	writeJSON(w, status, resp)
+}
@@ -0,0 +1,268 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/api"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/audit"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/provisioner"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const token = "s3cret"
+
+// newAPI serves the admin API for a provisioner on an embedded JetStream
+// server
+func newAPI(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	require.NoError(t, err)
+	go s.Start()
+	t.Cleanup(s.Shutdown)
+	require.True(t, s.ReadyForConnections(5*time.Second))
+
+	nc, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+	t.Cleanup(nc.Close)
+
+	account, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	seed, err := account.Seed()
+	require.NoError(t, err)
+	pub, err := account.PublicKey()
+	require.NoError(t, err)
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	prov, err := provisioner.New(provisioner.Config{
+		NATS:         nc,
+		Logger:       logger,
+		SigningKey:   string(seed),
+		AccountPub:   pub,
+		IssuerName:   "device-provisioner",
+		KVBucket:     "device-credentials",
+		TemplatesDir: "../../../../device-templates",
+	})
+	require.NoError(t, err)
+
+	srv, err := api.New(api.Config{Token: token}, prov, logger)
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(srv.Handler())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// call makes an authenticated request and decodes the JSON response into
+// out, if given
+func call(t *testing.T, ts *httptest.Server, method, path string, body interface{}, out interface{}) int {
+	t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, ts.URL+path, reader)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Homix-Actor", "alice")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	if out != nil {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+	}
+	return resp.StatusCode
+}
+
+func TestAuthentication(t *testing.T) {
+	ts := newAPI(t)
+
+	resp, err := http.Get(ts.URL + "/healthz")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	for _, header := range []string{"", "Bearer wrong", token} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/devices", nil)
+		require.NoError(t, err)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, header)
+	}
+
+	_, err = api.New(api.Config{}, nil, logrus.New())
+	assert.Error(t, err, "the API must not run without a token")
+}
+
+func TestDeviceLifecycle(t *testing.T) {
+	ts := newAPI(t)
+
+	var created models.ProvisionResponse
+	status := call(t, ts, http.MethodPost, "/api/devices", models.ProvisionRequest{
+		DeviceID:   "porch",
+		DeviceType: models.DeviceTypeLight,
+		Name:       "Porch Light",
+		Format:     models.BundleCreds,
+	}, &created)
+	require.Equal(t, http.StatusCreated, status)
+	assert.NotEmpty(t, created.JWT)
+	require.NotNil(t, created.Bundle)
+
+	var errResp models.ErrorResponse
+	status = call(t, ts, http.MethodPost, "/api/devices", models.ProvisionRequest{DeviceID: "porch", DeviceType: models.DeviceTypeLight}, &errResp)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Contains(t, errResp.Error, "already provisioned")
+	assert.Equal(t, models.CodeDeviceExists, errResp.Code)
+
+	status = call(t, ts, http.MethodPost, "/api/devices", models.ProvisionRequest{DeviceID: "porch"}, &errResp)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, models.ErrorResponse{Error: "device_type is required", Code: models.CodeInvalidRequest, Field: "device_type"}, errResp)
+
+	status = call(t, ts, http.MethodPost, "/api/devices", map[string]string{"device_id": "porch", "colour": "red"}, &errResp)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, models.CodeInvalidRequest, errResp.Code)
+
+	var device models.DeviceInfo
+	require.Equal(t, http.StatusOK, call(t, ts, http.MethodGet, "/api/devices/porch", nil, &device))
+	assert.Equal(t, models.StatusActive, device.Status)
+	assert.Equal(t, "Porch Light", device.Name)
+
+	// Admins renew without the device's signature
+	var renewed models.ProvisionResponse
+	require.Equal(t, http.StatusOK, call(t, ts, http.MethodPost, "/api/devices/porch/renew", nil, &renewed))
+	assert.NotEqual(t, created.Seed, renewed.Seed)
+	require.Equal(t, http.StatusOK, call(t, ts, http.MethodGet, "/api/devices/porch", nil, &device))
+	assert.Len(t, device.PreviousKeys, 1)
+
+	require.Equal(t, http.StatusOK, call(t, ts, http.MethodPost, "/api/devices/porch/revoke", nil, &device))
+	assert.Equal(t, models.StatusRevoked, device.Status)
+	assert.Equal(t, http.StatusConflict, call(t, ts, http.MethodPost, "/api/devices/porch/renew", nil, nil))
+
+	assert.Equal(t, http.StatusNoContent, call(t, ts, http.MethodDelete, "/api/devices/porch", nil, nil))
+	assert.Equal(t, http.StatusNotFound, call(t, ts, http.MethodGet, "/api/devices/porch", nil, &errResp))
+	assert.Equal(t, models.CodeDeviceNotFound, errResp.Code)
+	assert.Equal(t, http.StatusNotFound, call(t, ts, http.MethodDelete, "/api/devices/porch", nil, nil))
+
+	// The registry still knows what happened to it
+	var history models.DeviceHistory
+	require.Equal(t, http.StatusOK, call(t, ts, http.MethodGet, "/api/devices/porch/history", nil, &history))
+	var events []models.HistoryEvent
+	for _, entry := range history.Entries {
+		events = append(events, entry.Event)
+	}
+	assert.Equal(t, []models.HistoryEvent{models.EventProvisioned, models.EventRenewed, models.EventRevoked, models.EventDeleted}, events)
+	assert.Equal(t, http.StatusNotFound, call(t, ts, http.MethodGet, "/api/devices/attic/history", nil, nil))
+
+	// Every credential operation is in the audit log
+	var page audit.Page
+	require.Equal(t, http.StatusOK, call(t, ts, http.MethodGet, "/api/audit?device_id=porch", nil, &page))
+	var ops []audit.Operation
+	for _, rec := range page.Records {
+		ops = append(ops, rec.Operation)
+		assert.Equal(t, audit.ActorHTTP, rec.Actor.Kind)
+		assert.Equal(t, "127.0.0.1", rec.Actor.Address)
+		assert.Equal(t, "alice", rec.Actor.OnBehalfOf)
+	}
+	assert.Equal(t, []audit.Operation{audit.OpProvision, audit.OpReissue, audit.OpRevoke, audit.OpDelete}, ops)
+	user, err := jwt.DecodeUserClaims(renewed.JWT)
+	require.NoError(t, err)
+	assert.Equal(t, user.Subject, page.Records[1].PublicKey)
+	assert.Equal(t, user.ID, page.Records[1].JWTID)
+
+	require.Equal(t, http.StatusOK, call(t, ts, http.MethodGet, "/api/audit?operation=revoke&limit=1", nil, &page))
+	require.Len(t, page.Records, 1)
+	assert.Equal(t, http.StatusBadRequest, call(t, ts, http.MethodGet, "/api/audit?since=yesterday", nil, nil))
+	assert.Equal(t, http.StatusBadRequest, call(t, ts, http.MethodGet, "/api/audit?limit=-1", nil, nil))
+}
+
+func TestListDevices(t *testing.T) {
+	ts := newAPI(t)
+
+	for _, d := range []struct {
+		id         string
+		deviceType models.DeviceType
+	}{
+		{"a-light", models.DeviceTypeLight},
+		{"b-sensor", models.DeviceTypeSensor},
+		{"c-light", models.DeviceTypeLight},
+		{"d-light", models.DeviceTypeLight},
+	} {
+		req := models.ProvisionRequest{DeviceID: d.id, DeviceType: d.deviceType, Name: d.id}
+		require.Equal(t, http.StatusCreated, call(t, ts, http.MethodPost, "/api/devices", req, nil))
+	}
+	require.Equal(t, http.StatusOK, call(t, ts, http.MethodPost, "/api/devices/c-light/revoke", nil, nil))
+
+	ids := func(list models.DeviceList) []string {
+		var ids []string
+		for _, d := range list.Devices {
+			ids = append(ids, d.DeviceID)
+		}
+		return ids
+	}
+
+	// Pages of two lights
+	var list models.DeviceList
+	require.Equal(t, http.StatusOK, call(t, ts, http.MethodGet, "/api/devices?type=light&limit=2", nil, &list))
+	assert.Equal(t, []string{"a-light", "c-light"}, ids(list))
+	assert.Equal(t, 3, list.Total)
+	require.Equal(t, "c-light", list.NextCursor)
+
+	cursor := list.NextCursor
+	list = models.DeviceList{}
+	require.Equal(t, http.StatusOK, call(t, ts, http.MethodGet, "/api/devices?type=light&limit=2&cursor="+cursor, nil, &list))
+	assert.Equal(t, []string{"d-light"}, ids(list))
+	assert.Empty(t, list.NextCursor)
+
+	list = models.DeviceList{}
+	require.Equal(t, http.StatusOK, call(t, ts, http.MethodGet, "/api/devices?status=revoked", nil, &list))
+	assert.Equal(t, []string{"c-light"}, ids(list))
+
+	list = models.DeviceList{}
+	require.Equal(t, http.StatusOK, call(t, ts, http.MethodGet, "/api/devices?status=active", nil, &list))
+	assert.Equal(t, []string{"a-light", "b-sensor", "d-light"}, ids(list))
+
+	assert.Equal(t, http.StatusBadRequest, call(t, ts, http.MethodGet, "/api/devices?status=sleeping", nil, nil))
+	assert.Equal(t, http.StatusBadRequest, call(t, ts, http.MethodGet, "/api/devices?limit=many", nil, nil))
+
+	// Services and users share the registry
+	var creds models.ProvisionResponse
+	require.Equal(t, http.StatusCreated, call(t, ts, http.MethodPost, "/api/roles", models.RoleRequest{ID: "ui", Role: models.RoleViewer}, &creds))
+	assert.NotEmpty(t, creds.Creds)
+	assert.Equal(t, http.StatusBadRequest, call(t, ts, http.MethodPost, "/api/roles", models.RoleRequest{ID: "ui", Role: "owner"}, nil))
+
+	list = models.DeviceList{}
+	require.Equal(t, http.StatusOK, call(t, ts, http.MethodGet, "/api/devices?role=viewer", nil, &list))
+	assert.Equal(t, []string{"ui"}, ids(list))
+}
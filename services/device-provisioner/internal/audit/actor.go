@@ -0,0 +1,51 @@
+package audit
+
+import "context"
+
+// ActorKind says how the provisioner learned who asked for an operation
+type ActorKind string
+
+const (
+	ActorDevice  ActorKind = "device"  // A device proving it holds its key or claim PIN
+	ActorNATS    ActorKind = "nats"    // A request over NATS
+	ActorHTTP    ActorKind = "http"    // A request to the admin API
+	ActorCLI     ActorKind = "cli"     // A device-provisioner command run on a host
+	ActorUnknown ActorKind = "unknown" // A call that carried no actor
+)
+
+// Actor is who asked for an operation
+type Actor struct {
+	Kind ActorKind `json:"kind"`
+
+	// Name is the device ID, NATS user, API credential or OS user
+	Name string `json:"name,omitempty"`
+
+	// Account is the NATS account the request came from, when known
+	Account string `json:"account,omitempty"`
+
+	// Address is the caller's host
+	Address string `json:"address,omitempty"`
+
+	// OnBehalfOf is the person or tool the caller says it acts for, from
+	// the Homix-Actor header. Nothing checks it.
+	OnBehalfOf string `json:"on_behalf_of,omitempty"`
+}
+
+// HeaderActor is the NATS and HTTP header callers may set to name who they
+// act for
+const HeaderActor = "Homix-Actor"
+
+type actorKey struct{}
+
+// WithActor returns a context that records operations as done by actor
+func WithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom returns the actor set on ctx, or an unknown actor
+func ActorFrom(ctx context.Context) Actor {
+	if actor, ok := ctx.Value(actorKey{}).(Actor); ok {
+		return actor
+	}
+	return Actor{Kind: ActorUnknown}
+}
@@ -0,0 +1,241 @@
+// Package audit keeps a tamper-evident log of credential operations in a
+// JetStream stream.
+//
+// Every record names the previous record's hash and is signed by the
+// provisioner's signing key. Editing, dropping or inserting a record breaks
+// the chain, and records can't be forged without the signing key, which
+// Verify checks for.
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	// DefaultStream is the stream records are kept in
+	DefaultStream = "PROVISIONING_AUDIT"
+
+	// SubjectPrefix is followed by the device ID and the operation
+	SubjectPrefix = "home.audit.provisioning"
+
+	// Headers carrying a record's hash and signature, which can't be part of
+	// the record they cover
+	headerHash      = "Homix-Audit-Hash"
+	headerSignature = "Homix-Audit-Signature"
+
+	// How often Append retries when another provisioner appended first
+	maxAppendAttempts = 5
+)
+
+// Operation is a credential operation
+type Operation string
+
+const (
+	OpProvision   Operation = "provision"    // Credentials issued to a new device
+	OpRenew       Operation = "renew"        // A device rotated its own key
+	OpReissue     Operation = "reissue"      // An admin gave a device a new key
+	OpRevoke      Operation = "revoke"       // A device's credentials revoked
+	OpDelete      Operation = "delete"       // A device removed from the registry
+	OpClaimCreate Operation = "claim_create" // Bootstrap credentials issued for a claim
+	OpClaimRedeem Operation = "claim_redeem" // Credentials issued for a redeemed claim
+	OpGrant       Operation = "grant"        // Credentials issued to a service or user for a role
+)
+
+// Record is one credential operation
+type Record struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Operation Operation `json:"operation"`
+	DeviceID  string    `json:"device_id"`
+	PublicKey string    `json:"public_key,omitempty"`
+	JWTID     string    `json:"jwt_id,omitempty"`
+	Actor     Actor     `json:"actor"`
+
+	// PrevHash is the previous record's hash, empty for the first record
+	PrevHash string `json:"prev_hash"`
+
+	// Signer is the public key that signed the record
+	Signer string `json:"signer"`
+
+	// Hash is the hex SHA-256 of the record as stored, without Hash and
+	// Signature, and Signature the base64url signature of the hash bytes.
+	// Both travel in message headers.
+	Hash      string `json:"hash,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// Log appends to and reads the audit stream
+type Log struct {
+	js        jetstream.JetStream
+	name      string
+	stream    jetstream.Stream
+	signer    nkeys.KeyPair
+	signerPub string
+
+	// Head of the chain, loaded from the stream on first use
+	mu       sync.Mutex
+	loaded   bool
+	lastSeq  uint64
+	lastHash string
+}
+
+// Open opens the audit stream, creating it when it doesn't exist. Records
+// are signed with signer.
+func Open(ctx context.Context, js jetstream.JetStream, name string, signer nkeys.KeyPair) (*Log, error) {
+	if name == "" {
+		name = DefaultStream
+	}
+	signerPub, err := signer.PublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get audit signer public key: %w", err)
+	}
+
+	stream, err := js.Stream(ctx, name)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		stream, err = js.CreateStream(ctx, jetstream.StreamConfig{
+			Name:        name,
+			Description: "Device credential audit log",
+			Subjects:    []string{SubjectPrefix + ".>"},
+			Storage:     jetstream.FileStorage,
+			DenyDelete:  true,
+			DenyPurge:   true,
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit stream %s: %w", name, err)
+	}
+
+	return &Log{js: js, name: name, stream: stream, signer: signer, signerPub: signerPub}, nil
+}
+
+// Signer returns the public key records are signed with
+func (l *Log) Signer() string {
+	return l.signerPub
+}
+
+// Append records an operation, chained to the last record in the stream.
+// Operation, DeviceID, PublicKey and JWTID come from rec, the actor from ctx
+// and the rest is filled in.
+func (l *Log) Append(ctx context.Context, rec Record) (*Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rec.Actor = ActorFrom(ctx)
+	rec.Signer = l.signerPub
+
+	for attempt := 1; ; attempt++ {
+		if !l.loaded {
+			if err := l.loadHead(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		rec.Seq = l.lastSeq + 1
+		rec.Time = time.Now().UTC()
+		rec.PrevHash = l.lastHash
+		rec.Hash, rec.Signature = "", ""
+
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal audit record: %w", err)
+		}
+		sum := sha256.Sum256(data)
+		sig, err := l.signer.Sign(sum[:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign audit record: %w", err)
+		}
+		rec.Hash = hex.EncodeToString(sum[:])
+		rec.Signature = base64.RawURLEncoding.EncodeToString(sig)
+
+		msg := nats.NewMsg(subject(rec.DeviceID, rec.Operation))
+		msg.Data = data
+		msg.Header.Set(headerHash, rec.Hash)
+		msg.Header.Set(headerSignature, rec.Signature)
+
+		// Another provisioner may have appended since, then the chain is
+		// reloaded and the record redone
+		_, err = l.js.PublishMsg(ctx, msg, jetstream.WithExpectLastSequence(l.lastSeq))
+		var apiErr *jetstream.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode == jetstream.JSErrCodeStreamWrongLastSequence && attempt < maxAppendAttempts {
+			l.loaded = false
+			continue
+		}
+		if err != nil {
+			l.loaded = false
+			return nil, fmt.Errorf("failed to append audit record: %w", err)
+		}
+
+		l.lastSeq, l.lastHash = rec.Seq, rec.Hash
+		return &rec, nil
+	}
+}
+
+// loadHead reads the last record's sequence and hash from the stream
+func (l *Log) loadHead(ctx context.Context) error {
+	info, err := l.stream.Info(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read audit stream: %w", err)
+	}
+
+	l.lastSeq, l.lastHash = info.State.LastSeq, ""
+	if info.State.Msgs > 0 {
+		msg, err := l.stream.GetMsg(ctx, info.State.LastSeq)
+		if err != nil {
+			return fmt.Errorf("failed to read last audit record: %w", err)
+		}
+		// Chain to what is stored, not to what the header claims
+		l.lastHash = hashOf(msg.Data)
+	}
+
+	l.loaded = true
+	return nil
+}
+
+// decode reads a record as stored in the stream
+func decode(data []byte, header nats.Header) (*Record, error) {
+	var rec Record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return &rec, fmt.Errorf("failed to decode audit record: %w", err)
+	}
+	rec.Hash = header.Get(headerHash)
+	rec.Signature = header.Get(headerSignature)
+	return &rec, nil
+}
+
+func hashOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// subject returns the subject a device's operation is recorded on
+func subject(deviceID string, op Operation) string {
+	return SubjectPrefix + "." + token(deviceID) + "." + string(op)
+}
+
+// token makes a device ID usable as a single subject token. Different IDs
+// may map to the same token, so readers compare the record's device ID.
+func token(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '.', r == '*', r == '>', r <= ' ', r == 0x7f:
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,228 @@
+package audit_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/audit"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runJetStream starts an embedded JetStream server and connects to it
+func runJetStream(t *testing.T) (*nats.Conn, jetstream.JetStream) {
+	t.Helper()
+
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	require.NoError(t, err)
+	go s.Start()
+	t.Cleanup(s.Shutdown)
+	require.True(t, s.ReadyForConnections(5*time.Second))
+
+	nc, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+	t.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	require.NoError(t, err)
+	return nc, js
+}
+
+func openLog(t *testing.T, js jetstream.JetStream) (*audit.Log, nkeys.KeyPair) {
+	t.Helper()
+
+	signer, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	log, err := audit.Open(context.Background(), js, "", signer)
+	require.NoError(t, err)
+	return log, signer
+}
+
+func TestAppendAndQuery(t *testing.T) {
+	_, js := runJetStream(t)
+	log, _ := openLog(t, js)
+
+	admin := audit.WithActor(context.Background(), audit.Actor{Kind: audit.ActorHTTP, Name: "api-token", Address: "10.0.0.5", OnBehalfOf: "alice"})
+	device := audit.WithActor(context.Background(), audit.Actor{Kind: audit.ActorDevice, Name: "hall"})
+
+	first, err := log.Append(admin, audit.Record{Operation: audit.OpProvision, DeviceID: "hall", PublicKey: "UHALL1", JWTID: "JTI1"})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), first.Seq)
+	assert.Empty(t, first.PrevHash)
+	assert.Equal(t, log.Signer(), first.Signer)
+
+	second, err := log.Append(device, audit.Record{Operation: audit.OpRenew, DeviceID: "hall", PublicKey: "UHALL2", JWTID: "JTI2"})
+	require.NoError(t, err)
+	assert.Equal(t, first.Hash, second.PrevHash)
+
+	_, err = log.Append(admin, audit.Record{Operation: audit.OpProvision, DeviceID: "porch", PublicKey: "UPORCH"})
+	require.NoError(t, err)
+	_, err = log.Append(context.Background(), audit.Record{Operation: audit.OpRevoke, DeviceID: "hall", PublicKey: "UHALL2"})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	page, err := log.Query(ctx, audit.Query{DeviceID: "hall"})
+	require.NoError(t, err)
+	require.Len(t, page.Records, 3)
+	assert.Equal(t, *first, page.Records[0], "records read back as written")
+	assert.Equal(t, audit.Actor{Kind: audit.ActorDevice, Name: "hall"}, page.Records[1].Actor)
+	assert.Equal(t, audit.ActorUnknown, page.Records[2].Actor.Kind)
+
+	page, err = log.Query(ctx, audit.Query{Operation: audit.OpProvision})
+	require.NoError(t, err)
+	require.Len(t, page.Records, 2)
+	assert.Equal(t, "porch", page.Records[1].DeviceID)
+
+	// Paging
+	page, err = log.Query(ctx, audit.Query{Limit: 3})
+	require.NoError(t, err)
+	require.Len(t, page.Records, 3)
+	assert.Equal(t, uint64(3), page.NextAfter)
+	page, err = log.Query(ctx, audit.Query{After: page.NextAfter})
+	require.NoError(t, err)
+	require.Len(t, page.Records, 1)
+	assert.Equal(t, audit.OpRevoke, page.Records[0].Operation)
+	assert.Zero(t, page.NextAfter)
+
+	page, err = log.Query(ctx, audit.Query{Since: time.Now().Add(time.Minute)})
+	require.NoError(t, err)
+	assert.Empty(t, page.Records)
+
+	report, err := log.Verify(ctx, log.Signer())
+	require.NoError(t, err)
+	assert.True(t, report.OK(), report.Problems)
+	assert.Equal(t, 4, report.Records)
+}
+
+func TestAppendFromReplicas(t *testing.T) {
+	_, js := runJetStream(t)
+	signer, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+
+	// Two provisioners sharing the stream keep one chain
+	var logs []*audit.Log
+	for range 2 {
+		log, err := audit.Open(context.Background(), js, "", signer)
+		require.NoError(t, err)
+		logs = append(logs, log)
+	}
+
+	var wg sync.WaitGroup
+	for i, log := range logs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range 10 {
+				_, err := log.Append(context.Background(), audit.Record{Operation: audit.OpProvision, DeviceID: fmt.Sprintf("device-%d-%d", i, n)})
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	report, err := logs[0].Verify(context.Background(), logs[0].Signer())
+	require.NoError(t, err)
+	assert.True(t, report.OK(), report.Problems)
+	assert.Equal(t, 20, report.Records)
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	nc, js := runJetStream(t)
+	log, _ := openLog(t, js)
+	ctx := context.Background()
+
+	for _, id := range []string{"hall", "porch", "attic"} {
+		_, err := log.Append(ctx, audit.Record{Operation: audit.OpProvision, DeviceID: id, PublicKey: "U" + id})
+		require.NoError(t, err)
+	}
+
+	// Someone with publish rights replays record 2 with their own key in it
+	stream, err := js.Stream(ctx, audit.DefaultStream)
+	require.NoError(t, err)
+	stored, err := stream.GetMsg(ctx, 2)
+	require.NoError(t, err)
+	var rec map[string]interface{}
+	require.NoError(t, json.Unmarshal(stored.Data, &rec))
+	rec["public_key"] = "UEVIL"
+	data, err := json.Marshal(rec)
+	require.NoError(t, err)
+	forged := nats.NewMsg(stored.Subject)
+	forged.Data = data
+	for _, header := range []string{"Homix-Audit-Hash", "Homix-Audit-Signature"} {
+		forged.Header.Set(header, stored.Header.Get(header))
+	}
+	require.NoError(t, nc.PublishMsg(forged))
+	require.NoError(t, nc.Flush())
+
+	report, err := log.Verify(ctx, log.Signer())
+	require.NoError(t, err)
+	assert.False(t, report.OK())
+	assert.Equal(t, 4, report.Records)
+	for _, problem := range report.Problems {
+		assert.Equal(t, uint64(4), problem.Seq, problem.Reason)
+	}
+	reasons := fmt.Sprint(report.Problems)
+	assert.Contains(t, reasons, "record says it is number 2")
+	assert.Contains(t, reasons, "previous hash does not match")
+	assert.Contains(t, reasons, "hash does not match the record's content")
+
+	// A well formed record from a log with another key isn't trusted
+	other, _ := openLog(t, js)
+	_, err = other.Append(ctx, audit.Record{Operation: audit.OpRevoke, DeviceID: "hall"})
+	require.NoError(t, err)
+	report, err = log.Verify(ctx, log.Signer())
+	require.NoError(t, err)
+	last := report.Problems[len(report.Problems)-1]
+	assert.Equal(t, uint64(5), last.Seq)
+	assert.Contains(t, last.Reason, "untrusted key")
+
+	// but is once its key is
+	report, err = log.Verify(ctx, log.Signer(), other.Signer())
+	require.NoError(t, err)
+	for _, problem := range report.Problems {
+		assert.Equal(t, uint64(4), problem.Seq, problem.Reason)
+	}
+}
+
+func TestVerifyDetectsMissingRecords(t *testing.T) {
+	_, js := runJetStream(t)
+	ctx := context.Background()
+
+	// A stream that, unlike the one Open creates, allows deletes
+	stream, err := js.CreateStream(ctx, jetstream.StreamConfig{
+		Name:     audit.DefaultStream,
+		Subjects: []string{audit.SubjectPrefix + ".>"},
+	})
+	require.NoError(t, err)
+	log, _ := openLog(t, js)
+
+	for _, id := range []string{"hall", "porch", "attic", "garage"} {
+		_, err := log.Append(ctx, audit.Record{Operation: audit.OpProvision, DeviceID: id})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, stream.DeleteMsg(ctx, 2))
+	require.NoError(t, stream.DeleteMsg(ctx, 4))
+
+	report, err := log.Verify(ctx, log.Signer())
+	require.NoError(t, err)
+	assert.Equal(t, []audit.Problem{
+		{Seq: 3, Reason: "record 2 is missing"},
+		{Seq: 4, Reason: "record 4 is missing"},
+	}, report.Problems)
+}
@@ -0,0 +1,254 @@
+package audit
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+
+	// Messages fetched per round trip
+	fetchBatch = 256
+)
+
+// Query selects records. All fields are optional.
+type Query struct {
+	DeviceID  string    `json:"device_id,omitempty"`
+	Operation Operation `json:"operation,omitempty"`
+	Since     time.Time `json:"since,omitempty"` // Records at or after this time
+	After     uint64    `json:"after,omitempty"` // Records after this sequence, for paging
+	Limit     int       `json:"limit,omitempty"` // Default 100, at most 1000
+}
+
+// Page is a page of records in stream order
+type Page struct {
+	Records []Record `json:"records"`
+
+	// NextAfter is passed as the next query's After while more records
+	// follow the page
+	NextAfter uint64 `json:"next_after,omitempty"`
+}
+
+// Query returns the records matching q, oldest first
+func (l *Log) Query(ctx context.Context, q Query) (*Page, error) {
+	if q.Limit < 0 {
+		return nil, fmt.Errorf("limit must not be negative")
+	}
+	if q.Limit == 0 {
+		q.Limit = defaultQueryLimit
+	}
+	if q.Limit > maxQueryLimit {
+		q.Limit = maxQueryLimit
+	}
+
+	device, op := "*", "*"
+	if q.DeviceID != "" {
+		device = token(q.DeviceID)
+	}
+	if q.Operation != "" {
+		op = token(string(q.Operation))
+	}
+	cfg := jetstream.OrderedConsumerConfig{
+		FilterSubjects: []string{SubjectPrefix + "." + device + "." + op},
+		DeliverPolicy:  jetstream.DeliverAllPolicy,
+	}
+	switch {
+	case q.After > 0:
+		cfg.DeliverPolicy = jetstream.DeliverByStartSequencePolicy
+		cfg.OptStartSeq = q.After + 1
+	case !q.Since.IsZero():
+		cfg.DeliverPolicy = jetstream.DeliverByStartTimePolicy
+		cfg.OptStartTime = &q.Since
+	}
+
+	page := &Page{Records: make([]Record, 0)}
+	err := l.read(ctx, cfg, func(rec *storedRecord, _ uint64) bool {
+		// Unreadable records are left to Verify to report
+		if rec.err != nil {
+			return true
+		}
+		if q.DeviceID != "" && rec.DeviceID != q.DeviceID {
+			return true
+		}
+		if rec.Time.Before(q.Since) {
+			return true
+		}
+		if len(page.Records) == q.Limit {
+			page.NextAfter = page.Records[q.Limit-1].Seq
+			return false
+		}
+		page.Records = append(page.Records, *rec.Record)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// Problem is a record that fails verification
+type Problem struct {
+	Seq    uint64 `json:"seq"`
+	Reason string `json:"reason"`
+}
+
+// Report is the outcome of verifying the log
+type Report struct {
+	Records  int       `json:"records"`
+	LastSeq  uint64    `json:"last_seq"`
+	LastHash string    `json:"last_hash"`
+	Problems []Problem `json:"problems"`
+}
+
+// OK reports whether the log verified cleanly
+func (r *Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Verify walks the whole log and checks that no record is missing, each
+// record chains to the one before, its hash matches its content and it is
+// signed by one of the trusted public keys. Problems are reported rather
+// than returned as errors.
+func (l *Log) Verify(ctx context.Context, trusted ...string) (*Report, error) {
+	report := &Report{Problems: make([]Problem, 0)}
+	problem := func(seq uint64, format string, args ...interface{}) {
+		report.Problems = append(report.Problems, Problem{Seq: seq, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	var prevHash string
+	err := l.read(ctx, jetstream.OrderedConsumerConfig{DeliverPolicy: jetstream.DeliverAllPolicy}, func(rec *storedRecord, seq uint64) bool {
+		report.Records++
+		if seq != report.LastSeq+1 {
+			problem(seq, "%s", missing(report.LastSeq+1, seq-1))
+			// Chain on from here, so one gap is reported once
+			prevHash = rec.PrevHash
+		}
+		report.LastSeq = seq
+
+		hash := hashOf(rec.raw)
+		if rec.err != nil {
+			problem(seq, "%v", rec.err)
+			prevHash = hash
+			return true
+		}
+		if rec.Seq != seq {
+			problem(seq, "record says it is number %d", rec.Seq)
+		}
+		if rec.PrevHash != prevHash {
+			problem(seq, "previous hash does not match record %d", seq-1)
+		}
+		if rec.Hash != hash {
+			problem(seq, "hash does not match the record's content")
+		}
+		if subject(rec.DeviceID, rec.Operation) != rec.subject {
+			problem(seq, "stored on %s, not the record's own subject", rec.subject)
+		}
+		if err := verifySignature(rec, hash, trusted); err != nil {
+			problem(seq, "%v", err)
+		}
+
+		prevHash = hash
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Records at the end can't be dropped unnoticed either
+	info, err := l.stream.Info(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit stream: %w", err)
+	}
+	if info.State.LastSeq > report.LastSeq {
+		problem(info.State.LastSeq, "%s", missing(report.LastSeq+1, info.State.LastSeq))
+	}
+
+	report.LastHash = prevHash
+	return report, nil
+}
+
+func missing(from, to uint64) string {
+	if from == to {
+		return fmt.Sprintf("record %d is missing", from)
+	}
+	return fmt.Sprintf("records %d to %d are missing", from, to)
+}
+
+// verifySignature checks a record is signed by a trusted key over hash
+func verifySignature(rec *storedRecord, hash string, trusted []string) error {
+	if !slices.Contains(trusted, rec.Signer) {
+		return fmt.Errorf("signed by untrusted key %q", rec.Signer)
+	}
+	key, err := nkeys.FromPublicKey(rec.Signer)
+	if err != nil {
+		return fmt.Errorf("invalid signer: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(rec.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %v", err)
+	}
+	sum, err := hex.DecodeString(hash)
+	if err != nil {
+		return err
+	}
+	if err := key.Verify(sum, sig); err != nil {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// storedRecord is a record with the message it was read from
+type storedRecord struct {
+	*Record
+	raw     []byte
+	subject string
+	err     error // Set when the message isn't a record
+}
+
+// read passes the stream's records selected by cfg to fn, with their stream
+// sequence, until fn returns false or no records are left
+func (l *Log) read(ctx context.Context, cfg jetstream.OrderedConsumerConfig, fn func(rec *storedRecord, seq uint64) bool) error {
+	consumer, err := l.js.OrderedConsumer(ctx, l.name, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to read audit stream: %w", err)
+	}
+
+	pending := consumer.CachedInfo().NumPending
+	for pending > 0 {
+		batch, err := consumer.Fetch(int(min(pending, fetchBatch)), jetstream.FetchMaxWait(5*time.Second))
+		if err != nil {
+			return fmt.Errorf("failed to read audit stream: %w", err)
+		}
+
+		received := 0
+		for msg := range batch.Messages() {
+			pending--
+			received++
+			meta, err := msg.Metadata()
+			if err != nil {
+				return fmt.Errorf("failed to read audit record metadata: %w", err)
+			}
+			stored := &storedRecord{raw: msg.Data(), subject: msg.Subject()}
+			stored.Record, stored.err = decode(msg.Data(), msg.Headers())
+			if !fn(stored, meta.Sequence.Stream) {
+				return nil
+			}
+		}
+		if err := batch.Error(); err != nil {
+			return fmt.Errorf("failed to read audit stream: %w", err)
+		}
+		if received == 0 {
+			return fmt.Errorf("timed out reading audit stream")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package bulk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/provisioner"
+)
+
+// ReportFile is the summary report written next to the bundles
+const ReportFile = "summary.json"
+
+// Provisioner is the part of the provisioner a run uses
+type Provisioner interface {
+	GetDevice(ctx context.Context, deviceID string) (*models.DeviceInfo, error)
+	ProvisionDevice(ctx context.Context, req models.ProvisionRequest) (*models.ProvisionResponse, error)
+	ReissueDevice(ctx context.Context, deviceID string, format models.BundleFormat) (*models.ProvisionResponse, error)
+}
+
+// Existing says what to do with manifest devices that are already
+// provisioned. Revoked devices are always provisioned again.
+type Existing string
+
+const (
+	SkipExisting  Existing = "skip"  // Leave them be, writing no bundle
+	RenewExisting Existing = "renew" // Issue them new credentials
+)
+
+// Options configure a run
+type Options struct {
+	Format   models.BundleFormat // Bundle format, default creds
+	Existing Existing            // Default skip
+	DryRun   bool                // Only report what would be done
+}
+
+// Action is what a run did, or would do, with a device
+type Action string
+
+const (
+	Provisioned Action = "provisioned"
+	Renewed     Action = "renewed"
+	Skipped     Action = "skipped"
+	Failed      Action = "failed"
+)
+
+// Result is the outcome for one device
+type Result struct {
+	DeviceID   string            `json:"device_id"`
+	DeviceType models.DeviceType `json:"device_type"`
+	Action     Action            `json:"action"`
+	File       string            `json:"file,omitempty"`
+	ExpiresAt  *time.Time        `json:"expires_at,omitempty"`
+	Reason     string            `json:"reason,omitempty"`
+}
+
+// Report summarizes a run. It holds no credentials.
+type Report struct {
+	DryRun      bool      `json:"dry_run"`
+	StartedAt   time.Time `json:"started_at"`
+	Results     []Result  `json:"results"`
+	Provisioned int       `json:"provisioned"`
+	Renewed     int       `json:"renewed"`
+	Skipped     int       `json:"skipped"`
+	Failed      int       `json:"failed"`
+}
+
+// Run provisions every manifest entry and writes its bundle to out. A failed
+// entry doesn't stop the run. Dry runs write nothing and out may be nil;
+// otherwise the report is written to out as ReportFile.
+func Run(ctx context.Context, prov Provisioner, entries []Entry, out Output, opts Options) (*Report, error) {
+	if opts.Format == "" {
+		opts.Format = models.BundleCreds
+	}
+	switch opts.Existing {
+	case "":
+		opts.Existing = SkipExisting
+	case SkipExisting, RenewExisting:
+	default:
+		return nil, fmt.Errorf("unknown existing device policy %q", opts.Existing)
+	}
+
+	report := &Report{DryRun: opts.DryRun, StartedAt: time.Now()}
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		result := runEntry(ctx, prov, entry, out, opts)
+		switch result.Action {
+		case Provisioned:
+			report.Provisioned++
+		case Renewed:
+			report.Renewed++
+		case Skipped:
+			report.Skipped++
+		case Failed:
+			report.Failed++
+		}
+		report.Results = append(report.Results, result)
+	}
+
+	if opts.DryRun {
+		return report, nil
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return report, fmt.Errorf("failed to marshal report: %w", err)
+	}
+	if err := out.Write(ReportFile, data); err != nil {
+		return report, fmt.Errorf("failed to write report: %w", err)
+	}
+	return report, nil
+}
+
+func runEntry(ctx context.Context, prov Provisioner, entry Entry, out Output, opts Options) Result {
+	result := Result{DeviceID: entry.DeviceID, DeviceType: entry.DeviceType}
+	fail := func(err error) Result {
+		result.Action = Failed
+		result.Reason = err.Error()
+		return result
+	}
+
+	existing, err := prov.GetDevice(ctx, entry.DeviceID)
+	if errors.Is(err, provisioner.ErrDeviceNotFound) {
+		existing, err = nil, nil
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	var resp *models.ProvisionResponse
+	switch {
+	case existing == nil || existing.Status == models.StatusRevoked:
+		result.Action = Provisioned
+		if !opts.DryRun {
+			resp, err = prov.ProvisionDevice(ctx, entry.Request(opts.Format))
+		}
+
+	case existing.DeviceType != entry.DeviceType:
+		return fail(fmt.Errorf("already provisioned as a %s", existing.DeviceType))
+
+	case opts.Existing == SkipExisting:
+		result.Action = Skipped
+		result.Reason = "already provisioned"
+		result.ExpiresAt = &existing.ExpiresAt
+		return result
+
+	default:
+		result.Action = Renewed
+		if !opts.DryRun {
+			resp, err = prov.ReissueDevice(ctx, entry.DeviceID, opts.Format)
+		}
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if opts.DryRun {
+		return result
+	}
+
+	result.ExpiresAt = &resp.ExpiresAt
+	result.File = bundlePath(entry.DeviceID, resp.Bundle)
+	if err := out.Write(result.File, []byte(resp.Bundle.Content)); err != nil {
+		// The device has credentials nobody got, so don't call it a success
+		return fail(fmt.Errorf("credentials issued but not written, renew the device: %w", err))
+	}
+	return result
+}
+
+// bundlePath names a device's bundle in the output. Bundles named after the
+// device go at the top, the others, like ESPHome's secrets.yaml, in a
+// directory per device.
+func bundlePath(deviceID string, bundle *models.Bundle) string {
+	if strings.HasPrefix(bundle.Filename, deviceID+".") {
+		return bundle.Filename
+	}
+	return filepath.Join(deviceID, bundle.Filename)
+}
+
+// Print writes a human readable summary of a report
+func (r *Report) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEVICE\tTYPE\tACTION\tFILE\tNOTE")
+	for _, result := range r.Results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", result.DeviceID, result.DeviceType, result.Action, result.File, result.Reason)
+	}
+	tw.Flush()
+
+	prefix := ""
+	if r.DryRun {
+		prefix = "Dry run, would have: "
+	}
+	fmt.Fprintf(w, "\n%sprovisioned %d, renewed %d, skipped %d, failed %d\n", prefix, r.Provisioned, r.Renewed, r.Skipped, r.Failed)
+}
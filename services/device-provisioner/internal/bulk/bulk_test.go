@@ -0,0 +1,207 @@
+package bulk_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/bulk"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/provisioner"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeProvisioner keeps devices in memory and names bundles like the real
+// one
+type fakeProvisioner struct {
+	devices map[string]*models.DeviceInfo
+	issued  int
+}
+
+func newFake() *fakeProvisioner {
+	return &fakeProvisioner{devices: make(map[string]*models.DeviceInfo)}
+}
+
+func (f *fakeProvisioner) GetDevice(_ context.Context, deviceID string) (*models.DeviceInfo, error) {
+	device, ok := f.devices[deviceID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", provisioner.ErrDeviceNotFound, deviceID)
+	}
+	return device, nil
+}
+
+func (f *fakeProvisioner) ProvisionDevice(_ context.Context, req models.ProvisionRequest) (*models.ProvisionResponse, error) {
+	if req.DeviceType == "broken" {
+		return nil, fmt.Errorf("no template for broken")
+	}
+	f.devices[req.DeviceID] = &models.DeviceInfo{
+		DeviceCredentials: models.DeviceCredentials{DeviceID: req.DeviceID, DeviceType: req.DeviceType},
+		Status:            models.StatusActive,
+	}
+	return f.issue(req.DeviceID, req.Format), nil
+}
+
+func (f *fakeProvisioner) ReissueDevice(_ context.Context, deviceID string, format models.BundleFormat) (*models.ProvisionResponse, error) {
+	return f.issue(deviceID, format), nil
+}
+
+func (f *fakeProvisioner) issue(deviceID string, format models.BundleFormat) *models.ProvisionResponse {
+	f.issued++
+	filename := deviceID + ".creds"
+	if format == models.BundleESPHome {
+		filename = "secrets.yaml"
+	}
+	return &models.ProvisionResponse{
+		DeviceID:  deviceID,
+		ExpiresAt: time.Now().Add(time.Hour),
+		Bundle:    &models.Bundle{Format: format, Filename: filename, Content: fmt.Sprintf("creds %d", f.issued)},
+	}
+}
+
+func TestParseCSV(t *testing.T) {
+	entries, err := bulk.ParseCSV(strings.NewReader(`# Ground floor sensors
+device_id,device_type,name,description,room,floor
+hall-temp, sensor, Hall Temperature,,hall,0
+kitchen-temp,sensor,"Kitchen, by the window",Over the sink,kitchen,
+`))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, bulk.Entry{
+		DeviceID:   "hall-temp",
+		DeviceType: models.DeviceTypeSensor,
+		Name:       "Hall Temperature",
+		Room:       "hall",
+		Metadata:   map[string]interface{}{"floor": "0"},
+	}, entries[0])
+	assert.Equal(t, "Kitchen, by the window", entries[1].Name)
+	assert.Equal(t, "kitchen", entries[1].Room)
+	assert.Nil(t, entries[1].Metadata)
+
+	_, err = bulk.ParseCSV(strings.NewReader("device_id,device_type\nhall-temp,\n"))
+	assert.ErrorContains(t, err, "line 2: device_type is required")
+
+	_, err = bulk.ParseCSV(strings.NewReader("device_id,device_type\na,light\na,light\n"))
+	assert.ErrorContains(t, err, "listed twice")
+}
+
+func TestParseYAML(t *testing.T) {
+	entries, err := bulk.ParseYAML(strings.NewReader(`
+devices:
+  - device_id: porch
+    device_type: light
+    name: Porch Light
+    room: porch
+    firmware: 1.2.0
+    metadata:
+      watts: 9
+  - device_id: gate
+    device_type: cover
+`))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, 9, entries[0].Metadata["watts"])
+	assert.Equal(t, "1.2.0", entries[0].Request(models.BundleCreds).Firmware)
+	assert.Equal(t, models.DeviceTypeCover, entries[1].DeviceType)
+
+	_, err = bulk.ParseYAML(strings.NewReader("devices:\n  - device_id: porch\n    type: light\n"))
+	assert.Error(t, err, "unknown fields are rejected")
+}
+
+func TestRunIsIdempotent(t *testing.T) {
+	prov := newFake()
+	entries := []bulk.Entry{
+		{DeviceID: "hall", DeviceType: models.DeviceTypeSensor},
+		{DeviceID: "attic", DeviceType: "broken"},
+		{DeviceID: "porch", DeviceType: models.DeviceTypeLight},
+	}
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// A dry run touches nothing
+	report, err := bulk.Run(ctx, prov, entries, nil, bulk.Options{DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Provisioned)
+	assert.Zero(t, prov.issued)
+
+	out, err := bulk.OpenOutput(dir)
+	require.NoError(t, err)
+	report, err = bulk.Run(ctx, prov, entries, out, bulk.Options{})
+	require.NoError(t, err)
+	require.NoError(t, out.Close())
+	assert.Equal(t, 2, report.Provisioned)
+	assert.Equal(t, 1, report.Failed)
+	assert.Equal(t, "no template for broken", report.Results[1].Reason)
+
+	data, err := os.ReadFile(filepath.Join(dir, "hall.creds"))
+	require.NoError(t, err)
+	assert.Equal(t, "creds 1", string(data))
+	info, err := os.Stat(filepath.Join(dir, "hall.creds"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	var written bulk.Report
+	data, err = os.ReadFile(filepath.Join(dir, bulk.ReportFile))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &written))
+	assert.Equal(t, 2, written.Provisioned)
+	assert.NotContains(t, string(data), "creds 1", "the report must not hold credentials")
+
+	// Running again skips what's done
+	report, err = bulk.Run(ctx, prov, entries, out, bulk.Options{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Skipped)
+	assert.Equal(t, 2, prov.issued)
+
+	// or renews it, and a device can't change type
+	entries[0].DeviceType = models.DeviceTypeSwitch
+	report, err = bulk.Run(ctx, prov, entries, out, bulk.Options{Existing: bulk.RenewExisting})
+	require.NoError(t, err)
+	assert.Equal(t, bulk.Failed, report.Results[0].Action)
+	assert.Contains(t, report.Results[0].Reason, "already provisioned as a sensor")
+	assert.Equal(t, bulk.Renewed, report.Results[2].Action)
+
+	_, err = bulk.Run(ctx, prov, entries, out, bulk.Options{Existing: "replace"})
+	assert.Error(t, err)
+}
+
+func TestRunToTarball(t *testing.T) {
+	prov := newFake()
+	path := filepath.Join(t.TempDir(), "bundles.tar.gz")
+
+	out, err := bulk.OpenOutput(path)
+	require.NoError(t, err)
+	report, err := bulk.Run(context.Background(), prov, []bulk.Entry{
+		{DeviceID: "hall", DeviceType: models.DeviceTypeSensor},
+		{DeviceID: "porch", DeviceType: models.DeviceTypeLight},
+	}, out, bulk.Options{Format: models.BundleESPHome})
+	require.NoError(t, err)
+	require.NoError(t, out.Close())
+	assert.Equal(t, filepath.Join("hall", "secrets.yaml"), report.Results[0].File)
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	require.NoError(t, err)
+
+	var names []string
+	r := tar.NewReader(gz)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	assert.Equal(t, []string{"hall/secrets.yaml", "porch/secrets.yaml", bulk.ReportFile}, names)
+}
@@ -0,0 +1,180 @@
+// Package bulk provisions the devices listed in a manifest and writes their
+// credentials out in one go
+package bulk
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"gopkg.in/yaml.v3"
+)
+
+// Entry is a device in a manifest
+type Entry struct {
+	DeviceID    string                 `yaml:"device_id"`
+	DeviceType  models.DeviceType      `yaml:"device_type"`
+	Name        string                 `yaml:"name"`
+	Description string                 `yaml:"description"`
+	Room        string                 `yaml:"room"`
+	Firmware    string                 `yaml:"firmware"`
+	Metadata    map[string]interface{} `yaml:"metadata"`
+}
+
+// manifest is the YAML manifest layout
+type manifest struct {
+	Devices []Entry `yaml:"devices"`
+}
+
+// csvColumns are the CSV columns that map to entry fields, all other columns
+// become metadata
+var csvColumns = map[string]bool{"device_id": true, "device_type": true, "name": true, "description": true, "room": true, "firmware": true}
+
+// ReadManifest reads a CSV or YAML manifest, picked by the file extension
+func ReadManifest(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open manifest: %w", err)
+	}
+	defer f.Close()
+
+	var entries []Entry
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		entries, err = ParseCSV(f)
+	case ".yaml", ".yml":
+		entries, err = ParseYAML(f)
+	default:
+		return nil, fmt.Errorf("manifest %s must be .csv, .yaml or .yml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return entries, nil
+}
+
+// ParseCSV reads a CSV manifest. The header row names the columns:
+// device_id, device_type, name, description, room and firmware, plus any
+// number of metadata columns. Empty metadata cells are left out.
+func ParseCSV(r io.Reader) ([]Entry, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("manifest is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+	}
+
+	var entries []Entry
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		var entry Entry
+		for i, column := range header {
+			value := strings.TrimSpace(record[i])
+			switch column {
+			case "device_id":
+				entry.DeviceID = value
+			case "device_type":
+				entry.DeviceType = models.DeviceType(value)
+			case "name":
+				entry.Name = value
+			case "description":
+				entry.Description = value
+			case "room":
+				entry.Room = value
+			case "firmware":
+				entry.Firmware = value
+			default:
+				if value == "" {
+					continue
+				}
+				if entry.Metadata == nil {
+					entry.Metadata = make(map[string]interface{})
+				}
+				entry.Metadata[column] = value
+			}
+		}
+		if err := entry.validate(); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, unique(entries)
+}
+
+// ParseYAML reads a YAML manifest, a devices list of entries
+func ParseYAML(r io.Reader) ([]Entry, error) {
+	var m manifest
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(&m); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("manifest is empty")
+		}
+		return nil, err
+	}
+
+	for i, entry := range m.Devices {
+		if err := entry.validate(); err != nil {
+			return nil, fmt.Errorf("device %d: %w", i+1, err)
+		}
+	}
+	return m.Devices, unique(m.Devices)
+}
+
+// Request returns the provision request for an entry
+func (e Entry) Request(format models.BundleFormat) models.ProvisionRequest {
+	return models.ProvisionRequest{
+		DeviceID:    e.DeviceID,
+		DeviceType:  e.DeviceType,
+		Name:        e.Name,
+		Description: e.Description,
+		Room:        e.Room,
+		Firmware:    e.Firmware,
+		Metadata:    e.Metadata,
+		Format:      format,
+	}
+}
+
+func (e Entry) validate() error {
+	if e.DeviceID == "" {
+		return fmt.Errorf("device_id is required")
+	}
+	if e.DeviceType == "" {
+		return fmt.Errorf("device_type is required for %s", e.DeviceID)
+	}
+	return nil
+}
+
+// unique rejects manifests listing a device twice
+func unique(entries []Entry) error {
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if seen[entry.DeviceID] {
+			return fmt.Errorf("device %s is listed twice", entry.DeviceID)
+		}
+		seen[entry.DeviceID] = true
+	}
+	return nil
+}
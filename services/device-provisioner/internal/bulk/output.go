@@ -0,0 +1,101 @@
+package bulk
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Output receives the files a run writes
+type Output interface {
+	Write(name string, data []byte) error
+	Close() error
+}
+
+// OpenOutput opens a directory, or a tarball when path ends in .tar, .tar.gz
+// or .tgz. Directories are created as needed and existing files in them are
+// kept; tarballs are overwritten.
+func OpenOutput(path string) (Output, error) {
+	lower := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return newTarOutput(path, true)
+	case strings.HasSuffix(lower, ".tar"):
+		return newTarOutput(path, false)
+	}
+
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	return dirOutput(path), nil
+}
+
+// dirOutput writes files under a directory
+type dirOutput string
+
+func (d dirOutput) Write(name string, data []byte) error {
+	path := filepath.Join(string(d), name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	// Bundles hold private keys
+	return os.WriteFile(path, data, 0o600)
+}
+
+func (d dirOutput) Close() error {
+	return nil
+}
+
+// tarOutput writes files into a tarball
+type tarOutput struct {
+	file *os.File
+	gz   *gzip.Writer
+	tar  *tar.Writer
+}
+
+func newTarOutput(path string, compress bool) (*tarOutput, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tarball: %w", err)
+	}
+
+	out := &tarOutput{file: file}
+	var w io.Writer = file
+	if compress {
+		out.gz = gzip.NewWriter(file)
+		w = out.gz
+	}
+	out.tar = tar.NewWriter(w)
+	return out, nil
+}
+
+func (t *tarOutput) Write(name string, data []byte) error {
+	if err := t.tar.WriteHeader(&tar.Header{
+		Name:    filepath.ToSlash(name),
+		Mode:    0o600,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	_, err := t.tar.Write(data)
+	return err
+}
+
+func (t *tarOutput) Close() error {
+	err := t.tar.Close()
+	if t.gz != nil {
+		if gzErr := t.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	if fileErr := t.file.Close(); err == nil {
+		err = fileErr
+	}
+	return err
+}
@@ -1,53 +1,341 @@
 package models
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 // DeviceType represents the type of device
 type DeviceType string
 
 const (
-	DeviceTypeLight       DeviceType = "light"
-	DeviceTypeSensor      DeviceType = "sensor"
-	DeviceTypeSwitch      DeviceType = "switch"
-	DeviceTypeThermostat  DeviceType = "thermostat"
-	DeviceTypeLock        DeviceType = "lock"
-	DeviceTypeCover       DeviceType = "cover"
-	DeviceTypeCamera      DeviceType = "camera"
-	DeviceTypeFan         DeviceType = "fan"
+	DeviceTypeLight      DeviceType = "light"
+	DeviceTypeSensor     DeviceType = "sensor"
+	DeviceTypeSwitch     DeviceType = "switch"
+	DeviceTypeThermostat DeviceType = "thermostat"
+	DeviceTypeLock       DeviceType = "lock"
+	DeviceTypeCover      DeviceType = "cover"
+	DeviceTypeCamera     DeviceType = "camera"
+	DeviceTypeFan        DeviceType = "fan"
 )
 
+// DeviceTypes are the built-in device types. Device templates may add more.
+var DeviceTypes = []DeviceType{
+	DeviceTypeLight,
+	DeviceTypeSensor,
+	DeviceTypeSwitch,
+	DeviceTypeThermostat,
+	DeviceTypeLock,
+	DeviceTypeCover,
+	DeviceTypeCamera,
+	DeviceTypeFan,
+}
+
+// Role is a kind of service or user credentials. Each role has a fixed
+// permission profile.
+type Role string
+
+const (
+	RoleBridge  Role = "bridge"  // Protocol bridges that speak for other devices, e.g. zigbee2mqtt
+	RoleService Role = "service" // Backend services such as the automation engine
+	RoleAdmin   Role = "admin"   // Users that manage the home
+	RoleViewer  Role = "viewer"  // Users that may look but not touch
+	RoleGuest   Role = "guest"   // Time boxed users that may control everyday devices
+)
+
+// Roles are the roles credentials can be issued for
+var Roles = []Role{RoleBridge, RoleService, RoleAdmin, RoleViewer, RoleGuest}
+
+// RoleRequest asks for credentials for a service or user. They are kept in
+// the device registry under ID, so IDs are shared with devices, and are
+// revoked, renewed and listed like devices.
+type RoleRequest struct {
+	ID          string `json:"id"`
+	Role        Role   `json:"role"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+
+	// How long access lasts, e.g. "48h"; renewals don't extend it. Guests
+	// default to 48 hours and may have at most 7 days, other roles are
+	// renewed indefinitely without one.
+	TTL string `json:"ttl,omitempty"`
+
+	Format BundleFormat `json:"format,omitempty"`
+	Key    *KeyProof    `json:"key,omitempty"`
+}
+
 // ProvisionRequest represents a request to provision a new device
 type ProvisionRequest struct {
 	DeviceID    string                 `json:"device_id"`
 	DeviceType  DeviceType             `json:"device_type"`
 	Name        string                 `json:"name"`
 	Description string                 `json:"description"`
+	Room        string                 `json:"room,omitempty"`
+	Firmware    string                 `json:"firmware,omitempty"` // Firmware version
 	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	Format      BundleFormat           `json:"format,omitempty"` // Optional bundle to include in the response
+
+	// Key the device generated itself. Without one the provisioner
+	// generates the device's key and returns its seed.
+	Key *KeyProof `json:"key,omitempty"`
+}
+
+// KeyProof is a public key a device generated, with its proof of holding the
+// private key: KeyProofPayload(device ID, Nonce) signed with the key,
+// base64url encoded without padding. Nonce comes from a NonceResponse.
+type KeyProof struct {
+	PublicKey string `json:"public_key"`
+	Nonce     string `json:"nonce"`
+	Signature string `json:"signature"`
+}
+
+// KeyProofPayload returns the bytes a device signs for a KeyProof
+func KeyProofPayload(deviceID, nonce string) []byte {
+	return []byte(fmt.Sprintf("key:%s:%s", deviceID, nonce))
+}
+
+// NonceResponse is a nonce for a KeyProof, usable until ExpiresAt
+type NonceResponse struct {
+	Nonce     string    `json:"nonce"`
+	ExpiresAt time.Time `json:"expires_at"`
 }
 
-// ProvisionResponse contains the provisioned device credentials
+// BundleFormat selects a ready-to-use rendering of device credentials
+type BundleFormat string
+
+const (
+	BundleCreds   BundleFormat = "creds"   // NATS .creds file
+	BundleESPHome BundleFormat = "esphome" // ESPHome secrets.yaml snippet
+	BundleArduino BundleFormat = "arduino" // C header for arduino-nats-client
+	BundleJSON    BundleFormat = "json"    // JSON with server URL, credentials and subjects
+)
+
+// Bundle is device credentials rendered in a BundleFormat
+type Bundle struct {
+	Format   BundleFormat `json:"format"`
+	Filename string       `json:"filename"`
+	Content  string       `json:"content"`
+}
+
+// ProvisionResponse contains the provisioned device credentials. Devices
+// that generated their own key get no seed, creds or bundle.
 type ProvisionResponse struct {
-	DeviceID    string    `json:"device_id"`
-	JWT         string    `json:"jwt"`
-	Seed        string    `json:"seed"`
-	CreatedAt   time.Time `json:"created_at"`
-	ExpiresAt   time.Time `json:"expires_at"`
-	Subjects    Subjects  `json:"subjects"`
+	DeviceID  string    `json:"device_id"`
+	JWT       string    `json:"jwt"`
+	Seed      string    `json:"seed,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Subjects  Subjects  `json:"subjects"`
+
+	// Creds is the JWT and seed as a decorated NATS .creds file
+	Creds  string  `json:"creds,omitempty"`
+	Bundle *Bundle `json:"bundle,omitempty"`
 }
 
-// Subjects contains the NATS subjects this device can use
+// Subjects contains the NATS subjects this device can use. Requests must use
+// InboxPrefix as the inbox prefix, other inboxes can't be read.
 type Subjects struct {
-	Publish   []string `json:"publish"`
-	Subscribe []string `json:"subscribe"`
+	Publish     []string `json:"publish"`
+	Subscribe   []string `json:"subscribe"`
+	InboxPrefix string   `json:"inbox_prefix"`
 }
 
 // DeviceCredentials represents stored device credentials
 type DeviceCredentials struct {
-	DeviceID    string     `json:"device_id"`
-	DeviceType  DeviceType `json:"device_type"`
-	Name        string     `json:"name"`
-	PublicKey   string     `json:"public_key"`
-	CreatedAt   time.Time  `json:"created_at"`
-	ExpiresAt   time.Time  `json:"expires_at"`
-	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
-}
\ No newline at end of file
+	DeviceID    string                 `json:"device_id"`
+	DeviceType  DeviceType             `json:"device_type"`
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	Room        string                 `json:"room,omitempty"`
+	Firmware    string                 `json:"firmware,omitempty"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	PublicKey   string                 `json:"public_key"`
+	CreatedAt   time.Time              `json:"created_at"`
+	ExpiresAt   time.Time              `json:"expires_at"`
+	RevokedAt   *time.Time             `json:"revoked_at,omitempty"`
+	RenewedAt   *time.Time             `json:"renewed_at,omitempty"`
+	RenewNonce  string                 `json:"renew_nonce,omitempty"` // Used by the last renewal, can't renew again
+
+	// Role is set for service and user credentials, which have no device
+	// type. Their access may end at AccessUntil.
+	Role        Role       `json:"role,omitempty"`
+	AccessUntil *time.Time `json:"access_until,omitempty"`
+
+	// Keys the device used before its last renewals, or before it was
+	// revoked and provisioned again, oldest first
+	PreviousKeys []KeyRecord `json:"previous_keys,omitempty"`
+}
+
+// KeyRecord is a public key a device held and the validity of its JWT
+type KeyRecord struct {
+	PublicKey string     `json:"public_key"`
+	IssuedAt  time.Time  `json:"issued_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// DeviceStatus is the state of a device's credentials
+type DeviceStatus string
+
+const (
+	StatusActive   DeviceStatus = "active"
+	StatusExpiring DeviceStatus = "expiring" // Active, but within the renew window
+	StatusExpired  DeviceStatus = "expired"
+	StatusRevoked  DeviceStatus = "revoked"
+)
+
+// ListRequest selects a page of devices, ordered by device ID. Empty fields
+// don't filter.
+type ListRequest struct {
+	DeviceType DeviceType   `json:"device_type,omitempty"`
+	Role       Role         `json:"role,omitempty"`
+	Status     DeviceStatus `json:"status,omitempty"`
+	Limit      int          `json:"limit,omitempty"`  // Default 100, at most 1000
+	Cursor     string       `json:"cursor,omitempty"` // NextCursor of the previous page
+}
+
+// DeviceInfo is a registry entry with the status of its credentials
+type DeviceInfo struct {
+	DeviceCredentials
+	Status DeviceStatus `json:"status"`
+}
+
+// DeviceList is a page of devices
+type DeviceList struct {
+	Devices    []DeviceInfo `json:"devices"`
+	Total      int          `json:"total"` // Devices matching the filter, on all pages
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// HistoryEvent is what a registry revision did to a device
+type HistoryEvent string
+
+const (
+	EventProvisioned HistoryEvent = "provisioned" // Provisioned, or provisioned again after revocation
+	EventRenewed     HistoryEvent = "renewed"     // Given a new key
+	EventRevoked     HistoryEvent = "revoked"
+	EventDeleted     HistoryEvent = "deleted"
+	EventUpdated     HistoryEvent = "updated" // Changed without a new key
+)
+
+// HistoryEntry is one revision of a device's registry entry
+type HistoryEntry struct {
+	Revision  uint64       `json:"revision"`
+	Time      time.Time    `json:"time"`
+	Event     HistoryEvent `json:"event"`
+	PublicKey string       `json:"public_key,omitempty"`
+
+	// The device as of this revision, nil for deletions
+	Device *DeviceCredentials `json:"device,omitempty"`
+}
+
+// DeviceHistory is the credential lifecycle of a device: the registry
+// revisions kept for it, oldest first
+type DeviceHistory struct {
+	DeviceID string         `json:"device_id"`
+	Entries  []HistoryEntry `json:"entries"`
+}
+
+// ReissueRequest asks for fresh credentials for a device on behalf of an
+// admin, without the device's signature
+type ReissueRequest struct {
+	Format BundleFormat `json:"format,omitempty"`
+}
+
+// RenewRequest asks for fresh credentials. The device signs
+// RenewalPayload(DeviceID, Nonce) with its current key to prove it holds it;
+// the signature is base64url encoded without padding. Nonce comes from a
+// NonceResponse and renews only once.
+type RenewRequest struct {
+	DeviceID  string `json:"device_id"`
+	PublicKey string `json:"public_key"`
+	Nonce     string `json:"nonce"`
+	Signature string `json:"signature"`
+
+	Format BundleFormat `json:"format,omitempty"`
+
+	// New key the device generated itself. Without one the provisioner
+	// generates the new key and returns its seed.
+	NewKey *KeyProof `json:"new_key,omitempty"`
+}
+
+// RenewalPayload returns the bytes a device signs for a RenewRequest
+func RenewalPayload(deviceID, nonce string) []byte {
+	return []byte(fmt.Sprintf("renew:%s:%s", deviceID, nonce))
+}
+
+// RenewalNotice is sent on a device's config subject when its credentials
+// are about to expire
+type RenewalNotice struct {
+	Action    string    `json:"action"` // Always "renew_credentials"
+	DeviceID  string    `json:"device_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Subject   string    `json:"subject"` // Where to send the RenewRequest
+}
+
+// RevocationEvent is published on home.provisioning.revoked when a device's
+// credentials are revoked
+type RevocationEvent struct {
+	DeviceID   string     `json:"device_id"`
+	DeviceType DeviceType `json:"device_type"`
+	PublicKey  string     `json:"public_key"`
+	RevokedAt  time.Time  `json:"revoked_at"`
+}
+
+// ClaimRequest pre-registers a device for PIN based onboarding
+type ClaimRequest struct {
+	ProvisionRequest
+}
+
+// ClaimResponse is handed to whoever sets up the device. The QR payload
+// carries the server URL, device ID and PIN; the bootstrap credentials only
+// allow redeeming this claim and expire with it.
+type ClaimResponse struct {
+	DeviceID  string               `json:"device_id"`
+	PIN       string               `json:"pin"`
+	ExpiresAt time.Time            `json:"expires_at"`
+	QRPayload string               `json:"qr_payload"`
+	Bootstrap BootstrapCredentials `json:"bootstrap"`
+}
+
+// BootstrapCredentials let a device connect to redeem its claim. Requests
+// must use InboxPrefix as the inbox prefix, other inboxes can't be read.
+type BootstrapCredentials struct {
+	JWT         string `json:"jwt"`
+	Seed        string `json:"seed"`
+	InboxPrefix string `json:"inbox_prefix"`
+}
+
+// RedeemRequest exchanges a claim PIN for device credentials
+type RedeemRequest struct {
+	DeviceID string `json:"device_id"`
+	PIN      string `json:"pin"`
+
+	Format BundleFormat `json:"format,omitempty"` // Overrides the format given at claim creation
+
+	// Key the device generated itself, see ProvisionRequest.Key
+	Key *KeyProof `json:"key,omitempty"`
+}
+
+// ErrorCode classifies a failed request
+type ErrorCode string
+
+const (
+	CodeInvalidRequest ErrorCode = "invalid_request"
+	CodeDeviceNotFound ErrorCode = "device_not_found"
+	CodeDeviceExists   ErrorCode = "device_exists"
+	CodeDeviceRevoked  ErrorCode = "device_revoked"
+	CodeConflict       ErrorCode = "conflict"
+	CodeAccessExpired  ErrorCode = "access_expired"
+	CodeClaimNotFound  ErrorCode = "claim_not_found"
+	CodeRateLimited    ErrorCode = "rate_limited"
+	CodeUnauthorized   ErrorCode = "unauthorized"
+	CodeInternal       ErrorCode = "internal"
+)
+
+// ErrorResponse is the reply to a failed request, over NATS and HTTP
+type ErrorResponse struct {
+	Error string    `json:"error"`
+	Code  ErrorCode `json:"code"`
+	Field string    `json:"field,omitempty"` // The invalid request field, if any
+}
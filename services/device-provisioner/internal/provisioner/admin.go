@@ -0,0 +1,187 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/audit"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SubjectList takes a models.ListRequest, or nothing for the first page
+	// of all devices, and replies with a models.DeviceList
+	SubjectList = "home.provisioning.list"
+
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// GetDevice returns a device from the registry
+func (p *Provisioner) GetDevice(ctx context.Context, deviceID string) (*models.DeviceInfo, error) {
+	device, err := p.getDevice(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	return &models.DeviceInfo{DeviceCredentials: *device, Status: p.status(device, time.Now())}, nil
+}
+
+// QueryDevices returns a page of devices matching the request's filters,
+// ordered by device ID
+func (p *Provisioner) QueryDevices(ctx context.Context, req models.ListRequest) (*models.DeviceList, error) {
+	switch req.Status {
+	case "", models.StatusActive, models.StatusExpiring, models.StatusExpired, models.StatusRevoked:
+	default:
+		return nil, invalidField("status", "unknown status %q", req.Status)
+	}
+	if req.Limit < 0 {
+		return nil, invalidField("limit", "limit must not be negative")
+	}
+	if req.Limit == 0 {
+		req.Limit = defaultListLimit
+	}
+	if req.Limit > maxListLimit {
+		req.Limit = maxListLimit
+	}
+
+	devices, err := p.ListDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].DeviceID < devices[j].DeviceID })
+
+	now := time.Now()
+	list := &models.DeviceList{Devices: make([]models.DeviceInfo, 0)}
+	for i := range devices {
+		device := &devices[i]
+		if !p.matches(device, req, now) {
+			continue
+		}
+
+		list.Total++
+		if device.DeviceID <= req.Cursor {
+			continue
+		}
+		if n := len(list.Devices); n == req.Limit {
+			// More devices follow the page
+			list.NextCursor = list.Devices[n-1].DeviceID
+			continue
+		}
+		list.Devices = append(list.Devices, models.DeviceInfo{DeviceCredentials: *device, Status: p.status(device, now)})
+	}
+
+	return list, nil
+}
+
+// ReissueDevice gives a device new credentials on an admin's behalf, as a
+// renewal does but without the device's signature. The outgoing key is
+// revoked, so whoever holds the previous credentials is cut off. Without a
+// revocation push the previous JWT stays valid until it expires.
+func (p *Provisioner) ReissueDevice(ctx context.Context, deviceID string, format models.BundleFormat) (*models.ProvisionResponse, error) {
+	if err := validBundleFormat(format); err != nil {
+		return nil, err
+	}
+
+	device, err := p.getDevice(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if device.RevokedAt != nil {
+		return nil, fmt.Errorf("%w: %s", ErrDeviceRevoked, deviceID)
+	}
+
+	outgoing := device.PublicKey
+	resp, err := p.rotate(ctx, device, format, "", "", audit.OpReissue)
+	if err != nil {
+		return nil, err
+	}
+
+	// The new credentials are issued, so a failed revocation is logged for
+	// the admin to retry with a revoke rather than failing the reissue
+	if err := p.revokeRetired(ctx, deviceID, outgoing, resp.CreatedAt); err != nil {
+		p.log.WithError(err).WithFields(logrus.Fields{
+			"device_id":  deviceID,
+			"public_key": outgoing,
+		}).Error("Failed to revoke the reissued device's previous key")
+	}
+	return resp, nil
+}
+
+// revokeRetired pushes the revocation of a key a device held before its
+// last rotation
+func (p *Provisioner) revokeRetired(ctx context.Context, deviceID, publicKey string, revokedAt time.Time) error {
+	if !p.canPushRevocations() {
+		p.log.WithField("device_id", deviceID).Warn("Revocation push not configured, the previous credentials stay valid until they expire")
+		return nil
+	}
+	if err := p.pushRevocation(ctx, revokedAt, publicKey); err != nil {
+		return fmt.Errorf("previous key revoked in registry but not in account JWT: %w", err)
+	}
+	return nil
+}
+
+// DeleteDevice removes a device from the registry, revoking it first if it
+// is still active
+func (p *Provisioner) DeleteDevice(ctx context.Context, deviceID string) error {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		device, rev, err := p.loadDevice(ctx, deviceID)
+		if err != nil {
+			return err
+		}
+
+		if device.RevokedAt == nil {
+			if err := p.RevokeDevice(ctx, deviceID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Only delete the revision that was checked, a device provisioned
+		// again in between stays
+		err = p.kv.Delete(ctx, deviceID, jetstream.LastRevision(rev))
+		if isConflict(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to delete device %s: %w", deviceID, err)
+		}
+		if err := p.record(ctx, audit.Record{Operation: audit.OpDelete, DeviceID: deviceID, PublicKey: device.PublicKey}); err != nil {
+			return err
+		}
+
+		p.log.WithFields(logrus.Fields{
+			"device_id":   deviceID,
+			"device_type": device.DeviceType,
+		}).Info("Device deleted")
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrConcurrentUpdate, deviceID)
+}
+
+// status returns the status of a device's credentials at now
+func (p *Provisioner) status(device *models.DeviceCredentials, now time.Time) models.DeviceStatus {
+	switch {
+	case device.RevokedAt != nil:
+		return models.StatusRevoked
+	case !now.Before(device.ExpiresAt):
+		return models.StatusExpired
+	case now.Add(p.renewWindow).After(device.ExpiresAt):
+		return models.StatusExpiring
+	}
+	return models.StatusActive
+}
+
+// matches reports whether a device passes a list request's filters
+func (p *Provisioner) matches(device *models.DeviceCredentials, req models.ListRequest, now time.Time) bool {
+	if req.DeviceType != "" && device.DeviceType != req.DeviceType {
+		return false
+	}
+	if req.Role != "" && device.Role != req.Role {
+		return false
+	}
+	return req.Status == "" || p.status(device, now) == req.Status
+}
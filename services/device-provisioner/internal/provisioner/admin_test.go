@@ -0,0 +1,88 @@
+package provisioner_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/provisioner"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListDevicesOverNATS(t *testing.T) {
+	env := runOperatorServer(t)
+	ctx := context.Background()
+
+	// A device close to expiry, then one with the default lifetime
+	short := newProvisioner(t, env, func(cfg *provisioner.Config) {
+		cfg.CredentialTTL = time.Hour
+		cfg.RenewWindow = time.Minute
+	})
+	_, err := short.ProvisionDevice(ctx, models.ProvisionRequest{DeviceID: "garage", DeviceType: models.DeviceTypeCover, Name: "Garage Door"})
+	require.NoError(t, err)
+
+	prov := newProvisioner(t, env, func(cfg *provisioner.Config) {
+		cfg.RenewWindow = 24 * time.Hour
+	})
+	_, err = prov.ProvisionDevice(ctx, models.ProvisionRequest{DeviceID: "gate", DeviceType: models.DeviceTypeCover, Name: "Gate"})
+	require.NoError(t, err)
+	runProvisioner(t, env, prov)
+
+	list := func(req interface{}) models.DeviceList {
+		t.Helper()
+		var data []byte
+		if req != nil {
+			data, err = json.Marshal(req)
+			require.NoError(t, err)
+		}
+		msg, err := env.home.Request(provisioner.SubjectList, data, 2*time.Second)
+		require.NoError(t, err)
+
+		var list models.DeviceList
+		require.NoError(t, json.Unmarshal(msg.Data, &list), string(msg.Data))
+		return list
+	}
+
+	all := list(nil)
+	require.Len(t, all.Devices, 2)
+	assert.Equal(t, "garage", all.Devices[0].DeviceID)
+	assert.Equal(t, models.StatusExpiring, all.Devices[0].Status)
+	assert.Equal(t, models.StatusActive, all.Devices[1].Status)
+
+	expiring := list(models.ListRequest{DeviceType: models.DeviceTypeCover, Status: models.StatusExpiring})
+	require.Len(t, expiring.Devices, 1)
+	assert.Equal(t, "garage", expiring.Devices[0].DeviceID)
+
+	assert.Empty(t, list(models.ListRequest{DeviceType: models.DeviceTypeLight}).Devices)
+}
+
+func TestReissueDeviceRevokesOutgoingKey(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env, withRevocationPush(t, env))
+	ctx := context.Background()
+
+	original, err := prov.ProvisionDevice(ctx, models.ProvisionRequest{
+		DeviceID:   "backdoor",
+		DeviceType: models.DeviceTypeLock,
+		Name:       "Back Door",
+	})
+	require.NoError(t, err)
+	reissued, err := prov.ReissueDevice(ctx, "backdoor", "")
+	require.NoError(t, err)
+
+	_, err = nats.Connect(env.server.ClientURL(), nats.UserJWTAndSeed(original.JWT, original.Seed), nats.NoReconnect())
+	assert.Error(t, err, "the outgoing credentials must be rejected")
+	device, err := nats.Connect(env.server.ClientURL(), nats.UserJWTAndSeed(reissued.JWT, reissued.Seed), nats.NoReconnect())
+	require.NoError(t, err, "reissued credentials must be accepted")
+	device.Close()
+
+	info, err := prov.GetDevice(ctx, "backdoor")
+	require.NoError(t, err)
+	assert.Nil(t, info.RevokedAt)
+	require.Len(t, info.PreviousKeys, 1)
+	assert.NotNil(t, info.PreviousKeys[0].RevokedAt)
+}
@@ -0,0 +1,89 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/audit"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+)
+
+// SubjectAudit takes an audit.Query, or nothing for the first page of all
+// records, and replies with an audit.Page
+const SubjectAudit = "home.provisioning.audit"
+
+// Audit returns the audit log of credential operations
+func (p *Provisioner) Audit() *audit.Log {
+	return p.audit
+}
+
+// QueryAudit returns a page of audit records matching q
+func (p *Provisioner) QueryAudit(ctx context.Context, q audit.Query) (*audit.Page, error) {
+	if q.Limit < 0 {
+		return nil, invalidField("limit", "limit must not be negative")
+	}
+	return p.audit.Query(ctx, q)
+}
+
+// recordIssued records credentials issued to a device, taking the public key
+// and JWT ID from the token
+func (p *Provisioner) recordIssued(ctx context.Context, op audit.Operation, deviceID, token string) error {
+	claims, err := jwt.DecodeUserClaims(token)
+	if err != nil {
+		return fmt.Errorf("failed to decode issued JWT: %w", err)
+	}
+	return p.record(ctx, audit.Record{
+		Operation: op,
+		DeviceID:  deviceID,
+		PublicKey: claims.Subject,
+		JWTID:     claims.ID,
+	})
+}
+
+// record appends a credential operation to the audit log
+func (p *Provisioner) record(ctx context.Context, rec audit.Record) error {
+	if _, err := p.audit.Append(ctx, rec); err != nil {
+		return fmt.Errorf("failed to record %s of device %s: %w", rec.Operation, rec.DeviceID, err)
+	}
+	return nil
+}
+
+// natsActor names who sent a request. The server sets Nats-Request-Info on
+// requests that reach the provisioner through a service import; users of the
+// provisioner's own account could set it themselves, so it names them only
+// as reliably as that account's users can be trusted.
+func natsActor(msg *nats.Msg) audit.Actor {
+	actor := audit.Actor{Kind: audit.ActorNATS}
+	if msg.Header == nil {
+		return actor
+	}
+
+	var info struct {
+		Account string `json:"acc"`
+		User    string `json:"user"`
+		Name    string `json:"name"`
+		Host    string `json:"host"`
+	}
+	if data := msg.Header.Get("Nats-Request-Info"); data != "" && json.Unmarshal([]byte(data), &info) == nil {
+		actor.Name = info.User
+		if actor.Name == "" {
+			actor.Name = info.Name
+		}
+		actor.Account = info.Account
+		actor.Address = info.Host
+	}
+	actor.OnBehalfOf = msg.Header.Get(audit.HeaderActor)
+	return actor
+}
+
+// deviceActor returns ctx with the device as the actor, for requests the
+// device proved it made. Where the request came from is kept.
+func deviceActor(ctx context.Context, deviceID string) context.Context {
+	actor := audit.ActorFrom(ctx)
+	actor.Kind = audit.ActorDevice
+	actor.Name = deviceID
+	actor.OnBehalfOf = ""
+	return audit.WithActor(ctx, actor)
+}
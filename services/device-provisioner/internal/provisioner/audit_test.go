@@ -0,0 +1,121 @@
+package provisioner_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/audit"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/provisioner"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditOverNATS(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env)
+	runProvisioner(t, env, prov)
+
+	request := func(subject string, req interface{}, out interface{}) {
+		t.Helper()
+		msg := nats.NewMsg(subject)
+		msg.Header.Set(audit.HeaderActor, "installer")
+		if req != nil {
+			data, err := json.Marshal(req)
+			require.NoError(t, err)
+			msg.Data = data
+		}
+		reply, err := env.home.RequestMsg(msg, 2*time.Second)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(reply.Data, out), string(reply.Data))
+	}
+
+	var created models.ProvisionResponse
+	request("home.provisioning.request", models.ProvisionRequest{DeviceID: "study", DeviceType: models.DeviceTypeLight}, &created)
+	require.NotEmpty(t, created.JWT)
+
+	// The device renews itself
+	device, err := nats.Connect(env.server.ClientURL(),
+		nats.UserJWTAndSeed(created.JWT, created.Seed),
+		nats.CustomInboxPrefix(created.Subjects.InboxPrefix),
+	)
+	require.NoError(t, err)
+	defer device.Close()
+	data, err := json.Marshal(signRenewal(t, "study", created.Seed, requestNonce(t, device)))
+	require.NoError(t, err)
+	msg, err := device.Request(provisioner.SubjectRenew, data, 2*time.Second)
+	require.NoError(t, err)
+	var renewed models.ProvisionResponse
+	require.NoError(t, json.Unmarshal(msg.Data, &renewed))
+
+	var revoked map[string]bool
+	msg, err = env.home.Request("home.provisioning.revoke", []byte("study"), 2*time.Second)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(msg.Data, &revoked))
+	require.True(t, revoked["success"], string(msg.Data))
+
+	var page audit.Page
+	request(provisioner.SubjectAudit, audit.Query{DeviceID: "study"}, &page)
+	require.Len(t, page.Records, 3)
+
+	provisioned, renewal, revocation := page.Records[0], page.Records[1], page.Records[2]
+	user, err := jwt.DecodeUserClaims(created.JWT)
+	require.NoError(t, err)
+	assert.Equal(t, audit.OpProvision, provisioned.Operation)
+	assert.Equal(t, user.Subject, provisioned.PublicKey)
+	assert.Equal(t, user.ID, provisioned.JWTID)
+	assert.Equal(t, audit.Actor{Kind: audit.ActorNATS, OnBehalfOf: "installer"}, provisioned.Actor)
+
+	user, err = jwt.DecodeUserClaims(renewed.JWT)
+	require.NoError(t, err)
+	assert.Equal(t, audit.OpRenew, renewal.Operation)
+	assert.Equal(t, user.ID, renewal.JWTID)
+	assert.Equal(t, audit.Actor{Kind: audit.ActorDevice, Name: "study"}, renewal.Actor)
+
+	assert.Equal(t, audit.OpRevoke, revocation.Operation)
+	assert.Equal(t, user.Subject, revocation.PublicKey)
+	assert.Empty(t, revocation.JWTID)
+
+	// Records are signed with the provisioner's signing key
+	assert.Equal(t, publicKey(t, env.accountSigningKey), revocation.Signer)
+	report, err := prov.Audit().Verify(context.Background(), prov.Audit().Signer())
+	require.NoError(t, err)
+	assert.True(t, report.OK(), report.Problems)
+	assert.Equal(t, 3, report.Records)
+}
+
+func TestAuditClaims(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env)
+	ctx := audit.WithActor(context.Background(), audit.Actor{Kind: audit.ActorCLI, Name: "root"})
+
+	claim, err := prov.CreateClaim(ctx, models.ClaimRequest{ProvisionRequest: models.ProvisionRequest{
+		DeviceID:   "cellar",
+		DeviceType: models.DeviceTypeSensor,
+	}})
+	require.NoError(t, err)
+	_, err = prov.RedeemClaim(context.Background(), models.RedeemRequest{DeviceID: "cellar", PIN: claim.PIN})
+	require.NoError(t, err)
+	require.NoError(t, prov.DeleteDevice(ctx, "cellar"))
+
+	page, err := prov.QueryAudit(context.Background(), audit.Query{})
+	require.NoError(t, err)
+	var ops []audit.Operation
+	for _, rec := range page.Records {
+		ops = append(ops, rec.Operation)
+	}
+	assert.Equal(t, []audit.Operation{audit.OpClaimCreate, audit.OpClaimRedeem, audit.OpRevoke, audit.OpDelete}, ops)
+
+	bootstrap, err := jwt.DecodeUserClaims(claim.Bootstrap.JWT)
+	require.NoError(t, err)
+	assert.Equal(t, bootstrap.Subject, page.Records[0].PublicKey)
+	assert.Equal(t, audit.Actor{Kind: audit.ActorCLI, Name: "root"}, page.Records[0].Actor)
+	assert.Equal(t, audit.Actor{Kind: audit.ActorDevice, Name: "cellar"}, page.Records[1].Actor)
+
+	_, err = prov.QueryAudit(context.Background(), audit.Query{Limit: -1})
+	assert.True(t, provisioner.IsInvalidRequest(err))
+}
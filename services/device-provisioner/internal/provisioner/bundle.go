@@ -0,0 +1,132 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/nats-io/jwt/v2"
+)
+
+// jsonBundle is the content of a models.BundleJSON bundle
+type jsonBundle struct {
+	DeviceID  string          `json:"device_id"`
+	Server    string          `json:"server"`
+	JWT       string          `json:"jwt"`
+	Seed      string          `json:"seed"`
+	Creds     string          `json:"creds"`
+	ExpiresAt time.Time       `json:"expires_at"`
+	Subjects  models.Subjects `json:"subjects"`
+}
+
+// validBundleFormat returns an error unless format is empty or known
+func validBundleFormat(format models.BundleFormat) error {
+	switch format {
+	case "", models.BundleCreds, models.BundleESPHome, models.BundleArduino, models.BundleJSON:
+		return nil
+	}
+	return invalidField("format", "unknown bundle format %q", format)
+}
+
+// addCreds fills in the response's .creds file and the bundle in the
+// requested format, if any. Without a seed there is neither.
+func (p *Provisioner) addCreds(resp *models.ProvisionResponse, format models.BundleFormat) error {
+	if resp.Seed == "" {
+		return nil
+	}
+
+	creds, err := jwt.FormatUserConfig(resp.JWT, []byte(resp.Seed))
+	if err != nil {
+		return fmt.Errorf("failed to format creds: %w", err)
+	}
+	resp.Creds = string(creds)
+
+	if format == "" {
+		return nil
+	}
+
+	bundle, err := p.bundle(resp, format)
+	if err != nil {
+		return err
+	}
+	resp.Bundle = bundle
+	return nil
+}
+
+// bundle renders credentials in a bundle format
+func (p *Provisioner) bundle(resp *models.ProvisionResponse, format models.BundleFormat) (*models.Bundle, error) {
+	host, port := serverAddress(p.serverURL)
+	header := fmt.Sprintf("Homix credentials for %s, expire %s", resp.DeviceID, resp.ExpiresAt.UTC().Format(time.RFC3339))
+
+	var b strings.Builder
+	switch format {
+	case models.BundleCreds:
+		return &models.Bundle{Format: format, Filename: resp.DeviceID + ".creds", Content: resp.Creds}, nil
+
+	case models.BundleESPHome:
+		fmt.Fprintf(&b, "# %s\n", header)
+		fmt.Fprintf(&b, "nats_server: %s\n", strconv.Quote(host))
+		fmt.Fprintf(&b, "nats_port: %d\n", port)
+		fmt.Fprintf(&b, "nats_device_id: %s\n", strconv.Quote(resp.DeviceID))
+		fmt.Fprintf(&b, "nats_inbox_prefix: %s\n", strconv.Quote(resp.Subjects.InboxPrefix))
+		fmt.Fprintf(&b, "nats_jwt: %s\n", strconv.Quote(resp.JWT))
+		fmt.Fprintf(&b, "nats_seed: %s\n", strconv.Quote(resp.Seed))
+		return &models.Bundle{Format: format, Filename: "secrets.yaml", Content: b.String()}, nil
+
+	case models.BundleArduino:
+		fmt.Fprintf(&b, "// %s\n", header)
+		b.WriteString("// Keep this file out of version control\n")
+		b.WriteString("#pragma once\n\n")
+		fmt.Fprintf(&b, "#define HOMIX_NATS_SERVER %s\n", strconv.Quote(host))
+		fmt.Fprintf(&b, "#define HOMIX_NATS_PORT %d\n", port)
+		fmt.Fprintf(&b, "#define HOMIX_DEVICE_ID %s\n", strconv.Quote(resp.DeviceID))
+		fmt.Fprintf(&b, "#define HOMIX_NATS_INBOX_PREFIX %s\n", strconv.Quote(resp.Subjects.InboxPrefix))
+		fmt.Fprintf(&b, "#define HOMIX_NATS_JWT %s\n", strconv.Quote(resp.JWT))
+		fmt.Fprintf(&b, "#define HOMIX_NATS_SEED %s\n", strconv.Quote(resp.Seed))
+		b.WriteString("\n// For the Arduino NATS client: include this file before NATSClient.h and\n")
+		b.WriteString("// pass NATS_INBOX_PREFIX to setInboxPrefix()\n")
+		fmt.Fprintf(&b, "#define NATS_INBOX_PREFIX %s\n", strconv.Quote(resp.Subjects.InboxPrefix+"."))
+		return &models.Bundle{Format: format, Filename: "homix_credentials.h", Content: b.String()}, nil
+
+	case models.BundleJSON:
+		data, err := json.MarshalIndent(jsonBundle{
+			DeviceID:  resp.DeviceID,
+			Server:    p.serverURL,
+			JWT:       resp.JWT,
+			Seed:      resp.Seed,
+			Creds:     resp.Creds,
+			ExpiresAt: resp.ExpiresAt,
+			Subjects:  resp.Subjects,
+		}, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal bundle: %w", err)
+		}
+		return &models.Bundle{Format: format, Filename: resp.DeviceID + ".json", Content: string(data)}, nil
+	}
+
+	return nil, validBundleFormat(format)
+}
+
+// serverAddress splits a NATS URL into host and port for clients that take
+// them separately
+func serverAddress(serverURL string) (string, int) {
+	u, err := url.Parse(serverURL)
+	if err != nil || u.Host == "" {
+		return serverURL, 4222
+	}
+
+	host, portStr, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return u.Host, 4222
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return host, 4222
+	}
+	return host, port
+}
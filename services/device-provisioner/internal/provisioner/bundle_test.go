@@ -0,0 +1,89 @@
+package provisioner_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/provisioner"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvisionReturnsCredsFile(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env, func(cfg *provisioner.Config) {
+		cfg.ServerURL = "nats://hub.local:4223"
+	})
+
+	resp, err := prov.ProvisionDevice(context.Background(), models.ProvisionRequest{
+		DeviceID:   "bedroom",
+		DeviceType: models.DeviceTypeLight,
+		Name:       "Bedroom Light",
+		Format:     models.BundleJSON,
+	})
+	require.NoError(t, err)
+	assert.Contains(t, resp.Creds, "-----BEGIN NATS USER JWT-----")
+
+	// The creds file works as is with nats.UserCredentials
+	path := filepath.Join(t.TempDir(), "bedroom.creds")
+	require.NoError(t, os.WriteFile(path, []byte(resp.Creds), 0o600))
+	nc, err := nats.Connect(env.server.ClientURL(), nats.UserCredentials(path))
+	require.NoError(t, err)
+	nc.Close()
+
+	require.NotNil(t, resp.Bundle)
+	assert.Equal(t, "bedroom.json", resp.Bundle.Filename)
+	var bundle struct {
+		Server   string          `json:"server"`
+		Creds    string          `json:"creds"`
+		Subjects models.Subjects `json:"subjects"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(resp.Bundle.Content), &bundle))
+	assert.Equal(t, "nats://hub.local:4223", bundle.Server)
+	assert.Equal(t, resp.Creds, bundle.Creds)
+	assert.Equal(t, resp.Subjects, bundle.Subjects)
+}
+
+func TestProvisionBundleFormats(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env, func(cfg *provisioner.Config) {
+		cfg.ServerURL = "nats://hub.local:4223"
+	})
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		format   models.BundleFormat
+		filename string
+		contains []string
+	}{
+		{models.BundleCreds, "creds-sensor.creds", []string{"-----BEGIN USER NKEY SEED-----"}},
+		{models.BundleESPHome, "secrets.yaml", []string{`nats_server: "hub.local"`, "nats_port: 4223", `nats_device_id: "esphome-sensor"`, `nats_inbox_prefix: "_INBOX_esphome-sensor"`, "nats_jwt: "}},
+		{models.BundleArduino, "homix_credentials.h", []string{"#pragma once", `#define HOMIX_NATS_SERVER "hub.local"`, "#define HOMIX_NATS_PORT 4223", `#define HOMIX_NATS_INBOX_PREFIX "_INBOX_arduino-sensor"`, "#define HOMIX_NATS_SEED \"SU", `#define NATS_INBOX_PREFIX "_INBOX_arduino-sensor."`}},
+	} {
+		resp, err := prov.ProvisionDevice(ctx, models.ProvisionRequest{
+			DeviceID:   string(tc.format) + "-sensor",
+			DeviceType: models.DeviceTypeSensor,
+			Name:       "Sensor",
+			Format:     tc.format,
+		})
+		require.NoError(t, err, tc.format)
+		require.NotNil(t, resp.Bundle, tc.format)
+		assert.Equal(t, tc.filename, resp.Bundle.Filename)
+		for _, s := range tc.contains {
+			assert.Contains(t, resp.Bundle.Content, s, tc.format)
+		}
+		assert.Contains(t, resp.Bundle.Content, resp.JWT, tc.format)
+	}
+
+	_, err := prov.ProvisionDevice(ctx, models.ProvisionRequest{
+		DeviceID:   "zip",
+		DeviceType: models.DeviceTypeSensor,
+		Format:     "zip",
+	})
+	assert.ErrorContains(t, err, "unknown bundle format")
+}
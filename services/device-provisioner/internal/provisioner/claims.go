@@ -0,0 +1,345 @@
+package provisioner
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/audit"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// SubjectClaimCreate takes a models.ClaimRequest from an admin and
+	// replies with a models.ClaimResponse
+	SubjectClaimCreate = "home.provisioning.claim.create"
+
+	// SubjectClaimRedeem takes a models.RedeemRequest from a device on its
+	// bootstrap credentials and replies with its credentials. The wildcard is
+	// the device ID, see ClaimRedeemSubject.
+	SubjectClaimRedeem = "home.provisioning.claim.*.redeem"
+
+	DefaultClaimTTL    = 15 * time.Minute
+	DefaultClaimBucket = "device-claims"
+
+	// A claim is burned after this many wrong PINs
+	maxClaimAttempts = 5
+
+	// Redeem attempts allowed per device ID: a burst, then one per interval
+	redeemBurst    = 3
+	redeemInterval = 10 * time.Second
+
+	// Rate limits kept before idle ones are dropped
+	maxRedeemLimiters = 1024
+)
+
+// ClaimRedeemSubject is the subject a device redeems its claim on. Bootstrap
+// credentials may only publish on their own device's.
+func ClaimRedeemSubject(deviceID string) string {
+	return "home.provisioning.claim." + deviceID + ".redeem"
+}
+
+// claim is a pending onboarding as stored in the claims bucket
+type claim struct {
+	Request   models.ProvisionRequest `json:"request"`
+	PINHash   string                  `json:"pin_hash"`
+	CreatedAt time.Time               `json:"created_at"`
+	ExpiresAt time.Time               `json:"expires_at"`
+	Attempts  int                     `json:"attempts"`
+}
+
+// redeemLimiter rate limits redeem attempts per device ID. Only devices with a
+// pending claim get a limit, and limits that filled back up are dropped once
+// there are too many, as they allow no more than a new one would.
+type redeemLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func (l *redeemLimiter) allow(deviceID string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limiters == nil {
+		l.limiters = make(map[string]*rate.Limiter)
+	}
+	limiter, ok := l.limiters[deviceID]
+	if !ok {
+		if len(l.limiters) >= maxRedeemLimiters {
+			now := time.Now()
+			for id, limiter := range l.limiters {
+				if limiter.TokensAt(now) >= redeemBurst {
+					delete(l.limiters, id)
+				}
+			}
+		}
+		limiter = rate.NewLimiter(rate.Every(redeemInterval), redeemBurst)
+		l.limiters[deviceID] = limiter
+	}
+	return limiter.Allow()
+}
+
+func (l *redeemLimiter) forget(deviceID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.limiters, deviceID)
+}
+
+// CreateClaim pre-registers a device and returns a one-time PIN for it.
+// Creating a claim for a device with a pending claim replaces that claim.
+func (p *Provisioner) CreateClaim(ctx context.Context, req models.ClaimRequest) (*models.ClaimResponse, error) {
+	if err := p.validateRequest(req.ProvisionRequest); err != nil {
+		return nil, err
+	}
+	if err := validBundleFormat(req.Format); err != nil {
+		return nil, err
+	}
+	if req.Key != nil {
+		return nil, invalidField("key", "a device gives its own key when it redeems the claim")
+	}
+
+	existing, err := p.getDevice(ctx, req.DeviceID)
+	if err == nil && existing != nil && existing.RevokedAt == nil {
+		return nil, fmt.Errorf("%w: %s", ErrDeviceExists, req.DeviceID)
+	}
+
+	pin, err := newPIN()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate PIN: %w", err)
+	}
+
+	now := time.Now()
+	expiry := now.Add(p.claimTTL)
+
+	bootstrap, err := p.bootstrapCredentials(req.DeviceID, expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.recordIssued(ctx, audit.OpClaimCreate, req.DeviceID, bootstrap.JWT); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(claim{
+		Request:   req.ProvisionRequest,
+		PINHash:   p.hashPIN(req.DeviceID, pin),
+		CreatedAt: now,
+		ExpiresAt: expiry,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal claim: %w", err)
+	}
+
+	if _, err := p.claims.Put(ctx, req.DeviceID, data); err != nil {
+		return nil, fmt.Errorf("failed to store claim: %w", err)
+	}
+	p.limiter.forget(req.DeviceID)
+
+	p.log.WithFields(logrus.Fields{
+		"device_id":  req.DeviceID,
+		"expires_at": expiry,
+	}).Info("Device claim created")
+
+	return &models.ClaimResponse{
+		DeviceID:  req.DeviceID,
+		PIN:       pin,
+		ExpiresAt: expiry,
+		QRPayload: "homix://claim?" + url.Values{
+			"server":    {p.serverURL},
+			"device_id": {req.DeviceID},
+			"pin":       {pin},
+		}.Encode(),
+		Bootstrap: *bootstrap,
+	}, nil
+}
+
+// RedeemClaim provisions a pre-registered device in exchange for its PIN.
+// Each claim can be redeemed once.
+func (p *Provisioner) RedeemClaim(ctx context.Context, req models.RedeemRequest) (*models.ProvisionResponse, error) {
+	if err := validateDeviceID(req.DeviceID); err != nil {
+		return nil, err
+	}
+	if req.PIN == "" {
+		return nil, invalidField("pin", "pin is required")
+	}
+	if err := validBundleFormat(req.Format); err != nil {
+		return nil, err
+	}
+
+	entry, err := p.claims.Get(ctx, req.DeviceID)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil, fmt.Errorf("%w for device %s", ErrClaimNotFound, req.DeviceID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load claim: %w", err)
+	}
+
+	if !p.limiter.allow(req.DeviceID) {
+		return nil, fmt.Errorf("%w for device %s, try again later", ErrTooManyAttempts, req.DeviceID)
+	}
+
+	// Check the device's own key before the claim is used up on it
+	if req.Key != nil {
+		if err := p.verifyKeyProof(req.DeviceID, "key", req.Key); err != nil {
+			return nil, err
+		}
+		if err := checkOwnKey("key", nil, req.Key.PublicKey, req.Format); err != nil {
+			return nil, err
+		}
+	}
+
+	var c claim
+	if err := json.Unmarshal(entry.Value(), &c); err != nil {
+		return nil, fmt.Errorf("failed to decode claim: %w", err)
+	}
+
+	if time.Now().After(c.ExpiresAt) {
+		p.claims.Delete(ctx, req.DeviceID, jetstream.LastRevision(entry.Revision()))
+		return nil, withMessage(ErrClaimNotFound, "claim for device %s has expired", req.DeviceID)
+	}
+
+	if !hmac.Equal([]byte(p.hashPIN(req.DeviceID, req.PIN)), []byte(c.PINHash)) {
+		return nil, p.countWrongPIN(ctx, req.DeviceID, entry)
+	}
+
+	// Deleting at the read revision makes the claim single use, even across
+	// provisioner replicas
+	if err := p.claims.Delete(ctx, req.DeviceID, jetstream.LastRevision(entry.Revision())); err != nil {
+		return nil, withMessage(ErrClaimNotFound, "claim for device %s was already used", req.DeviceID)
+	}
+	p.limiter.forget(req.DeviceID)
+
+	switch {
+	case req.Key != nil:
+		// There's no seed to put in the bundle chosen at claim creation
+		c.Request.Key = req.Key
+		c.Request.Format = req.Format
+	case req.Format != "":
+		c.Request.Format = req.Format
+	}
+	resp, err := p.provision(deviceActor(ctx, req.DeviceID), c.Request, audit.OpClaimRedeem)
+	if err != nil {
+		return nil, err
+	}
+
+	p.log.WithField("device_id", req.DeviceID).Info("Device claim redeemed")
+	return resp, nil
+}
+
+// countWrongPIN counts a wrong PIN against a claim and returns the error to
+// answer with, burning the claim after maxClaimAttempts. A count that loses a
+// race is retried on the claim as it is now, so parallel guesses all count;
+// every lost race means another guess was counted first, so this ends by the
+// time the claim burns.
+func (p *Provisioner) countWrongPIN(ctx context.Context, deviceID string, entry jetstream.KeyValueEntry) error {
+	for {
+		var c claim
+		if err := json.Unmarshal(entry.Value(), &c); err != nil {
+			return fmt.Errorf("failed to decode claim: %w", err)
+		}
+		c.Attempts++
+
+		var err error
+		if c.Attempts >= maxClaimAttempts {
+			err = p.claims.Delete(ctx, deviceID, jetstream.LastRevision(entry.Revision()))
+			if err == nil {
+				p.log.WithField("device_id", deviceID).Warn("Device claim burned after too many wrong PINs")
+				return withMessage(ErrClaimNotFound, "claim for device %s is locked after too many wrong PINs", deviceID)
+			}
+		} else {
+			data, merr := json.Marshal(c)
+			if merr != nil {
+				return fmt.Errorf("failed to marshal claim: %w", merr)
+			}
+			if _, err = p.claims.Update(ctx, deviceID, data, entry.Revision()); err == nil {
+				return invalidField("pin", "invalid PIN")
+			}
+		}
+		if !isConflict(err) {
+			return fmt.Errorf("failed to count wrong PIN: %w", err)
+		}
+
+		entry, err = p.claims.Get(ctx, deviceID)
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			// Redeemed or burned in the meantime
+			return withMessage(ErrClaimNotFound, "claim for device %s was already used", deviceID)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load claim: %w", err)
+		}
+	}
+}
+
+// bootstrapCredentials issues a user that may only redeem the device's claim
+// and read the replies on its own inbox prefix
+func (p *Provisioner) bootstrapCredentials(deviceID string, expiry time.Time) (*models.BootstrapCredentials, error) {
+	key, err := nkeys.CreateUser()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bootstrap key: %w", err)
+	}
+	pub, err := key.PublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bootstrap public key: %w", err)
+	}
+	seed, err := key.Seed()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bootstrap seed: %w", err)
+	}
+
+	inbox := inboxPrefix(deviceID)
+
+	claims := jwt.NewUserClaims(pub)
+	claims.Name = "bootstrap-" + deviceID
+	claims.Expires = expiry.Unix()
+	claims.Pub.Allow.Add(ClaimRedeemSubject(deviceID), SubjectNonce)
+	claims.Sub.Allow.Add(inbox + ".>")
+
+	token, err := p.sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.BootstrapCredentials{
+		JWT:         token,
+		Seed:        string(seed),
+		InboxPrefix: inbox,
+	}, nil
+}
+
+// newPIN returns a random 8 digit PIN
+func newPIN() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(100_000_000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%08d", n), nil
+}
+
+// pinKey derives the key claim PINs are hashed with from the account signing
+// key seed, so a leaked claims bucket can't be brute forced without it
+func pinKey(seed string) []byte {
+	mac := hmac.New(sha256.New, []byte(seed))
+	mac.Write([]byte("homix device claim pin"))
+	return mac.Sum(nil)
+}
+
+// hashPIN binds a PIN to its device so stored hashes can't be swapped
+func (p *Provisioner) hashPIN(deviceID, pin string) string {
+	mac := hmac.New(sha256.New, p.pinKey)
+	mac.Write([]byte(deviceID + ":" + pin))
+	return hex.EncodeToString(mac.Sum(nil))
+}
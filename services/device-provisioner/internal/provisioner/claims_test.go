@@ -0,0 +1,222 @@
+package provisioner_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/provisioner"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaimFlow(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env, func(cfg *provisioner.Config) {
+		cfg.ServerURL = env.server.ClientURL()
+	})
+	runProvisioner(t, env, prov)
+
+	// An admin pre-registers the device
+	data, err := json.Marshal(models.ClaimRequest{ProvisionRequest: models.ProvisionRequest{
+		DeviceID:   "office",
+		DeviceType: models.DeviceTypeThermostat,
+		Name:       "Office Thermostat",
+	}})
+	require.NoError(t, err)
+	msg, err := env.home.Request(provisioner.SubjectClaimCreate, data, 2*time.Second)
+	require.NoError(t, err)
+
+	var claim models.ClaimResponse
+	require.NoError(t, json.Unmarshal(msg.Data, &claim))
+	require.Len(t, claim.PIN, 8, "unexpected response %s", msg.Data)
+
+	qr, err := url.Parse(claim.QRPayload)
+	require.NoError(t, err)
+	assert.Equal(t, "homix", qr.Scheme)
+	assert.Equal(t, env.server.ClientURL(), qr.Query().Get("server"))
+	assert.Equal(t, "office", qr.Query().Get("device_id"))
+	assert.Equal(t, claim.PIN, qr.Query().Get("pin"))
+
+	// The device connects on its bootstrap credentials, which allow nothing
+	// but redeeming the claim
+	denied := make(chan error, 1)
+	device, err := nats.Connect(env.server.ClientURL(),
+		nats.UserJWTAndSeed(claim.Bootstrap.JWT, claim.Bootstrap.Seed),
+		nats.CustomInboxPrefix(claim.Bootstrap.InboxPrefix),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			denied <- err
+		}),
+	)
+	require.NoError(t, err)
+	defer device.Close()
+
+	// Not even another device's claim
+	for _, subject := range []string{"home.provisioning.request", provisioner.ClaimRedeemSubject("attic")} {
+		require.NoError(t, device.Publish(subject, data))
+		select {
+		case err := <-denied:
+			assert.Contains(t, strings.ToLower(err.Error()), "permissions violation")
+		case <-time.After(2 * time.Second):
+			t.Fatalf("bootstrap credentials may publish on %s", subject)
+		}
+	}
+
+	redeem := func(deviceID, pin string) (*models.ProvisionResponse, string) {
+		data, err := json.Marshal(models.RedeemRequest{DeviceID: deviceID, PIN: pin})
+		require.NoError(t, err)
+		msg, err := device.Request(provisioner.ClaimRedeemSubject("office"), data, 2*time.Second)
+		require.NoError(t, err)
+
+		var reply struct {
+			models.ProvisionResponse
+			Error string `json:"error"`
+		}
+		require.NoError(t, json.Unmarshal(msg.Data, &reply))
+		return &reply.ProvisionResponse, reply.Error
+	}
+
+	// The device ID in the request must be the one in the subject
+	_, errMsg := redeem("attic", claim.PIN)
+	assert.Contains(t, errMsg, "device_id must be the device in the subject")
+
+	_, errMsg = redeem("", "00000000")
+	if claim.PIN == "00000000" {
+		_, errMsg = redeem("", "11111111")
+	}
+	assert.Equal(t, "invalid PIN", errMsg)
+
+	creds, errMsg := redeem("", claim.PIN)
+	require.Empty(t, errMsg)
+	assert.Equal(t, "office", creds.DeviceID)
+
+	full, err := nats.Connect(env.server.ClientURL(), nats.UserJWTAndSeed(creds.JWT, creds.Seed))
+	require.NoError(t, err, "redeemed credentials must be accepted")
+	full.Close()
+
+	// Claims are single use
+	_, errMsg = redeem("office", claim.PIN)
+	assert.Contains(t, errMsg, "no pending claim")
+}
+
+func TestClaimRedeemLimits(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env, func(cfg *provisioner.Config) {
+		cfg.ClaimTTL = time.Second
+	})
+	ctx := context.Background()
+
+	request := models.ClaimRequest{ProvisionRequest: models.ProvisionRequest{
+		DeviceID:   "shed",
+		DeviceType: models.DeviceTypeLock,
+		Name:       "Shed Lock",
+	}}
+	claim, err := prov.CreateClaim(ctx, request)
+	require.NoError(t, err)
+
+	wrong := "00000000"
+	if claim.PIN == wrong {
+		wrong = "11111111"
+	}
+
+	// A burst of wrong PINs, then the device ID is rate limited even with
+	// the right one
+	for i := 0; i < 3; i++ {
+		_, err := prov.RedeemClaim(ctx, models.RedeemRequest{DeviceID: "shed", PIN: wrong})
+		require.EqualError(t, err, "invalid PIN")
+	}
+	_, err = prov.RedeemClaim(ctx, models.RedeemRequest{DeviceID: "shed", PIN: claim.PIN})
+	assert.ErrorContains(t, err, "too many attempts")
+
+	// A new claim resets the limit, and claims expire
+	claim, err = prov.CreateClaim(ctx, request)
+	require.NoError(t, err)
+	time.Sleep(1100 * time.Millisecond)
+	_, err = prov.RedeemClaim(ctx, models.RedeemRequest{DeviceID: "shed", PIN: claim.PIN})
+	assert.ErrorContains(t, err, "expired")
+
+	// Provisioned devices can't be claimed again
+	claim, err = prov.CreateClaim(ctx, request)
+	require.NoError(t, err)
+	_, err = prov.RedeemClaim(ctx, models.RedeemRequest{DeviceID: "shed", PIN: claim.PIN})
+	require.NoError(t, err)
+	_, err = prov.CreateClaim(ctx, request)
+	assert.ErrorContains(t, err, "already provisioned")
+}
+
+func TestClaimCountsParallelWrongPINs(t *testing.T) {
+	env := runOperatorServer(t)
+	replicas := []*provisioner.Provisioner{newProvisioner(t, env), newProvisioner(t, env)}
+	ctx := context.Background()
+
+	claim, err := replicas[0].CreateClaim(ctx, models.ClaimRequest{ProvisionRequest: models.ProvisionRequest{
+		DeviceID:   "porch",
+		DeviceType: models.DeviceTypeLight,
+		Name:       "Porch Light",
+	}})
+	require.NoError(t, err)
+
+	wrong := "00000000"
+	if claim.PIN == wrong {
+		wrong = "11111111"
+	}
+
+	// Each replica allows a burst of three; all six guesses count towards
+	// the claim's five, even though they race each other
+	var wg sync.WaitGroup
+	for _, prov := range replicas {
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func(prov *provisioner.Provisioner) {
+				defer wg.Done()
+				_, err := prov.RedeemClaim(ctx, models.RedeemRequest{DeviceID: "porch", PIN: wrong})
+				assert.Error(t, err)
+			}(prov)
+		}
+	}
+	wg.Wait()
+
+	_, err = replicas[1].RedeemClaim(ctx, models.RedeemRequest{DeviceID: "porch", PIN: claim.PIN})
+	assert.ErrorIs(t, err, provisioner.ErrClaimNotFound)
+}
+
+func TestClaimPINHashIsKeyed(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env)
+	ctx := context.Background()
+
+	claim, err := prov.CreateClaim(ctx, models.ClaimRequest{ProvisionRequest: models.ProvisionRequest{
+		DeviceID:   "cellar",
+		DeviceType: models.DeviceTypeSensor,
+		Name:       "Cellar Sensor",
+	}})
+	require.NoError(t, err)
+
+	js, err := jetstream.New(env.home)
+	require.NoError(t, err)
+	kv, err := js.KeyValue(ctx, provisioner.DefaultClaimBucket)
+	require.NoError(t, err)
+	entry, err := kv.Get(ctx, "cellar")
+	require.NoError(t, err)
+	var stored struct {
+		PINHash string `json:"pin_hash"`
+	}
+	require.NoError(t, json.Unmarshal(entry.Value(), &stored))
+
+	// Without the provisioner's key the PIN can't be found from the hash
+	unkeyed := sha256.Sum256([]byte("cellar:" + claim.PIN))
+	assert.NotEmpty(t, stored.PINHash)
+	assert.NotEqual(t, hex.EncodeToString(unkeyed[:]), stored.PINHash)
+
+	_, err = prov.RedeemClaim(ctx, models.RedeemRequest{DeviceID: "cellar", PIN: claim.PIN})
+	require.NoError(t, err)
+}
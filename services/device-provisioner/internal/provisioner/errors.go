@@ -0,0 +1,114 @@
+package provisioner
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+)
+
+var (
+	// ErrDeviceNotFound is returned for devices that aren't in the registry
+	ErrDeviceNotFound = errors.New("device not found")
+
+	// ErrDeviceExists is returned when provisioning a device that has active
+	// credentials
+	ErrDeviceExists = errors.New("device already provisioned")
+
+	// ErrDeviceRevoked is returned when renewing a revoked device
+	ErrDeviceRevoked = errors.New("device is revoked")
+
+	// ErrClaimNotFound is returned when redeeming a claim that doesn't exist,
+	// or no longer does
+	ErrClaimNotFound = errors.New("no pending claim")
+
+	// ErrTooManyAttempts is returned when a device redeems too often
+	ErrTooManyAttempts = errors.New("too many attempts")
+
+	// ErrConcurrentUpdate is returned when a device's registry entry kept
+	// changing under a request, or changed in a way the request can't build on
+	ErrConcurrentUpdate = errors.New("device was changed by another request")
+
+	// ErrAccessExpired is returned when renewing credentials whose time
+	// boxed access has ended
+	ErrAccessExpired = errors.New("access has expired")
+)
+
+// RequestError is a request the provisioner refuses as invalid, as opposed
+// to one it failed to carry out
+type RequestError struct {
+	Field string // The offending request field, if any
+	msg   string
+}
+
+func (e *RequestError) Error() string {
+	return e.msg
+}
+
+// invalidRequest returns a RequestError
+func invalidRequest(format string, args ...interface{}) error {
+	return &RequestError{msg: fmt.Sprintf(format, args...)}
+}
+
+// invalidField returns a RequestError about one request field
+func invalidField(field, format string, args ...interface{}) error {
+	return &RequestError{Field: field, msg: fmt.Sprintf(format, args...)}
+}
+
+// IsInvalidRequest reports whether err is, or wraps, a RequestError
+func IsInvalidRequest(err error) bool {
+	var reqErr *RequestError
+	return errors.As(err, &reqErr)
+}
+
+// sentinelError gives one of the sentinel errors a message of its own
+type sentinelError struct {
+	err error
+	msg string
+}
+
+func (e *sentinelError) Error() string {
+	return e.msg
+}
+
+func (e *sentinelError) Unwrap() error {
+	return e.err
+}
+
+func withMessage(err error, format string, args ...interface{}) error {
+	return &sentinelError{err: err, msg: fmt.Sprintf(format, args...)}
+}
+
+// internalErrorMessage replaces the text of internal errors in replies,
+// which may hold registry or JWT details
+const internalErrorMessage = "internal error"
+
+// ErrorResponse describes err for the reply to a failed request. Internal
+// errors get a generic message, callers log the detail.
+func ErrorResponse(err error) models.ErrorResponse {
+	resp := models.ErrorResponse{Error: err.Error(), Code: models.CodeInternal}
+
+	var reqErr *RequestError
+	switch {
+	case errors.As(err, &reqErr):
+		resp.Code = models.CodeInvalidRequest
+		resp.Field = reqErr.Field
+	case errors.Is(err, ErrDeviceNotFound):
+		resp.Code = models.CodeDeviceNotFound
+	case errors.Is(err, ErrDeviceExists):
+		resp.Code = models.CodeDeviceExists
+	case errors.Is(err, ErrDeviceRevoked):
+		resp.Code = models.CodeDeviceRevoked
+	case errors.Is(err, ErrClaimNotFound):
+		resp.Code = models.CodeClaimNotFound
+	case errors.Is(err, ErrTooManyAttempts):
+		resp.Code = models.CodeRateLimited
+	case errors.Is(err, ErrConcurrentUpdate):
+		resp.Code = models.CodeConflict
+	case errors.Is(err, ErrAccessExpired):
+		resp.Code = models.CodeAccessExpired
+	default:
+		resp.Error = internalErrorMessage
+	}
+	return resp
+}
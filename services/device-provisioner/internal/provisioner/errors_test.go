@@ -0,0 +1,39 @@
+package provisioner_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/provisioner"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorResponse(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		want models.ErrorResponse
+	}{
+		{
+			name: "not found",
+			err:  fmt.Errorf("%w: attic", provisioner.ErrDeviceNotFound),
+			want: models.ErrorResponse{Error: "device not found: attic", Code: models.CodeDeviceNotFound},
+		},
+		{
+			name: "conflict",
+			err:  fmt.Errorf("%w: attic", provisioner.ErrConcurrentUpdate),
+			want: models.ErrorResponse{Error: "device was changed by another request: attic", Code: models.CodeConflict},
+		},
+		{
+			name: "internal",
+			err:  fmt.Errorf("failed to store device credentials: %w", errors.New("nats: wrong last sequence: 7")),
+			want: models.ErrorResponse{Error: "internal error", Code: models.CodeInternal},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, provisioner.ErrorResponse(tt.err))
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package provisioner
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	// SubjectNonce takes nothing and replies with a models.NonceResponse
+	// for a device to sign its own key or a renewal with
+	SubjectNonce = "home.provisioning.nonce"
+
+	// How long a nonce can be used for
+	nonceTTL = 5 * time.Minute
+)
+
+// Nonces are signed with the signing key rather than stored, so any replica
+// accepts a nonce another one handed out. A key proof's nonce can be used
+// more than once before it expires; replaying a key proof only ever yields a
+// JWT for a key the replayer doesn't hold. A renewal's nonce is recorded with
+// the device, since replaying a renewal would yield a new seed.
+
+// NewNonce returns a nonce for a models.KeyProof or models.RenewRequest
+func (p *Provisioner) NewNonce() (*models.NonceResponse, error) {
+	expiry := time.Now().Add(nonceTTL)
+
+	payload := make([]byte, 24)
+	if _, err := rand.Read(payload[:16]); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	binary.BigEndian.PutUint64(payload[16:], uint64(expiry.Unix()))
+
+	sig, err := p.signingKey.Sign(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign nonce: %w", err)
+	}
+
+	return &models.NonceResponse{
+		Nonce:     base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(sig),
+		ExpiresAt: expiry,
+	}, nil
+}
+
+// verifyNonce checks a nonce was handed out by a provisioner with this
+// signing key and hasn't expired
+func (p *Provisioner) verifyNonce(nonce string) bool {
+	encoded, encodedSig, ok := strings.Cut(nonce, ".")
+	if !ok {
+		return false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(payload) != 24 {
+		return false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil || p.signingKey.Verify(payload, sig) != nil {
+		return false
+	}
+
+	expiry := time.Unix(int64(binary.BigEndian.Uint64(payload[16:])), 0)
+	return time.Now().Before(expiry)
+}
+
+// verifyKeyProof checks a device holds the private half of the key it sent.
+// field names the proof in the request for errors.
+func (p *Provisioner) verifyKeyProof(deviceID, field string, proof *models.KeyProof) error {
+	if !nkeys.IsValidPublicUserKey(proof.PublicKey) {
+		return invalidField(field+".public_key", "public key must be an nkey user public key")
+	}
+	if !p.verifyNonce(proof.Nonce) {
+		return invalidField(field+".nonce", "nonce is invalid or expired, ask %s for a new one", SubjectNonce)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(proof.Signature)
+	if err != nil {
+		return invalidField(field+".signature", "invalid signature encoding: %v", err)
+	}
+	key, err := nkeys.FromPublicKey(proof.PublicKey)
+	if err != nil {
+		return invalidField(field+".public_key", "invalid public key: %v", err)
+	}
+	if err := key.Verify(models.KeyProofPayload(deviceID, proof.Nonce), sig); err != nil {
+		return invalidField(field+".signature", "invalid signature")
+	}
+	return nil
+}
+
+// checkOwnKey checks a key a device generated can replace its credentials:
+// the device's key is not bundled, and a key the device held before, which
+// may have been revoked, is not taken again
+func checkOwnKey(field string, device *models.DeviceCredentials, publicKey string, format models.BundleFormat) error {
+	if format != "" {
+		return invalidField("format", "bundles hold the device's seed, there is none for a key the device generated")
+	}
+	if device == nil {
+		return nil
+	}
+	used := publicKey == device.PublicKey
+	for _, previous := range device.PreviousKeys {
+		used = used || publicKey == previous.PublicKey
+	}
+	if used {
+		return invalidField(field+".public_key", "device %s already used this key, generate a new one", device.DeviceID)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package provisioner_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/provisioner"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// proveKey signs a nonce for deviceID with key, as a device does before
+// sending its own public key
+func proveKey(t *testing.T, deviceID, nonce string, key nkeys.KeyPair) *models.KeyProof {
+	t.Helper()
+
+	sig, err := key.Sign(models.KeyProofPayload(deviceID, nonce))
+	require.NoError(t, err)
+	return &models.KeyProof{
+		PublicKey: publicKey(t, key),
+		Nonce:     nonce,
+		Signature: base64.RawURLEncoding.EncodeToString(sig),
+	}
+}
+
+// requestNonce asks the provisioner for a nonce over nc
+func requestNonce(t *testing.T, nc *nats.Conn) string {
+	t.Helper()
+
+	msg, err := nc.Request(provisioner.SubjectNonce, nil, 2*time.Second)
+	require.NoError(t, err)
+	var nonce models.NonceResponse
+	require.NoError(t, json.Unmarshal(msg.Data, &nonce))
+	require.NotEmpty(t, nonce.Nonce, string(msg.Data))
+	return nonce.Nonce
+}
+
+func TestOwnKeyOverNATS(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env)
+	runProvisioner(t, env, prov)
+
+	deviceKey, err := nkeys.CreateUser()
+	require.NoError(t, err)
+
+	data, err := json.Marshal(models.ProvisionRequest{
+		DeviceID:   "nursery",
+		DeviceType: models.DeviceTypeSensor,
+		Key:        proveKey(t, "nursery", requestNonce(t, env.home), deviceKey),
+	})
+	require.NoError(t, err)
+	msg, err := env.home.Request("home.provisioning.request", data, 2*time.Second)
+	require.NoError(t, err)
+
+	var created models.ProvisionResponse
+	require.NoError(t, json.Unmarshal(msg.Data, &created))
+	require.NotEmpty(t, created.JWT, string(msg.Data))
+	assert.Empty(t, created.Seed)
+	assert.Empty(t, created.Creds)
+	assert.NotContains(t, string(msg.Data), `"seed"`)
+	user, err := jwt.DecodeUserClaims(created.JWT)
+	require.NoError(t, err)
+	assert.Equal(t, publicKey(t, deviceKey), user.Subject)
+
+	// The device connects with the seed it kept, and renews onto a new key
+	// it generated
+	device, err := nats.Connect(env.server.ClientURL(),
+		nats.UserJWTAndSeed(created.JWT, seed(t, deviceKey)),
+		nats.CustomInboxPrefix(created.Subjects.InboxPrefix),
+	)
+	require.NoError(t, err)
+	defer device.Close()
+
+	nextKey, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	nonce := requestNonce(t, device)
+	renew := signRenewal(t, "nursery", seed(t, deviceKey), nonce)
+	renew.NewKey = proveKey(t, "nursery", nonce, nextKey)
+	data, err = json.Marshal(renew)
+	require.NoError(t, err)
+	msg, err = device.Request(provisioner.SubjectRenew, data, 2*time.Second)
+	require.NoError(t, err)
+
+	var renewed models.ProvisionResponse
+	require.NoError(t, json.Unmarshal(msg.Data, &renewed))
+	require.NotEmpty(t, renewed.JWT, string(msg.Data))
+	assert.Empty(t, renewed.Seed)
+	user, err = jwt.DecodeUserClaims(renewed.JWT)
+	require.NoError(t, err)
+	assert.Equal(t, publicKey(t, nextKey), user.Subject)
+
+	fresh, err := nats.Connect(env.server.ClientURL(), nats.UserJWTAndSeed(renewed.JWT, seed(t, nextKey)))
+	require.NoError(t, err, "renewed credentials must be accepted")
+	fresh.Close()
+}
+
+func TestOwnKeyRejectsBadProofs(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env)
+	ctx := context.Background()
+
+	nonce, err := prov.NewNonce()
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(5*time.Minute), nonce.ExpiresAt, time.Minute)
+
+	deviceKey, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	otherKey, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	accountKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+
+	// Nonces from a provisioner with another signing key aren't accepted
+	otherEnv := runOperatorServer(t)
+	foreign, err := newProvisioner(t, otherEnv).NewNonce()
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name  string
+		proof func() *models.KeyProof
+		field string
+	}{
+		{"account key", func() *models.KeyProof { return proveKey(t, "den", nonce.Nonce, accountKey) }, "key.public_key"},
+		{"made up nonce", func() *models.KeyProof { return proveKey(t, "den", "abc.def", deviceKey) }, "key.nonce"},
+		{"foreign nonce", func() *models.KeyProof { return proveKey(t, "den", foreign.Nonce, deviceKey) }, "key.nonce"},
+		{"other device's proof", func() *models.KeyProof { return proveKey(t, "hall", nonce.Nonce, deviceKey) }, "key.signature"},
+		{"other key's signature", func() *models.KeyProof {
+			proof := proveKey(t, "den", nonce.Nonce, otherKey)
+			proof.PublicKey = publicKey(t, deviceKey)
+			return proof
+		}, "key.signature"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := prov.ProvisionDevice(ctx, models.ProvisionRequest{DeviceID: "den", DeviceType: models.DeviceTypeLight, Key: tc.proof()})
+			var reqErr *provisioner.RequestError
+			require.True(t, errors.As(err, &reqErr), "want a request error, got %v", err)
+			assert.Equal(t, tc.field, reqErr.Field, err.Error())
+		})
+	}
+
+	// There's no seed to bundle
+	_, err = prov.ProvisionDevice(ctx, models.ProvisionRequest{
+		DeviceID:   "den",
+		DeviceType: models.DeviceTypeLight,
+		Format:     models.BundleESPHome,
+		Key:        proveKey(t, "den", nonce.Nonce, deviceKey),
+	})
+	assert.True(t, provisioner.IsInvalidRequest(err), err)
+
+	// A revoked key can't be brought back
+	req := models.ProvisionRequest{DeviceID: "den", DeviceType: models.DeviceTypeLight, Key: proveKey(t, "den", nonce.Nonce, deviceKey)}
+	_, err = prov.ProvisionDevice(ctx, req)
+	require.NoError(t, err)
+	require.NoError(t, prov.RevokeDevice(ctx, "den"))
+	_, err = prov.ProvisionDevice(ctx, req)
+	assert.True(t, provisioner.IsInvalidRequest(err), err)
+
+	req.Key = proveKey(t, "den", nonce.Nonce, otherKey)
+	_, err = prov.ProvisionDevice(ctx, req)
+	assert.NoError(t, err)
+}
+
+func TestRedeemClaimWithOwnKey(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env)
+	ctx := context.Background()
+
+	deviceKey, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	nonce, err := prov.NewNonce()
+	require.NoError(t, err)
+
+	// The key comes from the device, not whoever creates the claim
+	_, err = prov.CreateClaim(ctx, models.ClaimRequest{ProvisionRequest: models.ProvisionRequest{
+		DeviceID:   "pantry",
+		DeviceType: models.DeviceTypeSensor,
+		Key:        proveKey(t, "pantry", nonce.Nonce, deviceKey),
+	}})
+	assert.True(t, provisioner.IsInvalidRequest(err), err)
+
+	claim, err := prov.CreateClaim(ctx, models.ClaimRequest{ProvisionRequest: models.ProvisionRequest{
+		DeviceID:   "pantry",
+		DeviceType: models.DeviceTypeSensor,
+		Format:     models.BundleArduino,
+	}})
+	require.NoError(t, err)
+
+	// A bad proof doesn't use up the claim
+	_, err = prov.RedeemClaim(ctx, models.RedeemRequest{DeviceID: "pantry", PIN: claim.PIN, Key: proveKey(t, "attic", nonce.Nonce, deviceKey)})
+	assert.True(t, provisioner.IsInvalidRequest(err), err)
+
+	resp, err := prov.RedeemClaim(ctx, models.RedeemRequest{DeviceID: "pantry", PIN: claim.PIN, Key: proveKey(t, "pantry", nonce.Nonce, deviceKey)})
+	require.NoError(t, err)
+	assert.Empty(t, resp.Seed)
+	assert.Nil(t, resp.Bundle)
+	user, err := jwt.DecodeUserClaims(resp.JWT)
+	require.NoError(t, err)
+	assert.Equal(t, publicKey(t, deviceKey), user.Subject)
+
+	// Bootstrap credentials may ask for a nonce
+	bootstrap, err := jwt.DecodeUserClaims(claim.Bootstrap.JWT)
+	require.NoError(t, err)
+	assert.Contains(t, bootstrap.Pub.Allow, provisioner.SubjectNonce)
+}
@@ -0,0 +1,56 @@
+package provisioner
+
+import (
+	"fmt"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/templates"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultTemplatesDir is where device templates are read from by default
+const DefaultTemplatesDir = "device-templates"
+
+// ReloadTemplates reads the device templates again. Devices provisioned or
+// renewed afterwards get the new permissions; if the templates don't load the
+// current ones are kept.
+func (p *Provisioner) ReloadTemplates() error {
+	set, err := templates.Load(p.templatesDir)
+	if err != nil {
+		return fmt.Errorf("failed to load device templates: %w", err)
+	}
+	p.templates.Store(set)
+
+	p.log.WithFields(logrus.Fields{
+		"dir":   p.templatesDir,
+		"types": set.Types(),
+	}).Info("Device templates loaded")
+	return nil
+}
+
+// subjects returns the subjects a device may use: those of its template plus
+// the provisioner's own, and its inbox. Replies to requests it receives are
+// allowed by the response permission, so no wildcard inbox is granted.
+func (p *Provisioner) subjects(deviceID string, deviceType models.DeviceType) models.Subjects {
+	perms := p.templates.Load().Permissions(string(deviceType), deviceID)
+	inbox := inboxPrefix(deviceID)
+
+	return models.Subjects{
+		Publish:     append(perms.Publish, SubjectRenew, SubjectNonce, "$JS.API.CONSUMER.MSG.NEXT.>"),
+		Subscribe:   append(perms.Subscribe, inbox+".>"),
+		InboxPrefix: inbox,
+	}
+}
+
+// deviceSubject returns a device's subject with the given template name, e.g.
+// "config"
+func (p *Provisioner) deviceSubject(device models.DeviceCredentials, name string) (string, bool) {
+	perms := p.templates.Load().Permissions(string(device.DeviceType), device.DeviceID)
+	subject, ok := perms.Subjects[name]
+	return subject, ok
+}
+
+// inboxPrefix is the only inbox prefix a device can read replies on
+func inboxPrefix(deviceID string) string {
+	return "_INBOX_" + deviceID
+}
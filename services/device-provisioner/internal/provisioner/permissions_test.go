@@ -0,0 +1,118 @@
+package provisioner_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/provisioner"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/templates"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDevicePermissions(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env)
+	ctx := context.Background()
+
+	resp, err := prov.ProvisionDevice(ctx, models.ProvisionRequest{
+		DeviceID:   "kitchen",
+		DeviceType: models.DeviceTypeLight,
+		Name:       "Kitchen Light",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "_INBOX_kitchen", resp.Subjects.InboxPrefix)
+	assert.Contains(t, resp.Subjects.Publish, "home.devices.light.kitchen.state")
+	assert.Contains(t, resp.Subjects.Subscribe, "home.config.device.kitchen")
+	assert.NotContains(t, resp.Subjects.Publish, "_INBOX.>")
+	assert.NotContains(t, resp.Subjects.Subscribe, "_INBOX.>")
+
+	violations := make(chan error, 10)
+	device, err := nats.Connect(env.server.ClientURL(),
+		nats.UserJWTAndSeed(resp.JWT, resp.Seed),
+		nats.CustomInboxPrefix(resp.Subjects.InboxPrefix),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			violations <- err
+		}),
+	)
+	require.NoError(t, err)
+	defer device.Close()
+
+	expectViolation := func(what string) {
+		t.Helper()
+		select {
+		case err := <-violations:
+			assert.Contains(t, strings.ToLower(err.Error()), "permissions violation", what)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("device may %s", what)
+		}
+	}
+
+	// Its own subjects work
+	commands, err := device.SubscribeSync("home.devices.light.kitchen.command")
+	require.NoError(t, err)
+	require.NoError(t, device.Publish("home.devices.light.kitchen.state", []byte(`{"on":true}`)))
+	require.NoError(t, device.Flush())
+
+	// Other devices' subjects and inboxes don't
+	require.NoError(t, device.Publish("home.devices.light.hallway.state", nil))
+	expectViolation("publish another device's state")
+	_, err = device.SubscribeSync("_INBOX.>")
+	require.NoError(t, err)
+	expectViolation("read every inbox")
+
+	// It can reply to requests it receives
+	go func() {
+		if msg, err := commands.NextMsg(2 * time.Second); err == nil {
+			msg.Respond([]byte("ok"))
+		}
+	}()
+	reply, err := env.home.Request("home.devices.light.kitchen.command", []byte(`{"on":false}`), 2*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(reply.Data))
+}
+
+func TestReloadTemplatesAddsDeviceType(t *testing.T) {
+	env := runOperatorServer(t)
+
+	dir := t.TempDir()
+	base, err := os.ReadFile(filepath.Join(repoTemplates, templates.BaseTemplate))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, templates.BaseTemplate), base, 0o644))
+
+	prov := newProvisioner(t, env, func(cfg *provisioner.Config) {
+		cfg.TemplatesDir = dir
+	})
+	ctx := context.Background()
+
+	_, err = prov.ProvisionDevice(ctx, models.ProvisionRequest{DeviceID: "lawn", DeviceType: "sprinkler", Name: "Lawn"})
+	assert.True(t, provisioner.IsInvalidRequest(err), "types without a template are unknown: %v", err)
+
+	// Dropping in a template is all it takes to add a device type
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sprinkler.yaml"), []byte(`
+device_info:
+  device_type: "sprinkler"
+nats:
+  subjects:
+    flow: "home.devices.${device_type}.${device_id}.flow"
+`), 0o644))
+	require.NoError(t, prov.ReloadTemplates())
+
+	resp, err := prov.ProvisionDevice(ctx, models.ProvisionRequest{DeviceID: "hedge", DeviceType: "sprinkler", Name: "Hedge"})
+	require.NoError(t, err)
+	assert.Contains(t, resp.Subjects.Publish, "home.devices.sprinkler.hedge.flow")
+
+	// A broken template keeps the loaded ones
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken.yaml"), []byte("device_info: [\n"), 0o644))
+	assert.Error(t, prov.ReloadTemplates())
+
+	resp, err = prov.ProvisionDevice(ctx, models.ProvisionRequest{DeviceID: "pond", DeviceType: "sprinkler", Name: "Pond"})
+	require.NoError(t, err)
+	assert.Contains(t, resp.Subjects.Publish, "home.devices.sprinkler.pond.flow")
+}
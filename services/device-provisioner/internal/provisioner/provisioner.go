@@ -3,11 +3,16 @@ package provisioner
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/homix-dev/homix/services/device-provisioner/internal/audit"
 	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/templates"
 	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
@@ -24,16 +29,64 @@ type Provisioner struct {
 	signingKey nkeys.KeyPair
 	accountPub string
 	issuerName string
+
+	credentialTTL time.Duration
+	renewWindow   time.Duration
+	sweepInterval time.Duration
+
+	// Device templates, swapped on reload
+	templatesDir string
+	templates    atomic.Pointer[templates.Set]
+
+	// Record of every credential operation
+	audit *audit.Log
+
+	// Claim based onboarding
+	claims    jetstream.KeyValue
+	pinKey    []byte
+	claimTTL  time.Duration
+	serverURL string
+	limiter   redeemLimiter
+
+	// Subjects of the registry, claims and audit log, denied to every role
+	// but admin
+	protected []string
+
+	// Revocation push, optional
+	system      *nats.Conn
+	operatorKey nkeys.KeyPair
+	accountMu   sync.Mutex
 }
 
 // Config contains provisioner configuration
 type Config struct {
-	NATS        *nats.Conn
-	Logger      *logrus.Logger
-	SigningKey  string // Base64 encoded signing key
-	AccountPub  string // Account public key
-	IssuerName  string // Name for the issuer
-	KVBucket    string // KV bucket for storing device registry
+	NATS       *nats.Conn
+	Logger     *logrus.Logger
+	SigningKey string // Base64 encoded signing key
+	AccountPub string // Account public key
+	IssuerName string // Name for the issuer
+	KVBucket   string // KV bucket for storing device registry
+
+	// Stream the audit log of credential operations is kept in, default
+	// PROVISIONING_AUDIT
+	AuditStream string
+
+	// Directory of device templates that define device permissions,
+	// default device-templates
+	TemplatesDir string
+
+	CredentialTTL time.Duration // Lifetime of issued JWTs, default 365 days
+	RenewWindow   time.Duration // Devices are told to renew this long before expiry, default 30 days
+	SweepInterval time.Duration // How often to look for expiring devices, default 1 hour
+
+	ClaimBucket string        // KV bucket for pending claims, default device-claims
+	ClaimTTL    time.Duration // How long a claim PIN stays valid, default 15 minutes
+	ServerURL   string        // NATS URL devices connect to, put in claim QR codes
+
+	// System account connection and operator signing key seed used to push
+	// revocations into the account JWT. Both or neither must be set.
+	System             *nats.Conn
+	OperatorSigningKey string
 }
 
 // New creates a new device provisioner
@@ -44,6 +97,17 @@ func New(cfg Config) (*Provisioner, error) {
 		return nil, fmt.Errorf("invalid signing key: %w", err)
 	}
 
+	var operatorKey nkeys.KeyPair
+	if cfg.OperatorSigningKey != "" {
+		operatorKey, err = nkeys.FromSeed([]byte(cfg.OperatorSigningKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid operator signing key: %w", err)
+		}
+	}
+	if (cfg.System == nil) != (operatorKey == nil) {
+		return nil, fmt.Errorf("system connection and operator signing key must be set together")
+	}
+
 	// Get JetStream context
 	js, err := jetstream.New(cfg.NATS)
 	if err != nil {
@@ -51,22 +115,64 @@ func New(cfg Config) (*Provisioner, error) {
 	}
 
 	// Get or create KV bucket for device registry
-	kv, err := js.KeyValue(context.Background(), cfg.KVBucket)
+	kv, err := keyValue(js, jetstream.KeyValueConfig{
+		Bucket:      cfg.KVBucket,
+		Description: "Device credential registry",
+		TTL:         0, // No TTL - permanent storage
+		History:     registryHistory,
+	})
 	if err != nil {
-		// Try to create the bucket
-		kvConfig := jetstream.KeyValueConfig{
-			Bucket:      cfg.KVBucket,
-			Description: "Device credential registry",
-			TTL:         0, // No TTL - permanent storage
-			History:     10,
-		}
-		kv, err = js.CreateKeyValue(context.Background(), kvConfig)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create KV bucket: %w", err)
-		}
+		return nil, err
 	}
 
-	return &Provisioner{
+	auditStream := cfg.AuditStream
+	if auditStream == "" {
+		auditStream = audit.DefaultStream
+	}
+	auditLog, err := audit.Open(context.Background(), js, auditStream, signingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ClaimBucket == "" {
+		cfg.ClaimBucket = DefaultClaimBucket
+	}
+	if cfg.ClaimTTL <= 0 {
+		cfg.ClaimTTL = DefaultClaimTTL
+	}
+
+	// Claims are short lived, the bucket TTL cleans up unredeemed ones
+	claims, err := keyValue(js, jetstream.KeyValueConfig{
+		Bucket:      cfg.ClaimBucket,
+		Description: "Pending device claims",
+		TTL:         cfg.ClaimTTL + time.Hour,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.CredentialTTL <= 0 {
+		cfg.CredentialTTL = DefaultCredentialTTL
+	}
+	if cfg.RenewWindow <= 0 {
+		cfg.RenewWindow = DefaultRenewWindow
+	}
+	if cfg.SweepInterval <= 0 {
+		cfg.SweepInterval = DefaultSweepInterval
+	}
+	if cfg.RenewWindow >= cfg.CredentialTTL {
+		return nil, fmt.Errorf("renew window %s must be shorter than the credential TTL %s", cfg.RenewWindow, cfg.CredentialTTL)
+	}
+
+	if cfg.TemplatesDir == "" {
+		cfg.TemplatesDir = DefaultTemplatesDir
+	}
+	set, err := templates.Load(cfg.TemplatesDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load device templates: %w", err)
+	}
+
+	p := &Provisioner{
 		nc:         cfg.NATS,
 		js:         js,
 		kv:         kv,
@@ -74,93 +180,92 @@ func New(cfg Config) (*Provisioner, error) {
 		signingKey: signingKey,
 		accountPub: cfg.AccountPub,
 		issuerName: cfg.IssuerName,
-	}, nil
+
+		credentialTTL: cfg.CredentialTTL,
+		renewWindow:   cfg.RenewWindow,
+		sweepInterval: cfg.SweepInterval,
+
+		templatesDir: cfg.TemplatesDir,
+
+		audit: auditLog,
+
+		claims:    claims,
+		protected: protectedSubjects([]string{cfg.KVBucket, cfg.ClaimBucket}, auditStream),
+		pinKey:    pinKey(cfg.SigningKey),
+		claimTTL:  cfg.ClaimTTL,
+		serverURL: cfg.ServerURL,
+
+		system:      cfg.System,
+		operatorKey: operatorKey,
+	}
+	p.templates.Store(set)
+
+	return p, nil
 }
 
 // ProvisionDevice creates new credentials for a device
 func (p *Provisioner) ProvisionDevice(ctx context.Context, req models.ProvisionRequest) (*models.ProvisionResponse, error) {
+	return p.provision(ctx, req, audit.OpProvision)
+}
+
+// provision creates new credentials for a device, recording them as op
+func (p *Provisioner) provision(ctx context.Context, req models.ProvisionRequest, op audit.Operation) (*models.ProvisionResponse, error) {
 	// Validate request
-	if req.DeviceID == "" {
-		return nil, fmt.Errorf("device_id is required")
+	if err := p.validateRequest(req); err != nil {
+		return nil, err
 	}
-	if req.DeviceType == "" {
-		return nil, fmt.Errorf("device_type is required")
+	if err := validBundleFormat(req.Format); err != nil {
+		return nil, err
 	}
 
-	// Check if device already exists
+	// Check if device already exists, before issuing anything. createDevice
+	// checks again when storing it.
 	existing, err := p.getDevice(ctx, req.DeviceID)
 	if err == nil && existing != nil && existing.RevokedAt == nil {
-		return nil, fmt.Errorf("device %s already provisioned", req.DeviceID)
+		return nil, fmt.Errorf("%w: %s", ErrDeviceExists, req.DeviceID)
 	}
 
-	// Generate new nkey pair for the device
-	deviceKey, err := nkeys.CreateUser()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create device key: %w", err)
-	}
-
-	devicePub, err := deviceKey.PublicKey()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get device public key: %w", err)
+	// A device that generated its own key proves it holds it
+	var ownKey string
+	if req.Key != nil {
+		if err := p.verifyKeyProof(req.DeviceID, "key", req.Key); err != nil {
+			return nil, err
+		}
+		if err := checkOwnKey("key", existing, req.Key.PublicKey, req.Format); err != nil {
+			return nil, err
+		}
+		ownKey = req.Key.PublicKey
 	}
 
-	deviceSeed, err := deviceKey.Seed()
+	resp, devicePub, err := p.issueCredentials(req, ownKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get device seed: %w", err)
-	}
-
-	// Create JWT claims
-	now := time.Now()
-	expiry := now.Add(365 * 24 * time.Hour) // 1 year expiry
-
-	// Define allowed subjects based on device type
-	pubSubjects := p.getPublishSubjects(req.DeviceID, req.DeviceType)
-	subSubjects := p.getSubscribeSubjects(req.DeviceID, req.DeviceType)
-
-	claims := jwt.NewUserClaims(devicePub)
-	claims.Name = req.DeviceID
-	claims.Subject = devicePub
-	claims.Issuer = p.issuerName
-	claims.IssuedAt = now.Unix()
-	claims.Expires = expiry.Unix()
-	claims.Pub.Allow = pubSubjects
-	claims.Sub.Allow = subSubjects
-	claims.Resp = &jwt.ResponsePermission{
-		MaxMsgs: 1,
-		Expires: time.Minute,
-	}
-	
-	// Add metadata as tags
-	if req.Metadata != nil {
-		claims.Tags = make(jwt.TagList, 0)
-		claims.Tags.Add(fmt.Sprintf("device_type:%s", req.DeviceType))
-		claims.Tags.Add(fmt.Sprintf("name:%s", req.Name))
+		return nil, err
 	}
-
-	// Sign the JWT
-	token, err := claims.Encode(p.signingKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to encode JWT: %w", err)
+	if err := p.addCreds(resp, req.Format); err != nil {
+		return nil, err
 	}
 
 	// Store device info in KV
 	deviceCreds := models.DeviceCredentials{
-		DeviceID:   req.DeviceID,
-		DeviceType: req.DeviceType,
-		Name:       req.Name,
-		PublicKey:  devicePub,
-		CreatedAt:  now,
-		ExpiresAt:  expiry,
+		DeviceID:    req.DeviceID,
+		DeviceType:  req.DeviceType,
+		Name:        req.Name,
+		Description: req.Description,
+		Room:        req.Room,
+		Firmware:    req.Firmware,
+		Metadata:    req.Metadata,
+		PublicKey:   devicePub,
+		CreatedAt:   resp.CreatedAt,
+		ExpiresAt:   resp.ExpiresAt,
 	}
 
-	data, err := json.Marshal(deviceCreds)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal device credentials: %w", err)
+	// No credentials leave the provisioner unrecorded
+	if err := p.recordIssued(ctx, op, req.DeviceID, resp.JWT); err != nil {
+		return nil, err
 	}
 
-	_, err = p.kv.Put(ctx, req.DeviceID, data)
-	if err != nil {
-		return nil, fmt.Errorf("failed to store device credentials: %w", err)
+	if err := p.createDevice(ctx, deviceCreds); err != nil {
+		return nil, err
 	}
 
 	// Log provisioning event
@@ -170,45 +275,184 @@ func (p *Provisioner) ProvisionDevice(ctx context.Context, req models.ProvisionR
 		"name":        req.Name,
 	}).Info("Device provisioned")
 
+	return resp, nil
+}
+
+// issueCredentials signs a user JWT for a device. devicePub is a key the
+// device generated itself; when empty a new key pair is generated and its
+// seed returned with the credentials. It returns the credentials and the
+// device's public key.
+func (p *Provisioner) issueCredentials(req models.ProvisionRequest, devicePub string) (*models.ProvisionResponse, string, error) {
+	return p.issue(req.DeviceID, p.deviceGrant(req.DeviceID, req.DeviceType, req.Name, req.Room), devicePub)
+}
+
+// grant is what issued credentials allow
+type grant struct {
+	subjects      models.Subjects
+	denyPublish   []string
+	denySubscribe []string
+	tags          []string
+
+	// Whether the holder may reply to requests it receives
+	respond bool
+
+	// The credentials expire no later than this, zero for the credential TTL
+	until time.Time
+}
+
+// deviceGrant is what a device's credentials allow: the subjects of its
+// template, tagged with what the device is
+func (p *Provisioner) deviceGrant(deviceID string, deviceType models.DeviceType, name, room string) grant {
+	g := grant{
+		subjects: p.subjects(deviceID, deviceType),
+		tags:     []string{"device_type:" + string(deviceType)},
+		respond:  true,
+	}
+	if name != "" {
+		g.tags = append(g.tags, "name:"+name)
+	}
+	if room != "" {
+		g.tags = append(g.tags, "room:"+room)
+	}
+	return g
+}
+
+// grantFor is what a registry entry's credentials allow
+func (p *Provisioner) grantFor(device *models.DeviceCredentials) grant {
+	if device.Role != "" {
+		var until time.Time
+		if device.AccessUntil != nil {
+			until = *device.AccessUntil
+		}
+		return p.roleGrant(device.DeviceID, device.Role, device.Name, until)
+	}
+	return p.deviceGrant(device.DeviceID, device.DeviceType, device.Name, device.Room)
+}
+
+// issue signs a user JWT named id. pub is a key the holder generated itself;
+// when empty a new key pair is generated and its seed returned with the
+// credentials. It returns the credentials and the holder's public key.
+func (p *Provisioner) issue(id string, g grant, pub string) (*models.ProvisionResponse, string, error) {
+	var seed []byte
+	if pub == "" {
+		// Generate new nkey pair for the holder
+		key, err := nkeys.CreateUser()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create user key: %w", err)
+		}
+
+		pub, err = key.PublicKey()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to get user public key: %w", err)
+		}
+
+		seed, err = key.Seed()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to get user seed: %w", err)
+		}
+	}
+
+	// Create JWT claims
+	now := time.Now()
+	expiry := now.Add(p.credentialTTL)
+	if !g.until.IsZero() && g.until.Before(expiry) {
+		expiry = g.until
+	}
+
+	claims := jwt.NewUserClaims(pub)
+	claims.Name = id
+	claims.Subject = pub
+	claims.Issuer = p.issuerName
+	claims.IssuedAt = now.Unix()
+	claims.Expires = expiry.Unix()
+	claims.Pub.Allow = g.subjects.Publish
+	claims.Pub.Deny = g.denyPublish
+	claims.Sub.Allow = g.subjects.Subscribe
+	claims.Sub.Deny = g.denySubscribe
+	if g.respond {
+		claims.Resp = &jwt.ResponsePermission{
+			MaxMsgs: 1,
+			Expires: time.Minute,
+		}
+	}
+
+	// Tag the JWT with what the holder is
+	claims.Tags.Add(g.tags...)
+
+	// Sign the JWT
+	token, err := p.sign(claims)
+	if err != nil {
+		return nil, "", err
+	}
+
 	return &models.ProvisionResponse{
-		DeviceID:  req.DeviceID,
+		DeviceID:  id,
 		JWT:       token,
-		Seed:      string(deviceSeed),
+		Seed:      string(seed),
 		CreatedAt: now,
 		ExpiresAt: expiry,
-		Subjects: models.Subjects{
-			Publish:   pubSubjects,
-			Subscribe: subSubjects,
-		},
-	}, nil
+		Subjects:  g.subjects,
+	}, pub, nil
 }
 
-// RevokeDevice revokes a device's credentials
-func (p *Provisioner) RevokeDevice(ctx context.Context, deviceID string) error {
-	// Get existing device
-	device, err := p.getDevice(ctx, deviceID)
+// sign encodes user claims with the signing key
+func (p *Provisioner) sign(claims *jwt.UserClaims) (string, error) {
+	if signerPub, _ := p.signingKey.PublicKey(); signerPub != p.accountPub {
+		// Signed with an account signing key, name the account it belongs to
+		claims.IssuerAccount = p.accountPub
+	}
+
+	token, err := claims.Encode(p.signingKey)
 	if err != nil {
-		return fmt.Errorf("device not found: %w", err)
+		return "", fmt.Errorf("failed to encode JWT: %w", err)
 	}
+	return token, nil
+}
 
+// RevokeDevice revokes a device's credentials, including the keys it held
+// before renewals whose JWTs have not expired. The revocation is recorded in
+// the registry, pushed into the account JWT when a system connection is
+// configured, audited and announced on home.provisioning.revoked. Revoking a revoked
+// device pushes and announces it again, so a failed push can be retried.
+func (p *Provisioner) RevokeDevice(ctx context.Context, deviceID string) error {
 	// Mark as revoked
-	now := time.Now()
-	device.RevokedAt = &now
-
-	// Update in KV
-	data, err := json.Marshal(device)
+	device, err := p.updateDevice(ctx, deviceID, func(device *models.DeviceCredentials) error {
+		if device.RevokedAt == nil {
+			now := time.Now()
+			device.RevokedAt = &now
+		}
+		for i, previous := range device.PreviousKeys {
+			if previous.RevokedAt == nil && (previous.ExpiresAt.IsZero() || previous.ExpiresAt.After(*device.RevokedAt)) {
+				device.PreviousKeys[i].RevokedAt = device.RevokedAt
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to marshal device credentials: %w", err)
+		return err
 	}
 
-	_, err = p.kv.Put(ctx, deviceID, data)
-	if err != nil {
-		return fmt.Errorf("failed to update device credentials: %w", err)
+	// Make the server reject the key
+	if p.canPushRevocations() {
+		if err := p.pushRevocation(ctx, *device.RevokedAt, revocableKeys(device, *device.RevokedAt)...); err != nil {
+			return fmt.Errorf("device revoked in registry but not in account JWT: %w", err)
+		}
+	} else {
+		p.log.WithField("device_id", deviceID).Warn("Revocation push not configured, credentials stay valid until they expire")
 	}
 
-	// TODO: Publish revocation to NATS for immediate effect
+	if err := p.record(ctx, audit.Record{Operation: audit.OpRevoke, DeviceID: deviceID, PublicKey: device.PublicKey}); err != nil {
+		return err
+	}
 
-	p.log.WithField("device_id", deviceID).Info("Device revoked")
+	if err := p.publishRevocation(device); err != nil {
+		p.log.WithError(err).WithField("device_id", deviceID).Error("Failed to publish revocation event")
+	}
+
+	p.log.WithFields(logrus.Fields{
+		"device_id":  deviceID,
+		"public_key": device.PublicKey,
+	}).Info("Device revoked")
 	return nil
 }
 
@@ -217,6 +461,9 @@ func (p *Provisioner) ListDevices(ctx context.Context) ([]models.DeviceCredentia
 	devices := make([]models.DeviceCredentials, 0)
 
 	entries, err := p.kv.Keys(ctx)
+	if errors.Is(err, jetstream.ErrNoKeysFound) {
+		return devices, nil
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to list devices: %w", err)
 	}
@@ -238,124 +485,160 @@ func (p *Provisioner) ListDevices(ctx context.Context) ([]models.DeviceCredentia
 	return devices, nil
 }
 
-// getDevice retrieves a device from KV
-func (p *Provisioner) getDevice(ctx context.Context, deviceID string) (*models.DeviceCredentials, error) {
-	entry, err := p.kv.Get(ctx, deviceID)
-	if err != nil {
-		return nil, err
+// keyValue opens a KV bucket, creating it when it doesn't exist
+func keyValue(js jetstream.JetStream, cfg jetstream.KeyValueConfig) (jetstream.KeyValue, error) {
+	kv, err := js.KeyValue(context.Background(), cfg.Bucket)
+	if err == nil {
+		return kv, nil
 	}
 
-	var device models.DeviceCredentials
-	if err := json.Unmarshal(entry.Value(), &device); err != nil {
-		return nil, err
+	kv, err = js.CreateKeyValue(context.Background(), cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create KV bucket %s: %w", cfg.Bucket, err)
 	}
-
-	return &device, nil
+	return kv, nil
 }
 
-// getPublishSubjects returns allowed publish subjects for a device
-func (p *Provisioner) getPublishSubjects(deviceID string, deviceType models.DeviceType) []string {
-	base := fmt.Sprintf("home.devices.%s.%s", deviceType, deviceID)
-	
-	subjects := []string{
-		fmt.Sprintf("%s.state", base),
-		fmt.Sprintf("%s.announce", base),
-		fmt.Sprintf("%s.health", base),
-		"home.discovery.announce",
-		"_INBOX.>",
-		"$JS.API.CONSUMER.MSG.NEXT.>",
-	}
-
-	// Add type-specific subjects
-	switch deviceType {
-	case models.DeviceTypeSensor:
-		subjects = append(subjects, fmt.Sprintf("%s.reading", base))
-	case models.DeviceTypeCamera:
-		subjects = append(subjects, fmt.Sprintf("%s.motion", base))
-		subjects = append(subjects, fmt.Sprintf("%s.snapshot", base))
-	}
-
-	return subjects
-}
-
-// getSubscribeSubjects returns allowed subscribe subjects for a device
-func (p *Provisioner) getSubscribeSubjects(deviceID string, deviceType models.DeviceType) []string {
-	base := fmt.Sprintf("home.devices.%s.%s", deviceType, deviceID)
-	
-	subjects := []string{
-		fmt.Sprintf("%s.command", base),
-		fmt.Sprintf("%s.config", base),
-		"home.discovery.request",
-		"_INBOX.>",
-	}
-
-	// Add type-specific subjects
-	switch deviceType {
-	case models.DeviceTypeThermostat:
-		subjects = append(subjects, fmt.Sprintf("%s.schedule", base))
-	case models.DeviceTypeCamera:
-		subjects = append(subjects, fmt.Sprintf("%s.stream", base))
-	}
-
-	return subjects
+// getDevice retrieves a device from KV
+func (p *Provisioner) getDevice(ctx context.Context, deviceID string) (*models.DeviceCredentials, error) {
+	device, _, err := p.loadDevice(ctx, deviceID)
+	return device, err
 }
 
 // Run starts the provisioner service
 func (p *Provisioner) Run(ctx context.Context) error {
-	// Subscribe to provisioning requests
-	sub, err := p.nc.QueueSubscribe("home.provisioning.request", "provisioner", func(msg *nats.Msg) {
-		var req models.ProvisionRequest
-		if err := json.Unmarshal(msg.Data, &req); err != nil {
-			p.log.WithError(err).Error("Failed to unmarshal provision request")
-			msg.Respond([]byte(fmt.Sprintf(`{"error": "%s"}`, err.Error())))
-			return
-		}
-
-		resp, err := p.ProvisionDevice(ctx, req)
-		if err != nil {
-			p.log.WithError(err).Error("Failed to provision device")
-			msg.Respond([]byte(fmt.Sprintf(`{"error": "%s"}`, err.Error())))
-			return
-		}
+	handlers := []struct {
+		subject string
+		action  string
+		handle  func(ctx context.Context, msg *nats.Msg) (interface{}, error)
+	}{
+		{"home.provisioning.request", "provision device", func(ctx context.Context, msg *nats.Msg) (interface{}, error) {
+			var req models.ProvisionRequest
+			if err := decodeRequest(msg.Data, &req); err != nil {
+				return nil, err
+			}
+			return p.ProvisionDevice(ctx, req)
+		}},
+		{"home.provisioning.revoke", "revoke device", func(ctx context.Context, msg *nats.Msg) (interface{}, error) {
+			deviceID := strings.TrimSpace(string(msg.Data))
+			if err := validateDeviceID(deviceID); err != nil {
+				return nil, err
+			}
+			if err := p.RevokeDevice(ctx, deviceID); err != nil {
+				return nil, err
+			}
+			return map[string]bool{"success": true}, nil
+		}},
+		{SubjectList, "list devices", func(ctx context.Context, msg *nats.Msg) (interface{}, error) {
+			var req models.ListRequest
+			if len(msg.Data) > 0 {
+				if err := decodeRequest(msg.Data, &req); err != nil {
+					return nil, err
+				}
+			}
+			return p.QueryDevices(ctx, req)
+		}},
+		{SubjectHistory, "get device history", func(ctx context.Context, msg *nats.Msg) (interface{}, error) {
+			return p.DeviceHistory(ctx, strings.TrimSpace(string(msg.Data)))
+		}},
+		{SubjectAudit, "query audit log", func(ctx context.Context, msg *nats.Msg) (interface{}, error) {
+			var q audit.Query
+			if len(msg.Data) > 0 {
+				if err := decodeRequest(msg.Data, &q); err != nil {
+					return nil, err
+				}
+			}
+			return p.QueryAudit(ctx, q)
+		}},
+		{SubjectRole, "issue role credentials", func(ctx context.Context, msg *nats.Msg) (interface{}, error) {
+			var req models.RoleRequest
+			if err := decodeRequest(msg.Data, &req); err != nil {
+				return nil, err
+			}
+			return p.ProvisionRole(ctx, req)
+		}},
+		{SubjectNonce, "create nonce", func(ctx context.Context, msg *nats.Msg) (interface{}, error) {
+			return p.NewNonce()
+		}},
+		{SubjectRenew, "renew device", func(ctx context.Context, msg *nats.Msg) (interface{}, error) {
+			var req models.RenewRequest
+			if err := decodeRequest(msg.Data, &req); err != nil {
+				return nil, err
+			}
+			return p.RenewDevice(ctx, req)
+		}},
+		{SubjectClaimCreate, "create claim", func(ctx context.Context, msg *nats.Msg) (interface{}, error) {
+			var req models.ClaimRequest
+			if err := decodeRequest(msg.Data, &req); err != nil {
+				return nil, err
+			}
+			return p.CreateClaim(ctx, req)
+		}},
+		{SubjectClaimRedeem, "redeem claim", func(ctx context.Context, msg *nats.Msg) (interface{}, error) {
+			var req models.RedeemRequest
+			if err := decodeRequest(msg.Data, &req); err != nil {
+				return nil, err
+			}
+			// The subject names the device, as bootstrap credentials may
+			// only redeem their own device's claim
+			deviceID := strings.Split(msg.Subject, ".")[3]
+			if req.DeviceID == "" {
+				req.DeviceID = deviceID
+			}
+			if req.DeviceID != deviceID {
+				return nil, invalidField("device_id", "device_id must be the device in the subject, %s", deviceID)
+			}
+			return p.RedeemClaim(ctx, req)
+		}},
+	}
 
-		data, err := json.Marshal(resp)
+	for _, h := range handlers {
+		sub, err := p.handle(ctx, h.subject, h.action, h.handle)
 		if err != nil {
-			p.log.WithError(err).Error("Failed to marshal provision response")
-			msg.Respond([]byte(fmt.Sprintf(`{"error": "%s"}`, err.Error())))
-			return
+			return fmt.Errorf("failed to subscribe to %s: %w", h.subject, err)
 		}
-
-		msg.Respond(data)
-	})
-	if err != nil {
-		return fmt.Errorf("failed to subscribe to provisioning requests: %w", err)
+		defer sub.Unsubscribe()
 	}
-	defer sub.Unsubscribe()
 
-	// Subscribe to revocation requests
-	revokeSub, err := p.nc.QueueSubscribe("home.provisioning.revoke", "provisioner", func(msg *nats.Msg) {
-		deviceID := strings.TrimSpace(string(msg.Data))
-		if deviceID == "" {
-			msg.Respond([]byte(`{"error": "device_id is required"}`))
-			return
-		}
-
-		if err := p.RevokeDevice(ctx, deviceID); err != nil {
-			p.log.WithError(err).Error("Failed to revoke device")
-			msg.Respond([]byte(fmt.Sprintf(`{"error": "%s"}`, err.Error())))
-			return
-		}
-
-		msg.Respond([]byte(`{"success": true}`))
-	})
-	if err != nil {
-		return fmt.Errorf("failed to subscribe to revocation requests: %w", err)
-	}
-	defer revokeSub.Unsubscribe()
+	go p.runExpirySweep(ctx)
 
 	p.log.Info("Device provisioner started")
 
 	// Wait for context cancellation
 	<-ctx.Done()
 	return ctx.Err()
-}
\ No newline at end of file
+}
+
+// handle answers requests on subject with the JSON encoded result of fn, or
+// with a models.ErrorResponse when it fails. fn's context names the requester
+// for the audit log.
+func (p *Provisioner) handle(ctx context.Context, subject, action string, fn func(ctx context.Context, msg *nats.Msg) (interface{}, error)) (*nats.Subscription, error) {
+	return p.nc.QueueSubscribe(subject, "provisioner", func(msg *nats.Msg) {
+		resp, err := fn(audit.WithActor(ctx, natsActor(msg)), msg)
+		if err == nil {
+			var data []byte
+			if data, err = json.Marshal(resp); err == nil {
+				msg.Respond(data)
+				return
+			}
+			err = fmt.Errorf("failed to marshal response: %w", err)
+		}
+
+		errResp := ErrorResponse(err)
+		if errResp.Code == models.CodeInternal {
+			p.log.WithError(err).Errorf("Failed to %s", action)
+		} else {
+			p.log.WithError(err).Debugf("Refused to %s", action)
+		}
+		data, _ := json.Marshal(errResp)
+		msg.Respond(data)
+	})
+}
+
+// decodeRequest decodes a JSON request body
+func decodeRequest(data []byte, v interface{}) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return invalidRequest("invalid request body: %v", err)
+	}
+	return nil
+}
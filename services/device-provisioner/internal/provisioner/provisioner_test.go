@@ -0,0 +1,339 @@
+package provisioner_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/provisioner"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// repoTemplates are the device templates shipped in the repo
+const repoTemplates = "../../../../device-templates"
+
+// operatorEnv is an embedded nats-server in operator mode with a full
+// directory resolver, a system account and a HOME account with a signing key
+type operatorEnv struct {
+	server *server.Server
+
+	operatorSigningKey nkeys.KeyPair
+	accountPub         string
+	accountSigningKey  nkeys.KeyPair
+
+	home   *nats.Conn // HOME account user for the provisioner
+	system *nats.Conn // System account user
+}
+
+func seed(t *testing.T, kp nkeys.KeyPair) string {
+	t.Helper()
+	s, err := kp.Seed()
+	require.NoError(t, err)
+	return string(s)
+}
+
+func publicKey(t *testing.T, kp nkeys.KeyPair) string {
+	t.Helper()
+	pub, err := kp.PublicKey()
+	require.NoError(t, err)
+	return pub
+}
+
+// userConn issues a user JWT signed by one of account's signing keys and
+// connects with it
+func userConn(t *testing.T, s *server.Server, account string, signer nkeys.KeyPair) *nats.Conn {
+	t.Helper()
+
+	user, err := nkeys.CreateUser()
+	require.NoError(t, err)
+
+	claims := jwt.NewUserClaims(publicKey(t, user))
+	claims.IssuerAccount = account
+	token, err := claims.Encode(signer)
+	require.NoError(t, err)
+
+	nc, err := nats.Connect(s.ClientURL(), nats.UserJWTAndSeed(token, seed(t, user)))
+	require.NoError(t, err)
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+func runOperatorServer(t *testing.T) *operatorEnv {
+	t.Helper()
+
+	operator, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	operatorSigningKey, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	sysAccount, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	sysSigningKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	homeAccount, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	accountSigningKey, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+
+	sysPub := publicKey(t, sysAccount)
+	homePub := publicKey(t, homeAccount)
+
+	operatorClaims := jwt.NewOperatorClaims(publicKey(t, operator))
+	operatorClaims.SigningKeys.Add(publicKey(t, operatorSigningKey))
+	operatorClaims.SystemAccount = sysPub
+	// Strict usage: accounts are signed by operator signing keys and users by
+	// account signing keys, never by the identity keys themselves
+	operatorClaims.StrictSigningKeyUsage = true
+	operatorJWT, err := operatorClaims.Encode(operator)
+	require.NoError(t, err)
+	operatorClaims, err = jwt.DecodeOperatorClaims(operatorJWT)
+	require.NoError(t, err)
+
+	resolver, err := server.NewDirAccResolver(t.TempDir(), 0, 0, server.NoDelete)
+	require.NoError(t, err)
+
+	sysClaims := jwt.NewAccountClaims(sysPub)
+	sysClaims.Name = "SYS"
+	sysClaims.SigningKeys.Add(publicKey(t, sysSigningKey))
+	sysJWT, err := sysClaims.Encode(operatorSigningKey)
+	require.NoError(t, err)
+	require.NoError(t, resolver.Store(sysPub, sysJWT))
+
+	homeClaims := jwt.NewAccountClaims(homePub)
+	homeClaims.Name = "HOME"
+	homeClaims.SigningKeys.Add(publicKey(t, accountSigningKey))
+	homeClaims.Limits.JetStreamLimits = jwt.JetStreamLimits{MemoryStorage: -1, DiskStorage: -1, Streams: -1, Consumer: -1}
+	homeJWT, err := homeClaims.Encode(operatorSigningKey)
+	require.NoError(t, err)
+	require.NoError(t, resolver.Store(homePub, homeJWT))
+
+	s, err := server.NewServer(&server.Options{
+		Port:             -1,
+		NoLog:            true,
+		NoSigs:           true,
+		JetStream:        true,
+		StoreDir:         t.TempDir(),
+		TrustedOperators: []*jwt.OperatorClaims{operatorClaims},
+		SystemAccount:    sysPub,
+		AccountResolver:  resolver,
+	})
+	require.NoError(t, err)
+	s.Start()
+	require.True(t, s.ReadyForConnections(5*time.Second), "server did not start")
+	t.Cleanup(s.Shutdown)
+
+	return &operatorEnv{
+		server:             s,
+		operatorSigningKey: operatorSigningKey,
+		accountPub:         homePub,
+		accountSigningKey:  accountSigningKey,
+		home:               userConn(t, s, homePub, accountSigningKey),
+		system:             userConn(t, s, sysPub, sysSigningKey),
+	}
+}
+
+// withRevocationPush lets the provisioner push revocations to the resolver
+func withRevocationPush(t *testing.T, env *operatorEnv) func(*provisioner.Config) {
+	return func(cfg *provisioner.Config) {
+		cfg.System = env.system
+		cfg.OperatorSigningKey = seed(t, env.operatorSigningKey)
+	}
+}
+
+func newProvisioner(t *testing.T, env *operatorEnv, options ...func(*provisioner.Config)) *provisioner.Provisioner {
+	t.Helper()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	cfg := provisioner.Config{
+		NATS:       env.home,
+		Logger:     logger,
+		SigningKey: seed(t, env.accountSigningKey),
+		AccountPub: env.accountPub,
+		IssuerName: "device-provisioner",
+		KVBucket:   "device-credentials",
+
+		TemplatesDir: repoTemplates,
+	}
+	for _, option := range options {
+		option(&cfg)
+	}
+
+	prov, err := provisioner.New(cfg)
+	require.NoError(t, err)
+	return prov
+}
+
+// runProvisioner runs the provisioner's request handlers until the test ends
+func runProvisioner(t *testing.T, env *operatorEnv, prov *provisioner.Provisioner) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go prov.Run(ctx)
+
+	// An empty revoke request is answered with an error once Run subscribed
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, err := env.home.Request("home.provisioning.revoke", nil, time.Second)
+		if !errors.Is(err, nats.ErrNoResponders) {
+			require.NoError(t, err)
+			return
+		}
+		require.True(t, time.Now().Before(deadline), "provisioner did not start")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRevokeDevicePushesRevocation(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env, withRevocationPush(t, env))
+	ctx := context.Background()
+
+	resp, err := prov.ProvisionDevice(ctx, models.ProvisionRequest{
+		DeviceID:   "kitchen",
+		DeviceType: models.DeviceTypeLight,
+		Name:       "Kitchen Light",
+	})
+	require.NoError(t, err)
+
+	closed := make(chan struct{})
+	device, err := nats.Connect(env.server.ClientURL(),
+		nats.UserJWTAndSeed(resp.JWT, resp.Seed),
+		nats.NoReconnect(),
+		nats.ClosedHandler(func(*nats.Conn) { close(closed) }),
+	)
+	require.NoError(t, err, "provisioned credentials must be accepted")
+	defer device.Close()
+	require.NoError(t, device.Publish("home.devices.light.kitchen.state", []byte(`{"on": true}`)))
+	require.NoError(t, device.Flush())
+
+	events, err := env.home.SubscribeSync(provisioner.SubjectRevoked)
+	require.NoError(t, err)
+	require.NoError(t, env.home.Flush())
+
+	require.NoError(t, prov.RevokeDevice(ctx, "kitchen"))
+
+	msg, err := events.NextMsg(2 * time.Second)
+	require.NoError(t, err)
+	var event models.RevocationEvent
+	require.NoError(t, json.Unmarshal(msg.Data, &event))
+	assert.Equal(t, "kitchen", event.DeviceID)
+	assert.Equal(t, models.DeviceTypeLight, event.DeviceType)
+
+	// The server drops the live connection and refuses new ones
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("revoked device was not disconnected")
+	}
+	_, err = nats.Connect(env.server.ClientURL(), nats.UserJWTAndSeed(resp.JWT, resp.Seed), nats.NoReconnect())
+	assert.Error(t, err, "revoked credentials must be rejected")
+
+	// The account JWT now lists the key, and revoking again keeps it listed
+	require.NoError(t, prov.RevokeDevice(ctx, "kitchen"))
+	lookup, err := env.system.Request("$SYS.REQ.ACCOUNT."+env.accountPub+".CLAIMS.LOOKUP", nil, time.Second)
+	require.NoError(t, err)
+	account, err := jwt.DecodeAccountClaims(string(lookup.Data))
+	require.NoError(t, err)
+	user, err := jwt.DecodeUserClaims(resp.JWT)
+	require.NoError(t, err)
+	assert.Equal(t, user.Subject, event.PublicKey)
+	assert.True(t, account.Revocations.IsRevoked(user.Subject, time.Unix(user.IssuedAt, 0)))
+	assert.Len(t, account.Revocations, 1)
+}
+
+func TestRevokeDeviceRevokesPreviousKeys(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env, withRevocationPush(t, env))
+	ctx := context.Background()
+
+	original, err := prov.ProvisionDevice(ctx, models.ProvisionRequest{
+		DeviceID:   "stairs",
+		DeviceType: models.DeviceTypeLight,
+		Name:       "Stairs Light",
+	})
+	require.NoError(t, err)
+	renewed, err := prov.RenewDevice(ctx, signRenewal(t, "stairs", original.Seed, newNonce(t, prov)))
+	require.NoError(t, err)
+
+	require.NoError(t, prov.RevokeDevice(ctx, "stairs"))
+
+	// Both the renewed key and the retired one, whose JWT is still valid,
+	// are in the account's revocation list
+	lookup, err := env.system.Request("$SYS.REQ.ACCOUNT."+env.accountPub+".CLAIMS.LOOKUP", nil, time.Second)
+	require.NoError(t, err)
+	account, err := jwt.DecodeAccountClaims(string(lookup.Data))
+	require.NoError(t, err)
+	for _, resp := range []*models.ProvisionResponse{original, renewed} {
+		user, err := jwt.DecodeUserClaims(resp.JWT)
+		require.NoError(t, err)
+		assert.True(t, account.Revocations.IsRevoked(user.Subject, time.Unix(user.IssuedAt, 0)), "key %s not revoked", user.Subject)
+
+		_, err = nats.Connect(env.server.ClientURL(), nats.UserJWTAndSeed(resp.JWT, resp.Seed), nats.NoReconnect())
+		assert.Error(t, err, "revoked credentials must be rejected")
+	}
+	assert.Len(t, account.Revocations, 2)
+
+	devices, err := prov.ListDevices(ctx)
+	require.NoError(t, err)
+	require.Len(t, devices, 1)
+	require.Len(t, devices[0].PreviousKeys, 1)
+	assert.NotNil(t, devices[0].PreviousKeys[0].RevokedAt)
+}
+
+func TestRevokeDeviceWithoutPush(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env)
+	ctx := context.Background()
+
+	resp, err := prov.ProvisionDevice(ctx, models.ProvisionRequest{
+		DeviceID:   "porch",
+		DeviceType: models.DeviceTypeSensor,
+		Name:       "Porch Sensor",
+	})
+	require.NoError(t, err)
+
+	events, err := env.home.SubscribeSync(provisioner.SubjectRevoked)
+	require.NoError(t, err)
+	require.NoError(t, env.home.Flush())
+
+	require.NoError(t, prov.RevokeDevice(ctx, "porch"))
+
+	_, err = events.NextMsg(2 * time.Second)
+	require.NoError(t, err, "revocation must still be announced")
+
+	devices, err := prov.ListDevices(ctx)
+	require.NoError(t, err)
+	require.Len(t, devices, 1)
+	assert.NotNil(t, devices[0].RevokedAt)
+
+	// Without a push the server keeps accepting the credentials
+	device, err := nats.Connect(env.server.ClientURL(), nats.UserJWTAndSeed(resp.JWT, resp.Seed), nats.NoReconnect())
+	require.NoError(t, err)
+	device.Close()
+}
+
+func TestNewRequiresSystemConnectionWithOperatorKey(t *testing.T) {
+	env := runOperatorServer(t)
+
+	_, err := provisioner.New(provisioner.Config{
+		NATS:               env.home,
+		Logger:             logrus.New(),
+		SigningKey:         seed(t, env.accountSigningKey),
+		AccountPub:         env.accountPub,
+		KVBucket:           "device-credentials",
+		OperatorSigningKey: seed(t, env.operatorSigningKey),
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,208 @@
+package provisioner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// SubjectHistory takes a device ID and replies with its
+	// models.DeviceHistory
+	SubjectHistory = "home.provisioning.history"
+
+	// Revisions the registry keeps per device
+	registryHistory = 10
+
+	// How often a registry write is retried when another provisioner
+	// changed the device first
+	maxUpdateAttempts = 5
+)
+
+// Provisioner replicas share the registry, so every write names the revision
+// it read: Create for new devices, Update and Delete with the last revision
+// otherwise. A write that loses the race reads the device again and retries.
+
+// loadDevice retrieves a device from KV with the revision it was read at
+func (p *Provisioner) loadDevice(ctx context.Context, deviceID string) (*models.DeviceCredentials, uint64, error) {
+	if err := validateDeviceID(deviceID); err != nil {
+		return nil, 0, err
+	}
+
+	entry, err := p.kv.Get(ctx, deviceID)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil, 0, fmt.Errorf("%w: %s", ErrDeviceNotFound, deviceID)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to load device %s: %w", deviceID, err)
+	}
+
+	var device models.DeviceCredentials
+	if err := json.Unmarshal(entry.Value(), &device); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode device %s: %w", deviceID, err)
+	}
+
+	return &device, entry.Revision(), nil
+}
+
+// updateDevice applies change to the stored device and writes it back if it
+// changed anything. change may be called again with a fresh copy when another
+// request updates the device in between. It returns the device as stored.
+func (p *Provisioner) updateDevice(ctx context.Context, deviceID string, change func(device *models.DeviceCredentials) error) (*models.DeviceCredentials, error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		device, rev, err := p.loadDevice(ctx, deviceID)
+		if err != nil {
+			return nil, err
+		}
+		before, err := json.Marshal(device)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal device credentials: %w", err)
+		}
+
+		if err := change(device); err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(device)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal device credentials: %w", err)
+		}
+		if bytes.Equal(before, data) {
+			return device, nil
+		}
+
+		_, err = p.kv.Update(ctx, deviceID, data, rev)
+		if err == nil {
+			return device, nil
+		}
+		if !isConflict(err) {
+			return nil, fmt.Errorf("failed to update device credentials: %w", err)
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrConcurrentUpdate, deviceID)
+}
+
+// createDevice stores a newly provisioned device, unless another request
+// provisioned it first. A revoked device it replaces hands down its keys, so
+// provisioning again keeps the record of them.
+func (p *Provisioner) createDevice(ctx context.Context, device models.DeviceCredentials) error {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		existing, rev, err := p.loadDevice(ctx, device.DeviceID)
+		if err != nil && !errors.Is(err, ErrDeviceNotFound) {
+			return err
+		}
+		if existing != nil && existing.RevokedAt == nil {
+			return fmt.Errorf("%w: %s", ErrDeviceExists, device.DeviceID)
+		}
+
+		device.PreviousKeys = nil
+		if existing != nil {
+			retireKey(existing)
+			device.PreviousKeys = existing.PreviousKeys
+		}
+
+		data, err := json.Marshal(device)
+		if err != nil {
+			return fmt.Errorf("failed to marshal device credentials: %w", err)
+		}
+		if existing == nil {
+			_, err = p.kv.Create(ctx, device.DeviceID, data)
+		} else {
+			_, err = p.kv.Update(ctx, device.DeviceID, data, rev)
+		}
+		if err == nil {
+			return nil
+		}
+		if !isConflict(err) {
+			return fmt.Errorf("failed to store device credentials: %w", err)
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrConcurrentUpdate, device.DeviceID)
+}
+
+// retireKey moves a device's current key to its previous keys, keeping the
+// last maxPreviousKeys
+func retireKey(device *models.DeviceCredentials) {
+	previous := models.KeyRecord{
+		PublicKey: device.PublicKey,
+		IssuedAt:  device.CreatedAt,
+		ExpiresAt: device.ExpiresAt,
+		RevokedAt: device.RevokedAt,
+	}
+	if device.RenewedAt != nil {
+		previous.IssuedAt = *device.RenewedAt
+	}
+	device.PreviousKeys = append(device.PreviousKeys, previous)
+	if n := len(device.PreviousKeys); n > maxPreviousKeys {
+		device.PreviousKeys = device.PreviousKeys[n-maxPreviousKeys:]
+	}
+}
+
+// isConflict reports whether a KV write failed because the key is not at the
+// revision the write expected
+func isConflict(err error) bool {
+	return errors.Is(err, jetstream.ErrKeyExists)
+}
+
+// DeviceHistory returns the revisions the registry kept of a device, so its
+// credential lifecycle can be followed across renewals, revocation and
+// provisioning again. Only the last few revisions are kept; previous keys in
+// each revision reach further back.
+func (p *Provisioner) DeviceHistory(ctx context.Context, deviceID string) (*models.DeviceHistory, error) {
+	if err := validateDeviceID(deviceID); err != nil {
+		return nil, err
+	}
+
+	entries, err := p.kv.History(ctx, deviceID)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrDeviceNotFound, deviceID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load history of device %s: %w", deviceID, err)
+	}
+
+	history := &models.DeviceHistory{DeviceID: deviceID, Entries: make([]models.HistoryEntry, 0, len(entries))}
+	var previous *models.DeviceCredentials
+	for _, entry := range entries {
+		item := models.HistoryEntry{Revision: entry.Revision(), Time: entry.Created()}
+		if entry.Operation() != jetstream.KeyValuePut {
+			item.Event = models.EventDeleted
+			if previous != nil {
+				item.PublicKey = previous.PublicKey
+			}
+			history.Entries = append(history.Entries, item)
+			previous = nil
+			continue
+		}
+
+		var device models.DeviceCredentials
+		if err := json.Unmarshal(entry.Value(), &device); err != nil {
+			return nil, fmt.Errorf("failed to decode device %s at revision %d: %w", deviceID, entry.Revision(), err)
+		}
+		item.Device = &device
+		item.PublicKey = device.PublicKey
+		item.Event = historyEvent(previous, &device)
+		history.Entries = append(history.Entries, item)
+		previous = &device
+	}
+
+	return history, nil
+}
+
+// historyEvent names what happened between two revisions of a device;
+// previous is nil for the first revision and after a deletion
+func historyEvent(previous, device *models.DeviceCredentials) models.HistoryEvent {
+	switch {
+	case previous == nil, previous.RevokedAt != nil && device.RevokedAt == nil:
+		return models.EventProvisioned
+	case previous.RevokedAt == nil && device.RevokedAt != nil:
+		return models.EventRevoked
+	case previous.PublicKey != device.PublicKey:
+		return models.EventRenewed
+	}
+	return models.EventUpdated
+}
@@ -0,0 +1,182 @@
+package provisioner_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/provisioner"
+	"github.com/nats-io/jwt/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrentReplicasLoseNoUpdates(t *testing.T) {
+	env := runOperatorServer(t)
+	replicas := []*provisioner.Provisioner{newProvisioner(t, env), newProvisioner(t, env)}
+	ctx := context.Background()
+
+	_, err := replicas[0].ProvisionDevice(ctx, models.ProvisionRequest{DeviceID: "garage", DeviceType: models.DeviceTypeLock})
+	require.NoError(t, err)
+
+	// Both replicas reissue at once; every key they hand out that the
+	// registry kept is either current or in the device's history
+	var (
+		mu     sync.Mutex
+		issued []string
+		wg     sync.WaitGroup
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(prov *provisioner.Provisioner) {
+			defer wg.Done()
+			resp, err := prov.ReissueDevice(ctx, "garage", "")
+			if errors.Is(err, provisioner.ErrConcurrentUpdate) {
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			user, err := jwt.DecodeUserClaims(resp.JWT)
+			if !assert.NoError(t, err) {
+				return
+			}
+			mu.Lock()
+			issued = append(issued, user.Subject)
+			mu.Unlock()
+		}(replicas[i%2])
+	}
+	wg.Wait()
+	require.NotEmpty(t, issued)
+
+	device, err := replicas[1].GetDevice(ctx, "garage")
+	require.NoError(t, err)
+	known := []string{device.PublicKey}
+	for _, key := range device.PreviousKeys {
+		known = append(known, key.PublicKey)
+	}
+	for _, key := range issued {
+		assert.Contains(t, known, key)
+	}
+	assert.Len(t, device.PreviousKeys, len(issued))
+
+	// Two replicas provisioning the same device: one wins
+	errs := make(chan error, 2)
+	for _, prov := range replicas {
+		go func(prov *provisioner.Provisioner) {
+			_, err := prov.ProvisionDevice(ctx, models.ProvisionRequest{DeviceID: "shed", DeviceType: models.DeviceTypeSensor})
+			errs <- err
+		}(prov)
+	}
+	var failed []error
+	for range replicas {
+		if err := <-errs; err != nil {
+			failed = append(failed, err)
+		}
+	}
+	require.Len(t, failed, 1)
+	assert.ErrorIs(t, failed[0], provisioner.ErrDeviceExists)
+}
+
+func TestProvisionAfterRevokeKeepsKeys(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env)
+	ctx := context.Background()
+
+	req := models.ProvisionRequest{DeviceID: "office", DeviceType: models.DeviceTypeLight}
+	first, err := prov.ProvisionDevice(ctx, req)
+	require.NoError(t, err)
+	_, err = prov.ReissueDevice(ctx, "office", "")
+	require.NoError(t, err)
+	require.NoError(t, prov.RevokeDevice(ctx, "office"))
+	revoked, err := prov.GetDevice(ctx, "office")
+	require.NoError(t, err)
+
+	second, err := prov.ProvisionDevice(ctx, req)
+	require.NoError(t, err)
+
+	device, err := prov.GetDevice(ctx, "office")
+	require.NoError(t, err)
+	assert.Nil(t, device.RevokedAt)
+	require.Len(t, device.PreviousKeys, 2)
+	firstUser, err := jwt.DecodeUserClaims(first.JWT)
+	require.NoError(t, err)
+	assert.Equal(t, firstUser.Subject, device.PreviousKeys[0].PublicKey)
+	assert.NotNil(t, device.PreviousKeys[0].RevokedAt, "a reissue revokes the outgoing key")
+	assert.Equal(t, revoked.PublicKey, device.PreviousKeys[1].PublicKey)
+	require.NotNil(t, device.PreviousKeys[1].RevokedAt)
+	assert.True(t, revoked.RevokedAt.Equal(*device.PreviousKeys[1].RevokedAt))
+
+	history, err := prov.DeviceHistory(ctx, "office")
+	require.NoError(t, err)
+	var events []models.HistoryEvent
+	for _, entry := range history.Entries {
+		events = append(events, entry.Event)
+	}
+	assert.Equal(t, []models.HistoryEvent{
+		models.EventProvisioned,
+		models.EventRenewed,
+		models.EventRevoked,
+		models.EventProvisioned,
+	}, events)
+	secondUser, err := jwt.DecodeUserClaims(second.JWT)
+	require.NoError(t, err)
+	last := history.Entries[len(history.Entries)-1]
+	assert.Equal(t, secondUser.Subject, last.PublicKey)
+	assert.Equal(t, secondUser.Subject, last.Device.PublicKey)
+
+	// Revoking twice changes nothing, deleting and provisioning starts over
+	require.NoError(t, prov.RevokeDevice(ctx, "office"))
+	require.NoError(t, prov.RevokeDevice(ctx, "office"))
+	require.NoError(t, prov.DeleteDevice(ctx, "office"))
+	_, err = prov.ProvisionDevice(ctx, req)
+	require.NoError(t, err)
+
+	history, err = prov.DeviceHistory(ctx, "office")
+	require.NoError(t, err)
+	events = events[:0]
+	for _, entry := range history.Entries {
+		events = append(events, entry.Event)
+	}
+	assert.Equal(t, []models.HistoryEvent{
+		models.EventProvisioned,
+		models.EventRenewed,
+		models.EventRevoked,
+		models.EventProvisioned,
+		models.EventRevoked,
+		models.EventDeleted,
+		models.EventProvisioned,
+	}, events)
+	assert.Nil(t, history.Entries[5].Device)
+	assert.Equal(t, secondUser.Subject, history.Entries[5].PublicKey)
+
+	_, err = prov.DeviceHistory(ctx, "attic")
+	assert.ErrorIs(t, err, provisioner.ErrDeviceNotFound)
+}
+
+func TestHistoryOverNATS(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env)
+	runProvisioner(t, env, prov)
+
+	_, err := prov.ProvisionDevice(context.Background(), models.ProvisionRequest{DeviceID: "loft", DeviceType: models.DeviceTypeSensor})
+	require.NoError(t, err)
+
+	msg, err := env.home.Request(provisioner.SubjectHistory, []byte("loft"), 2*time.Second)
+	require.NoError(t, err)
+	var history models.DeviceHistory
+	require.NoError(t, json.Unmarshal(msg.Data, &history))
+	assert.Equal(t, "loft", history.DeviceID)
+	require.Len(t, history.Entries, 1)
+	assert.Equal(t, models.EventProvisioned, history.Entries[0].Event)
+
+	msg, err = env.home.Request(provisioner.SubjectHistory, []byte("cellar"), 2*time.Second)
+	require.NoError(t, err)
+	var errResp models.ErrorResponse
+	require.NoError(t, json.Unmarshal(msg.Data, &errResp))
+	assert.Equal(t, models.CodeDeviceNotFound, errResp.Code)
+}
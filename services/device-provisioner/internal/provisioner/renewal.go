@@ -0,0 +1,216 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/audit"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/nats-io/nkeys"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SubjectRenew takes a models.RenewRequest and replies with fresh
+	// credentials
+	SubjectRenew = "home.provisioning.renew"
+
+	DefaultCredentialTTL = 365 * 24 * time.Hour
+	DefaultRenewWindow   = 30 * 24 * time.Hour
+	DefaultSweepInterval = time.Hour
+
+	// How many previous keys are kept per device
+	maxPreviousKeys = 10
+)
+
+// RenewDevice rotates a device to a new key pair with a fresh expiry. The
+// request must be signed with the device's current key over a nonce that
+// hasn't renewed the device before, so a request seen on the wire can't be
+// replayed. The previous JWT stays valid until it expires, so the device can
+// reconnect at its own pace.
+func (p *Provisioner) RenewDevice(ctx context.Context, req models.RenewRequest) (*models.ProvisionResponse, error) {
+	if err := validBundleFormat(req.Format); err != nil {
+		return nil, err
+	}
+
+	device, err := p.getDevice(ctx, req.DeviceID)
+	if err != nil {
+		return nil, err
+	}
+	if device.RevokedAt != nil {
+		return nil, fmt.Errorf("%w: %s", ErrDeviceRevoked, req.DeviceID)
+	}
+	if req.PublicKey != device.PublicKey {
+		return nil, invalidField("public_key", "public key is not the device's current key")
+	}
+	if err := p.verifyRenewal(req); err != nil {
+		return nil, err
+	}
+	if req.Nonce == device.RenewNonce {
+		return nil, invalidField("nonce", "nonce was already used, ask %s for a new one", SubjectNonce)
+	}
+
+	var newKey string
+	if req.NewKey != nil {
+		if err := p.verifyKeyProof(req.DeviceID, "new_key", req.NewKey); err != nil {
+			return nil, err
+		}
+		if err := checkOwnKey("new_key", device, req.NewKey.PublicKey, req.Format); err != nil {
+			return nil, err
+		}
+		newKey = req.NewKey.PublicKey
+	}
+
+	return p.rotate(deviceActor(ctx, req.DeviceID), device, req.Format, newKey, req.Nonce, audit.OpRenew)
+}
+
+// rotate issues a device new credentials with a fresh expiry, recorded as op,
+// and keeps the outgoing key in its history, marked revoked for a reissue.
+// newKey is a key the device generated itself, or empty to generate one.
+// nonce is the renewal's nonce, recorded so it can't renew again.
+func (p *Provisioner) rotate(ctx context.Context, device *models.DeviceCredentials, format models.BundleFormat, newKey, nonce string, op audit.Operation) (*models.ProvisionResponse, error) {
+	if device.AccessUntil != nil && !time.Now().Before(*device.AccessUntil) {
+		return nil, fmt.Errorf("%w: %s at %s", ErrAccessExpired, device.DeviceID, device.AccessUntil.Format(time.RFC3339))
+	}
+
+	resp, devicePub, err := p.issue(device.DeviceID, p.grantFor(device), newKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.addCreds(resp, format); err != nil {
+		return nil, err
+	}
+
+	if err := p.recordIssued(ctx, op, device.DeviceID, resp.JWT); err != nil {
+		return nil, err
+	}
+
+	// Replace the key the request was checked against, keeping it in the
+	// device's history. Anyone replacing it first wins.
+	outgoing := device.PublicKey
+	_, err = p.updateDevice(ctx, device.DeviceID, func(device *models.DeviceCredentials) error {
+		if device.RevokedAt != nil {
+			return fmt.Errorf("%w: %s", ErrDeviceRevoked, device.DeviceID)
+		}
+		if device.PublicKey != outgoing {
+			return withMessage(ErrConcurrentUpdate, "device %s was given a new key by another request", device.DeviceID)
+		}
+		if nonce != "" && nonce == device.RenewNonce {
+			return invalidField("nonce", "nonce was already used, ask %s for a new one", SubjectNonce)
+		}
+
+		retireKey(device)
+		if op == audit.OpReissue {
+			// An admin reissues to cut off whoever holds the outgoing key
+			device.PreviousKeys[len(device.PreviousKeys)-1].RevokedAt = &resp.CreatedAt
+		}
+		device.PublicKey = devicePub
+		device.ExpiresAt = resp.ExpiresAt
+		device.RenewedAt = &resp.CreatedAt
+		if nonce != "" {
+			device.RenewNonce = nonce
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p.log.WithFields(logrus.Fields{
+		"device_id":  device.DeviceID,
+		"public_key": devicePub,
+		"expires_at": resp.ExpiresAt,
+	}).Info("Device credentials renewed")
+
+	return resp, nil
+}
+
+// verifyRenewal checks that a renew request carries a nonce this
+// provisioner handed out and is signed by the public key it names
+func (p *Provisioner) verifyRenewal(req models.RenewRequest) error {
+	if !p.verifyNonce(req.Nonce) {
+		return invalidField("nonce", "nonce is invalid or expired, ask %s for a new one", SubjectNonce)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(req.Signature)
+	if err != nil {
+		return invalidField("signature", "invalid signature encoding: %v", err)
+	}
+
+	key, err := nkeys.FromPublicKey(req.PublicKey)
+	if err != nil {
+		return invalidField("public_key", "invalid public key: %v", err)
+	}
+	if err := key.Verify(models.RenewalPayload(req.DeviceID, req.Nonce), sig); err != nil {
+		return invalidField("signature", "invalid signature")
+	}
+
+	return nil
+}
+
+// NotifyExpiring tells every active device whose credentials expire within
+// the renew window to renew them. It returns the number of devices notified.
+func (p *Provisioner) NotifyExpiring(ctx context.Context) (int, error) {
+	devices, err := p.ListDevices(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	deadline := time.Now().Add(p.renewWindow)
+	notified := 0
+	for _, device := range devices {
+		// Services and users don't listen on a config subject
+		if device.RevokedAt != nil || device.Role != "" || device.ExpiresAt.After(deadline) {
+			continue
+		}
+
+		subject, ok := p.deviceSubject(device, "config")
+		if !ok {
+			p.log.WithField("device_id", device.DeviceID).Warn("Device template has no config subject, can't ask it to renew")
+			continue
+		}
+
+		data, err := json.Marshal(models.RenewalNotice{
+			Action:    "renew_credentials",
+			DeviceID:  device.DeviceID,
+			ExpiresAt: device.ExpiresAt,
+			Subject:   SubjectRenew,
+		})
+		if err != nil {
+			return notified, fmt.Errorf("failed to marshal renewal notice: %w", err)
+		}
+
+		if err := p.nc.Publish(subject, data); err != nil {
+			return notified, fmt.Errorf("failed to notify device %s: %w", device.DeviceID, err)
+		}
+		notified++
+	}
+
+	return notified, nil
+}
+
+// runExpirySweep calls NotifyExpiring at startup and then every sweep
+// interval until ctx ends
+func (p *Provisioner) runExpirySweep(ctx context.Context) {
+	ticker := time.NewTicker(p.sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		notified, err := p.NotifyExpiring(ctx)
+		if err != nil {
+			p.log.WithError(err).Error("Failed to notify expiring devices")
+		}
+		if notified > 0 {
+			p.log.WithField("devices", notified).Info("Notified devices to renew credentials")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package provisioner_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/provisioner"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signRenewal builds a renew request over nonce signed with the device's seed
+func signRenewal(t *testing.T, deviceID, deviceSeed, nonce string) models.RenewRequest {
+	t.Helper()
+
+	key, err := nkeys.FromSeed([]byte(deviceSeed))
+	require.NoError(t, err)
+	sig, err := key.Sign(models.RenewalPayload(deviceID, nonce))
+	require.NoError(t, err)
+
+	return models.RenewRequest{
+		DeviceID:  deviceID,
+		PublicKey: publicKey(t, key),
+		Nonce:     nonce,
+		Signature: base64.RawURLEncoding.EncodeToString(sig),
+	}
+}
+
+// newNonce returns a nonce from prov
+func newNonce(t *testing.T, prov *provisioner.Provisioner) string {
+	t.Helper()
+
+	nonce, err := prov.NewNonce()
+	require.NoError(t, err)
+	return nonce.Nonce
+}
+
+func TestRenewDeviceOverNATS(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env)
+	runProvisioner(t, env, prov)
+	ctx := context.Background()
+
+	original, err := prov.ProvisionDevice(ctx, models.ProvisionRequest{
+		DeviceID:   "hallway",
+		DeviceType: models.DeviceTypeSensor,
+		Name:       "Hallway Sensor",
+	})
+	require.NoError(t, err)
+
+	// The device renews with its own credentials
+	device, err := nats.Connect(env.server.ClientURL(),
+		nats.UserJWTAndSeed(original.JWT, original.Seed),
+		nats.CustomInboxPrefix(original.Subjects.InboxPrefix),
+	)
+	require.NoError(t, err)
+	defer device.Close()
+
+	data, err := json.Marshal(signRenewal(t, "hallway", original.Seed, requestNonce(t, device)))
+	require.NoError(t, err)
+	msg, err := device.Request(provisioner.SubjectRenew, data, 2*time.Second)
+	require.NoError(t, err)
+
+	var renewed models.ProvisionResponse
+	require.NoError(t, json.Unmarshal(msg.Data, &renewed))
+	require.NotEmpty(t, renewed.JWT, "unexpected response %s", msg.Data)
+	assert.NotEqual(t, original.Seed, renewed.Seed, "renewal must rotate the key")
+
+	fresh, err := nats.Connect(env.server.ClientURL(), nats.UserJWTAndSeed(renewed.JWT, renewed.Seed))
+	require.NoError(t, err, "renewed credentials must be accepted")
+	fresh.Close()
+
+	// The registry holds the new key and remembers the old one
+	devices, err := prov.ListDevices(ctx)
+	require.NoError(t, err)
+	require.Len(t, devices, 1)
+	originalKey, err := nkeys.FromSeed([]byte(original.Seed))
+	require.NoError(t, err)
+	renewedKey, err := nkeys.FromSeed([]byte(renewed.Seed))
+	require.NoError(t, err)
+	assert.Equal(t, publicKey(t, renewedKey), devices[0].PublicKey)
+	assert.NotNil(t, devices[0].RenewedAt)
+	require.Len(t, devices[0].PreviousKeys, 1)
+	assert.Equal(t, publicKey(t, originalKey), devices[0].PreviousKeys[0].PublicKey)
+	assert.Equal(t, original.ExpiresAt.Unix(), devices[0].PreviousKeys[0].ExpiresAt.Unix())
+
+	// The old key can no longer renew
+	_, err = prov.RenewDevice(ctx, signRenewal(t, "hallway", original.Seed, newNonce(t, prov)))
+	assert.Error(t, err)
+}
+
+func TestRenewDeviceRejectsBadRequests(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env)
+	ctx := context.Background()
+
+	resp, err := prov.ProvisionDevice(ctx, models.ProvisionRequest{
+		DeviceID:   "garage",
+		DeviceType: models.DeviceTypeCover,
+		Name:       "Garage Door",
+	})
+	require.NoError(t, err)
+
+	other, err := nkeys.CreateUser()
+	require.NoError(t, err)
+
+	nonce := newNonce(t, prov)
+	forged := signRenewal(t, "garage", seed(t, other), nonce)
+	forged.PublicKey = signRenewal(t, "garage", resp.Seed, nonce).PublicKey
+	wrongDevice := signRenewal(t, "garage", resp.Seed, nonce)
+	wrongDevice.DeviceID = "unknown"
+	noNonce := signRenewal(t, "garage", resp.Seed, "")
+	foreignNonce := signRenewal(t, "garage", resp.Seed, newNonce(t, newProvisioner(t, runOperatorServer(t))))
+	swappedNonce := signRenewal(t, "garage", resp.Seed, nonce)
+	swappedNonce.Nonce = newNonce(t, prov)
+
+	for name, req := range map[string]models.RenewRequest{
+		"forged signature": forged,
+		"unknown device":   wrongDevice,
+		"no nonce":         noNonce,
+		"foreign nonce":    foreignNonce,
+		"unsigned nonce":   swappedNonce,
+	} {
+		_, err := prov.RenewDevice(ctx, req)
+		assert.Error(t, err, name)
+	}
+
+	require.NoError(t, prov.RevokeDevice(ctx, "garage"))
+	_, err = prov.RenewDevice(ctx, signRenewal(t, "garage", resp.Seed, newNonce(t, prov)))
+	assert.Error(t, err, "revoked devices must not renew")
+}
+
+func TestRenewDeviceRejectsReplays(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env)
+	ctx := context.Background()
+
+	resp, err := prov.ProvisionDevice(ctx, models.ProvisionRequest{
+		DeviceID:   "porch",
+		DeviceType: models.DeviceTypeLight,
+		Name:       "Porch Light",
+	})
+	require.NoError(t, err)
+
+	// The same request sent twice at once renews the device only once
+	nonce := newNonce(t, prov)
+	req := signRenewal(t, "porch", resp.Seed, nonce)
+	results := make(chan *models.ProvisionResponse, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			renewed, _ := prov.RenewDevice(ctx, req)
+			results <- renewed
+		}()
+	}
+	var renewed *models.ProvisionResponse
+	for i := 0; i < 2; i++ {
+		if r := <-results; r != nil {
+			require.Nil(t, renewed, "a replayed renewal was accepted")
+			renewed = r
+		}
+	}
+	require.NotNil(t, renewed)
+
+	// The nonce can't renew again, even signed with the new key
+	_, err = prov.RenewDevice(ctx, signRenewal(t, "porch", renewed.Seed, nonce))
+	assert.ErrorContains(t, err, "nonce was already used")
+	_, err = prov.RenewDevice(ctx, signRenewal(t, "porch", renewed.Seed, newNonce(t, prov)))
+	assert.NoError(t, err)
+}
+
+func TestNotifyExpiring(t *testing.T) {
+	env := runOperatorServer(t)
+	ctx := context.Background()
+
+	// One device gets short lived credentials, the other the default
+	short := newProvisioner(t, env, func(cfg *provisioner.Config) {
+		cfg.CredentialTTL = time.Hour
+		cfg.RenewWindow = time.Minute
+	})
+	_, err := short.ProvisionDevice(ctx, models.ProvisionRequest{DeviceID: "attic", DeviceType: models.DeviceTypeFan, Name: "Attic Fan"})
+	require.NoError(t, err)
+
+	prov := newProvisioner(t, env, func(cfg *provisioner.Config) {
+		cfg.RenewWindow = 24 * time.Hour
+	})
+	_, err = prov.ProvisionDevice(ctx, models.ProvisionRequest{DeviceID: "cellar", DeviceType: models.DeviceTypeFan, Name: "Cellar Fan"})
+	require.NoError(t, err)
+
+	notices, err := env.home.SubscribeSync("home.config.device.*")
+	require.NoError(t, err)
+	require.NoError(t, env.home.Flush())
+
+	notified, err := prov.NotifyExpiring(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, notified)
+
+	msg, err := notices.NextMsg(time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "home.config.device.attic", msg.Subject)
+
+	var notice models.RenewalNotice
+	require.NoError(t, json.Unmarshal(msg.Data, &notice))
+	assert.Equal(t, "renew_credentials", notice.Action)
+	assert.Equal(t, provisioner.SubjectRenew, notice.Subject)
+}
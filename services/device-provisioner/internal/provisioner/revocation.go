@@ -0,0 +1,123 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/nats-io/jwt/v2"
+)
+
+const (
+	// SubjectRevoked carries a models.RevocationEvent for every revoked device
+	SubjectRevoked = "home.provisioning.revoked"
+
+	// Resolver subjects, only served to the system account
+	accountLookupSubject = "$SYS.REQ.ACCOUNT.%s.CLAIMS.LOOKUP"
+	claimsUpdateSubject  = "$SYS.REQ.CLAIMS.UPDATE"
+
+	resolverTimeout = 5 * time.Second
+)
+
+// claimsUpdateResponse is the server's reply to $SYS.REQ.CLAIMS.UPDATE
+type claimsUpdateResponse struct {
+	Data *struct {
+		Account string `json:"account"`
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"data,omitempty"`
+	Error *struct {
+		Account     string `json:"account"`
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error,omitempty"`
+}
+
+// canPushRevocations reports whether revocations are pushed to the resolver
+func (p *Provisioner) canPushRevocations() bool {
+	return p.system != nil && p.operatorKey != nil
+}
+
+// revocableKeys returns a device's current key and the previous keys whose
+// JWTs have not expired at now, which a revocation must cover
+func revocableKeys(device *models.DeviceCredentials, now time.Time) []string {
+	keys := []string{device.PublicKey}
+	for _, previous := range device.PreviousKeys {
+		if previous.ExpiresAt.IsZero() || previous.ExpiresAt.After(now) {
+			keys = append(keys, previous.PublicKey)
+		}
+	}
+	return keys
+}
+
+// pushRevocation adds the device keys to the account JWT's revocation list
+// and pushes the reissued JWT through the resolver. The server then rejects
+// the keys and disconnects any client still using them.
+func (p *Provisioner) pushRevocation(ctx context.Context, revokedAt time.Time, publicKeys ...string) error {
+	// Serialize updates so concurrent revocations don't drop each other
+	p.accountMu.Lock()
+	defer p.accountMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, resolverTimeout)
+	defer cancel()
+
+	msg, err := p.system.RequestWithContext(ctx, fmt.Sprintf(accountLookupSubject, p.accountPub), nil)
+	if err != nil {
+		return fmt.Errorf("failed to look up account JWT: %w", err)
+	}
+	if len(msg.Data) == 0 {
+		return fmt.Errorf("account %s is unknown to the resolver", p.accountPub)
+	}
+
+	account, err := jwt.DecodeAccountClaims(string(msg.Data))
+	if err != nil {
+		return fmt.Errorf("failed to decode account JWT: %w", err)
+	}
+	changed := false
+	for _, publicKey := range publicKeys {
+		if !account.Revocations.IsRevoked(publicKey, revokedAt) {
+			account.RevokeAt(publicKey, revokedAt)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	token, err := account.Encode(p.operatorKey)
+	if err != nil {
+		return fmt.Errorf("failed to encode account JWT: %w", err)
+	}
+
+	msg, err = p.system.RequestWithContext(ctx, claimsUpdateSubject, []byte(token))
+	if err != nil {
+		return fmt.Errorf("failed to push account JWT: %w", err)
+	}
+
+	var resp claimsUpdateResponse
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		return fmt.Errorf("invalid resolver response: %w", err)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("resolver rejected account JWT: %s", resp.Error.Description)
+	}
+
+	return nil
+}
+
+// publishRevocation announces a revocation so edges can drop live connections
+func (p *Provisioner) publishRevocation(device *models.DeviceCredentials) error {
+	data, err := json.Marshal(models.RevocationEvent{
+		DeviceID:   device.DeviceID,
+		DeviceType: device.DeviceType,
+		PublicKey:  device.PublicKey,
+		RevokedAt:  *device.RevokedAt,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal revocation event: %w", err)
+	}
+
+	return p.nc.Publish(SubjectRevoked, data)
+}
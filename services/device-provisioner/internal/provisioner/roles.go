@@ -0,0 +1,279 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/audit"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/sirupsen/logrus"
+)
+
+// SubjectRole takes a models.RoleRequest and replies with the credentials
+const SubjectRole = "home.provisioning.role"
+
+// adminSubjects issue and revoke credentials; only admins may use them
+var adminSubjects = []string{
+	"home.provisioning.request",
+	"home.provisioning.revoke",
+	SubjectRole,
+	SubjectClaimCreate,
+}
+
+// provisioningSubjects carry claim PINs, signed renewals and credentials on
+// their way to the provisioner; only admins may subscribe to them
+var provisioningSubjects = []string{"home.provisioning.>"}
+
+// serviceBuckets are the KV buckets services keep their state in: the
+// automations and the simulated devices
+var serviceBuckets = []string{"automations", "device-simulator"}
+
+// roleProfile is what credentials of a role allow
+type roleProfile struct {
+	publish     []string
+	subscribe   []string
+	denyPublish []string
+
+	// Whether the role answers requests, which allows it to publish on the
+	// reply subject of a request it received
+	respond bool
+
+	// Access is time boxed to defaultTTL unless the request gives a TTL,
+	// which may be at most maxTTL. Zero means unlimited.
+	defaultTTL time.Duration
+	maxTTL     time.Duration
+}
+
+// roleProfiles are the permission profiles of the roles. Every role may also
+// renew its credentials and read its own inbox, and every role but admin is
+// denied the provisioner's buckets and audit log, and can't listen in on
+// provisioning requests.
+var roleProfiles = map[models.Role]roleProfile{
+	// Speaks for the devices behind it, e.g. zigbee2mqtt
+	models.RoleBridge: {
+		publish:   []string{"home.devices.>", "home.events.>", "home.discovery.announce"},
+		subscribe: []string{"home.devices.*.*.command", "home.config.device.>", "home.discovery.request"},
+		respond:   true,
+	},
+	// Everything in the home and the service buckets, but no credential
+	// management
+	models.RoleService: {
+		publish:     append([]string{"home.>"}, kvWrite(serviceBuckets...)...),
+		subscribe:   []string{"home.>"},
+		denyPublish: adminSubjects,
+		respond:     true,
+	},
+	models.RoleAdmin: {
+		publish:   []string{">"},
+		subscribe: []string{">"},
+		respond:   true,
+	},
+	// Reads the home, the registry and the service buckets
+	models.RoleViewer: {
+		publish:   append([]string{SubjectList, SubjectHistory, SubjectAudit}, kvRead(serviceBuckets...)...),
+		subscribe: []string{"home.>"},
+	},
+	// Sees device state and controls everyday devices, but not locks or
+	// cameras
+	models.RoleGuest: {
+		publish: []string{
+			"home.devices.light.*.command",
+			"home.devices.switch.*.command",
+			"home.devices.fan.*.command",
+			"home.devices.cover.*.command",
+			"home.devices.thermostat.*.command",
+		},
+		subscribe:  []string{"home.devices.*.*.state"},
+		defaultTTL: 48 * time.Hour,
+		maxTTL:     7 * 24 * time.Hour,
+	},
+}
+
+// ProvisionRole issues credentials for a service or user with the permission
+// profile of their role. They are kept in the device registry, so they are
+// revoked, renewed, listed and deleted like devices.
+func (p *Provisioner) ProvisionRole(ctx context.Context, req models.RoleRequest) (*models.ProvisionResponse, error) {
+	ttl, err := validateRoleRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := validBundleFormat(req.Format); err != nil {
+		return nil, err
+	}
+
+	existing, err := p.getDevice(ctx, req.ID)
+	if err == nil && existing != nil && existing.RevokedAt == nil {
+		return nil, fmt.Errorf("%w: %s", ErrDeviceExists, req.ID)
+	}
+
+	var ownKey string
+	if req.Key != nil {
+		if err := p.verifyKeyProof(req.ID, "key", req.Key); err != nil {
+			return nil, err
+		}
+		if err := checkOwnKey("key", existing, req.Key.PublicKey, req.Format); err != nil {
+			return nil, err
+		}
+		ownKey = req.Key.PublicKey
+	}
+
+	var until time.Time
+	if ttl > 0 {
+		until = time.Now().Add(ttl)
+	}
+	resp, pub, err := p.issue(req.ID, p.roleGrant(req.ID, req.Role, req.Name, until), ownKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.addCreds(resp, req.Format); err != nil {
+		return nil, err
+	}
+
+	if err := p.recordIssued(ctx, audit.OpGrant, req.ID, resp.JWT); err != nil {
+		return nil, err
+	}
+
+	entry := models.DeviceCredentials{
+		DeviceID:    req.ID,
+		Role:        req.Role,
+		Name:        req.Name,
+		Description: req.Description,
+		PublicKey:   pub,
+		CreatedAt:   resp.CreatedAt,
+		ExpiresAt:   resp.ExpiresAt,
+	}
+	if !until.IsZero() {
+		entry.AccessUntil = &until
+	}
+	if err := p.createDevice(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	p.log.WithFields(logrus.Fields{
+		"id":         req.ID,
+		"role":       req.Role,
+		"expires_at": resp.ExpiresAt,
+	}).Info("Role credentials issued")
+
+	return resp, nil
+}
+
+// kvRead returns the subjects to read and watch KV buckets
+func kvRead(buckets ...string) []string {
+	subjects := []string{"$JS.API.INFO"}
+	for _, bucket := range buckets {
+		stream := "KV_" + bucket
+		subjects = append(subjects,
+			"$JS.API.STREAM.INFO."+stream,
+			"$JS.API.STREAM.MSG.GET."+stream,
+			"$JS.API.DIRECT.GET."+stream,
+			"$JS.API.DIRECT.GET."+stream+".>",
+			"$JS.API.CONSUMER.CREATE."+stream,
+			"$JS.API.CONSUMER.CREATE."+stream+".>",
+			"$JS.API.CONSUMER.DELETE."+stream+".>",
+		)
+	}
+	return subjects
+}
+
+// kvWrite returns the subjects to create, read and write KV buckets
+func kvWrite(buckets ...string) []string {
+	subjects := kvRead(buckets...)
+	for _, bucket := range buckets {
+		stream := "KV_" + bucket
+		subjects = append(subjects,
+			"$JS.API.STREAM.CREATE."+stream,
+			"$JS.API.STREAM.UPDATE."+stream,
+			"$KV."+bucket+".>",
+		)
+	}
+	return subjects
+}
+
+// protectedSubjects returns the subjects that reach the provisioner's KV
+// buckets and audit stream, directly or through the JetStream API
+func protectedSubjects(buckets []string, auditStream string) []string {
+	streams := []string{auditStream}
+	subjects := []string{audit.SubjectPrefix + ".>"}
+	for _, bucket := range buckets {
+		streams = append(streams, "KV_"+bucket)
+		subjects = append(subjects, "$KV."+bucket+".>")
+	}
+	for _, stream := range streams {
+		subjects = append(subjects,
+			"$JS.API.STREAM.*."+stream,
+			"$JS.API.STREAM.MSG.*."+stream,
+			"$JS.API.DIRECT.GET."+stream,
+			"$JS.API.DIRECT.GET."+stream+".>",
+			"$JS.API.CONSUMER.*."+stream,
+			"$JS.API.CONSUMER.*."+stream+".>",
+			"$JS.API.CONSUMER.*.*."+stream+".>",
+		)
+	}
+	return subjects
+}
+
+// roleGrant is what credentials of a role allow, until their access ends
+func (p *Provisioner) roleGrant(id string, role models.Role, name string, until time.Time) grant {
+	profile := roleProfiles[role]
+	inbox := inboxPrefix(id)
+
+	denyPublish := profile.denyPublish
+	var denySubscribe []string
+	if role != models.RoleAdmin {
+		denyPublish = append(slices.Clone(denyPublish), p.protected...)
+		denySubscribe = provisioningSubjects
+	}
+
+	g := grant{
+		subjects: models.Subjects{
+			Publish:     append(slices.Clone(profile.publish), SubjectRenew, SubjectNonce),
+			Subscribe:   append(slices.Clone(profile.subscribe), inbox+".>"),
+			InboxPrefix: inbox,
+		},
+		denyPublish:   denyPublish,
+		denySubscribe: denySubscribe,
+		respond:       profile.respond,
+		tags:          []string{"role:" + string(role)},
+		until:         until,
+	}
+	if name != "" {
+		g.tags = append(g.tags, "name:"+name)
+	}
+	return g
+}
+
+// validateRoleRequest checks a role request and returns how long its access
+// lasts, zero for unlimited
+func validateRoleRequest(req models.RoleRequest) (time.Duration, error) {
+	if err := validateID("id", req.ID); err != nil {
+		return 0, err
+	}
+	if req.Role == "" {
+		return 0, invalidField("role", "role is required")
+	}
+	profile, ok := roleProfiles[req.Role]
+	if !ok {
+		return 0, invalidField("role", "unknown role %q, want one of %v", req.Role, models.Roles)
+	}
+	if err := validateText("name", req.Name, maxNameLength); err != nil {
+		return 0, err
+	}
+	if err := validateText("description", req.Description, maxDescriptionLength); err != nil {
+		return 0, err
+	}
+
+	if req.TTL == "" {
+		return profile.defaultTTL, nil
+	}
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil || ttl <= 0 {
+		return 0, invalidField("ttl", "ttl must be a positive duration such as 48h, got %q", req.TTL)
+	}
+	if profile.maxTTL > 0 && ttl > profile.maxTTL {
+		return 0, invalidField("ttl", "%s access may last at most %s", req.Role, profile.maxTTL)
+	}
+	return ttl, nil
+}
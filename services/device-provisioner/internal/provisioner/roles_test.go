@@ -0,0 +1,319 @@
+package provisioner_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/audit"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/provisioner"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvisionRole(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env)
+	ctx := context.Background()
+
+	// Guests are time boxed by default
+	resp, err := prov.ProvisionRole(ctx, models.RoleRequest{ID: "grandma", Role: models.RoleGuest, Name: "Grandma"})
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(48*time.Hour), resp.ExpiresAt, time.Minute)
+
+	user, err := jwt.DecodeUserClaims(resp.JWT)
+	require.NoError(t, err)
+	assert.Equal(t, jwt.TagList{"role:guest", "name:grandma"}, user.Tags)
+	assert.Contains(t, user.Pub.Allow, "home.devices.light.*.command")
+	assert.NotContains(t, user.Pub.Allow, "home.devices.lock.*.command")
+	assert.Contains(t, user.Sub.Allow, "home.devices.*.*.state")
+
+	guest, err := prov.GetDevice(ctx, "grandma")
+	require.NoError(t, err)
+	assert.Equal(t, models.RoleGuest, guest.Role)
+	assert.Empty(t, guest.DeviceType)
+	require.NotNil(t, guest.AccessUntil)
+	assert.Equal(t, resp.ExpiresAt.Unix(), guest.AccessUntil.Unix())
+
+	// Other roles aren't, unless asked
+	resp, err = prov.ProvisionRole(ctx, models.RoleRequest{ID: "automations", Role: models.RoleService})
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(provisioner.DefaultCredentialTTL), resp.ExpiresAt, time.Minute)
+	service, err := prov.GetDevice(ctx, "automations")
+	require.NoError(t, err)
+	assert.Nil(t, service.AccessUntil)
+
+	// IDs are shared with devices
+	_, err = prov.ProvisionDevice(ctx, models.ProvisionRequest{DeviceID: "automations", DeviceType: models.DeviceTypeLight})
+	assert.ErrorIs(t, err, provisioner.ErrDeviceExists)
+
+	list, err := prov.QueryDevices(ctx, models.ListRequest{Role: models.RoleService})
+	require.NoError(t, err)
+	require.Len(t, list.Devices, 1)
+	assert.Equal(t, "automations", list.Devices[0].DeviceID)
+
+	for _, tc := range []struct {
+		name  string
+		req   models.RoleRequest
+		field string
+	}{
+		{"no ID", models.RoleRequest{Role: models.RoleAdmin}, "id"},
+		{"dotted ID", models.RoleRequest{ID: "a.b", Role: models.RoleAdmin}, "id"},
+		{"no role", models.RoleRequest{ID: "alice"}, "role"},
+		{"unknown role", models.RoleRequest{ID: "alice", Role: "root"}, "role"},
+		{"bad TTL", models.RoleRequest{ID: "alice", Role: models.RoleAdmin, TTL: "tomorrow"}, "ttl"},
+		{"negative TTL", models.RoleRequest{ID: "alice", Role: models.RoleAdmin, TTL: "-1h"}, "ttl"},
+		{"long guest TTL", models.RoleRequest{ID: "alice", Role: models.RoleGuest, TTL: "200h"}, "ttl"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := prov.ProvisionRole(ctx, tc.req)
+			var reqErr *provisioner.RequestError
+			require.True(t, errors.As(err, &reqErr), "want a request error, got %v", err)
+			assert.Equal(t, tc.field, reqErr.Field, err.Error())
+		})
+	}
+}
+
+func TestRoleAccessEnds(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env)
+	ctx := context.Background()
+
+	_, err := prov.ProvisionRole(ctx, models.RoleRequest{ID: "contractor", Role: models.RoleViewer, TTL: "2s"})
+	require.NoError(t, err)
+
+	// Renewal doesn't extend access
+	resp, err := prov.ReissueDevice(ctx, "contractor", "")
+	require.NoError(t, err)
+	device, err := prov.GetDevice(ctx, "contractor")
+	require.NoError(t, err)
+	assert.False(t, resp.ExpiresAt.After(*device.AccessUntil))
+	user, err := jwt.DecodeUserClaims(resp.JWT)
+	require.NoError(t, err)
+	assert.Equal(t, jwt.TagList{"role:viewer"}, user.Tags)
+
+	time.Sleep(time.Until(*device.AccessUntil))
+	_, err = prov.ReissueDevice(ctx, "contractor", "")
+	assert.ErrorIs(t, err, provisioner.ErrAccessExpired)
+	assert.Equal(t, models.CodeAccessExpired, provisioner.ErrorResponse(err).Code)
+
+	// Revocation goes through the registry, and the ID can be granted again
+	require.NoError(t, prov.RevokeDevice(ctx, "contractor"))
+	_, err = prov.ProvisionRole(ctx, models.RoleRequest{ID: "contractor", Role: models.RoleViewer, TTL: "1h"})
+	require.NoError(t, err)
+
+	page, err := prov.QueryAudit(ctx, audit.Query{DeviceID: "contractor"})
+	require.NoError(t, err)
+	var ops []audit.Operation
+	for _, rec := range page.Records {
+		ops = append(ops, rec.Operation)
+	}
+	assert.Equal(t, []audit.Operation{audit.OpGrant, audit.OpReissue, audit.OpRevoke, audit.OpGrant}, ops)
+}
+
+func TestRolePermissionsOverNATS(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env)
+	runProvisioner(t, env, prov)
+
+	data, err := json.Marshal(models.RoleRequest{ID: "automations", Role: models.RoleService})
+	require.NoError(t, err)
+	msg, err := env.home.Request(provisioner.SubjectRole, data, 2*time.Second)
+	require.NoError(t, err)
+	var creds models.ProvisionResponse
+	require.NoError(t, json.Unmarshal(msg.Data, &creds))
+	require.NotEmpty(t, creds.JWT, string(msg.Data))
+
+	violations := make(chan string, 10)
+	service, err := nats.Connect(env.server.ClientURL(),
+		nats.UserJWTAndSeed(creds.JWT, creds.Seed),
+		nats.CustomInboxPrefix(creds.Subjects.InboxPrefix),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			violations <- err.Error()
+		}),
+	)
+	require.NoError(t, err)
+	defer service.Close()
+
+	// Services see the home and can list devices, but can't hand out
+	// credentials
+	msg, err = service.Request(provisioner.SubjectList, nil, 2*time.Second)
+	require.NoError(t, err)
+	var list models.DeviceList
+	require.NoError(t, json.Unmarshal(msg.Data, &list))
+	assert.Equal(t, 1, list.Total)
+
+	data, err = json.Marshal(models.RoleRequest{ID: "mallory", Role: models.RoleAdmin})
+	require.NoError(t, err)
+	require.NoError(t, service.Publish(provisioner.SubjectRole, data))
+	require.NoError(t, service.Flush())
+	select {
+	case violation := <-violations:
+		assert.True(t, strings.Contains(strings.ToLower(violation), "permissions violation"), violation)
+	case <-time.After(2 * time.Second):
+		t.Fatal("publishing to the role subject should be refused")
+	}
+	_, err = prov.GetDevice(context.Background(), "mallory")
+	assert.ErrorIs(t, err, provisioner.ErrDeviceNotFound)
+}
+
+func TestRolesCantReachProvisionerState(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env)
+	ctx := context.Background()
+
+	protected := []string{
+		"$KV.device-credentials.>",
+		"$KV.device-claims.>",
+		"home.audit.provisioning.>",
+		"$JS.API.STREAM.*.KV_device-credentials",
+		"$JS.API.DIRECT.GET.KV_device-claims.>",
+		"$JS.API.STREAM.*.PROVISIONING_AUDIT",
+	}
+	for _, role := range models.Roles {
+		resp, err := prov.ProvisionRole(ctx, models.RoleRequest{ID: "r-" + string(role), Role: role})
+		require.NoError(t, err)
+		user, err := jwt.DecodeUserClaims(resp.JWT)
+		require.NoError(t, err)
+		for _, subject := range protected {
+			if role == models.RoleAdmin {
+				assert.NotContains(t, user.Pub.Deny, subject)
+			} else {
+				assert.Contains(t, user.Pub.Deny, subject, "%s may publish to %s", role, subject)
+			}
+		}
+	}
+
+	connect := func(role models.Role) (*nats.Conn, chan string) {
+		resp, err := prov.ProvisionRole(ctx, models.RoleRequest{ID: "live-" + string(role), Role: role})
+		require.NoError(t, err)
+		violations := make(chan string, 10)
+		nc, err := nats.Connect(env.server.ClientURL(),
+			nats.UserJWTAndSeed(resp.JWT, resp.Seed),
+			nats.CustomInboxPrefix(resp.Subjects.InboxPrefix),
+			nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+				violations <- err.Error()
+			}),
+		)
+		require.NoError(t, err)
+		t.Cleanup(nc.Close)
+		return nc, violations
+	}
+	denied := func(nc *nats.Conn, violations chan string, subject string) {
+		t.Helper()
+		require.NoError(t, nc.Publish(subject, []byte(`{}`)))
+		require.NoError(t, nc.Flush())
+		select {
+		case violation := <-violations:
+			assert.Contains(t, strings.ToLower(violation), "permissions violation", subject)
+		case <-time.After(2 * time.Second):
+			t.Errorf("publishing to %s should be refused", subject)
+		}
+	}
+
+	// Services can't write the registry or claims or forge audit records,
+	// but use their own buckets
+	service, violations := connect(models.RoleService)
+	denied(service, violations, "$KV.device-credentials.kitchen")
+	denied(service, violations, "$JS.API.STREAM.DELETE.KV_device-claims")
+	denied(service, violations, "$JS.API.STREAM.PURGE.PROVISIONING_AUDIT")
+	denied(service, violations, "home.audit.provisioning.kitchen.revoke")
+	require.NoError(t, service.Publish("$KV.automations.motion-light", []byte(`{}`)))
+	require.NoError(t, service.Flush())
+	select {
+	case violation := <-violations:
+		t.Fatalf("service bucket refused: %s", violation)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Viewers can't read claims or the registry bucket
+	viewer, violations := connect(models.RoleViewer)
+	denied(viewer, violations, "$JS.API.DIRECT.GET.KV_device-claims.$KV.device-claims.kitchen")
+	denied(viewer, violations, "$JS.API.STREAM.MSG.GET.KV_device-credentials")
+}
+
+func TestRolesCantListenToProvisioning(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env)
+	runProvisioner(t, env, prov)
+	ctx := context.Background()
+
+	for _, role := range models.Roles {
+		resp, err := prov.ProvisionRole(ctx, models.RoleRequest{ID: "r-" + string(role), Role: role})
+		require.NoError(t, err)
+		user, err := jwt.DecodeUserClaims(resp.JWT)
+		require.NoError(t, err)
+		if role == models.RoleAdmin {
+			assert.Empty(t, user.Sub.Deny)
+		} else {
+			assert.Contains(t, user.Sub.Deny, "home.provisioning.>", "%s may listen to provisioning", role)
+		}
+		if role == models.RoleViewer || role == models.RoleGuest {
+			assert.Nil(t, user.Resp, "%s may answer requests", role)
+		}
+	}
+
+	resp, err := prov.ProvisionRole(ctx, models.RoleRequest{ID: "nosy", Role: models.RoleViewer})
+	require.NoError(t, err)
+	violations := make(chan string, 10)
+	viewer, err := nats.Connect(env.server.ClientURL(),
+		nats.UserJWTAndSeed(resp.JWT, resp.Seed),
+		nats.CustomInboxPrefix(resp.Subjects.InboxPrefix),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			violations <- err.Error()
+		}),
+	)
+	require.NoError(t, err)
+	defer viewer.Close()
+
+	home, err := viewer.SubscribeSync("home.>")
+	require.NoError(t, err)
+	_, err = viewer.SubscribeSync(provisioner.ClaimRedeemSubject("office"))
+	require.NoError(t, err)
+	require.NoError(t, viewer.Flush())
+	select {
+	case violation := <-violations:
+		assert.Contains(t, strings.ToLower(violation), "permissions violation")
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscribing to the redeem subject should be refused")
+	}
+
+	// A device redeems its claim while the viewer watches the home
+	claim, err := prov.CreateClaim(ctx, models.ClaimRequest{ProvisionRequest: models.ProvisionRequest{
+		DeviceID:   "office",
+		DeviceType: models.DeviceTypeThermostat,
+		Name:       "Office Thermostat",
+	}})
+	require.NoError(t, err)
+	device, err := nats.Connect(env.server.ClientURL(),
+		nats.UserJWTAndSeed(claim.Bootstrap.JWT, claim.Bootstrap.Seed),
+		nats.CustomInboxPrefix(claim.Bootstrap.InboxPrefix),
+	)
+	require.NoError(t, err)
+	defer device.Close()
+
+	data, err := json.Marshal(models.RedeemRequest{PIN: claim.PIN})
+	require.NoError(t, err)
+	msg, err := device.Request(provisioner.ClaimRedeemSubject("office"), data, 2*time.Second)
+	require.NoError(t, err)
+	assert.NotContains(t, string(msg.Data), `"error"`)
+
+	// Up to what is published after it, the viewer saw nothing of the
+	// redeem or its reply
+	require.NoError(t, env.home.Publish("home.devices.thermostat.office.state", []byte(`{}`)))
+	for {
+		msg, err := home.NextMsg(2 * time.Second)
+		require.NoError(t, err)
+		if msg.Subject == "home.devices.thermostat.office.state" {
+			break
+		}
+		assert.False(t, strings.HasPrefix(msg.Subject, "home.provisioning."), "viewer saw %s: %s", msg.Subject, msg.Data)
+		assert.NotContains(t, string(msg.Data), claim.PIN)
+	}
+}
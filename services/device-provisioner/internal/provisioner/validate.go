@@ -0,0 +1,118 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+)
+
+// Limits on what a provision request may carry
+const (
+	maxDeviceIDLength    = 64
+	maxNameLength        = 128
+	maxRoomLength        = 64
+	maxFirmwareLength    = 64
+	maxDescriptionLength = 1024
+	maxMetadataKeys      = 32
+	maxMetadataKeyLength = 64
+	maxMetadataSize      = 4096 // Bytes of JSON
+)
+
+// deviceIDPattern matches IDs that are safe as a NATS subject token, a KV key
+// and part of an inbox prefix
+var deviceIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// validateDeviceID checks a device ID can be used in subjects and keys
+func validateDeviceID(deviceID string) error {
+	return validateID("device_id", deviceID)
+}
+
+// validateID checks a registry ID given in a request field
+func validateID(field, id string) error {
+	switch {
+	case id == "":
+		return invalidField(field, "%s is required", field)
+	case len(id) > maxDeviceIDLength:
+		return invalidField(field, "%s must be at most %d characters", field, maxDeviceIDLength)
+	case !deviceIDPattern.MatchString(id):
+		return invalidField(field, "%s %q may only hold letters, digits, '-' and '_', starting with a letter or digit", field, id)
+	}
+	return nil
+}
+
+// validateRequest checks a provision request before any credentials are
+// issued for it
+func (p *Provisioner) validateRequest(req models.ProvisionRequest) error {
+	if err := validateDeviceID(req.DeviceID); err != nil {
+		return err
+	}
+	if req.DeviceType == "" {
+		return invalidField("device_type", "device_type is required")
+	}
+	if !p.knownType(req.DeviceType) {
+		return invalidField("device_type", "unknown device_type %q", req.DeviceType)
+	}
+
+	for _, field := range []struct {
+		name, value string
+		max         int
+	}{
+		{"name", req.Name, maxNameLength},
+		{"description", req.Description, maxDescriptionLength},
+		{"room", req.Room, maxRoomLength},
+		{"firmware", req.Firmware, maxFirmwareLength},
+	} {
+		if err := validateText(field.name, field.value, field.max); err != nil {
+			return err
+		}
+	}
+
+	return validateMetadata(req.Metadata)
+}
+
+// knownType reports whether a device type is built in or has a template
+func (p *Provisioner) knownType(deviceType models.DeviceType) bool {
+	return slices.Contains(models.DeviceTypes, deviceType) || p.templates.Load().Has(string(deviceType))
+}
+
+// validateText checks a free text field's length and that it holds no
+// control characters; descriptions may span lines
+func validateText(field, value string, max int) error {
+	if !utf8.ValidString(value) {
+		return invalidField(field, "%s must be valid UTF-8", field)
+	}
+	if n := utf8.RuneCountInString(value); n > max {
+		return invalidField(field, "%s must be at most %d characters, got %d", field, max, n)
+	}
+	if strings.IndexFunc(value, func(r rune) bool {
+		return unicode.IsControl(r) && !(field == "description" && (r == '\n' || r == '\t'))
+	}) >= 0 {
+		return invalidField(field, "%s must not contain control characters", field)
+	}
+	return nil
+}
+
+func validateMetadata(metadata map[string]interface{}) error {
+	if len(metadata) > maxMetadataKeys {
+		return invalidField("metadata", "metadata may have at most %d keys", maxMetadataKeys)
+	}
+	for key := range metadata {
+		if key == "" || len(key) > maxMetadataKeyLength {
+			return invalidField("metadata", "metadata keys must be 1 to %d bytes", maxMetadataKeyLength)
+		}
+	}
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return invalidField("metadata", "metadata must be JSON: %v", err)
+	}
+	if len(data) > maxMetadataSize {
+		return invalidField("metadata", "metadata must be at most %d bytes of JSON", maxMetadataSize)
+	}
+	return nil
+}
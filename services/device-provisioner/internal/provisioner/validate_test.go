@@ -0,0 +1,149 @@
+package provisioner_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/models"
+	"github.com/homix-dev/homix/services/device-provisioner/internal/provisioner"
+	"github.com/nats-io/jwt/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvisionValidation(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env)
+	ctx := context.Background()
+
+	valid := models.ProvisionRequest{DeviceID: "hall-light_1", DeviceType: models.DeviceTypeLight, Name: "Hall Light"}
+	for _, tc := range []struct {
+		name   string
+		modify func(req *models.ProvisionRequest)
+		field  string
+	}{
+		{"empty ID", func(req *models.ProvisionRequest) { req.DeviceID = "" }, "device_id"},
+		{"dotted ID", func(req *models.ProvisionRequest) { req.DeviceID = "hall.light" }, "device_id"},
+		{"wildcard ID", func(req *models.ProvisionRequest) { req.DeviceID = "*" }, "device_id"},
+		{"ID with spaces", func(req *models.ProvisionRequest) { req.DeviceID = "hall light" }, "device_id"},
+		{"ID starting with a dash", func(req *models.ProvisionRequest) { req.DeviceID = "-hall" }, "device_id"},
+		{"long ID", func(req *models.ProvisionRequest) { req.DeviceID = strings.Repeat("a", 65) }, "device_id"},
+		{"no type", func(req *models.ProvisionRequest) { req.DeviceType = "" }, "device_type"},
+		{"unknown type", func(req *models.ProvisionRequest) { req.DeviceType = "toaster" }, "device_type"},
+		{"long name", func(req *models.ProvisionRequest) { req.Name = strings.Repeat("é", 129) }, "name"},
+		{"name with a newline", func(req *models.ProvisionRequest) { req.Name = "Hall\nLight" }, "name"},
+		{"long room", func(req *models.ProvisionRequest) { req.Room = strings.Repeat("a", 65) }, "room"},
+		{"long description", func(req *models.ProvisionRequest) { req.Description = strings.Repeat("a", 1025) }, "description"},
+		{"empty metadata key", func(req *models.ProvisionRequest) { req.Metadata = map[string]interface{}{"": 1} }, "metadata"},
+		{"large metadata", func(req *models.ProvisionRequest) {
+			req.Metadata = map[string]interface{}{"notes": strings.Repeat("a", 5000)}
+		}, "metadata"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := valid
+			tc.modify(&req)
+			_, err := prov.ProvisionDevice(ctx, req)
+			var reqErr *provisioner.RequestError
+			require.True(t, errors.As(err, &reqErr), "want a request error, got %v", err)
+			assert.Equal(t, tc.field, reqErr.Field, err.Error())
+		})
+	}
+
+	// Built in types, template types and multi-line descriptions are fine
+	for _, deviceType := range []models.DeviceType{models.DeviceTypeCamera, "climate", "binary_sensor"} {
+		req := valid
+		req.DeviceID = string(deviceType) + "-1"
+		req.DeviceType = deviceType
+		req.Description = "Line one\nLine two"
+		_, err := prov.ProvisionDevice(ctx, req)
+		assert.NoError(t, err, deviceType)
+	}
+}
+
+func TestProvisionStoresDetails(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env)
+	ctx := context.Background()
+
+	resp, err := prov.ProvisionDevice(ctx, models.ProvisionRequest{
+		DeviceID:    "kitchen",
+		DeviceType:  models.DeviceTypeThermostat,
+		Name:        "Kitchen Thermostat",
+		Description: `Above the "good" counter`,
+		Room:        "Kitchen",
+		Firmware:    "2.4.1",
+		Metadata:    map[string]interface{}{"vendor": "acme", "zones": 2.0},
+	})
+	require.NoError(t, err)
+
+	device, err := prov.GetDevice(ctx, "kitchen")
+	require.NoError(t, err)
+	assert.Equal(t, `Above the "good" counter`, device.Description)
+	assert.Equal(t, "Kitchen", device.Room)
+	assert.Equal(t, "2.4.1", device.Firmware)
+	assert.Equal(t, map[string]interface{}{"vendor": "acme", "zones": 2.0}, device.Metadata)
+
+	user, err := jwt.DecodeUserClaims(resp.JWT)
+	require.NoError(t, err)
+	assert.Equal(t, jwt.TagList{"device_type:thermostat", "name:kitchen thermostat", "room:kitchen"}, user.Tags)
+
+	// Tags don't depend on metadata, and survive renewal
+	resp, err = prov.ProvisionDevice(ctx, models.ProvisionRequest{DeviceID: "porch", DeviceType: models.DeviceTypeLight})
+	require.NoError(t, err)
+	user, err = jwt.DecodeUserClaims(resp.JWT)
+	require.NoError(t, err)
+	assert.Equal(t, jwt.TagList{"device_type:light"}, user.Tags)
+
+	resp, err = prov.ReissueDevice(ctx, "kitchen", "")
+	require.NoError(t, err)
+	user, err = jwt.DecodeUserClaims(resp.JWT)
+	require.NoError(t, err)
+	assert.Contains(t, user.Tags, "room:kitchen")
+	device, err = prov.GetDevice(ctx, "kitchen")
+	require.NoError(t, err)
+	assert.Equal(t, "2.4.1", device.Firmware)
+}
+
+func TestErrorResponsesOverNATS(t *testing.T) {
+	env := runOperatorServer(t)
+	prov := newProvisioner(t, env)
+	runProvisioner(t, env, prov)
+
+	request := func(subject string, data []byte) models.ErrorResponse {
+		t.Helper()
+		msg, err := env.home.Request(subject, data, 2*time.Second)
+		require.NoError(t, err)
+
+		var resp models.ErrorResponse
+		require.NoError(t, json.Unmarshal(msg.Data, &resp), "error responses must be JSON: %s", msg.Data)
+		return resp
+	}
+
+	// Quotes in the error no longer break the JSON
+	resp := request("home.provisioning.revoke", []byte(`say "hi"`))
+	assert.Equal(t, models.CodeInvalidRequest, resp.Code)
+	assert.Equal(t, "device_id", resp.Field)
+	assert.Contains(t, resp.Error, `"say \"hi\""`)
+
+	resp = request("home.provisioning.revoke", []byte("attic"))
+	assert.Equal(t, models.ErrorResponse{Error: "device not found: attic", Code: models.CodeDeviceNotFound}, resp)
+
+	resp = request("home.provisioning.request", []byte("{"))
+	assert.Equal(t, models.CodeInvalidRequest, resp.Code)
+
+	data, err := json.Marshal(models.ProvisionRequest{DeviceID: "attic", DeviceType: models.DeviceTypeSensor})
+	require.NoError(t, err)
+	_, err = env.home.Request("home.provisioning.request", data, 2*time.Second)
+	require.NoError(t, err)
+	resp = request("home.provisioning.request", data)
+	assert.Equal(t, models.CodeDeviceExists, resp.Code)
+
+	data, err = json.Marshal(models.RedeemRequest{DeviceID: "attic", PIN: "12345678"})
+	require.NoError(t, err)
+	resp = request(provisioner.ClaimRedeemSubject("attic"), data)
+	assert.Equal(t, models.CodeClaimNotFound, resp.Code)
+}
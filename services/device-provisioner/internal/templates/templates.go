@@ -0,0 +1,321 @@
+// Package templates loads the device templates under device-templates/ and
+// derives device permissions from their nats section.
+package templates
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// BaseTemplate is the template every device type starts from. Its device_type
+// is only an example and does not define a type.
+const BaseTemplate = "base-template.yaml"
+
+// Direction says whether a device publishes or subscribes on a subject
+type Direction string
+
+const (
+	Publish   Direction = "publish"
+	Subscribe Direction = "subscribe"
+)
+
+// Subject is an entry of a template's nats.subjects. It is written either as
+// a plain pattern, whose direction follows from its name, or as a mapping with
+// subject and direction.
+type Subject struct {
+	Pattern   string    `yaml:"subject"`
+	Direction Direction `yaml:"direction"`
+}
+
+// UnmarshalYAML accepts both the plain and the mapping form
+func (s *Subject) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&s.Pattern)
+	}
+	type plain Subject
+	return node.Decode((*plain)(s))
+}
+
+// Discovery is a template's nats.discovery section
+type Discovery struct {
+	Enabled *bool  `yaml:"enabled"`
+	Topic   string `yaml:"topic"`
+}
+
+// template is the part of a template file the provisioner reads. Decoding
+// into a struct leaves the rest of the file, mostly device firmware, alone.
+type template struct {
+	DeviceInfo struct {
+		DeviceType string `yaml:"device_type"`
+	} `yaml:"device_info"`
+	NATS struct {
+		Subjects  map[string]Subject `yaml:"subjects"`
+		Discovery Discovery          `yaml:"discovery"`
+	} `yaml:"nats"`
+}
+
+// Permissions are the subjects a device may use
+type Permissions struct {
+	Publish   []string
+	Subscribe []string
+
+	// Subjects by template name, e.g. "config"
+	Subjects map[string]string
+}
+
+// Set is the device templates loaded from a directory
+type Set struct {
+	dir  string
+	base template
+
+	// Per type templates merged over the base template
+	types map[string]template
+}
+
+// Load reads every YAML template under dir. The base template is required;
+// other templates add device types, and templates sharing a device_type are
+// merged.
+func Load(dir string) (*Set, error) {
+	base, err := readTemplate(filepath.Join(dir, BaseTemplate))
+	if err != nil {
+		return nil, err
+	}
+	if err := base.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", BaseTemplate, err)
+	}
+
+	set := &Set{dir: dir, base: *base, types: make(map[string]template)}
+	defined := make(map[string]map[string]bool)
+
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() == BaseTemplate {
+			return nil
+		}
+		if ext := filepath.Ext(path); ext != ".yaml" && ext != ".yml" {
+			return nil
+		}
+
+		t, err := readTemplate(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		if t.DeviceInfo.DeviceType == "" {
+			return fmt.Errorf("%s: device_info.device_type is required", rel)
+		}
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("%s: %w", rel, err)
+		}
+
+		deviceType := t.DeviceInfo.DeviceType
+		merged, ok := set.types[deviceType]
+		if !ok {
+			merged = set.base.clone()
+			defined[deviceType] = make(map[string]bool)
+		}
+		if err := merged.merge(t, defined[deviceType]); err != nil {
+			return fmt.Errorf("%s: %w", rel, err)
+		}
+		set.types[deviceType] = merged
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return set, nil
+}
+
+// Dir returns the directory the templates were loaded from
+func (s *Set) Dir() string {
+	return s.dir
+}
+
+// Types returns the device types that have a template, sorted
+func (s *Set) Types() []string {
+	types := make([]string, 0, len(s.types))
+	for t := range s.types {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Has reports whether a device type has a template
+func (s *Set) Has(deviceType string) bool {
+	_, ok := s.types[deviceType]
+	return ok
+}
+
+// Permissions returns the subjects a device may use. Types without a template
+// get the base template's subjects.
+func (s *Set) Permissions(deviceType, deviceID string) Permissions {
+	t, ok := s.types[deviceType]
+	if !ok {
+		t = s.base
+	}
+
+	vars := map[string]string{"device_type": deviceType, "device_id": deviceID}
+	perms := Permissions{Subjects: make(map[string]string, len(t.NATS.Subjects))}
+
+	names := make([]string, 0, len(t.NATS.Subjects))
+	for name := range t.NATS.Subjects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		subject := t.NATS.Subjects[name]
+		rendered, _ := expand(subject.Pattern, vars)
+		perms.Subjects[name] = rendered
+		if subject.direction(name) == Subscribe {
+			perms.Subscribe = appendUnique(perms.Subscribe, rendered)
+		} else {
+			perms.Publish = appendUnique(perms.Publish, rendered)
+		}
+	}
+
+	if d := t.NATS.Discovery; d.Topic != "" && (d.Enabled == nil || *d.Enabled) {
+		rendered, _ := expand(d.Topic, vars)
+		perms.Publish = appendUnique(perms.Publish, rendered)
+	}
+
+	return perms
+}
+
+func readTemplate(path string) (*template, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template: %w", err)
+	}
+	var t template
+	if err := yaml.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("failed to parse template %s: %w", path, err)
+	}
+	return &t, nil
+}
+
+// validate checks that every subject renders to a valid NATS subject
+func (t *template) validate() error {
+	sample := map[string]string{"device_type": "type", "device_id": "id"}
+
+	for name, subject := range t.NATS.Subjects {
+		switch subject.Direction {
+		case "", Publish, Subscribe:
+		default:
+			return fmt.Errorf("subject %s: unknown direction %q", name, subject.Direction)
+		}
+		if err := validSubject(subject.Pattern, sample); err != nil {
+			return fmt.Errorf("subject %s: %w", name, err)
+		}
+	}
+	if topic := t.NATS.Discovery.Topic; topic != "" {
+		if err := validSubject(topic, sample); err != nil {
+			return fmt.Errorf("discovery topic: %w", err)
+		}
+	}
+	return nil
+}
+
+// merge adds a type template's subjects. Type templates may override the
+// base template's subjects, but not each other's.
+func (t *template) merge(other *template, defined map[string]bool) error {
+	for name, subject := range other.NATS.Subjects {
+		if existing, ok := t.NATS.Subjects[name]; ok && defined[name] && existing != subject {
+			return fmt.Errorf("subject %s conflicts with another %s template", name, other.DeviceInfo.DeviceType)
+		}
+		t.NATS.Subjects[name] = subject
+		defined[name] = true
+	}
+	if other.NATS.Discovery.Enabled != nil {
+		t.NATS.Discovery.Enabled = other.NATS.Discovery.Enabled
+	}
+	if other.NATS.Discovery.Topic != "" {
+		t.NATS.Discovery.Topic = other.NATS.Discovery.Topic
+	}
+	return nil
+}
+
+func (t template) clone() template {
+	c := t
+	c.NATS.Subjects = make(map[string]Subject, len(t.NATS.Subjects))
+	for name, s := range t.NATS.Subjects {
+		c.NATS.Subjects[name] = s
+	}
+	return c
+}
+
+// direction returns the subject's direction, inferring it from the name when
+// the template doesn't give one: devices receive commands and config and
+// publish everything else.
+func (s Subject) direction(name string) Direction {
+	if s.Direction != "" {
+		return s.Direction
+	}
+	for _, in := range []string{"command", "config"} {
+		if name == in || strings.HasSuffix(name, "_"+in) {
+			return Subscribe
+		}
+	}
+	return Publish
+}
+
+var variable = regexp.MustCompile(`\$\{([A-Za-z_]+)\}`)
+
+// expand replaces ${device_type} and ${device_id}, in any case, in a pattern
+func expand(pattern string, vars map[string]string) (string, error) {
+	var unknown string
+	out := variable.ReplaceAllStringFunc(pattern, func(m string) string {
+		name := strings.ToLower(variable.FindStringSubmatch(m)[1])
+		value, ok := vars[name]
+		if !ok && unknown == "" {
+			unknown = m
+		}
+		return value
+	})
+	if unknown != "" {
+		return "", fmt.Errorf("unknown variable %s", unknown)
+	}
+	return out, nil
+}
+
+// validSubject checks a pattern renders to a subject NATS accepts in a
+// permission
+func validSubject(pattern string, vars map[string]string) error {
+	subject, err := expand(pattern, vars)
+	if err != nil {
+		return err
+	}
+	if subject == "" {
+		return fmt.Errorf("empty subject")
+	}
+	tokens := strings.Split(subject, ".")
+	for i, token := range tokens {
+		if token == "" || strings.ContainsAny(token, " \t\r\n") {
+			return fmt.Errorf("invalid subject %q", pattern)
+		}
+		if token == ">" && i != len(tokens)-1 {
+			return fmt.Errorf("invalid subject %q: > must be the last token", pattern)
+		}
+	}
+	return nil
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, existing := range list {
+		if existing == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
@@ -0,0 +1,142 @@
+package templates_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/homix-dev/homix/services/device-provisioner/internal/templates"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const base = `
+device_info:
+  device_type: "sensor"
+nats:
+  subjects:
+    state: "home.devices.${device_type}.${device_id}.state"
+    command: "home.devices.${device_type}.${device_id}.command"
+    config: "home.config.device.${DEVICE_ID}"
+  discovery:
+    enabled: true
+    topic: "home.discovery.announce"
+`
+
+func writeTemplates(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+	return dir
+}
+
+func TestPermissions(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{
+		templates.BaseTemplate: base,
+		"garden/sprinkler.yaml": `
+device_info:
+  device_type: "sprinkler"
+nats:
+  subjects:
+    zone_command: "home.devices.${device_type}.${device_id}.zone.*"
+    flow: "home.devices.${device_type}.${device_id}.flow"
+    schedule:
+      subject: "home.schedules.${device_id}"
+      direction: subscribe
+`,
+		"garden/valve.yml": `
+device_info:
+  device_type: "sprinkler"
+nats:
+  subjects:
+    flow: "home.devices.${device_type}.${device_id}.flow"
+  discovery:
+    enabled: false
+esphome:
+  sensor: []
+  sensor: []
+`,
+		"README.md": "not a template",
+	})
+
+	set, err := templates.Load(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sprinkler"}, set.Types())
+	assert.True(t, set.Has("sprinkler"))
+	assert.False(t, set.Has("sensor"), "the base template's type is an example")
+
+	perms := set.Permissions("sprinkler", "lawn")
+	assert.ElementsMatch(t, []string{
+		"home.devices.sprinkler.lawn.flow",
+		"home.devices.sprinkler.lawn.state",
+	}, perms.Publish)
+	assert.ElementsMatch(t, []string{
+		"home.devices.sprinkler.lawn.command",
+		"home.config.device.lawn",
+		"home.schedules.lawn",
+		"home.devices.sprinkler.lawn.zone.*",
+	}, perms.Subscribe)
+	assert.Equal(t, "home.config.device.lawn", perms.Subjects["config"])
+
+	// Types without a template get the base template
+	perms = set.Permissions("fan", "attic")
+	assert.ElementsMatch(t, []string{
+		"home.devices.fan.attic.state",
+		"home.discovery.announce",
+	}, perms.Publish)
+	assert.ElementsMatch(t, []string{
+		"home.devices.fan.attic.command",
+		"home.config.device.attic",
+	}, perms.Subscribe)
+}
+
+func TestLoadErrors(t *testing.T) {
+	for name, files := range map[string]map[string]string{
+		"missing base": {
+			"light.yaml": "device_info:\n  device_type: light\n",
+		},
+		"no device type": {
+			templates.BaseTemplate: base,
+			"light.yaml":           "nats:\n  subjects: {}\n",
+		},
+		"unknown variable": {
+			templates.BaseTemplate: base,
+			"light.yaml":           "device_info:\n  device_type: light\nnats:\n  subjects:\n    state: home.${room}.state\n",
+		},
+		"invalid subject": {
+			templates.BaseTemplate: base,
+			"light.yaml":           "device_info:\n  device_type: light\nnats:\n  subjects:\n    state: home..state\n",
+		},
+		"unknown direction": {
+			templates.BaseTemplate: base,
+			"light.yaml":           "device_info:\n  device_type: light\nnats:\n  subjects:\n    state:\n      subject: home.state\n      direction: both\n",
+		},
+		"conflicting templates": {
+			templates.BaseTemplate: base,
+			"a.yaml":               "device_info:\n  device_type: light\nnats:\n  subjects:\n    dim: home.a.dim\n",
+			"b.yaml":               "device_info:\n  device_type: light\nnats:\n  subjects:\n    dim: home.b.dim\n",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := templates.Load(writeTemplates(t, files))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestRepoTemplates(t *testing.T) {
+	set, err := templates.Load("../../../../device-templates")
+	require.NoError(t, err)
+	assert.Subset(t, set.Types(), []string{"binary_sensor", "climate", "light", "lock", "sensor", "switch"})
+
+	perms := set.Permissions("climate", "office")
+	assert.Contains(t, perms.Subscribe, "home.devices.climate.office.schedule")
+	assert.Contains(t, perms.Subscribe, "home.discovery.request")
+	assert.Contains(t, perms.Publish, "home.devices.climate.office.announce")
+	assert.NotContains(t, perms.Publish, "home.discovery.request")
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Battery level a drain runs down to when none is given
+const defaultDrainTo = 5.0
+
+// FaultProfile makes a device misbehave. Percentages are chances from 0 to
+// 100, durations strings such as "30s".
+type FaultProfile struct {
+	// Offline stops heartbeats, state and command replies
+	Offline bool `yaml:"offline" json:"offline,omitempty"`
+
+	// FlapInterval takes the device offline and back every interval
+	FlapInterval string `yaml:"flap_interval" json:"flap_interval,omitempty"`
+
+	// Latency delays command replies
+	Latency string `yaml:"latency" json:"latency,omitempty"`
+
+	// DropCommands ignores commands without replying
+	DropCommands float64 `yaml:"drop_commands" json:"drop_commands,omitempty"`
+
+	// MalformedState sends state messages cut short, so not valid JSON
+	MalformedState float64 `yaml:"malformed_state" json:"malformed_state,omitempty"`
+
+	// DuplicateState sends state messages twice
+	DuplicateState float64 `yaml:"duplicate_state" json:"duplicate_state,omitempty"`
+
+	// ReorderState holds state messages back until after the next one
+	ReorderState float64 `yaml:"reorder_state" json:"reorder_state,omitempty"`
+
+	BatteryDrain *BatteryDrain `yaml:"battery_drain" json:"battery_drain,omitempty"`
+
+	// Seed makes the chances repeatable
+	Seed *int64 `yaml:"seed" json:"seed,omitempty"`
+}
+
+// BatteryDrain runs the battery state down linearly
+type BatteryDrain struct {
+	To   float64 `yaml:"to" json:"to"`     // Level to stop at, default 5
+	Over string  `yaml:"over" json:"over"` // How long it takes
+}
+
+// deviceFaults is a fault profile in effect on a device
+type deviceFaults struct {
+	profile      FaultProfile
+	flapInterval time.Duration
+	latency      time.Duration
+	drainOver    time.Duration
+
+	offline atomic.Bool
+	stopCh  chan struct{}
+
+	mu   sync.Mutex
+	rng  *rand.Rand
+	held []byte // State message held back to send after the next
+}
+
+func (p *FaultProfile) empty() bool {
+	return *p == FaultProfile{Seed: p.Seed}
+}
+
+// compile checks a profile and prepares it for a device
+func (p *FaultProfile) compile() (*deviceFaults, error) {
+	f := &deviceFaults{profile: *p, stopCh: make(chan struct{})}
+
+	var err error
+	if f.flapInterval, err = parsePositiveDuration("flap_interval", p.FlapInterval); err != nil {
+		return nil, err
+	}
+	if f.latency, err = parsePositiveDuration("latency", p.Latency); err != nil {
+		return nil, err
+	}
+	if p.Offline && f.flapInterval > 0 {
+		return nil, fmt.Errorf("offline and flap_interval can't be combined")
+	}
+	for name, chance := range map[string]float64{
+		"drop_commands":   p.DropCommands,
+		"malformed_state": p.MalformedState,
+		"duplicate_state": p.DuplicateState,
+		"reorder_state":   p.ReorderState,
+	} {
+		if chance < 0 || chance > 100 {
+			return nil, fmt.Errorf("%s must be a percentage from 0 to 100", name)
+		}
+	}
+	if drain := p.BatteryDrain; drain != nil {
+		if drain.Over == "" {
+			return nil, fmt.Errorf("battery_drain needs over")
+		}
+		if f.drainOver, err = parsePositiveDuration("battery_drain.over", drain.Over); err != nil {
+			return nil, err
+		}
+		if drain.To < 0 || drain.To > 100 {
+			return nil, fmt.Errorf("battery_drain.to must be a level from 0 to 100")
+		}
+	}
+
+	seed := time.Now().UnixNano()
+	if p.Seed != nil {
+		seed = *p.Seed
+	}
+	f.rng = rand.New(rand.NewSource(seed))
+	f.offline.Store(p.Offline)
+	return f, nil
+}
+
+func parsePositiveDuration(field, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration such as 30s, got %q", field, value)
+	}
+	return d, nil
+}
+
+// isOffline reports whether the device is down; nil faults never are
+func (f *deviceFaults) isOffline() bool {
+	return f != nil && f.offline.Load()
+}
+
+// chance rolls a percentage
+func (f *deviceFaults) chance(percent float64) bool {
+	if f == nil || percent <= 0 {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rng.Float64()*100 < percent
+}
+
+// dropsCommand reports whether a command goes unanswered
+func (f *deviceFaults) dropsCommand() bool {
+	return f != nil && (f.offline.Load() || f.chance(f.profile.DropCommands))
+}
+
+// delayReply waits out the reply latency
+func (f *deviceFaults) delayReply() {
+	if f != nil && f.latency > 0 {
+		time.Sleep(f.latency)
+	}
+}
+
+// stateMessages returns what to publish for a state message: nothing,
+// the message cut short, twice, or after a held back one
+func (f *deviceFaults) stateMessages(data []byte) [][]byte {
+	if f == nil {
+		return [][]byte{data}
+	}
+	if f.isOffline() {
+		return nil
+	}
+
+	if f.chance(f.profile.MalformedState) {
+		data = data[:len(data)/2]
+	}
+	messages := [][]byte{data}
+	if f.chance(f.profile.DuplicateState) {
+		messages = append(messages, data)
+	}
+
+	reorder := f.chance(f.profile.ReorderState)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.held != nil {
+		messages = append(messages, f.held)
+		f.held = nil
+	} else if reorder {
+		f.held = data
+		return nil
+	}
+	return messages
+}
+
+// flush returns the held back state message, if any
+func (f *deviceFaults) flush() []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	held := f.held
+	f.held = nil
+	return held
+}
+
+// run flaps and drains the battery until the faults are replaced
+func (f *deviceFaults) run(d *SimulatedDevice) {
+	var flap <-chan time.Time
+	if f.flapInterval > 0 {
+		ticker := time.NewTicker(f.flapInterval)
+		defer ticker.Stop()
+		flap = ticker.C
+	}
+
+	var drain <-chan time.Time
+	var drainFrom float64
+	start := time.Now()
+	if f.profile.BatteryDrain != nil {
+		d.mu.RLock()
+		level, ok := toFloat(d.State["battery"])
+		d.mu.RUnlock()
+		if !ok {
+			level = 100
+		}
+		drainFrom = level
+
+		ticker := time.NewTicker(max(f.drainOver/50, time.Second))
+		defer ticker.Stop()
+		drain = ticker.C
+	}
+
+	for {
+		select {
+		case <-f.stopCh:
+			return
+
+		case <-flap:
+			if f.offline.Load() {
+				f.offline.Store(false)
+				d.setOnline(true)
+			} else {
+				f.offline.Store(true)
+				d.setOnline(false)
+			}
+
+		case <-drain:
+			to := f.profile.BatteryDrain.To
+			if to == 0 {
+				to = defaultDrainTo
+			}
+			progress := math.Min(float64(time.Since(start))/float64(f.drainOver), 1)
+			level := drainFrom - (drainFrom-to)*progress
+
+			d.mu.Lock()
+			d.State["battery"] = math.Round(level*10) / 10
+			d.LastUpdate = time.Now()
+			d.publishState()
+			d.mu.Unlock()
+
+			if progress == 1 {
+				drain = nil
+			}
+		}
+	}
+}
+
+// setFaults puts a fault profile in effect, replacing any other; nil or an
+// empty profile clears them
+func (d *SimulatedDevice) setFaults(profile *FaultProfile) error {
+	var f *deviceFaults
+	if profile != nil && !profile.empty() {
+		var err error
+		if f, err = profile.compile(); err != nil {
+			return err
+		}
+	} else {
+		profile = nil
+	}
+
+	old := d.faults.Swap(f)
+	if old != nil {
+		close(old.stopCh)
+		if held := old.flush(); held != nil && !old.isOffline() {
+			d.nc.Publish(fmt.Sprintf("home.devices.%s.state", d.ID), held)
+		}
+	}
+
+	d.mu.Lock()
+	d.Faults = profile
+	d.mu.Unlock()
+
+	d.setOnline(!f.isOffline())
+	if f != nil {
+		go f.run(d)
+	}
+	return nil
+}
+
+// setOnline marks the device up or down and tells the system
+func (d *SimulatedDevice) setOnline(online bool) {
+	d.mu.Lock()
+	changed := d.Online != online
+	d.Online = online
+	d.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if online {
+		d.announce()
+		d.mu.RLock()
+		d.publishState()
+		d.mu.RUnlock()
+	} else {
+		d.nc.Publish(fmt.Sprintf("home.devices.%s.offline", d.ID), []byte{})
+	}
+}
+
+// HTTP handlers
+func (s *Simulator) handleGetFaults(w http.ResponseWriter, r *http.Request) {
+	device, ok := s.findDevice(w, r)
+	if !ok {
+		return
+	}
+
+	device.mu.RLock()
+	profile := device.Faults
+	device.mu.RUnlock()
+	if profile == nil {
+		profile = &FaultProfile{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+func (s *Simulator) handleSetFaults(w http.ResponseWriter, r *http.Request) {
+	device, ok := s.findDevice(w, r)
+	if !ok {
+		return
+	}
+
+	var profile FaultProfile
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&profile); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := device.setFaults(&profile); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.saveDevice(device)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+func (s *Simulator) handleClearFaults(w http.ResponseWriter, r *http.Request) {
+	device, ok := s.findDevice(w, r)
+	if !ok {
+		return
+	}
+
+	device.setFaults(nil)
+	s.saveDevice(device)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// findDevice looks up the device a request is for, replying 404 when there
+// is none
+func (s *Simulator) findDevice(w http.ResponseWriter, r *http.Request) (*SimulatedDevice, bool) {
+	s.mu.RLock()
+	device, exists := s.devices[mux.Vars(r)["id"]]
+	s.mu.RUnlock()
+
+	if !exists {
+		http.Error(w, "Device not found", http.StatusNotFound)
+	}
+	return device, exists
+}
+
+// saveDevice stores a device in KV and tells the UI it changed
+func (s *Simulator) saveDevice(device *SimulatedDevice) {
+	device.mu.RLock()
+	data, err := json.Marshal(device.DeviceState)
+	device.mu.RUnlock()
+	if err != nil {
+		log.Printf("Failed to save %s: %v", device.ID, err)
+		return
+	}
+	s.kv.Put(context.Background(), device.ID, data)
+
+	s.broadcastUpdate(device.ID, "device_updated")
+}
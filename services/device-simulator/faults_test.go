@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFaultProfileCompileRejects(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		profile FaultProfile
+		want    string
+	}{
+		{"offline and flapping", FaultProfile{Offline: true, FlapInterval: "30s"}, "offline and flap_interval can't be combined"},
+		{"bad flap interval", FaultProfile{FlapInterval: "often"}, "flap_interval must be a positive duration"},
+		{"negative latency", FaultProfile{Latency: "-1s"}, "latency must be a positive duration"},
+		{"negative chance", FaultProfile{DropCommands: -1}, "drop_commands must be a percentage"},
+		{"chance over 100", FaultProfile{ReorderState: 101}, "reorder_state must be a percentage"},
+		{"drain without over", FaultProfile{BatteryDrain: &BatteryDrain{To: 10}}, "battery_drain needs over"},
+		{"drain below empty", FaultProfile{BatteryDrain: &BatteryDrain{To: -5, Over: "1h"}}, "battery_drain.to must be a level"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.profile.compile()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("compile() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestStateMessages(t *testing.T) {
+	seed := int64(7)
+	compile := func(profile FaultProfile) *deviceFaults {
+		t.Helper()
+		profile.Seed = &seed
+		f, err := profile.compile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	messages := func(f *deviceFaults, data ...string) []string {
+		var out []string
+		for _, d := range data {
+			for _, msg := range f.stateMessages([]byte(d)) {
+				out = append(out, string(msg))
+			}
+		}
+		return out
+	}
+
+	if got := messages(compile(FaultProfile{MalformedState: 100}), `{"on":true}`); !slices.Equal(got, []string{`{"on"`}) {
+		t.Errorf("malformed: got %q", got)
+	}
+	if got := messages(compile(FaultProfile{DuplicateState: 100}), "a", "b"); !slices.Equal(got, []string{"a", "a", "b", "b"}) {
+		t.Errorf("duplicate: got %q", got)
+	}
+	if got := messages(compile(FaultProfile{ReorderState: 100}), "a", "b", "c"); !slices.Equal(got, []string{"b", "a"}) {
+		t.Errorf("reorder: got %q, want the held message after the next and the last one held", got)
+	}
+	if got := messages(compile(FaultProfile{Offline: true}), "a"); len(got) != 0 {
+		t.Errorf("offline: got %q", got)
+	}
+
+	drops := compile(FaultProfile{DropCommands: 100})
+	if !drops.dropsCommand() || compile(FaultProfile{}).dropsCommand() {
+		t.Error("drop_commands 100 must drop every command, 0 none")
+	}
+
+	// The same seed makes partial chances repeatable
+	var runs [2][]string
+	for i := range runs {
+		f := compile(FaultProfile{DropCommands: 50, DuplicateState: 50, MalformedState: 50, ReorderState: 50})
+		for n := 0; n < 20; n++ {
+			runs[i] = append(runs[i], fmt.Sprint(f.dropsCommand()))
+			runs[i] = append(runs[i], messages(f, fmt.Sprintf(`{"n":%02d}`, n))...)
+		}
+	}
+	if !slices.Equal(runs[0], runs[1]) {
+		t.Errorf("runs with the same seed differ:\n%q\n%q", runs[0], runs[1])
+	}
+	for _, want := range []string{"true", "false", `{"n"`} {
+		if !slices.Contains(runs[0], want) {
+			t.Errorf("expected %q among %q", want, runs[0])
+		}
+	}
+}
+
+func TestClearingFaultsFlushesHeldState(t *testing.T) {
+	nc := connect(t, runServer(t))
+	states, err := nc.SubscribeSync("home.devices.lamp.state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc.Flush()
+
+	device := &SimulatedDevice{
+		DeviceState: &DeviceState{ID: "lamp", Type: "light", State: map[string]interface{}{"on": true}, Online: true},
+		nc:          nc,
+	}
+	seed := int64(1)
+	if err := device.setFaults(&FaultProfile{ReorderState: 100, Seed: &seed}); err != nil {
+		t.Fatal(err)
+	}
+
+	device.mu.RLock()
+	device.publishState()
+	device.mu.RUnlock()
+	nc.Flush()
+	if msg, err := states.NextMsg(200 * time.Millisecond); err == nil {
+		t.Fatalf("state should be held back, got %s", msg.Data)
+	}
+
+	if err := device.setFaults(nil); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := states.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("held state not flushed: %v", err)
+	}
+	if !strings.Contains(string(msg.Data), `"device_id":"lamp"`) {
+		t.Fatalf("unexpected state %s", msg.Data)
+	}
+	if device.Faults != nil || device.faults.Load() != nil {
+		t.Fatal("faults not cleared")
+	}
+}
@@ -0,0 +1,773 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// How often publishers wake up to send what is due
+	loadTick = 10 * time.Millisecond
+
+	// Latency samples kept for percentiles; beyond that a random sample is
+	// kept
+	maxLatencySamples = 100000
+
+	// Goroutines handling commands, per connection
+	loadCommandWorkers = 4
+
+	// Prefix of load device IDs, so other devices on the server aren't
+	// counted
+	loadDevicePrefix = "load_"
+)
+
+// LoadProfile describes a deployment to generate load for, e.g.
+//
+//	name: street
+//	homes: 50
+//	devices_per_home: 40
+//	mix: {light: 4, switch: 2, sensor: 3, thermostat: 1}
+//	connections: 4
+//	state_interval: 30s
+//	command_rate: 20
+//	max_inflight: 256
+//	duration: 5m
+type LoadProfile struct {
+	Name           string `yaml:"name"`
+	Homes          int    `yaml:"homes"`
+	DevicesPerHome int    `yaml:"devices_per_home"`
+
+	// Mix weighs device types against each other; all lights by default
+	Mix map[string]int `yaml:"mix"`
+
+	// Connections the devices share, 4 by default
+	Connections int `yaml:"connections"`
+
+	// How often each device publishes its state, 30s by default, and
+	// re-announces itself, 60s by default
+	StateInterval     time.Duration `yaml:"state_interval"`
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+
+	// Commands sent to random devices per second, and how long to wait
+	// for their reply, 2s by default
+	CommandRate    float64       `yaml:"command_rate"`
+	CommandTimeout time.Duration `yaml:"command_timeout"`
+
+	// Commands awaiting a reply at once, 256 by default; commands due
+	// beyond that are skipped
+	MaxInflight int `yaml:"max_inflight"`
+
+	// How long to run, until interrupted when zero
+	Duration time.Duration `yaml:"duration"`
+
+	// How often progress is logged, 10s by default
+	ReportInterval time.Duration `yaml:"report_interval"`
+
+	// Seed decides device types, values and command targets
+	Seed int64 `yaml:"seed"`
+}
+
+// LoadReport is the outcome of a load run
+type LoadReport struct {
+	Name        string  `json:"name"`
+	Homes       int     `json:"homes"`
+	Devices     int     `json:"devices"`
+	Connections int     `json:"connections"`
+	Seconds     float64 `json:"seconds"`
+
+	Published      int64       `json:"published"`
+	PublishErrors  int64       `json:"publish_errors"`
+	PublishRate    float64     `json:"publish_rate"` // Messages per second
+	Received       int64       `json:"received"`
+	Dropped        int64       `json:"dropped"` // By the receiving client
+	PublishLatency Percentiles `json:"publish_latency"`
+
+	Commands        int64       `json:"commands"`
+	CommandsSkipped int64       `json:"commands_skipped"` // Over max_inflight
+	CommandTimeouts int64       `json:"command_timeouts"`
+	CommandErrors   int64       `json:"command_errors"`
+	CommandRate     float64     `json:"command_rate"` // Replies per second
+	CommandLatency  Percentiles `json:"command_latency"`
+}
+
+// Percentiles of a latency, in milliseconds
+type Percentiles struct {
+	Samples int64   `json:"samples"`
+	P50     float64 `json:"p50_ms"`
+	P90     float64 `json:"p90_ms"`
+	P99     float64 `json:"p99_ms"`
+	Max     float64 `json:"max_ms"`
+}
+
+// loadDevice is a virtual device; unlike a SimulatedDevice it has no
+// goroutines, ticker or storage of its own
+type loadDevice struct {
+	id         string
+	home       int
+	deviceType string
+
+	mu    sync.Mutex
+	state map[string]interface{}
+}
+
+// loadConn is a connection shared by a slice of the devices
+type loadConn struct {
+	nc      *nats.Conn
+	devices []*loadDevice
+	byID    map[string]*loadDevice
+	rng     *rand.Rand
+}
+
+// latencyRecorder keeps latencies for percentiles
+type latencyRecorder struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	count   int64
+	max     time.Duration
+	rng     *rand.Rand
+}
+
+// loadRun is a load run in progress
+type loadRun struct {
+	profile *LoadProfile
+	conns   []*loadConn
+	devices []*loadDevice
+	start   time.Time
+
+	published, publishErrors, received atomic.Int64
+	commands, skipped                  atomic.Int64
+	timeouts, commandErrors            atomic.Int64
+	publishLatency, commandLatency     *latencyRecorder
+
+	probe *nats.Subscription
+}
+
+// LoadLoadProfile reads a load profile from a YAML file
+func LoadLoadProfile(path string) (*LoadProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read load profile: %w", err)
+	}
+
+	var profile LoadProfile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&profile); err != nil {
+		return nil, fmt.Errorf("invalid load profile: %w", err)
+	}
+	if err := profile.validate(); err != nil {
+		return nil, fmt.Errorf("invalid load profile: %w", err)
+	}
+	return &profile, nil
+}
+
+// validate checks a profile and fills in defaults
+func (p *LoadProfile) validate() error {
+	if p.Homes <= 0 || p.DevicesPerHome <= 0 {
+		return fmt.Errorf("homes and devices_per_home must be positive")
+	}
+	if len(p.Mix) == 0 {
+		p.Mix = map[string]int{"light": 1}
+	}
+	for deviceType, weight := range p.Mix {
+		if len(defaultState(deviceType)) == 0 {
+			return fmt.Errorf("mix: unknown device type %s", deviceType)
+		}
+		if weight <= 0 {
+			return fmt.Errorf("mix: %s must weigh more than zero", deviceType)
+		}
+	}
+
+	if p.Connections == 0 {
+		p.Connections = 4
+	}
+	if p.StateInterval == 0 {
+		p.StateInterval = 30 * time.Second
+	}
+	if p.HeartbeatInterval == 0 {
+		p.HeartbeatInterval = 60 * time.Second
+	}
+	if p.CommandTimeout == 0 {
+		p.CommandTimeout = 2 * time.Second
+	}
+	if p.MaxInflight == 0 {
+		p.MaxInflight = 256
+	}
+	if p.ReportInterval == 0 {
+		p.ReportInterval = 10 * time.Second
+	}
+
+	switch {
+	case p.Connections < 0:
+		return fmt.Errorf("connections must be positive")
+	case p.MaxInflight < 0:
+		return fmt.Errorf("max_inflight must be positive")
+	case p.StateInterval < 0, p.HeartbeatInterval < 0, p.CommandTimeout < 0, p.ReportInterval < 0, p.Duration < 0:
+		return fmt.Errorf("durations must be positive")
+	case p.CommandRate < 0:
+		return fmt.Errorf("command_rate must not be negative")
+	}
+	return nil
+}
+
+// RunLoad simulates the profile's devices until its duration is up or ctx is
+// done, and reports how the system coped
+func RunLoad(ctx context.Context, url string, profile *LoadProfile) (*LoadReport, error) {
+	if profile.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, profile.Duration)
+		defer cancel()
+	}
+
+	run := &loadRun{
+		profile:        profile,
+		publishLatency: newLatencyRecorder(profile.Seed),
+		commandLatency: newLatencyRecorder(profile.Seed),
+	}
+	run.createDevices()
+
+	for i := 0; i < profile.Connections; i++ {
+		nc, err := nats.Connect(url, nats.Name(fmt.Sprintf("device-simulator-load-%d", i)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+		}
+		defer nc.Close()
+		run.conns = append(run.conns, &loadConn{
+			nc:   nc,
+			byID: make(map[string]*loadDevice),
+			rng:  rand.New(rand.NewSource(profile.Seed + int64(i) + 1)),
+		})
+	}
+	for i, device := range run.devices {
+		conn := run.conns[i%len(run.conns)]
+		conn.devices = append(conn.devices, device)
+		conn.byID[device.id] = device
+	}
+
+	// The probe sees what devices publish, to time delivery, and sends
+	// the commands
+	probe, err := nats.Connect(url, nats.Name("device-simulator-load-probe"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	defer probe.Close()
+	run.probe, err = probe.Subscribe("home.devices.*.state", run.receiveState)
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to state: %w", err)
+	}
+	run.probe.SetPendingLimits(-1, -1)
+	if err := probe.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to subscribe to state: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	for _, conn := range run.conns {
+		if err := run.serveCommands(ctx, &wg, conn); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("Load %q: %d devices in %d homes on %d connections", profile.Name, len(run.devices), profile.Homes, len(run.conns))
+	run.start = time.Now()
+
+	for _, conn := range run.conns {
+		wg.Add(1)
+		go func(conn *loadConn) {
+			defer wg.Done()
+			run.publish(ctx, conn)
+		}(conn)
+	}
+	if profile.CommandRate > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run.sendCommands(ctx, probe)
+		}()
+	}
+
+	ticker := time.NewTicker(profile.ReportInterval)
+	defer ticker.Stop()
+	last := run.report()
+	for done := false; !done; {
+		select {
+		case <-ctx.Done():
+			done = true
+		case <-ticker.C:
+			current := run.report()
+			logProgress(last, current)
+			last = current
+		}
+	}
+
+	wg.Wait()
+	for _, conn := range run.conns {
+		conn.nc.Flush()
+	}
+	probe.Flush()
+	// Let what is in flight arrive before the last count
+	time.Sleep(100 * time.Millisecond)
+
+	return run.report(), nil
+}
+
+// runLoadMode runs a load profile until it is done or interrupted, and
+// writes the report as JSON to reportPath, or stdout
+func runLoadMode(url, profilePath, reportPath string) {
+	profile, err := LoadLoadProfile(profilePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	report, err := RunLoad(ctx, url, profile)
+	if err != nil {
+		log.Fatal("Load run failed: ", err)
+	}
+
+	data, _ := json.MarshalIndent(report, "", "  ")
+	data = append(data, '\n')
+	if reportPath == "" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := os.WriteFile(reportPath, data, 0644); err != nil {
+		log.Fatal("Failed to write load report: ", err)
+	}
+	log.Printf("Wrote load report to %s", reportPath)
+}
+
+// createDevices spreads the devices over the homes, with types drawn from the
+// mix
+func (r *loadRun) createDevices() {
+	profile := r.profile
+	rng := rand.New(rand.NewSource(profile.Seed))
+
+	types := make([]string, 0, len(profile.Mix))
+	total := 0
+	for deviceType, weight := range profile.Mix {
+		types = append(types, deviceType)
+		total += weight
+	}
+	sort.Strings(types)
+
+	for home := 1; home <= profile.Homes; home++ {
+		for n := 1; n <= profile.DevicesPerHome; n++ {
+			pick := rng.Intn(total)
+			deviceType := types[0]
+			for _, t := range types {
+				if pick < profile.Mix[t] {
+					deviceType = t
+					break
+				}
+				pick -= profile.Mix[t]
+			}
+
+			r.devices = append(r.devices, &loadDevice{
+				id:         fmt.Sprintf("%sh%04d_%s_%03d", loadDevicePrefix, home, deviceType, n),
+				home:       home,
+				deviceType: deviceType,
+				state:      defaultState(deviceType),
+			})
+		}
+	}
+}
+
+// publish announces the connection's devices, then sends state and
+// heartbeats at the profile's rates, round robin
+func (r *loadRun) publish(ctx context.Context, conn *loadConn) {
+	if len(conn.devices) == 0 {
+		return
+	}
+	for _, device := range conn.devices {
+		r.send(conn.nc, device.announceSubject(), device.announcement())
+	}
+
+	perSecond := float64(len(conn.devices))
+	stateRate := perSecond / r.profile.StateInterval.Seconds()
+	heartbeatRate := perSecond / r.profile.HeartbeatInterval.Seconds()
+
+	var stateDue, heartbeatDue float64
+	var nextState, nextHeartbeat int
+
+	ticker := time.NewTicker(loadTick)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			elapsed := now.Sub(last).Seconds()
+			last = now
+
+			stateDue += elapsed * stateRate
+			for ; stateDue >= 1; stateDue-- {
+				device := conn.devices[nextState]
+				nextState = (nextState + 1) % len(conn.devices)
+				device.wander(conn.rng)
+				r.send(conn.nc, device.stateSubject(), device.stateMessage())
+			}
+
+			heartbeatDue += elapsed * heartbeatRate
+			for ; heartbeatDue >= 1; heartbeatDue-- {
+				device := conn.devices[nextHeartbeat]
+				nextHeartbeat = (nextHeartbeat + 1) % len(conn.devices)
+				r.send(conn.nc, device.announceSubject(), device.announcement())
+			}
+		}
+	}
+}
+
+func (r *loadRun) send(nc *nats.Conn, subject string, data []byte) {
+	if err := nc.Publish(subject, data); err != nil {
+		r.publishErrors.Add(1)
+		return
+	}
+	r.published.Add(1)
+}
+
+// receiveState times a state message from publish to delivery. The probe
+// sees every device's state, so only load devices are counted.
+func (r *loadRun) receiveState(msg *nats.Msg) {
+	if !strings.HasPrefix(msg.Subject, "home.devices."+loadDevicePrefix) {
+		return
+	}
+	r.received.Add(1)
+
+	var state struct {
+		Timestamp time.Time `json:"timestamp"`
+	}
+	if err := json.Unmarshal(msg.Data, &state); err != nil || state.Timestamp.IsZero() {
+		return
+	}
+	r.publishLatency.record(time.Since(state.Timestamp))
+}
+
+// serveCommands answers commands for the connection's devices. The
+// subscriptions share a channel, so thousands of devices need only a few
+// goroutines.
+func (r *loadRun) serveCommands(ctx context.Context, wg *sync.WaitGroup, conn *loadConn) error {
+	msgs := make(chan *nats.Msg, 4096)
+	for _, device := range conn.devices {
+		if _, err := conn.nc.ChanSubscribe(fmt.Sprintf("home.devices.%s.command", device.id), msgs); err != nil {
+			return fmt.Errorf("failed to subscribe to commands: %w", err)
+		}
+	}
+	if err := conn.nc.Flush(); err != nil {
+		return fmt.Errorf("failed to subscribe to commands: %w", err)
+	}
+
+	for i := 0; i < loadCommandWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case msg := <-msgs:
+					// home.devices.{id}.command
+					id := strings.TrimSuffix(strings.TrimPrefix(msg.Subject, "home.devices."), ".command")
+					device, ok := conn.byID[id]
+					if !ok {
+						continue
+					}
+
+					var cmd map[string]interface{}
+					if err := json.Unmarshal(msg.Data, &cmd); err != nil {
+						continue
+					}
+					command, _ := cmd["command"].(string)
+					device.handleCommand(command, cmd)
+					r.send(conn.nc, device.stateSubject(), device.stateMessage())
+
+					response, _ := json.Marshal(map[string]interface{}{
+						"success":   true,
+						"device_id": device.id,
+						"command":   cmd,
+					})
+					msg.Respond(response)
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// sendCommands sends commands to random devices at the profile's rate and
+// times their replies. At most MaxInflight commands wait for a reply; due
+// commands beyond that are skipped and counted, so a slow system can't pile
+// up goroutines.
+func (r *loadRun) sendCommands(ctx context.Context, nc *nats.Conn) {
+	var targets []*loadDevice
+	for _, device := range r.devices {
+		if loadCommand(device.deviceType, nil) != nil {
+			targets = append(targets, device)
+		}
+	}
+	if len(targets) == 0 {
+		log.Printf("Load: no device in the mix takes commands, sending none")
+		return
+	}
+
+	rng := rand.New(rand.NewSource(r.profile.Seed - 1))
+	slots := make(chan struct{}, r.profile.MaxInflight)
+	var inflight sync.WaitGroup
+	defer inflight.Wait()
+
+	var due float64
+	ticker := time.NewTicker(loadTick)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			due += now.Sub(last).Seconds() * r.profile.CommandRate
+			last = now
+
+			for ; due >= 1; due-- {
+				device := targets[rng.Intn(len(targets))]
+				data, _ := json.Marshal(loadCommand(device.deviceType, rng))
+
+				select {
+				case slots <- struct{}{}:
+				default:
+					r.skipped.Add(1)
+					continue
+				}
+				inflight.Add(1)
+				go func() {
+					defer func() {
+						<-slots
+						inflight.Done()
+					}()
+					r.commands.Add(1)
+					start := time.Now()
+					_, err := nc.Request(fmt.Sprintf("home.devices.%s.command", device.id), data, r.profile.CommandTimeout)
+					switch {
+					case err == nats.ErrTimeout:
+						r.timeouts.Add(1)
+					case err != nil:
+						r.commandErrors.Add(1)
+					default:
+						r.commandLatency.record(time.Since(start))
+					}
+				}()
+			}
+		}
+	}
+}
+
+// loadCommand returns a command for a device type, nil for types that take
+// none. The rng picks values; without one the command is only checked for.
+func loadCommand(deviceType string, rng *rand.Rand) map[string]interface{} {
+	switch deviceType {
+	case "light", "switch", "fan":
+		return map[string]interface{}{"command": "toggle"}
+	case "lock":
+		return map[string]interface{}{"command": "unlock"}
+	case "cover":
+		return map[string]interface{}{"command": "open"}
+	case "thermostat":
+		temperature := 21.0
+		if rng != nil {
+			temperature = float64(18 + rng.Intn(8))
+		}
+		return map[string]interface{}{"command": "set_temperature", "temperature": temperature}
+	}
+	return nil
+}
+
+// report counts what happened so far
+func (r *loadRun) report() *LoadReport {
+	seconds := time.Since(r.start).Seconds()
+	if r.start.IsZero() || seconds <= 0 {
+		seconds = 0
+	}
+
+	report := &LoadReport{
+		Name:            r.profile.Name,
+		Homes:           r.profile.Homes,
+		Devices:         len(r.devices),
+		Connections:     len(r.conns),
+		Seconds:         math.Round(seconds*10) / 10,
+		Published:       r.published.Load(),
+		PublishErrors:   r.publishErrors.Load(),
+		Received:        r.received.Load(),
+		PublishLatency:  r.publishLatency.percentiles(),
+		Commands:        r.commands.Load(),
+		CommandsSkipped: r.skipped.Load(),
+		CommandTimeouts: r.timeouts.Load(),
+		CommandErrors:   r.commandErrors.Load(),
+		CommandLatency:  r.commandLatency.percentiles(),
+	}
+	if r.probe != nil {
+		if dropped, err := r.probe.Dropped(); err == nil {
+			report.Dropped = int64(dropped)
+		}
+	}
+	if seconds > 0 {
+		report.PublishRate = math.Round(float64(report.Published)/seconds*10) / 10
+		report.CommandRate = math.Round(float64(report.CommandLatency.Samples)/seconds*10) / 10
+	}
+	return report
+}
+
+// logProgress logs the rates between two reports and the latencies so far
+func logProgress(last, current *LoadReport) {
+	seconds := current.Seconds - last.Seconds
+	if seconds <= 0 {
+		return
+	}
+	log.Printf("Load: %.0f msg/s published, %.0f received, publish p99 %.1fms, %.0f commands/s p99 %.1fms, %d timeouts",
+		float64(current.Published-last.Published)/seconds,
+		float64(current.Received-last.Received)/seconds,
+		current.PublishLatency.P99,
+		float64(current.CommandLatency.Samples-last.CommandLatency.Samples)/seconds,
+		current.CommandLatency.P99,
+		current.CommandTimeouts,
+	)
+}
+
+func newLatencyRecorder(seed int64) *latencyRecorder {
+	return &latencyRecorder{rng: rand.New(rand.NewSource(seed))}
+}
+
+func (l *latencyRecorder) record(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.count++
+	if d > l.max {
+		l.max = d
+	}
+	if len(l.samples) < maxLatencySamples {
+		l.samples = append(l.samples, d)
+	} else if i := l.rng.Int63n(l.count); i < maxLatencySamples {
+		l.samples[i] = d
+	}
+}
+
+func (l *latencyRecorder) percentiles() Percentiles {
+	l.mu.Lock()
+	samples := append([]time.Duration(nil), l.samples...)
+	p := Percentiles{Samples: l.count, Max: milliseconds(l.max)}
+	l.mu.Unlock()
+
+	if len(samples) == 0 {
+		return p
+	}
+	sort.Slice(samples, func(a, b int) bool { return samples[a] < samples[b] })
+	at := func(q float64) float64 {
+		return milliseconds(samples[int(q*float64(len(samples)-1))])
+	}
+	p.P50, p.P90, p.P99 = at(0.50), at(0.90), at(0.99)
+	return p
+}
+
+func milliseconds(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Millisecond)*100) / 100
+}
+
+func (d *loadDevice) stateSubject() string {
+	return fmt.Sprintf("home.devices.%s.state", d.id)
+}
+
+func (d *loadDevice) announceSubject() string {
+	return fmt.Sprintf("home.devices.%s.announce", d.id)
+}
+
+func (d *loadDevice) stateMessage() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	data, _ := json.Marshal(map[string]interface{}{
+		"device_id": d.id,
+		"state":     d.state,
+		"online":    true,
+		"timestamp": time.Now(),
+	})
+	return data
+}
+
+func (d *loadDevice) announcement() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	data, _ := json.Marshal(map[string]interface{}{
+		"device_id":    d.id,
+		"type":         d.deviceType,
+		"name":         d.id,
+		"room":         fmt.Sprintf("home %d", d.home),
+		"online":       true,
+		"state":        d.state,
+		"manufacturer": "NATS Simulator",
+		"model":        "Virtual Device",
+		"metadata": map[string]interface{}{
+			"simulated": true,
+			"source":    "device-simulator",
+			"load":      true,
+			"home":      d.home,
+		},
+	})
+	return data
+}
+
+// wander moves sensor readings a little
+func (d *loadDevice) wander(rng *rand.Rand) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, key := range []string{"temperature", "humidity", "current_temperature"} {
+		if value, ok := d.state[key].(float64); ok {
+			d.state[key] = math.Round((value+rng.Float64()-0.5)*100) / 100
+		}
+	}
+}
+
+// handleCommand applies the commands the load generator sends
+func (d *loadDevice) handleCommand(command string, cmd map[string]interface{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch command {
+	case "toggle":
+		if d.state["state"] == "on" {
+			d.state["state"] = "off"
+		} else {
+			d.state["state"] = "on"
+		}
+	case "turn_on", "turn_off":
+		d.state["state"] = strings.TrimPrefix(command, "turn_")
+	case "lock", "unlock":
+		d.state["state"] = command + "ed"
+	case "open":
+		d.state["state"] = "open"
+	case "close":
+		d.state["state"] = "closed"
+	case "set_temperature":
+		if temperature, ok := cmd["temperature"].(float64); ok {
+			d.state["target_temperature"] = temperature
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestLatencyRecorderSamples(t *testing.T) {
+	l := newLatencyRecorder(1)
+	for i := 0; i < maxLatencySamples; i++ {
+		l.record(time.Millisecond)
+	}
+	for i := 0; i < maxLatencySamples; i++ {
+		l.record(2 * time.Millisecond)
+	}
+	l.record(time.Second)
+
+	if l.count != 2*maxLatencySamples+1 {
+		t.Errorf("count = %d, want %d", l.count, 2*maxLatencySamples+1)
+	}
+	if len(l.samples) != maxLatencySamples {
+		t.Errorf("kept %d samples, want %d", len(l.samples), maxLatencySamples)
+	}
+	if l.max != time.Second {
+		t.Errorf("max = %v, want 1s", l.max)
+	}
+
+	// Later latencies replace earlier ones at random, so the reservoir
+	// holds about as many of each
+	later := 0
+	for _, d := range l.samples {
+		if d > time.Millisecond {
+			later++
+		}
+	}
+	if share := float64(later) / maxLatencySamples; share < 0.45 || share > 0.55 {
+		t.Errorf("%.2f of the samples are from the second half, want about 0.5", share)
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+	l := newLatencyRecorder(1)
+	if p := l.percentiles(); p != (Percentiles{}) {
+		t.Errorf("no samples: got %+v", p)
+	}
+
+	// Recorded out of order, 1ms to 100ms
+	for i := 100; i >= 1; i-- {
+		l.record(time.Duration(i) * time.Millisecond)
+	}
+	want := Percentiles{Samples: 100, P50: 50, P90: 90, P99: 99, Max: 100}
+	if p := l.percentiles(); p != want {
+		t.Errorf("got %+v, want %+v", p, want)
+	}
+}
+
+func TestLoadProfileValidate(t *testing.T) {
+	profile := &LoadProfile{Homes: 2, DevicesPerHome: 3}
+	if err := profile.validate(); err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case len(profile.Mix) != 1 || profile.Mix["light"] != 1:
+		t.Errorf("mix = %v, want all lights", profile.Mix)
+	case profile.Connections != 4:
+		t.Errorf("connections = %d, want 4", profile.Connections)
+	case profile.StateInterval != 30*time.Second, profile.HeartbeatInterval != 60*time.Second:
+		t.Errorf("intervals = %v/%v, want 30s/60s", profile.StateInterval, profile.HeartbeatInterval)
+	case profile.CommandTimeout != 2*time.Second:
+		t.Errorf("command timeout = %v, want 2s", profile.CommandTimeout)
+	case profile.MaxInflight != 256:
+		t.Errorf("max inflight = %d, want 256", profile.MaxInflight)
+	case profile.ReportInterval != 10*time.Second:
+		t.Errorf("report interval = %v, want 10s", profile.ReportInterval)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		profile LoadProfile
+		want    string
+	}{
+		{"no homes", LoadProfile{DevicesPerHome: 1}, "homes and devices_per_home must be positive"},
+		{"no devices", LoadProfile{Homes: 1}, "homes and devices_per_home must be positive"},
+		{"unknown type", LoadProfile{Homes: 1, DevicesPerHome: 1, Mix: map[string]int{"toaster": 1}}, "unknown device type toaster"},
+		{"zero weight", LoadProfile{Homes: 1, DevicesPerHome: 1, Mix: map[string]int{"light": 0}}, "light must weigh more than zero"},
+		{"negative connections", LoadProfile{Homes: 1, DevicesPerHome: 1, Connections: -1}, "connections must be positive"},
+		{"negative max inflight", LoadProfile{Homes: 1, DevicesPerHome: 1, MaxInflight: -1}, "max_inflight must be positive"},
+		{"negative duration", LoadProfile{Homes: 1, DevicesPerHome: 1, Duration: -time.Second}, "durations must be positive"},
+		{"negative command rate", LoadProfile{Homes: 1, DevicesPerHome: 1, CommandRate: -1}, "command_rate must not be negative"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.profile.validate()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("validate() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateDevicesMix(t *testing.T) {
+	profile := &LoadProfile{Homes: 100, DevicesPerHome: 40, Mix: map[string]int{"light": 6, "sensor": 3, "thermostat": 1}, Seed: 3}
+	if err := profile.validate(); err != nil {
+		t.Fatal(err)
+	}
+	run := &loadRun{profile: profile}
+	run.createDevices()
+
+	if len(run.devices) != 4000 {
+		t.Fatalf("created %d devices, want 4000", len(run.devices))
+	}
+	counts := make(map[string]int)
+	for _, device := range run.devices {
+		counts[device.deviceType]++
+		if !strings.HasPrefix(device.id, loadDevicePrefix) {
+			t.Fatalf("device ID %q lacks the %s prefix", device.id, loadDevicePrefix)
+		}
+	}
+	for deviceType, weight := range profile.Mix {
+		want := float64(weight) / 10
+		if share := float64(counts[deviceType]) / 4000; share < want-0.03 || share > want+0.03 {
+			t.Errorf("%s: %.3f of the devices, want about %.1f", deviceType, share, want)
+		}
+	}
+
+	// The same seed gives the same devices
+	again := &loadRun{profile: profile}
+	again.createDevices()
+	for i, device := range again.devices {
+		if device.id != run.devices[i].id {
+			t.Fatalf("device %d is %s, want %s", i, device.id, run.devices[i].id)
+		}
+	}
+}
+
+func TestReceiveStateCountsLoadDevices(t *testing.T) {
+	run := &loadRun{
+		profile:        &LoadProfile{},
+		publishLatency: newLatencyRecorder(1),
+		commandLatency: newLatencyRecorder(1),
+	}
+	device := &loadDevice{id: "load_h0001_light_001", state: defaultState("light")}
+	run.receiveState(&nats.Msg{Subject: device.stateSubject(), Data: device.stateMessage()})
+	run.receiveState(&nats.Msg{Subject: "home.devices.kitchen_light.state", Data: device.stateMessage()})
+
+	if got := run.received.Load(); got != 1 {
+		t.Errorf("received = %d, want only the load device's state", got)
+	}
+	if got := run.publishLatency.percentiles().Samples; got != 1 {
+		t.Errorf("publish latency samples = %d, want 1", got)
+	}
+}
+
+func TestSendCommandsCapsInflight(t *testing.T) {
+	ns := runServer(t)
+	nc := connect(t, ns)
+
+	// Take commands without replying, so they stay in flight
+	responder := connect(t, ns)
+	if _, err := responder.Subscribe("home.devices.*.command", func(*nats.Msg) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := responder.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	profile := &LoadProfile{Homes: 1, DevicesPerHome: 5, CommandRate: 1000, CommandTimeout: 500 * time.Millisecond, MaxInflight: 3}
+	if err := profile.validate(); err != nil {
+		t.Fatal(err)
+	}
+	run := &loadRun{
+		profile:        profile,
+		publishLatency: newLatencyRecorder(1),
+		commandLatency: newLatencyRecorder(1),
+	}
+	run.createDevices()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	run.sendCommands(ctx, nc)
+
+	report := run.report()
+	if report.Commands != 3 || report.CommandTimeouts != 3 {
+		t.Errorf("sent %d commands, %d timed out, want 3 of each", report.Commands, report.CommandTimeouts)
+	}
+	if report.CommandsSkipped < 100 {
+		t.Errorf("skipped %d commands, want the ones due while 3 were in flight", report.CommandsSkipped)
+	}
+}
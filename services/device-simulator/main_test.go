@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func runServer(t *testing.T) *server.Server {
+	t.Helper()
+
+	ns, err := server.NewServer(&server.Options{
+		Port:      -1,
+		NoLog:     true,
+		NoSigs:    true,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("server did not start")
+	}
+	t.Cleanup(ns.Shutdown)
+	return ns
+}
+
+func connect(t *testing.T, ns *server.Server) *nats.Conn {
+	t.Helper()
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+// newSimulator returns a simulator on its own server, and a connection to
+// watch what it publishes
+func newSimulator(t *testing.T) (*Simulator, *nats.Conn) {
+	t.Helper()
+
+	ns := runServer(t)
+	nc := connect(t, ns)
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, err := js.CreateKeyValue(context.Background(), jetstream.KeyValueConfig{Bucket: "device-simulator"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub := &WSHub{
+		clients:    make(map[*WSClient]bool),
+		broadcast:  make(chan []byte),
+		register:   make(chan *WSClient),
+		unregister: make(chan *WSClient),
+	}
+	go hub.run()
+
+	sim := &Simulator{
+		nc:      nc,
+		js:      js,
+		kv:      kv,
+		devices: make(map[string]*SimulatedDevice),
+		config:  &Config{KVBucket: "device-simulator"},
+		wsHub:   hub,
+	}
+	return sim, connect(t, ns)
+}
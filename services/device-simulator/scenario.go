@@ -0,0 +1,615 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Default time between the values a ramp publishes, in scenario time
+const defaultRampEvery = 10 * time.Second
+
+// Largest scenario accepted over HTTP
+const maxScenarioSize = 1 << 20
+
+var errScenarioRunning = errors.New("a scenario is already running")
+
+// Scenario is a timeline of device changes read from YAML, e.g.
+//
+//	name: evening
+//	seed: 42
+//	speed: 60
+//	steps:
+//	  - at: 5s
+//	    device: hallway_motion
+//	    set: {motion: true}
+//	  - at: 30s
+//	    device: living_sensor
+//	    ramp: {temperature: 28}
+//	    over: 10m
+//	  - at: 2m
+//	    device: front_door
+//	    set: {contact: open}
+type Scenario struct {
+	Name        string `yaml:"name" json:"name"`
+	Description string `yaml:"description" json:"description,omitempty"`
+
+	// Seed makes noise repeatable; without one a seed is picked and reported
+	// in the run's status so the run can be repeated
+	Seed *int64 `yaml:"seed" json:"seed,omitempty"`
+
+	// Speed is how many times faster than real time the scenario runs
+	Speed float64 `yaml:"speed" json:"speed,omitempty"`
+
+	// Devices are created when they don't exist yet
+	Devices []ScenarioDevice `yaml:"devices" json:"devices,omitempty"`
+
+	Steps []ScenarioStep `yaml:"steps" json:"steps"`
+}
+
+// ScenarioDevice is a device a scenario needs
+type ScenarioDevice struct {
+	ID    string                 `yaml:"id" json:"id"`
+	Type  string                 `yaml:"type" json:"type"`
+	Name  string                 `yaml:"name" json:"name,omitempty"`
+	Room  string                 `yaml:"room" json:"room,omitempty"`
+	State map[string]interface{} `yaml:"state" json:"state,omitempty"`
+}
+
+// ScenarioStep changes a device at a point in the timeline. It sets state,
+// ramps numeric state linearly to a target over a duration, sends the device
+// a command as if it came over NATS, or sets its faults.
+type ScenarioStep struct {
+	At     time.Duration          `yaml:"at" json:"at"`
+	Device string                 `yaml:"device" json:"device"`
+	Set    map[string]interface{} `yaml:"set" json:"set,omitempty"`
+	Ramp   map[string]float64     `yaml:"ramp" json:"ramp,omitempty"`
+	Over   time.Duration          `yaml:"over" json:"over,omitempty"`
+	Every  time.Duration          `yaml:"every" json:"every,omitempty"`
+
+	// Noise adds a random amount of up to plus or minus this to numeric
+	// values set or ramped
+	Noise map[string]float64 `yaml:"noise" json:"noise,omitempty"`
+
+	Command map[string]interface{} `yaml:"command" json:"command,omitempty"`
+
+	// Faults replace the device's faults; an empty profile clears them
+	Faults *FaultProfile `yaml:"faults" json:"faults,omitempty"`
+}
+
+// ScenarioStatus reports on a scenario run
+type ScenarioStatus struct {
+	Name       string     `json:"name"`
+	State      string     `json:"state"` // running, finished, stopped or failed
+	Seed       int64      `json:"seed"`
+	Speed      float64    `json:"speed"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Elapsed    string     `json:"elapsed"`  // In scenario time
+	Duration   string     `json:"duration"` // In scenario time
+	Events     int        `json:"events"`
+	EventsRun  int        `json:"events_run"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// scenarioEvent is one change to apply; a ramp is a series of events
+type scenarioEvent struct {
+	at       time.Duration
+	step     int
+	fraction float64 // How far along a ramp, unused otherwise
+}
+
+// scenarioRun is a scenario being played against the simulator
+type scenarioRun struct {
+	sim      *Simulator
+	scenario *Scenario
+	events   []scenarioEvent
+	rng      *rand.Rand
+
+	// Values ramps start from, by step
+	rampFrom map[int]map[string]float64
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	mu     sync.Mutex
+	status ScenarioStatus
+}
+
+// LoadScenario reads a scenario from a YAML file
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scenario: %w", err)
+	}
+	return ParseScenario(data)
+}
+
+// ParseScenario reads a scenario from YAML, or JSON, and checks it
+func ParseScenario(data []byte) (*Scenario, error) {
+	var scenario Scenario
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&scenario); err != nil {
+		return nil, fmt.Errorf("invalid scenario: %w", err)
+	}
+	if err := scenario.validate(); err != nil {
+		return nil, fmt.Errorf("invalid scenario: %w", err)
+	}
+	return &scenario, nil
+}
+
+func (sc *Scenario) validate() error {
+	if sc.Speed < 0 {
+		return fmt.Errorf("speed must be positive")
+	}
+	for i, device := range sc.Devices {
+		if device.ID == "" || device.Type == "" {
+			return fmt.Errorf("devices[%d]: id and type are required", i)
+		}
+	}
+	if len(sc.Steps) == 0 {
+		return fmt.Errorf("no steps")
+	}
+	for i, step := range sc.Steps {
+		actions := 0
+		for _, set := range []bool{len(step.Set) > 0, len(step.Ramp) > 0, len(step.Command) > 0, step.Faults != nil} {
+			if set {
+				actions++
+			}
+		}
+		switch {
+		case step.Device == "":
+			return fmt.Errorf("steps[%d]: device is required", i)
+		case step.At < 0:
+			return fmt.Errorf("steps[%d]: at must not be negative", i)
+		case actions != 1:
+			return fmt.Errorf("steps[%d]: want exactly one of set, ramp, command or faults", i)
+		case len(step.Ramp) > 0 && step.Over <= 0:
+			return fmt.Errorf("steps[%d]: a ramp needs a positive over", i)
+		case step.Every < 0:
+			return fmt.Errorf("steps[%d]: every must be positive", i)
+		}
+		if _, ok := step.Command["command"].(string); len(step.Command) > 0 && !ok {
+			return fmt.Errorf("steps[%d]: command needs a command name", i)
+		}
+		if step.Faults != nil {
+			if _, err := step.Faults.compile(); err != nil {
+				return fmt.Errorf("steps[%d]: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// events expands the steps into the changes to apply, in order
+func (sc *Scenario) events() []scenarioEvent {
+	var events []scenarioEvent
+	for i, step := range sc.Steps {
+		if len(step.Ramp) == 0 {
+			events = append(events, scenarioEvent{at: step.At, step: i})
+			continue
+		}
+
+		every := step.Every
+		if every == 0 {
+			every = defaultRampEvery
+		}
+		samples := int(math.Ceil(float64(step.Over) / float64(every)))
+		for k := 0; k <= samples; k++ {
+			fraction := float64(k) / float64(samples)
+			at := step.At + time.Duration(fraction*float64(step.Over))
+			events = append(events, scenarioEvent{at: at, step: i, fraction: fraction})
+		}
+	}
+
+	// Steps at the same time apply in the order they are written
+	sort.SliceStable(events, func(a, b int) bool {
+		return events[a].at < events[b].at
+	})
+	return events
+}
+
+// StartScenario plays a scenario against the simulator, creating the devices
+// it declares. Only one scenario runs at a time. A positive speed or a
+// non-nil seed overrides the scenario's.
+func (s *Simulator) StartScenario(scenario *Scenario, speed float64, seed *int64) (*scenarioRun, error) {
+	if speed <= 0 {
+		speed = scenario.Speed
+	}
+	if speed <= 0 {
+		speed = 1
+	}
+	if seed == nil {
+		seed = scenario.Seed
+	}
+	if seed == nil {
+		picked := time.Now().UnixNano()
+		seed = &picked
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.scenario != nil && s.scenario.running() {
+		return nil, fmt.Errorf("%w: %s", errScenarioRunning, s.scenario.scenario.Name)
+	}
+
+	declared := make(map[string]bool)
+	for _, device := range scenario.Devices {
+		declared[device.ID] = true
+	}
+	for i, step := range scenario.Steps {
+		if _, exists := s.devices[step.Device]; !exists && !declared[step.Device] {
+			return nil, fmt.Errorf("steps[%d]: unknown device %s", i, step.Device)
+		}
+	}
+
+	events := scenario.events()
+	run := &scenarioRun{
+		sim:      s,
+		scenario: scenario,
+		events:   events,
+		rng:      rand.New(rand.NewSource(*seed)),
+		rampFrom: make(map[int]map[string]float64),
+		stopCh:   make(chan struct{}),
+		done:     make(chan struct{}),
+		status: ScenarioStatus{
+			Name:      scenario.Name,
+			State:     "running",
+			Seed:      *seed,
+			Speed:     speed,
+			StartedAt: time.Now(),
+			Duration:  events[len(events)-1].at.String(),
+			Events:    len(events),
+		},
+	}
+	s.scenario = run
+
+	go run.run()
+	return run, nil
+}
+
+// StopScenario stops the running scenario, if there is one
+func (s *Simulator) StopScenario() *scenarioRun {
+	s.mu.RLock()
+	run := s.scenario
+	s.mu.RUnlock()
+
+	if run == nil {
+		return nil
+	}
+	run.stopOnce.Do(func() { close(run.stopCh) })
+	<-run.done
+	return run
+}
+
+func (r *scenarioRun) running() bool {
+	select {
+	case <-r.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Status reports how far the run is
+func (r *scenarioRun) Status() ScenarioStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := r.status
+	end := time.Now()
+	if status.FinishedAt != nil {
+		end = *status.FinishedAt
+	}
+	elapsed := time.Duration(float64(end.Sub(status.StartedAt)) * status.Speed)
+	if duration := r.events[len(r.events)-1].at; elapsed > duration {
+		elapsed = duration
+	}
+	status.Elapsed = elapsed.Round(time.Millisecond).String()
+	return status
+}
+
+func (r *scenarioRun) run() {
+	sim := r.sim
+	log.Printf("Running scenario %q at %gx with seed %d", r.status.Name, r.status.Speed, r.status.Seed)
+	sim.publishEvent("scenario_started", map[string]interface{}{
+		"scenario": r.status.Name,
+		"seed":     r.status.Seed,
+		"speed":    r.status.Speed,
+	})
+
+	state, err := r.play()
+	if err != nil {
+		log.Printf("Scenario %q failed: %v", r.status.Name, err)
+	} else {
+		log.Printf("Scenario %q %s", r.status.Name, state)
+	}
+
+	// Random walks resume once the scenario is over
+	for _, device := range r.devices() {
+		device.mu.Lock()
+		device.scripted = false
+		device.mu.Unlock()
+	}
+
+	r.mu.Lock()
+	now := time.Now()
+	r.status.State = state
+	r.status.FinishedAt = &now
+	if err != nil {
+		r.status.Error = err.Error()
+	}
+	status := r.status
+	r.mu.Unlock()
+	close(r.done)
+
+	sim.publishEvent("scenario_"+state, map[string]interface{}{
+		"scenario":   status.Name,
+		"seed":       status.Seed,
+		"events_run": status.EventsRun,
+		"error":      status.Error,
+	})
+}
+
+// play creates the scenario's devices and applies its events on time, and
+// returns how the run ended
+func (r *scenarioRun) play() (string, error) {
+	sim := r.sim
+	for _, def := range r.scenario.Devices {
+		sim.mu.RLock()
+		_, exists := sim.devices[def.ID]
+		sim.mu.RUnlock()
+		if exists {
+			continue
+		}
+
+		state := &DeviceState{
+			ID:         def.ID,
+			Type:       def.Type,
+			Name:       def.Name,
+			Room:       def.Room,
+			State:      defaultState(def.Type),
+			Online:     true,
+			LastUpdate: time.Now(),
+		}
+		for key, value := range normalize(def.State) {
+			state.State[key] = value
+		}
+		sim.createSimulatedDevice(state)
+		sim.broadcastUpdate(def.ID, "device_created")
+	}
+
+	// Random walks would make runs differ, so they pause on the devices
+	// the scenario drives
+	for _, device := range r.devices() {
+		device.mu.Lock()
+		device.scripted = true
+		device.mu.Unlock()
+	}
+
+	for i, event := range r.events {
+		due := r.status.StartedAt.Add(time.Duration(float64(event.at) / r.status.Speed))
+		select {
+		case <-time.After(time.Until(due)):
+		case <-r.stopCh:
+			return "stopped", nil
+		}
+
+		if err := r.apply(event); err != nil {
+			return "failed", fmt.Errorf("steps[%d] at %s: %w", event.step, event.at, err)
+		}
+
+		r.mu.Lock()
+		r.status.EventsRun = i + 1
+		r.mu.Unlock()
+	}
+	return "finished", nil
+}
+
+// devices returns the simulated devices the scenario's steps drive
+func (r *scenarioRun) devices() []*SimulatedDevice {
+	r.sim.mu.RLock()
+	defer r.sim.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var devices []*SimulatedDevice
+	for _, step := range r.scenario.Steps {
+		device, exists := r.sim.devices[step.Device]
+		if exists && !seen[step.Device] {
+			seen[step.Device] = true
+			devices = append(devices, device)
+		}
+	}
+	return devices
+}
+
+// apply makes one change to a device and publishes its state
+func (r *scenarioRun) apply(event scenarioEvent) error {
+	step := r.scenario.Steps[event.step]
+
+	r.sim.mu.RLock()
+	device, exists := r.sim.devices[step.Device]
+	r.sim.mu.RUnlock()
+	if !exists {
+		return fmt.Errorf("device %s no longer exists", step.Device)
+	}
+
+	if len(step.Command) > 0 {
+		device.handleCommand(normalize(step.Command))
+		r.sim.broadcastUpdate(device.ID, "state_updated")
+		return nil
+	}
+
+	if step.Faults != nil {
+		// Fault chances follow the scenario's seed unless given their own
+		profile := *step.Faults
+		if profile.Seed == nil {
+			seed := r.rng.Int63()
+			profile.Seed = &seed
+		}
+		if err := device.setFaults(&profile); err != nil {
+			return err
+		}
+		r.sim.saveDevice(device)
+		return nil
+	}
+
+	device.mu.Lock()
+	if len(step.Ramp) > 0 {
+		// A ramp starts from whatever the value is when it begins, or jumps
+		// to its target when there is no number to start from
+		if event.fraction == 0 {
+			from := make(map[string]float64)
+			for key, target := range step.Ramp {
+				value, ok := toFloat(device.State[key])
+				if !ok {
+					value = target
+				}
+				from[key] = value
+			}
+			r.rampFrom[event.step] = from
+			device.mu.Unlock()
+			return nil
+		}
+		for key, target := range step.Ramp {
+			from := r.rampFrom[event.step][key]
+			value := from + (target-from)*event.fraction
+			device.State[key] = r.withNoise(step, key, value)
+		}
+	} else {
+		for key, value := range normalize(step.Set) {
+			if number, ok := toFloat(value); ok {
+				value = r.withNoise(step, key, number)
+			}
+			device.State[key] = value
+		}
+	}
+	device.LastUpdate = time.Now()
+	device.mu.Unlock()
+
+	device.mu.RLock()
+	device.publishState()
+	device.mu.RUnlock()
+	r.sim.broadcastUpdate(device.ID, "state_updated")
+	return nil
+}
+
+// withNoise adds the step's noise for key to value, rounded to hundredths
+func (r *scenarioRun) withNoise(step ScenarioStep, key string, value float64) float64 {
+	if amount := step.Noise[key]; amount > 0 {
+		value += (r.rng.Float64()*2 - 1) * amount
+	}
+	return math.Round(value*100) / 100
+}
+
+// normalize gives YAML values the types JSON decoding would, which is what
+// command and state handling expect
+func normalize(values map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	if len(values) == 0 {
+		return result
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return values
+	}
+	json.Unmarshal(data, &result)
+	return result
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// HTTP handlers
+func (s *Simulator) handleRunScenario(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxScenarioSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scenario, err := ParseScenario(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var speed float64
+	if value := r.URL.Query().Get("speed"); value != "" {
+		speed, err = strconv.ParseFloat(value, 64)
+		if err != nil || speed <= 0 {
+			http.Error(w, "speed must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	var seed *int64
+	if value := r.URL.Query().Get("seed"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "seed must be an integer", http.StatusBadRequest)
+			return
+		}
+		seed = &parsed
+	}
+
+	run, err := s.StartScenario(scenario, speed, seed)
+	if errors.Is(err, errScenarioRunning) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(run.Status())
+}
+
+func (s *Simulator) handleGetScenario(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	run := s.scenario
+	s.mu.RUnlock()
+
+	if run == nil {
+		http.Error(w, "No scenario has run", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run.Status())
+}
+
+func (s *Simulator) handleStopScenario(w http.ResponseWriter, r *http.Request) {
+	run := s.StopScenario()
+	if run == nil {
+		http.Error(w, "No scenario has run", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run.Status())
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScenarioRejects(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{"unknown field", "steps:\n  - at: 1s\n    device: a\n    sett: {on: true}\n", "field sett not found"},
+		{"no steps", "name: empty\n", "no steps"},
+		{"negative speed", "speed: -1\nsteps:\n  - device: a\n    set: {on: true}\n", "speed must be positive"},
+		{"device without type", "devices:\n  - id: a\nsteps:\n  - device: a\n    set: {on: true}\n", "devices[0]: id and type are required"},
+		{"step without device", "steps:\n  - at: 1s\n    set: {on: true}\n", "steps[0]: device is required"},
+		{"negative at", "steps:\n  - at: -1s\n    device: a\n    set: {on: true}\n", "steps[0]: at must not be negative"},
+		{"no action", "steps:\n  - device: a\n", "want exactly one of"},
+		{"two actions", "steps:\n  - device: a\n    set: {on: true}\n    ramp: {level: 5}\n    over: 1m\n", "want exactly one of"},
+		{"ramp without over", "steps:\n  - device: a\n    ramp: {level: 5}\n", "steps[0]: a ramp needs a positive over"},
+		{"negative every", "steps:\n  - device: a\n    ramp: {level: 5}\n    over: 1m\n    every: -1s\n", "every must be positive"},
+		{"command without name", "steps:\n  - device: a\n    command: {brightness: 5}\n", "command needs a command name"},
+		{"bad faults", "steps:\n  - device: a\n    faults: {drop_commands: 150}\n", "steps[0]: drop_commands must be a percentage"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseScenario([]byte(tt.yaml))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("ParseScenario() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestScenarioEvents(t *testing.T) {
+	scenario, err := ParseScenario([]byte(`
+steps:
+  - at: 30s
+    device: b
+    set: {on: true}
+  - at: 10s
+    device: a
+    ramp: {level: 30}
+    over: 20s
+  - at: 30s
+    device: c
+    set: {on: false}
+  - at: 0s
+    device: c
+    command: {command: turn_on}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type event struct {
+		at       time.Duration
+		step     int
+		fraction float64
+	}
+	var got []event
+	for _, e := range scenario.events() {
+		got = append(got, event{e.at, e.step, e.fraction})
+	}
+
+	// The ramp is sampled every 10s by default; steps at the same time keep
+	// the order they are written in
+	want := []event{
+		{0, 3, 0},
+		{10 * time.Second, 1, 0},
+		{20 * time.Second, 1, 0.5},
+		{30 * time.Second, 0, 0},
+		{30 * time.Second, 1, 1},
+		{30 * time.Second, 2, 0},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d events %v, want %v", len(got), got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestScenarioRun(t *testing.T) {
+	sim, watch := newSimulator(t)
+
+	states, err := watch.SubscribeSync("home.devices.desk.state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	watch.Flush()
+
+	// 100x speed: the steps are 100ms apart in real time
+	scenario, err := ParseScenario([]byte(`
+name: desk
+speed: 100
+devices:
+  - id: desk
+    type: light
+    state: {level: 0}
+steps:
+  - at: 10s
+    device: desk
+    set: {scene: first}
+  - at: 20s
+    device: desk
+    ramp: {level: 10}
+    over: 20s
+  - at: 20s
+    device: desk
+    set: {scene: second}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	run, err := sim.StartScenario(scenario, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sim.StartScenario(scenario, 0, nil); err == nil {
+		t.Fatal("expected a second scenario to be refused while one runs")
+	}
+
+	type change struct {
+		scene string
+		level float64
+		at    time.Time
+	}
+	var changes []change
+	deadline := time.Now().Add(5 * time.Second)
+	for len(changes) < 4 {
+		msg, err := states.NextMsg(time.Until(deadline))
+		if err != nil {
+			t.Fatalf("got %d of 4 state changes: %v", len(changes), err)
+		}
+		var state struct {
+			State struct {
+				Scene string  `json:"scene"`
+				Level float64 `json:"level"`
+			} `json:"state"`
+		}
+		if err := json.Unmarshal(msg.Data, &state); err != nil {
+			t.Fatal(err)
+		}
+		c := change{state.State.Scene, state.State.Level, time.Now()}
+		if c.scene == "" && c.level == 0 {
+			continue // The initial state
+		}
+		changes = append(changes, c)
+	}
+
+	// The ramp's first sample only records where it starts, and steps at
+	// the same time apply in the order they are written
+	want := []change{{scene: "first"}, {scene: "second"}, {scene: "second", level: 5}, {scene: "second", level: 10}}
+	for i := range want {
+		if changes[i].scene != want[i].scene || changes[i].level != want[i].level {
+			t.Fatalf("change %d = %s/%g, want %s/%g", i, changes[i].scene, changes[i].level, want[i].scene, want[i].level)
+		}
+	}
+	for _, pair := range [][2]int{{0, 1}, {1, 2}, {2, 3}} {
+		if gap := changes[pair[1]].at.Sub(changes[pair[0]].at); gap < 90*time.Millisecond {
+			t.Errorf("changes %d and %d %s apart, want 10s of scenario time", pair[0], pair[1], gap)
+		}
+	}
+
+	<-run.done
+	status := run.Status()
+	if status.State != "finished" || status.EventsRun != status.Events || status.Elapsed != "40s" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}